@@ -17,6 +17,13 @@ type Publication struct {
 	// Tags contains a map with custom key-values attached to a Publication. Tags map
 	// will be delivered to a client.
 	Tags map[string]string
+	// Time is a Unix time in milliseconds when Publication was published. Assigned
+	// by Broker, zero value means that time is unknown (for example for publications
+	// saved to history before time support was added).
+	Time int64
+	// CompactionKey publication was published with (see PublishOptions.CompactionKey).
+	// It's not delivered to clients.
+	CompactionKey string
 }
 
 // ClientInfo contains information about client connection.
@@ -55,6 +62,54 @@ type HistoryFilter struct {
 	Limit int
 	// Reverse direction.
 	Reverse bool
+	// TagsFilter if set makes Broker return only publications with Tags matching
+	// filter. In this case Limit applies to the number of matching publications.
+	TagsFilter *TagsFilter
+	// SinceTime if set makes Broker return only publications with Publication.Time
+	// not before SinceTime. Limit applies to the number of matching publications.
+	// Publications without time never match – see Config.PublicationTimeTag for
+	// the case of RedisBroker with history in lists.
+	SinceTime time.Time
+	// UntilTime if set makes Broker return only publications with Publication.Time
+	// before UntilTime. Limit applies to the number of matching publications.
+	UntilTime time.Time
+}
+
+// HasPublicationFilter reports whether filter restricts publications by their
+// content and not only by position in a stream. Such filters must be applied by
+// Broker to publications read from a stream using Match.
+func (f HistoryFilter) HasPublicationFilter() bool {
+	return f.TagsFilter != nil || !f.SinceTime.IsZero() || !f.UntilTime.IsZero()
+}
+
+// Match reports whether publication matches TagsFilter, SinceTime and UntilTime
+// of filter.
+func (f HistoryFilter) Match(pub *Publication) bool {
+	if !f.SinceTime.IsZero() && (pub.Time == 0 || pub.Time < f.SinceTime.UnixMilli()) {
+		return false
+	}
+	if !f.UntilTime.IsZero() && (pub.Time == 0 || pub.Time >= f.UntilTime.UnixMilli()) {
+		return false
+	}
+	return f.TagsFilter.Match(pub.Tags)
+}
+
+// filterPublications returns publications which match filter. Limit applied
+// to the result if positive.
+func filterPublications(pubs []*Publication, filter HistoryFilter, limit int) []*Publication {
+	if !filter.HasPublicationFilter() {
+		return pubs
+	}
+	result := make([]*Publication, 0, len(pubs))
+	for _, pub := range pubs {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		if filter.Match(pub) {
+			result = append(result, pub)
+		}
+	}
+	return result
 }
 
 // StreamPosition contains fields to describe position in stream.
@@ -87,10 +142,134 @@ type PublishOptions struct {
 	HistoryTTL time.Duration
 	// HistorySize sets history size limit to prevent infinite stream growth.
 	HistorySize int
+	// HistoryMaxBytes if set limits the total size of publications kept in history
+	// stream (size of publication in encoded form is used). The oldest publications
+	// are removed from stream to satisfy the limit, the latest publication is always
+	// kept. RedisBroker supports this option only for Redis Streams (Redis >= 6.2).
+	HistoryMaxBytes int
+	// HistoryMaxPublicationAge if set makes Broker remove publications older than
+	// this value from history stream. Publications are removed when new ones added
+	// to a stream, the latest publication is always kept. HistoryTTL still applies to
+	// the whole stream. RedisBroker supports this option only for Redis Streams
+	// (Redis >= 6.2).
+	HistoryMaxPublicationAge time.Duration
 	// ClientInfo to include into Publication. By default, no ClientInfo will be appended.
 	ClientInfo *ClientInfo
 	// Tags to set Publication.Tags.
 	Tags map[string]string
+	// CompactionKey if set makes Broker keep only the latest publication with the
+	// same key in history stream (similar to Kafka log compaction). Offsets of
+	// publications stay monotonic, so stream may contain gaps in offsets.
+	CompactionKey string
+	// IdempotencyKey if set makes Broker save the result of publishing (StreamPosition)
+	// for IdempotentResultTTL. Subsequent publications with the same key during
+	// this period are not delivered and not saved to history, the original result
+	// is returned instead. This is useful to safely retry publish operations.
+	IdempotencyKey string
+	// IdempotentResultTTL is a period to keep IdempotencyKey. Current Broker
+	// implementations only work with seconds resolution for it.
+	IdempotentResultTTL time.Duration
+	// ExcludeClients is a list of client IDs which must not receive publication
+	// (for example, to not send publication back to a client which published it).
+	// Excluded clients still advance their position in a stream, publication is
+	// kept in history as usual. Exclusion list is not a part of Publication: Broker
+	// passes it to all nodes along with publication in PUB/SUB message and never
+	// saves it to history – see ExcludeClientsBrokerEventHandler.
+	ExcludeClients []string
+}
+
+// BrokerPublishRequest describes a single publication in BatchPublisher.PublishMany.
+type BrokerPublishRequest struct {
+	// Channel to publish into.
+	Channel string
+	// Data to publish.
+	Data []byte
+	// Options of publication.
+	Options PublishOptions
+}
+
+// BrokerPublishResult is a result of a single publication in BatchPublisher.PublishMany.
+type BrokerPublishResult struct {
+	// StreamPosition of publication in channel history stream. See Broker.Publish.
+	StreamPosition StreamPosition
+	// Error is set if publication failed.
+	Error error
+}
+
+// BatchPublisher is an interface Broker can optionally implement to publish many
+// publications in an efficient way – for example, using a single round trip to
+// a remote storage for many channels. If Broker does not implement BatchPublisher
+// then Node publishes publications of a batch one by one.
+type BatchPublisher interface {
+	// PublishMany publishes data into many channels. Each publication must be
+	// published according to the rules described for Broker.Publish. Publications
+	// into the same channel must be published in order they appear in reqs.
+	// Returned slice must contain a result for each request at the same index.
+	PublishMany(reqs []BrokerPublishRequest) []BrokerPublishResult
+}
+
+// StreamResetter is an interface Broker can optionally implement to support
+// Node.ResetStream.
+type StreamResetter interface {
+	// ResetStream removes all publications from channel history stream and
+	// starts a new stream epoch with zero offset. Returns new stream position.
+	ResetStream(ch string) (StreamPosition, error)
+}
+
+// HistoryImporter is an interface Broker can optionally implement to support
+// Node.ImportHistory keeping offsets and epoch of imported publications.
+type HistoryImporter interface {
+	// ImportHistory replaces channel history stream with pubs. Publications are
+	// ordered by offset, sp contains epoch and top offset of a new stream. Only
+	// history related fields of opts (HistorySize, HistoryTTL etc.) are used,
+	// publications are not delivered to channel subscribers.
+	ImportHistory(ch string, pubs []*Publication, sp StreamPosition, opts PublishOptions) error
+}
+
+// RateLimiter is an interface Broker can optionally implement to provide token
+// bucket rate limits shared by all nodes – see CommandRateLimitConfig.UserLimitsClusterWide.
+type RateLimiter interface {
+	// AllowRate takes one token from a token bucket identified by key. Bucket is
+	// created full upon first access. Returns false if bucket has no tokens at
+	// the moment.
+	AllowRate(key string, limit RateLimit) (bool, error)
+}
+
+// PatternSubscriber is an interface Broker can optionally implement to support
+// pattern subscriptions (see SubscribeOptions.Pattern). In pattern * matches any
+// sequence of characters. Publications into channels matching subscribed pattern
+// must be delivered to PatternBrokerEventHandler.HandlePatternPublication once
+// for each matching pattern, independently of exact channel subscriptions.
+type PatternSubscriber interface {
+	// SubscribePattern subscribes node on all channels matching pattern.
+	SubscribePattern(pattern string) error
+	// UnsubscribePattern unsubscribes node from pattern.
+	UnsubscribePattern(pattern string) error
+}
+
+// PatternBrokerEventHandler is implemented by BrokerEventHandler passed to
+// Broker.Run by Node. Brokers implementing PatternSubscriber use it to deliver
+// publications received over pattern subscriptions.
+type PatternBrokerEventHandler interface {
+	BrokerEventHandler
+	// HandlePatternPublication to handle Publication received over pattern
+	// subscription, ch is a concrete channel Publication was published to.
+	// Publication must not be delivered to clients with IDs from excludeClients
+	// (see PublishOptions.ExcludeClients).
+	HandlePatternPublication(pattern string, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error
+}
+
+// ExcludeClientsBrokerEventHandler is implemented by BrokerEventHandler passed
+// to Broker.Run by Node. Brokers use it to deliver publications published with
+// PublishOptions.ExcludeClients. Exclusion list must be passed by Broker to all
+// nodes along with publication (for example, in PUB/SUB message envelope) and
+// must never be saved to history. Publications without exclusions are delivered
+// over BrokerEventHandler.HandlePublication.
+type ExcludeClientsBrokerEventHandler interface {
+	BrokerEventHandler
+	// HandlePublicationExcludeClients to handle received Publication which must
+	// not be delivered to clients with IDs from excludeClients.
+	HandlePublicationExcludeClients(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error
 }
 
 // Broker is responsible for PUB/SUB mechanics.
@@ -0,0 +1,344 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// FailoverBroker is a Broker which wraps another Broker (usually RedisBroker) and
+// falls back to local delivery when the wrapped Broker is unavailable. This way
+// clients connected to the same Node as a publisher still receive publications
+// during Broker outage.
+//
+// FailoverBroker works as a circuit breaker: after FailoverBrokerConfig.FailureThreshold
+// consecutive failed publish operations it switches to degraded mode. In degraded
+// mode publications, join and leave messages are only delivered to subscribers of
+// the current Node without saving to history. Meanwhile, FailoverBroker probes the
+// wrapped Broker health and switches back once health check succeeds.
+//
+// Streams of channels with history which got publications in degraded mode are
+// marked as affected. After recovery subscribers of those channels with positioning
+// or recovery on all nodes are forced to resubscribe (or reconnect for server-side
+// subscriptions) as their state is insufficient.
+//
+// Wrapped Broker must restore PUB/SUB subscriptions to Hub channels upon reconnect
+// (RedisBroker does this), since subscription errors are ignored in degraded mode.
+type FailoverBroker struct {
+	node         *Node
+	config       FailoverBrokerConfig
+	eventHandler BrokerEventHandler
+	patterns     *channelPatterns
+
+	mu       sync.Mutex
+	failures int
+	degraded bool
+	affected map[string]struct{}
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+var _ Broker = (*FailoverBroker)(nil)
+
+// FailoverBrokerConfig is a config for FailoverBroker.
+type FailoverBrokerConfig struct {
+	// Broker to wrap. Required.
+	Broker Broker
+	// FailureThreshold is a number of consecutive failed publish operations after
+	// which FailoverBroker switches to degraded mode. By default, 3.
+	FailureThreshold int
+	// ProbeInterval is an interval between health checks of wrapped Broker in
+	// degraded mode. By default, 1 second.
+	ProbeInterval time.Duration
+	// HealthCheck checks wrapped Broker health in degraded mode. By default,
+	// FailoverBroker requests stream position of a service channel from wrapped
+	// Broker history.
+	HealthCheck func() error
+}
+
+const (
+	defaultFailoverFailureThreshold = 3
+	defaultFailoverProbeInterval    = time.Second
+	failoverProbeChannel            = "_failover_probe"
+)
+
+// NewFailoverBroker initializes FailoverBroker.
+func NewFailoverBroker(n *Node, config FailoverBrokerConfig) (*FailoverBroker, error) {
+	if config.Broker == nil {
+		return nil, errors.New("failover broker: broker required")
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaultFailoverFailureThreshold
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = defaultFailoverProbeInterval
+	}
+	if config.HealthCheck == nil {
+		broker := config.Broker
+		config.HealthCheck = func() error {
+			_, _, err := broker.History(failoverProbeChannel, HistoryFilter{})
+			return err
+		}
+	}
+	return &FailoverBroker{
+		node:     n,
+		config:   config,
+		patterns: newChannelPatterns(),
+		affected: make(map[string]struct{}),
+		closeCh:  make(chan struct{}),
+	}, nil
+}
+
+// Degraded reports whether FailoverBroker works in degraded mode at the moment.
+func (b *FailoverBroker) Degraded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.degraded
+}
+
+// Run runs wrapped Broker.
+func (b *FailoverBroker) Run(h BrokerEventHandler) error {
+	b.eventHandler = h
+	return b.config.Broker.Run(h)
+}
+
+// Close stops health probing and closes wrapped Broker if it implements Closer.
+func (b *FailoverBroker) Close(ctx context.Context) error {
+	b.closeOnce.Do(func() {
+		close(b.closeCh)
+	})
+	if closer, ok := b.config.Broker.(Closer); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
+
+// onSuccess resets consecutive failures counter.
+func (b *FailoverBroker) onSuccess() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+// onFailure counts failed operation and switches to degraded mode when
+// FailureThreshold reached.
+func (b *FailoverBroker) onFailure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.degraded {
+		return
+	}
+	b.failures++
+	if b.failures < b.config.FailureThreshold {
+		return
+	}
+	b.degraded = true
+	b.node.Log(NewLogEntry(LogLevelWarn, "broker unavailable, switching to local delivery", map[string]interface{}{"error": err.Error()}))
+	go b.probe()
+}
+
+// probe checks wrapped Broker health until it succeeds.
+func (b *FailoverBroker) probe() {
+	ticker := time.NewTicker(b.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closeCh:
+			return
+		case <-ticker.C:
+			if err := b.config.HealthCheck(); err != nil {
+				if b.node.LogEnabled(LogLevelDebug) {
+					b.node.Log(NewLogEntry(LogLevelDebug, "broker health check failed", map[string]interface{}{"error": err.Error()}))
+				}
+				continue
+			}
+			b.recover()
+			return
+		}
+	}
+}
+
+// recover switches FailoverBroker back to wrapped Broker and invalidates
+// state of affected stream subscribers.
+func (b *FailoverBroker) recover() {
+	b.mu.Lock()
+	b.degraded = false
+	b.failures = 0
+	affected := b.affected
+	b.affected = make(map[string]struct{})
+	b.mu.Unlock()
+
+	b.node.Log(NewLogEntry(LogLevelInfo, "broker recovered, switching from local delivery", map[string]interface{}{"numAffectedChannels": len(affected)}))
+
+	for ch := range affected {
+		// Zero position never matches subscriber position, so all positioned
+		// subscribers resubscribe.
+		b.node.hub.resetStream(ch, StreamPosition{})
+		if err := b.node.pubResetStream(ch, StreamPosition{}); err != nil {
+			b.node.Log(NewLogEntry(LogLevelError, "error publishing reset stream after broker recovery", map[string]interface{}{"channel": ch, "error": err.Error()}))
+		}
+	}
+}
+
+// Publish - see Broker interface description. In degraded mode publication is
+// delivered to current Node subscribers only, returned StreamPosition is empty.
+func (b *FailoverBroker) Publish(ch string, data []byte, opts PublishOptions) (StreamPosition, error) {
+	if !b.Degraded() {
+		sp, err := b.config.Broker.Publish(ch, data, opts)
+		if err == nil {
+			b.onSuccess()
+			return sp, nil
+		}
+		b.onFailure(err)
+		return StreamPosition{}, err
+	}
+	if opts.HistorySize > 0 && opts.HistoryTTL > 0 {
+		b.mu.Lock()
+		b.affected[ch] = struct{}{}
+		b.mu.Unlock()
+	}
+	pub := &Publication{
+		Data: data,
+		Info: opts.ClientInfo,
+		Tags: opts.Tags,
+		Time: time.Now().UnixMilli(),
+	}
+	if err := handleBrokerPublication(b.eventHandler, ch, pub, StreamPosition{}, opts.ExcludeClients); err != nil {
+		return StreamPosition{}, err
+	}
+	return StreamPosition{}, b.patterns.handlePatternPublication(b.eventHandler, ch, pub, StreamPosition{}, opts.ExcludeClients)
+}
+
+// PublishJoin - see Broker interface description.
+func (b *FailoverBroker) PublishJoin(ch string, info *ClientInfo) error {
+	if !b.Degraded() {
+		err := b.config.Broker.PublishJoin(ch, info)
+		if err == nil {
+			b.onSuccess()
+			return nil
+		}
+		b.onFailure(err)
+		return err
+	}
+	return b.eventHandler.HandleJoin(ch, info)
+}
+
+// PublishLeave - see Broker interface description.
+func (b *FailoverBroker) PublishLeave(ch string, info *ClientInfo) error {
+	if !b.Degraded() {
+		err := b.config.Broker.PublishLeave(ch, info)
+		if err == nil {
+			b.onSuccess()
+			return nil
+		}
+		b.onFailure(err)
+		return err
+	}
+	return b.eventHandler.HandleLeave(ch, info)
+}
+
+// PublishControl - see Broker interface description.
+func (b *FailoverBroker) PublishControl(data []byte, nodeID, shardKey string) error {
+	return b.config.Broker.PublishControl(data, nodeID, shardKey)
+}
+
+// Subscribe - see Broker interface description. Errors are ignored in degraded mode.
+func (b *FailoverBroker) Subscribe(ch string) error {
+	err := b.config.Broker.Subscribe(ch)
+	if err != nil && b.Degraded() {
+		return nil
+	}
+	return err
+}
+
+// Unsubscribe - see Broker interface description. Errors are ignored in degraded mode.
+func (b *FailoverBroker) Unsubscribe(ch string) error {
+	err := b.config.Broker.Unsubscribe(ch)
+	if err != nil && b.Degraded() {
+		return nil
+	}
+	return err
+}
+
+// History - see Broker interface description.
+func (b *FailoverBroker) History(ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
+	return b.config.Broker.History(ch, filter)
+}
+
+// RemoveHistory - see Broker interface description.
+func (b *FailoverBroker) RemoveHistory(ch string) error {
+	return b.config.Broker.RemoveHistory(ch)
+}
+
+var _ StreamResetter = (*FailoverBroker)(nil)
+
+// ResetStream - see StreamResetter interface description. Returns
+// ErrorNotAvailable if wrapped Broker does not implement StreamResetter.
+func (b *FailoverBroker) ResetStream(ch string) (StreamPosition, error) {
+	resetter, ok := b.config.Broker.(StreamResetter)
+	if !ok {
+		return StreamPosition{}, ErrorNotAvailable
+	}
+	return resetter.ResetStream(ch)
+}
+
+var _ HistoryImporter = (*FailoverBroker)(nil)
+
+// ImportHistory - see HistoryImporter interface description. Returns
+// ErrorNotAvailable if wrapped Broker does not implement HistoryImporter.
+func (b *FailoverBroker) ImportHistory(ch string, pubs []*Publication, sp StreamPosition, opts PublishOptions) error {
+	importer, ok := b.config.Broker.(HistoryImporter)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	return importer.ImportHistory(ch, pubs, sp, opts)
+}
+
+var _ RateLimiter = (*FailoverBroker)(nil)
+
+// AllowRate - see RateLimiter interface description. Returns
+// ErrorNotAvailable if wrapped Broker does not implement RateLimiter.
+func (b *FailoverBroker) AllowRate(key string, limit RateLimit) (bool, error) {
+	limiter, ok := b.config.Broker.(RateLimiter)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	return limiter.AllowRate(key, limit)
+}
+
+var _ PatternSubscriber = (*FailoverBroker)(nil)
+
+// SubscribePattern - see PatternSubscriber interface description. Returns
+// ErrorNotAvailable if wrapped Broker does not implement PatternSubscriber.
+// Errors are ignored in degraded mode – publications are matched against
+// subscribed patterns locally then.
+func (b *FailoverBroker) SubscribePattern(pattern string) error {
+	subscriber, ok := b.config.Broker.(PatternSubscriber)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	err := subscriber.SubscribePattern(pattern)
+	if err != nil && !b.Degraded() {
+		return err
+	}
+	b.patterns.add(pattern)
+	return nil
+}
+
+// UnsubscribePattern - see PatternSubscriber interface description. Returns
+// ErrorNotAvailable if wrapped Broker does not implement PatternSubscriber.
+// Errors are ignored in degraded mode.
+func (b *FailoverBroker) UnsubscribePattern(pattern string) error {
+	subscriber, ok := b.config.Broker.(PatternSubscriber)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	b.patterns.remove(pattern)
+	err := subscriber.UnsubscribePattern(pattern)
+	if err != nil && b.Degraded() {
+		return nil
+	}
+	return err
+}
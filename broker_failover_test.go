@@ -0,0 +1,162 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+// failingBroker is a MemoryBroker which fails publish operations on demand.
+type failingBroker struct {
+	*MemoryBroker
+	fail int32
+}
+
+var errFailingBroker = errors.New("broker unavailable")
+
+func (b *failingBroker) Publish(ch string, data []byte, opts PublishOptions) (StreamPosition, error) {
+	if atomic.LoadInt32(&b.fail) == 1 {
+		return StreamPosition{}, errFailingBroker
+	}
+	return b.MemoryBroker.Publish(ch, data, opts)
+}
+
+func (b *failingBroker) History(ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
+	if atomic.LoadInt32(&b.fail) == 1 {
+		return nil, StreamPosition{}, errFailingBroker
+	}
+	return b.MemoryBroker.History(ch, filter)
+}
+
+func newTestFailoverNode(t *testing.T) (*Node, *failingBroker, *FailoverBroker) {
+	n, err := New(Config{
+		LogLevel:   LogLevelTrace,
+		LogHandler: func(entry LogEntry) {},
+	})
+	require.NoError(t, err)
+	memoryBroker, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	broker := &failingBroker{MemoryBroker: memoryBroker}
+	failoverBroker, err := NewFailoverBroker(n, FailoverBrokerConfig{
+		Broker:           broker,
+		FailureThreshold: 2,
+		ProbeInterval:    10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	n.SetBroker(failoverBroker)
+	require.NoError(t, n.Run())
+	return n, broker, failoverBroker
+}
+
+func TestNewFailoverBroker(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	_, err := NewFailoverBroker(n, FailoverBrokerConfig{})
+	require.Error(t, err)
+}
+
+func TestFailoverBrokerLocalDelivery(t *testing.T) {
+	node, broker, failoverBroker := newTestFailoverNode(t)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	newCtx := SetCredentials(context.Background(), &Credentials{UserID: "42"})
+	client, _ := newClient(newCtx, node, transport)
+	connectClient(t, client)
+	subscribeClient(t, client, "test")
+
+	atomic.StoreInt32(&broker.fail, 1)
+	for i := 0; i < 2; i++ {
+		_, err := node.Publish("test", []byte(`{"text": "lost"}`))
+		require.ErrorIs(t, err, errFailingBroker)
+	}
+	require.True(t, failoverBroker.Degraded())
+
+	_, err := node.Publish("test", []byte(`{"text": "local"}`))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		for data := range transport.sink {
+			if strings.Contains(string(data), "local") {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout receiving publication")
+	}
+
+	atomic.StoreInt32(&broker.fail, 0)
+	require.Eventually(t, func() bool { return !failoverBroker.Degraded() }, time.Second, 10*time.Millisecond)
+
+	sp, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sp.Offset)
+}
+
+func TestFailoverBrokerInsufficientStateAfterRecovery(t *testing.T) {
+	node, broker, failoverBroker := newTestFailoverNode(t)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	done := make(chan struct{})
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EnableRecovery: true}}, nil)
+		})
+		client.OnUnsubscribe(func(event UnsubscribeEvent) {
+			require.Equal(t, UnsubscribeCodeInsufficient, event.Code)
+			close(done)
+		})
+	})
+
+	_, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	client := newTestClientV2(t, node, "42")
+	connectClientV2(t, client)
+	rwWrapper := testReplyWriterWrapper()
+	err = client.handleSubscribe(&protocol.SubscribeRequest{
+		Channel: "test",
+		Recover: true,
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&broker.fail, 1)
+	for i := 0; i < 2; i++ {
+		_, _ = node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	}
+	require.True(t, failoverBroker.Degraded())
+	_, err = node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	select {
+	case <-done:
+		require.Fail(t, "unexpected unsubscribe in degraded mode")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&broker.fail, 0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout waiting for insufficient state")
+	}
+	require.False(t, failoverBroker.Degraded())
+}
@@ -3,6 +3,8 @@ package centrifuge
 import (
 	"container/heap"
 	"context"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -23,6 +25,9 @@ import (
 type MemoryBroker struct {
 	node         *Node
 	historyHub   *historyHub
+	resultCache  *resultCache
+	rateLimiter  *rateLimiter
+	patterns     *channelPatterns
 	eventHandler BrokerEventHandler
 
 	// pubLocks synchronize access to publishing. We have to sync publish
@@ -46,6 +51,20 @@ type MemoryBrokerConfig struct {
 	// without new messages). We can make this optional and disabled by default at
 	// least.
 	HistoryMetaTTL time.Duration
+
+	// PersistenceDir enables durable history when set. Publications kept in
+	// history streams, stream top offsets and epochs are written into append-only
+	// segment files inside this directory and loaded back when MemoryBroker is
+	// created. So clients are able to recover from history after node restart.
+	// Directory must not be shared between several running nodes. Segments are
+	// synced to disk every second. Zero value means that history is only kept
+	// in process memory.
+	PersistenceDir string
+	// PersistenceSegmentSize is a size of active segment file in bytes upon
+	// reaching which segments are compacted – i.e. rewritten to only contain
+	// stream positions and publications which are still kept in history according
+	// to HistorySize and HistoryTTL. Zero value means DefaultMemoryPersistenceSegmentSize.
+	PersistenceSegmentSize int64
 }
 
 const numPubLocks = 4096
@@ -57,9 +76,18 @@ func NewMemoryBroker(n *Node, c MemoryBrokerConfig) (*MemoryBroker, error) {
 		pubLocks[i] = &sync.Mutex{}
 	}
 	b := &MemoryBroker{
-		node:       n,
-		historyHub: newHistoryHub(c.HistoryMetaTTL),
-		pubLocks:   pubLocks,
+		node:        n,
+		historyHub:  newHistoryHub(c.HistoryMetaTTL),
+		resultCache: newResultCache(),
+		rateLimiter: newRateLimiter(),
+		patterns:    newChannelPatterns(),
+		pubLocks:    pubLocks,
+	}
+	if c.PersistenceDir != "" {
+		err := b.historyHub.openStorage(n, c.PersistenceDir, c.PersistenceSegmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("error opening history storage: %w", err)
+		}
 	}
 	return b, nil
 }
@@ -68,18 +96,31 @@ func NewMemoryBroker(n *Node, c MemoryBrokerConfig) (*MemoryBroker, error) {
 func (b *MemoryBroker) Run(h BrokerEventHandler) error {
 	b.eventHandler = h
 	b.historyHub.runCleanups()
+	go b.resultCache.expireResults()
 	return nil
 }
 
-// Close is noop for now.
+// Close closes history storage if persistence enabled.
 func (b *MemoryBroker) Close(_ context.Context) error {
-	return nil
+	return b.historyHub.closeStorage()
 }
 
 func (b *MemoryBroker) pubLock(ch string) *sync.Mutex {
 	return b.pubLocks[index(ch, numPubLocks)]
 }
 
+var _ BatchPublisher = (*MemoryBroker)(nil)
+
+// PublishMany - see BatchPublisher interface description.
+func (b *MemoryBroker) PublishMany(reqs []BrokerPublishRequest) []BrokerPublishResult {
+	results := make([]BrokerPublishResult, len(reqs))
+	for i, req := range reqs {
+		sp, err := b.Publish(req.Channel, req.Data, req.Options)
+		results[i] = BrokerPublishResult{StreamPosition: sp, Error: err}
+	}
+	return results
+}
+
 // Publish adds message into history hub and calls node method to handle message.
 // We don't have any PUB/SUB here as Memory Engine is single node only.
 func (b *MemoryBroker) Publish(ch string, data []byte, opts PublishOptions) (StreamPosition, error) {
@@ -87,20 +128,34 @@ func (b *MemoryBroker) Publish(ch string, data []byte, opts PublishOptions) (Str
 	mu.Lock()
 	defer mu.Unlock()
 
+	if opts.IdempotencyKey != "" {
+		if res, ok := b.resultCache.get(ch, opts.IdempotencyKey); ok {
+			return res, nil
+		}
+	}
+
 	pub := &Publication{
-		Data: data,
-		Info: opts.ClientInfo,
-		Tags: opts.Tags,
+		Data:          data,
+		Info:          opts.ClientInfo,
+		Tags:          opts.Tags,
+		Time:          time.Now().UnixMilli(),
+		CompactionKey: opts.CompactionKey,
 	}
+	var streamTop StreamPosition
 	if opts.HistorySize > 0 && opts.HistoryTTL > 0 {
-		streamTop, err := b.historyHub.add(ch, pub, opts)
+		var err error
+		streamTop, err = b.historyHub.add(ch, pub, opts)
 		if err != nil {
 			return StreamPosition{}, err
 		}
-		pub.Offset = streamTop.Offset
-		return streamTop, b.eventHandler.HandlePublication(ch, pub, streamTop)
 	}
-	return StreamPosition{}, b.eventHandler.HandlePublication(ch, pub, StreamPosition{})
+	if opts.IdempotencyKey != "" && opts.IdempotentResultTTL > 0 {
+		b.resultCache.set(ch, opts.IdempotencyKey, streamTop, opts.IdempotentResultTTL)
+	}
+	if err := handleBrokerPublication(b.eventHandler, ch, pub, streamTop, opts.ExcludeClients); err != nil {
+		return streamTop, err
+	}
+	return streamTop, b.patterns.handlePatternPublication(b.eventHandler, ch, pub, streamTop, opts.ExcludeClients)
 }
 
 // PublishJoin - see Broker interface description.
@@ -130,7 +185,16 @@ func (b *MemoryBroker) Unsubscribe(_ string) error {
 
 // History - see Broker interface description.
 func (b *MemoryBroker) History(ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
-	return b.historyHub.get(ch, filter)
+	limit := filter.Limit
+	if filter.HasPublicationFilter() && limit > 0 {
+		// Limit applies to matching publications so we need to read the whole range.
+		filter.Limit = -1
+	}
+	pubs, sp, err := b.historyHub.get(ch, filter)
+	if err != nil {
+		return nil, StreamPosition{}, err
+	}
+	return filterPublications(pubs, filter, limit), sp, nil
 }
 
 // RemoveHistory - see Broker interface description.
@@ -138,6 +202,121 @@ func (b *MemoryBroker) RemoveHistory(ch string) error {
 	return b.historyHub.remove(ch)
 }
 
+var _ StreamResetter = (*MemoryBroker)(nil)
+
+// ResetStream - see StreamResetter interface description.
+func (b *MemoryBroker) ResetStream(ch string) (StreamPosition, error) {
+	mu := b.pubLock(ch)
+	mu.Lock()
+	defer mu.Unlock()
+	return b.historyHub.reset(ch)
+}
+
+var _ HistoryImporter = (*MemoryBroker)(nil)
+
+// ImportHistory - see HistoryImporter interface description.
+func (b *MemoryBroker) ImportHistory(ch string, pubs []*Publication, sp StreamPosition, opts PublishOptions) error {
+	mu := b.pubLock(ch)
+	mu.Lock()
+	defer mu.Unlock()
+	return b.historyHub.importHistory(ch, pubs, sp, opts)
+}
+
+var _ RateLimiter = (*MemoryBroker)(nil)
+
+// AllowRate - see RateLimiter interface description.
+func (b *MemoryBroker) AllowRate(key string, limit RateLimit) (bool, error) {
+	return b.rateLimiter.allow(key, limit, time.Now().UnixNano()), nil
+}
+
+var _ PatternSubscriber = (*MemoryBroker)(nil)
+
+// SubscribePattern - see PatternSubscriber interface description.
+func (b *MemoryBroker) SubscribePattern(pattern string) error {
+	b.patterns.add(pattern)
+	return nil
+}
+
+// UnsubscribePattern - see PatternSubscriber interface description.
+func (b *MemoryBroker) UnsubscribePattern(pattern string) error {
+	b.patterns.remove(pattern)
+	return nil
+}
+
+// resultCache keeps results of publishing with idempotency key.
+type resultCache struct {
+	sync.Mutex
+	results         map[string]resultCacheItem
+	expireQueue     priority.Queue
+	nextExpireCheck int64
+}
+
+type resultCacheItem struct {
+	streamPosition StreamPosition
+	expireAt       int64
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{
+		results: make(map[string]resultCacheItem),
+	}
+}
+
+func resultCacheKey(ch string, key string) string {
+	return strconv.Itoa(len(ch)) + ":" + ch + key
+}
+
+func (c *resultCache) get(ch string, key string) (StreamPosition, bool) {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.results[resultCacheKey(ch, key)]
+	if !ok || item.expireAt <= time.Now().UnixNano() {
+		return StreamPosition{}, false
+	}
+	return item.streamPosition, true
+}
+
+func (c *resultCache) set(ch string, key string, sp StreamPosition, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	expireAt := time.Now().Add(ttl).UnixNano()
+	cacheKey := resultCacheKey(ch, key)
+	c.results[cacheKey] = resultCacheItem{streamPosition: sp, expireAt: expireAt}
+	heap.Push(&c.expireQueue, &priority.Item{Value: cacheKey, Priority: expireAt})
+	if c.nextExpireCheck == 0 || c.nextExpireCheck > expireAt {
+		c.nextExpireCheck = expireAt
+	}
+}
+
+func (c *resultCache) expireResults() {
+	var nextExpireCheck int64
+	for {
+		time.Sleep(time.Second)
+		c.Lock()
+		now := time.Now().UnixNano()
+		if c.nextExpireCheck == 0 || c.nextExpireCheck > now {
+			c.Unlock()
+			continue
+		}
+		nextExpireCheck = 0
+		for c.expireQueue.Len() > 0 {
+			item := heap.Pop(&c.expireQueue).(*priority.Item)
+			expireAt := item.Priority
+			if expireAt > now {
+				heap.Push(&c.expireQueue, item)
+				nextExpireCheck = expireAt
+				break
+			}
+			result, ok := c.results[item.Value]
+			if ok && result.expireAt <= expireAt {
+				delete(c.results, item.Value)
+			}
+		}
+		c.nextExpireCheck = nextExpireCheck
+		c.Unlock()
+	}
+}
+
 type historyHub struct {
 	sync.RWMutex
 	streams         map[string]*memstream.Stream
@@ -148,6 +327,7 @@ type historyHub struct {
 	nextRemoveCheck int64
 	removeQueue     priority.Queue
 	removes         map[string]int64
+	storage         *historyStorage
 }
 
 func newHistoryHub(historyMetaTTL time.Duration) *historyHub {
@@ -166,6 +346,9 @@ func (h *historyHub) runCleanups() {
 	if h.historyMetaTTL > 0 {
 		go h.removeStreams()
 	}
+	if h.storage != nil {
+		go h.syncStorage()
+	}
 }
 
 func (h *historyHub) removeStreams() {
@@ -194,6 +377,9 @@ func (h *historyHub) removeStreams() {
 			if exp <= expireAt {
 				delete(h.removes, ch)
 				delete(h.streams, ch)
+				if err := h.persistRemove(ch); err != nil {
+					h.storage.logError("error persisting history removal", err)
+				}
 			} else {
 				heap.Push(&h.removeQueue, &priority.Item{Value: ch, Priority: exp})
 			}
@@ -230,6 +416,9 @@ func (h *historyHub) expireStreams() {
 				delete(h.expires, ch)
 				if stream, ok := h.streams[ch]; ok {
 					stream.Clear()
+					if err := h.persistClear(ch); err != nil {
+						h.storage.logError("error persisting history expiration", err)
+					}
 				}
 			} else {
 				heap.Push(&h.expireQueue, &priority.Item{Value: ch, Priority: exp})
@@ -247,7 +436,35 @@ func (h *historyHub) add(ch string, pub *Publication, opts PublishOptions) (Stre
 	var offset uint64
 	var epoch string
 
-	expireAt := time.Now().Unix() + int64(opts.HistoryTTL.Seconds())
+	h.updateExpire(ch, opts.HistoryTTL)
+
+	stream, ok := h.streams[ch]
+	if !ok {
+		stream = memstream.New()
+	}
+	if err := h.persistPublication(ch, stream, pub, opts); err != nil {
+		return StreamPosition{}, err
+	}
+	offset, _ = stream.AddWithOptions(pub, memstream.AddOptions{
+		Key:      opts.CompactionKey,
+		Size:     opts.HistorySize,
+		Bytes:    historyPubBytes(pub),
+		MaxBytes: opts.HistoryMaxBytes,
+		Time:     pub.Time,
+		MaxAge:   opts.HistoryMaxPublicationAge,
+	})
+	epoch = stream.Epoch()
+	h.streams[ch] = stream
+	pub.Offset = offset
+	h.maybeCompact()
+
+	return StreamPosition{Offset: offset, Epoch: epoch}, nil
+}
+
+// updateExpire prolongs channel stream expiration and meta removal time.
+// Lock must be held outside.
+func (h *historyHub) updateExpire(ch string, historyTTL time.Duration) {
+	expireAt := time.Now().Unix() + int64(historyTTL.Seconds())
 	if _, ok := h.expires[ch]; !ok {
 		heap.Push(&h.expireQueue, &priority.Item{Value: ch, Priority: expireAt})
 	}
@@ -266,29 +483,62 @@ func (h *historyHub) add(ch string, pub *Publication, opts PublishOptions) (Stre
 			h.nextRemoveCheck = removeAt
 		}
 	}
+}
 
-	if stream, ok := h.streams[ch]; ok {
-		offset, _ = stream.Add(pub, opts.HistorySize)
-		epoch = stream.Epoch()
-	} else {
-		stream := memstream.New()
-		offset, _ = stream.Add(pub, opts.HistorySize)
-		epoch = stream.Epoch()
-		h.streams[ch] = stream
-	}
-	pub.Offset = offset
+// importHistory replaces channel stream with a stream which contains pubs.
+func (h *historyHub) importHistory(ch string, pubs []*Publication, sp StreamPosition, opts PublishOptions) error {
+	h.Lock()
+	defer h.Unlock()
 
-	return StreamPosition{Offset: offset, Epoch: epoch}, nil
+	h.updateExpire(ch, opts.HistoryTTL)
+
+	var startOffset uint64
+	if len(pubs) > 0 {
+		startOffset = pubs[0].Offset - 1
+	}
+	stream := memstream.Restore(sp.Epoch, startOffset)
+	if err := h.persistStream(ch, stream); err != nil {
+		return err
+	}
+	for _, pub := range pubs {
+		if pub.Offset > stream.Top()+1 {
+			// Gap left by compacted or trimmed publications.
+			stream.Advance(pub.Offset - 1)
+		}
+		if err := h.persistPublication(ch, stream, pub, opts); err != nil {
+			return err
+		}
+		_, _ = stream.AddWithOptions(pub, memstream.AddOptions{
+			Key:      pub.CompactionKey,
+			Size:     opts.HistorySize,
+			Bytes:    historyPubBytes(pub),
+			MaxBytes: opts.HistoryMaxBytes,
+			Time:     pub.Time,
+			MaxAge:   opts.HistoryMaxPublicationAge,
+		})
+	}
+	if sp.Offset > stream.Top() {
+		stream.Advance(sp.Offset)
+		if err := h.persistTop(ch, stream); err != nil {
+			return err
+		}
+	}
+	h.streams[ch] = stream
+	h.maybeCompact()
+	return nil
 }
 
 // Lock must be held outside.
-func (h *historyHub) createStream(ch string) StreamPosition {
+func (h *historyHub) createStream(ch string) (StreamPosition, error) {
 	stream := memstream.New()
+	if err := h.persistStream(ch, stream); err != nil {
+		return StreamPosition{}, err
+	}
 	h.streams[ch] = stream
 	streamPosition := StreamPosition{}
 	streamPosition.Offset = 0
 	streamPosition.Epoch = stream.Epoch()
-	return streamPosition
+	return streamPosition, nil
 }
 
 func getPosition(stream *memstream.Stream) StreamPosition {
@@ -315,7 +565,8 @@ func (h *historyHub) get(ch string, filter HistoryFilter) ([]*Publication, Strea
 
 	stream, ok := h.streams[ch]
 	if !ok {
-		return nil, h.createStream(ch), nil
+		streamPosition, err := h.createStream(ch)
+		return nil, streamPosition, err
 	}
 
 	if filter.Since == nil {
@@ -344,6 +595,13 @@ func (h *historyHub) get(ch string, filter HistoryFilter) ([]*Publication, Strea
 		}
 	}
 
+	if !filter.Reverse && stream.Compacted() && since.Offset < stream.Trimmed() {
+		// Some publications after since position were removed not due to compaction,
+		// so we can't provide all missed publications. Since compacted stream has gaps
+		// in offsets returning no publications here tells the caller about it.
+		return nil, streamPosition, nil
+	}
+
 	streamOffset := since.Offset + 1
 	if filter.Reverse {
 		streamOffset = since.Offset - 1
@@ -362,10 +620,27 @@ func (h *historyHub) get(ch string, filter HistoryFilter) ([]*Publication, Strea
 	return pubs, streamPosition, nil
 }
 
+// reset replaces channel stream with an empty one in a new epoch.
+func (h *historyHub) reset(ch string) (StreamPosition, error) {
+	h.Lock()
+	defer h.Unlock()
+	stream := memstream.New()
+	if err := h.persistStream(ch, stream); err != nil {
+		return StreamPosition{}, err
+	}
+	h.streams[ch] = stream
+	delete(h.expires, ch)
+	h.maybeCompact()
+	return getPosition(stream), nil
+}
+
 func (h *historyHub) remove(ch string) error {
 	h.Lock()
 	defer h.Unlock()
 	if stream, ok := h.streams[ch]; ok {
+		if err := h.persistClear(ch); err != nil {
+			return err
+		}
 		stream.Clear()
 	}
 	return nil
@@ -0,0 +1,569 @@
+package centrifuge
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/centrifugal/centrifuge/internal/memstream"
+	"github.com/centrifugal/centrifuge/internal/priority"
+	"github.com/centrifugal/centrifuge/internal/segmentlog"
+
+	"github.com/centrifugal/protocol"
+)
+
+// DefaultMemoryPersistenceSegmentSize is a default value for
+// MemoryBrokerConfig.PersistenceSegmentSize.
+const DefaultMemoryPersistenceSegmentSize = 64 * 1024 * 1024
+
+const historyStorageSyncInterval = time.Second
+
+const (
+	// historyRecordPublication appends publication to a stream.
+	historyRecordPublication byte = iota + 1
+	// historyRecordStream sets stream epoch, top offset and meta expiration times.
+	historyRecordStream
+	// historyRecordClear removes publications from a stream keeping its position.
+	historyRecordClear
+	// historyRecordSnapshot resets all state – written as the first record of
+	// compacted segment.
+	historyRecordSnapshot
+	// historyRecordTop moves stream top offset forward keeping publications.
+	historyRecordTop
+	// historyRecordRemove removes stream with its meta information.
+	historyRecordRemove
+)
+
+// historyRecord is a unit of history persistence. Not all fields are
+// meaningful for every record kind.
+type historyRecord struct {
+	kind     byte
+	channel  string
+	epoch    string
+	offset   uint64
+	size     int
+	expireAt int64
+	removeAt int64
+	pub      []byte
+	time     int64
+	key      string
+	maxBytes int
+	maxAge   int64
+}
+
+func (r historyRecord) encode() []byte {
+	var buf bytes.Buffer
+	tmp := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(tmp, v)
+		buf.Write(tmp[:n])
+	}
+	putVarint := func(v int64) {
+		n := binary.PutVarint(tmp, v)
+		buf.Write(tmp[:n])
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		buf.Write(b)
+	}
+	buf.WriteByte(r.kind)
+	putBytes([]byte(r.channel))
+	putBytes([]byte(r.epoch))
+	putUvarint(r.offset)
+	putUvarint(uint64(r.size))
+	putVarint(r.expireAt)
+	putVarint(r.removeAt)
+	putBytes(r.pub)
+	putVarint(r.time)
+	putBytes([]byte(r.key))
+	putUvarint(uint64(r.maxBytes))
+	putVarint(r.maxAge)
+	return buf.Bytes()
+}
+
+var errMalformedHistoryRecord = errors.New("malformed history record")
+
+func decodeHistoryRecord(data []byte) (historyRecord, error) {
+	var r historyRecord
+	reader := bytes.NewReader(data)
+	readBytes := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(reader.Len()) {
+			return nil, errMalformedHistoryRecord
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(reader, b)
+		return b, err
+	}
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	r.kind = kind
+	channel, err := readBytes()
+	if err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	r.channel = string(channel)
+	epoch, err := readBytes()
+	if err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	r.epoch = string(epoch)
+	if r.offset, err = binary.ReadUvarint(reader); err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	r.size = int(size)
+	if r.expireAt, err = binary.ReadVarint(reader); err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	if r.removeAt, err = binary.ReadVarint(reader); err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	if r.pub, err = readBytes(); err != nil {
+		return r, errMalformedHistoryRecord
+	}
+	if reader.Len() > 0 {
+		// Publication time, absent in records written before time support.
+		if r.time, err = binary.ReadVarint(reader); err != nil {
+			return r, errMalformedHistoryRecord
+		}
+	}
+	if reader.Len() > 0 {
+		// Compaction key, absent in records written before compaction support.
+		key, err := readBytes()
+		if err != nil {
+			return r, errMalformedHistoryRecord
+		}
+		r.key = string(key)
+	}
+	if reader.Len() > 0 {
+		// Stream limits, absent in records written before limits support.
+		maxBytes, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return r, errMalformedHistoryRecord
+		}
+		r.maxBytes = int(maxBytes)
+		if r.maxAge, err = binary.ReadVarint(reader); err != nil {
+			return r, errMalformedHistoryRecord
+		}
+	}
+	return r, nil
+}
+
+// historyStorage persists historyHub state into segment log. Not thread-safe,
+// all methods must be called with historyHub lock held. The only exception is
+// snapshot writing which happens in a separate goroutine without lock.
+type historyStorage struct {
+	node             *Node
+	log              *segmentlog.Log
+	segmentSize      int64
+	lastSnapshotSize int64
+	dirty            bool
+	closed           bool
+	compacting       bool
+	compactWG        sync.WaitGroup
+}
+
+func (s *historyStorage) append(r historyRecord) error {
+	if s.closed {
+		return errors.New("history storage closed")
+	}
+	s.dirty = true
+	return s.log.Append(r.encode())
+}
+
+func (s *historyStorage) logError(msg string, err error) {
+	if s.node == nil {
+		return
+	}
+	s.node.logger.log(newLogEntry(LogLevelError, msg, map[string]interface{}{"error": err.Error()}))
+}
+
+// openStorage loads history state persisted in dir and makes hub persist all
+// further modifications there.
+func (h *historyHub) openStorage(n *Node, dir string, segmentSize int64) error {
+	h.Lock()
+	defer h.Unlock()
+	l, err := segmentlog.Open(dir, func(data []byte) error {
+		r, err := decodeHistoryRecord(data)
+		if err != nil {
+			return err
+		}
+		return h.applyRecord(r)
+	})
+	if err != nil {
+		return err
+	}
+	if segmentSize <= 0 {
+		segmentSize = DefaultMemoryPersistenceSegmentSize
+	}
+	h.storage = &historyStorage{
+		node:        n,
+		log:         l,
+		segmentSize: segmentSize,
+	}
+	h.rebuildQueues()
+	return nil
+}
+
+// Lock must be held outside.
+func (h *historyHub) applyRecord(r historyRecord) error {
+	switch r.kind {
+	case historyRecordSnapshot:
+		h.streams = make(map[string]*memstream.Stream)
+		h.expires = make(map[string]int64)
+		h.removes = make(map[string]int64)
+	case historyRecordStream:
+		h.streams[r.channel] = memstream.Restore(r.epoch, r.offset)
+		h.setRecordMeta(r)
+	case historyRecordPublication:
+		stream, ok := h.streams[r.channel]
+		if ok && stream.Epoch() == r.epoch && r.offset <= stream.Top() {
+			// Already applied.
+			return nil
+		}
+		if !ok || stream.Epoch() != r.epoch {
+			stream = memstream.Restore(r.epoch, r.offset-1)
+			h.streams[r.channel] = stream
+		} else if r.offset > stream.Top()+1 {
+			// Gap left by compacted publications.
+			stream.Advance(r.offset - 1)
+		}
+		var protoPub protocol.Publication
+		if err := protoPub.UnmarshalVT(r.pub); err != nil {
+			return err
+		}
+		pub := pubFromProto(&protoPub)
+		pub.Time = r.time
+		pub.CompactionKey = r.key
+		_, _ = stream.AddWithOptions(pub, memstream.AddOptions{
+			Key:      r.key,
+			Size:     r.size,
+			Bytes:    historyPubBytes(pub),
+			MaxBytes: r.maxBytes,
+			Time:     r.time,
+			MaxAge:   time.Duration(r.maxAge) * time.Millisecond,
+		})
+		h.setRecordMeta(r)
+	case historyRecordTop:
+		if stream, ok := h.streams[r.channel]; ok && stream.Epoch() == r.epoch {
+			stream.Advance(r.offset)
+		}
+	case historyRecordClear:
+		if stream, ok := h.streams[r.channel]; ok {
+			stream.Clear()
+		}
+		delete(h.expires, r.channel)
+	case historyRecordRemove:
+		delete(h.streams, r.channel)
+		delete(h.expires, r.channel)
+		delete(h.removes, r.channel)
+	default:
+		return errMalformedHistoryRecord
+	}
+	return nil
+}
+
+// historyPubBytes returns publication size used to limit stream by MaxBytes.
+// Offset is not taken into account so size is the same before and after adding
+// publication to a stream.
+func historyPubBytes(pub *Publication) int {
+	p := pubToProto(pub)
+	p.Offset = 0
+	return p.SizeVT()
+}
+
+func (h *historyHub) setRecordMeta(r historyRecord) {
+	if r.expireAt > 0 {
+		h.expires[r.channel] = r.expireAt
+	}
+	if r.removeAt > 0 {
+		h.removes[r.channel] = r.removeAt
+	}
+}
+
+// rebuildQueues applies expirations which already happened and fills expire
+// and remove queues with the rest. Lock must be held outside.
+func (h *historyHub) rebuildQueues() {
+	now := time.Now().Unix()
+	for ch, expireAt := range h.expires {
+		if expireAt <= now {
+			delete(h.expires, ch)
+			if stream, ok := h.streams[ch]; ok {
+				stream.Clear()
+			}
+			continue
+		}
+		heap.Push(&h.expireQueue, &priority.Item{Value: ch, Priority: expireAt})
+		if h.nextExpireCheck == 0 || h.nextExpireCheck > expireAt {
+			h.nextExpireCheck = expireAt
+		}
+	}
+	if h.historyMetaTTL == 0 {
+		h.removes = make(map[string]int64)
+		return
+	}
+	for ch, removeAt := range h.removes {
+		if removeAt <= now {
+			delete(h.removes, ch)
+			delete(h.streams, ch)
+			continue
+		}
+		heap.Push(&h.removeQueue, &priority.Item{Value: ch, Priority: removeAt})
+		if h.nextRemoveCheck == 0 || h.nextRemoveCheck > removeAt {
+			h.nextRemoveCheck = removeAt
+		}
+	}
+}
+
+// persistPublication must be called before adding publication to a stream.
+// Lock must be held outside.
+func (h *historyHub) persistPublication(ch string, stream *memstream.Stream, pub *Publication, opts PublishOptions) error {
+	if h.storage == nil {
+		return nil
+	}
+	p := pubToProto(pub)
+	p.Offset = stream.Top() + 1
+	data, err := p.MarshalVT()
+	if err != nil {
+		return err
+	}
+	return h.storage.append(historyRecord{
+		kind:     historyRecordPublication,
+		channel:  ch,
+		epoch:    stream.Epoch(),
+		offset:   p.Offset,
+		size:     opts.HistorySize,
+		expireAt: h.expires[ch],
+		removeAt: h.removes[ch],
+		pub:      data,
+		time:     pub.Time,
+		key:      pub.CompactionKey,
+		maxBytes: opts.HistoryMaxBytes,
+		maxAge:   opts.HistoryMaxPublicationAge.Milliseconds(),
+	})
+}
+
+// Lock must be held outside.
+func (h *historyHub) persistStream(ch string, stream *memstream.Stream) error {
+	if h.storage == nil {
+		return nil
+	}
+	return h.storage.append(historyRecord{
+		kind:     historyRecordStream,
+		channel:  ch,
+		epoch:    stream.Epoch(),
+		offset:   stream.Top(),
+		removeAt: h.removes[ch],
+	})
+}
+
+// Lock must be held outside.
+func (h *historyHub) persistTop(ch string, stream *memstream.Stream) error {
+	if h.storage == nil {
+		return nil
+	}
+	return h.storage.append(historyRecord{
+		kind:    historyRecordTop,
+		channel: ch,
+		epoch:   stream.Epoch(),
+		offset:  stream.Top(),
+	})
+}
+
+// Lock must be held outside.
+func (h *historyHub) persistClear(ch string) error {
+	if h.storage == nil {
+		return nil
+	}
+	return h.storage.append(historyRecord{
+		kind:    historyRecordClear,
+		channel: ch,
+	})
+}
+
+// Lock must be held outside.
+func (h *historyHub) persistRemove(ch string) error {
+	if h.storage == nil {
+		return nil
+	}
+	return h.storage.append(historyRecord{
+		kind:    historyRecordRemove,
+		channel: ch,
+	})
+}
+
+// streamSnapshot is a copy of stream state taken for compaction.
+type streamSnapshot struct {
+	channel  string
+	epoch    string
+	top      uint64
+	expireAt int64
+	removeAt int64
+	limits   memstream.Limits
+	items    []memstream.Item
+}
+
+// maybeCompact replaces segments with a snapshot of current hub state when
+// active segment grows too much. Hub state is copied under lock, but snapshot
+// is encoded and written in a separate goroutine so publishing is not blocked
+// by compaction IO – records appended meanwhile go to a new active segment
+// which follows the snapshot. Must be called after all persisted changes
+// applied to the hub state. Lock must be held outside.
+func (h *historyHub) maybeCompact() {
+	if h.storage == nil || h.storage.compacting || h.storage.closed {
+		return
+	}
+	threshold := h.storage.segmentSize
+	if h.storage.lastSnapshotSize > threshold {
+		// Prevent compacting too often when the actual state is large.
+		threshold = h.storage.lastSnapshotSize
+	}
+	if h.storage.log.Size() < threshold {
+		return
+	}
+	streams := make([]streamSnapshot, 0, len(h.streams))
+	for ch, stream := range h.streams {
+		items, top, _ := stream.Get(0, false, -1, false)
+		streams = append(streams, streamSnapshot{
+			channel:  ch,
+			epoch:    stream.Epoch(),
+			top:      top,
+			expireAt: h.expires[ch],
+			removeAt: h.removes[ch],
+			limits:   stream.Limits(),
+			items:    items,
+		})
+	}
+	seq, err := h.storage.log.Rotate()
+	if err != nil {
+		h.storage.logError("error rotating history storage", err)
+		return
+	}
+	h.storage.compacting = true
+	h.storage.compactWG.Add(1)
+	go h.writeSnapshot(seq, streams)
+}
+
+func (h *historyHub) writeSnapshot(seq uint64, streams []streamSnapshot) {
+	defer h.storage.compactWG.Done()
+	size, err := h.storage.log.WriteSnapshot(seq, func(add func(data []byte) error) error {
+		return writeSnapshotRecords(add, streams)
+	})
+	h.Lock()
+	defer h.Unlock()
+	h.storage.compacting = false
+	if err != nil {
+		h.storage.logError("error compacting history storage", err)
+		return
+	}
+	h.storage.lastSnapshotSize = size
+}
+
+func writeSnapshotRecords(add func(data []byte) error, streams []streamSnapshot) error {
+	if err := add(historyRecord{kind: historyRecordSnapshot}.encode()); err != nil {
+		return err
+	}
+	for _, s := range streams {
+		// Items may have gaps left by compaction keys and may end before top
+		// (after history import), so stream is restored right before the first
+		// item and then its top is set explicitly.
+		start := s.top
+		if len(s.items) > 0 {
+			start = s.items[0].Offset - 1
+		}
+		err := add(historyRecord{
+			kind:     historyRecordStream,
+			channel:  s.channel,
+			epoch:    s.epoch,
+			offset:   start,
+			expireAt: s.expireAt,
+			removeAt: s.removeAt,
+		}.encode())
+		if err != nil {
+			return err
+		}
+		// Items are restored with stream's original retention limits, so they
+		// keep applying to the stream as before compaction.
+		for _, item := range s.items {
+			pub := item.Value.(*Publication)
+			data, err := pubToProto(pub).MarshalVT()
+			if err != nil {
+				return err
+			}
+			err = add(historyRecord{
+				kind:     historyRecordPublication,
+				channel:  s.channel,
+				epoch:    s.epoch,
+				offset:   item.Offset,
+				size:     s.limits.Size,
+				pub:      data,
+				time:     pub.Time,
+				key:      pub.CompactionKey,
+				maxBytes: s.limits.MaxBytes,
+				maxAge:   s.limits.MaxAge.Milliseconds(),
+			}.encode())
+			if err != nil {
+				return err
+			}
+		}
+		if len(s.items) > 0 && s.items[len(s.items)-1].Offset < s.top {
+			err := add(historyRecord{
+				kind:    historyRecordTop,
+				channel: s.channel,
+				epoch:   s.epoch,
+				offset:  s.top,
+			}.encode())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *historyHub) syncStorage() {
+	for {
+		time.Sleep(historyStorageSyncInterval)
+		h.Lock()
+		if h.storage.closed {
+			h.Unlock()
+			return
+		}
+		if h.storage.dirty {
+			if err := h.storage.log.Sync(); err != nil {
+				h.storage.logError("error syncing history storage", err)
+			} else {
+				h.storage.dirty = false
+			}
+		}
+		h.Unlock()
+	}
+}
+
+func (h *historyHub) closeStorage() error {
+	h.Lock()
+	if h.storage == nil || h.storage.closed {
+		h.Unlock()
+		return nil
+	}
+	h.storage.closed = true
+	h.Unlock()
+	// Snapshot in progress takes lock when finished.
+	h.storage.compactWG.Wait()
+	h.Lock()
+	defer h.Unlock()
+	return h.storage.log.Close()
+}
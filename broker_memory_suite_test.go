@@ -0,0 +1,17 @@
+package centrifuge_test
+
+import (
+	"testing"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/centrifugal/centrifuge/internal/brokertest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBrokerSuite(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) centrifuge.Broker {
+		b, err := centrifuge.NewMemoryBroker(brokertest.NewNode(t, centrifuge.Config{}), centrifuge.MemoryBrokerConfig{})
+		require.NoError(t, err)
+		return b
+	})
+}
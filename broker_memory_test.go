@@ -2,10 +2,14 @@ package centrifuge
 
 import (
 	"context"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/centrifugal/centrifuge/internal/memstream"
+
 	"github.com/centrifugal/protocol"
 	"github.com/stretchr/testify/require"
 )
@@ -254,6 +258,522 @@ func TestMemoryBrokerRecover(t *testing.T) {
 	require.Equal(t, 0, len(pubs))
 }
 
+func TestMemoryBrokerHistoryTagsFilter(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	for i := 0; i < 10; i++ {
+		tags := map[string]string{"parity": "even"}
+		if i%2 == 1 {
+			tags["parity"] = "odd"
+		}
+		_, err := e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute, Tags: tags})
+		require.NoError(t, err)
+	}
+
+	filter := MustParseTagsFilter(`parity = odd`)
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1, TagsFilter: filter})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), sp.Offset)
+	require.Len(t, pubs, 5)
+	for _, pub := range pubs {
+		require.Equal(t, "odd", pub.Tags["parity"])
+	}
+
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: 2, TagsFilter: filter})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	require.Equal(t, uint64(2), pubs[0].Offset)
+	require.Equal(t, uint64(4), pubs[1].Offset)
+
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: 2, Reverse: true, TagsFilter: filter})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	require.Equal(t, uint64(10), pubs[0].Offset)
+	require.Equal(t, uint64(8), pubs[1].Offset)
+
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: 0, TagsFilter: filter})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+}
+
+func TestMemoryBrokerHistoryTimeFilter(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	started := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+		require.NoError(t, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		_, err := e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+		require.NoError(t, err)
+	}
+
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), sp.Offset)
+	for _, pub := range pubs {
+		require.GreaterOrEqual(t, pub.Time, started.UnixMilli())
+	}
+
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, SinceTime: middle})
+	require.NoError(t, err)
+	require.Len(t, pubs, 3)
+	require.Equal(t, uint64(3), pubs[0].Offset)
+
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, UntilTime: middle})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	require.Equal(t, uint64(2), pubs[1].Offset)
+
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: 1, Reverse: true, UntilTime: middle})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, uint64(2), pubs[0].Offset)
+
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, SinceTime: middle, UntilTime: middle})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+}
+
+func TestMemoryBrokerHistoryMaxBytes(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	for i := 0; i < 10; i++ {
+		_, err := e.Publish("channel", []byte("0123456789"), PublishOptions{
+			HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxBytes: 40,
+		})
+		require.NoError(t, err)
+	}
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), sp.Offset)
+	// Each publication takes 12 bytes in encoded form.
+	require.Len(t, pubs, 3)
+	require.Equal(t, uint64(8), pubs[0].Offset)
+
+	// The latest publication is kept even if it exceeds limit.
+	_, err = e.Publish("channel", make([]byte, 100), PublishOptions{
+		HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxBytes: 40,
+	})
+	require.NoError(t, err)
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, uint64(11), pubs[0].Offset)
+}
+
+func TestMemoryBrokerResetStream(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	for i := 0; i < 3; i++ {
+		_, err := e.Publish("channel", []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+		require.NoError(t, err)
+	}
+	_, sp, err := e.History("channel", HistoryFilter{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), sp.Offset)
+
+	resetSP, err := e.ResetStream("channel")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), resetSP.Offset)
+	require.NotEqual(t, sp.Epoch, resetSP.Epoch)
+
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	require.Equal(t, resetSP, sp)
+
+	pos, err := e.Publish("channel", []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, StreamPosition{Offset: 1, Epoch: resetSP.Epoch}, pos)
+}
+
+func TestMemoryBrokerHistoryMaxPublicationAge(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	for i := 0; i < 3; i++ {
+		_, err := e.Publish("channel", []byte("{}"), PublishOptions{
+			HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxPublicationAge: 100 * time.Millisecond,
+		})
+		require.NoError(t, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	_, err := e.Publish("channel", []byte("{}"), PublishOptions{
+		HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxPublicationAge: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), sp.Offset)
+	require.Len(t, pubs, 1)
+	require.Equal(t, uint64(4), pubs[0].Offset)
+}
+
+func TestMemoryBrokerHistoryCompaction(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	for i := 0; i < 9; i++ {
+		_, err := e.Publish("channel", []byte(strconv.Itoa(i)), PublishOptions{
+			HistorySize: 10, HistoryTTL: time.Minute, CompactionKey: "key" + strconv.Itoa(i%3),
+		})
+		require.NoError(t, err)
+	}
+
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), sp.Offset)
+	require.Len(t, pubs, 3)
+	require.Equal(t, uint64(7), pubs[0].Offset)
+	require.Equal(t, []byte("6"), pubs[0].Data)
+	require.Equal(t, "key0", pubs[0].CompactionKey)
+
+	// Since position inside compacted range.
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, Since: &StreamPosition{Offset: 2, Epoch: sp.Epoch}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 3)
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: 1, Since: &StreamPosition{Offset: 7, Epoch: sp.Epoch}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, uint64(8), pubs[0].Offset)
+
+	// Trim stream by size, so some keys lost.
+	for i := 0; i < 10; i++ {
+		_, err := e.Publish("channel", []byte("new"), PublishOptions{
+			HistorySize: 10, HistoryTTL: time.Minute, CompactionKey: "new" + strconv.Itoa(i),
+		})
+		require.NoError(t, err)
+	}
+	pubs, sp, err = e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), sp.Offset)
+	require.Len(t, pubs, 10)
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, Since: &StreamPosition{Offset: 8, Epoch: sp.Epoch}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, Since: &StreamPosition{Offset: 9, Epoch: sp.Epoch}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 10)
+}
+
+func TestMemoryBrokerIdempotentPublish(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	numPubs := 0
+	e.eventHandler = &testBrokerEventHandler{
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			numPubs++
+			return nil
+		},
+	}
+
+	opts := PublishOptions{
+		HistorySize: 10, HistoryTTL: time.Minute, IdempotencyKey: "test", IdempotentResultTTL: time.Minute,
+	}
+	sp1, err := e.Publish("channel", []byte("{}"), opts)
+	require.NoError(t, err)
+	sp2, err := e.Publish("channel", []byte("{}"), opts)
+	require.NoError(t, err)
+	require.Equal(t, sp1, sp2)
+	require.Equal(t, 1, numPubs)
+
+	// Same key in another channel is not a duplicate.
+	_, err = e.Publish("other", []byte("{}"), opts)
+	require.NoError(t, err)
+	require.Equal(t, 2, numPubs)
+
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, sp1, sp)
+
+	// Without history.
+	opts = PublishOptions{IdempotencyKey: "test_no_history", IdempotentResultTTL: time.Minute}
+	_, err = e.Publish("channel", []byte("{}"), opts)
+	require.NoError(t, err)
+	_, err = e.Publish("channel", []byte("{}"), opts)
+	require.NoError(t, err)
+	require.Equal(t, 3, numPubs)
+
+	// Result expired.
+	opts = PublishOptions{IdempotencyKey: "test_expire", IdempotentResultTTL: time.Millisecond}
+	_, err = e.Publish("channel", []byte("{}"), opts)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = e.Publish("channel", []byte("{}"), opts)
+	require.NoError(t, err)
+	require.Equal(t, 5, numPubs)
+}
+
+func testPersistentMemoryBroker(t testing.TB, c MemoryBrokerConfig) *MemoryBroker {
+	n, _ := New(Config{
+		LogLevel:   LogLevelDebug,
+		LogHandler: func(entry LogEntry) {},
+	})
+	e, err := NewMemoryBroker(n, c)
+	require.NoError(t, err)
+	n.SetBroker(e)
+	require.NoError(t, n.Run())
+	return e
+}
+
+func TestMemoryBrokerPersistence(t *testing.T) {
+	dir := t.TempDir()
+	e := testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir})
+
+	for i := 0; i < 5; i++ {
+		_, err := e.Publish("channel", []byte(strconv.Itoa(i)), PublishOptions{
+			HistorySize: 3, HistoryTTL: time.Minute, ClientInfo: &ClientInfo{UserID: "user"},
+		})
+		require.NoError(t, err)
+	}
+	_, emptyStreamTop, err := e.History("empty", HistoryFilter{})
+	require.NoError(t, err)
+	_, err = e.Publish("removed", testPublicationData(), PublishOptions{HistorySize: 3, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	require.NoError(t, e.RemoveHistory("removed"))
+	_, removedStreamTop, err := e.History("removed", HistoryFilter{})
+	require.NoError(t, err)
+	pubs, streamTop, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 3)
+	require.NoError(t, e.node.Shutdown(context.Background()))
+
+	e = testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir})
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	restoredPubs, restoredStreamTop, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, streamTop, restoredStreamTop)
+	require.Len(t, restoredPubs, 3)
+	for i := range pubs {
+		require.Equal(t, pubs[i].Offset, restoredPubs[i].Offset)
+		require.Equal(t, pubs[i].Data, restoredPubs[i].Data)
+		require.Equal(t, "user", restoredPubs[i].Info.UserID)
+		require.NotZero(t, restoredPubs[i].Time)
+		require.Equal(t, pubs[i].Time, restoredPubs[i].Time)
+	}
+
+	_, restoredEmptyStreamTop, err := e.History("empty", HistoryFilter{})
+	require.NoError(t, err)
+	require.Equal(t, emptyStreamTop, restoredEmptyStreamTop)
+
+	removedPubs, restoredRemovedStreamTop, err := e.History("removed", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, removedPubs, 0)
+	require.Equal(t, removedStreamTop, restoredRemovedStreamTop)
+
+	sp, err := e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 3, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), sp.Offset)
+	require.Equal(t, streamTop.Epoch, sp.Epoch)
+}
+
+func TestMemoryBrokerPersistenceExpired(t *testing.T) {
+	dir := t.TempDir()
+	e := testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir})
+	_, err := e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 3, HistoryTTL: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, e.node.Shutdown(context.Background()))
+
+	time.Sleep(2 * time.Second)
+
+	e = testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir})
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	require.Equal(t, uint64(1), sp.Offset)
+}
+
+func TestMemoryBrokerPersistenceCompaction(t *testing.T) {
+	dir := t.TempDir()
+	conf := MemoryBrokerConfig{PersistenceDir: dir, PersistenceSegmentSize: 1024}
+	e := testPersistentMemoryBroker(t, conf)
+
+	for i := 0; i < 1000; i++ {
+		_, err := e.Publish("channel"+strconv.Itoa(i%2), []byte(strconv.Itoa(i)), PublishOptions{HistorySize: 5, HistoryTTL: time.Minute})
+		require.NoError(t, err)
+	}
+	require.NoError(t, e.node.Shutdown(context.Background()))
+	// Old segments replaced with a snapshot followed by active segment.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(entries), 2)
+
+	e = testPersistentMemoryBroker(t, conf)
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+	pubs, sp, err := e.History("channel1", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(500), sp.Offset)
+	require.Len(t, pubs, 5)
+	require.Equal(t, uint64(496), pubs[0].Offset)
+	require.Equal(t, []byte("999"), pubs[4].Data)
+}
+
+func TestMemoryBrokerPersistenceCompactionOnAppend(t *testing.T) {
+	dir := t.TempDir()
+	conf := MemoryBrokerConfig{PersistenceDir: dir, PersistenceSegmentSize: 1024}
+	e := testPersistentMemoryBroker(t, conf)
+
+	// Every append exceeds segment size and triggers compaction – publication
+	// which triggered it, including the first one in a new stream, must be kept.
+	data := []byte(strings.Repeat("x", 2048))
+	for i := 0; i < 3; i++ {
+		_, err := e.Publish("channel"+strconv.Itoa(i), data, PublishOptions{HistorySize: 5, HistoryTTL: time.Minute})
+		require.NoError(t, err)
+	}
+	require.NoError(t, e.node.Shutdown(context.Background()))
+
+	e = testPersistentMemoryBroker(t, conf)
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+	for i := 0; i < 3; i++ {
+		pubs, sp, err := e.History("channel"+strconv.Itoa(i), HistoryFilter{Limit: -1})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), sp.Offset)
+		require.Len(t, pubs, 1)
+	}
+}
+
+func TestMemoryBrokerPersistenceStreamLimits(t *testing.T) {
+	dir := t.TempDir()
+	e := testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir})
+
+	for i := 0; i < 5; i++ {
+		_, err := e.Publish("channel", []byte(strings.Repeat("x", 100)), PublishOptions{
+			HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxBytes: 250,
+		})
+		require.NoError(t, err)
+	}
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	require.NoError(t, e.node.Shutdown(context.Background()))
+
+	e = testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir})
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+	restoredPubs, restoredSp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, sp, restoredSp)
+	require.Len(t, restoredPubs, 2)
+	require.Equal(t, pubs[0].Offset, restoredPubs[0].Offset)
+}
+
+func TestMemoryBrokerPersistenceCompactionStreamLimits(t *testing.T) {
+	dir := t.TempDir()
+	conf := MemoryBrokerConfig{PersistenceDir: dir, PersistenceSegmentSize: 1024}
+	e := testPersistentMemoryBroker(t, conf)
+
+	opts := PublishOptions{
+		HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxBytes: 250, HistoryMaxPublicationAge: time.Hour,
+	}
+	for i := 0; i < 50; i++ {
+		_, err := e.Publish("channel", []byte(strings.Repeat("x", 100)), opts)
+		require.NoError(t, err)
+	}
+	require.NoError(t, e.node.Shutdown(context.Background()))
+
+	// Stream restored from a snapshot keeps retention limits it was published with.
+	e = testPersistentMemoryBroker(t, conf)
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+	stream, ok := e.historyHub.streams["channel"]
+	require.True(t, ok)
+	require.Equal(t, memstream.Limits{Size: 10, MaxBytes: 250, MaxAge: time.Hour}, stream.Limits())
+	pubs, _, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+}
+
+func TestMemoryBrokerPersistenceRemoved(t *testing.T) {
+	dir := t.TempDir()
+	e := testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir, HistoryMetaTTL: time.Second})
+	sp, err := e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 3, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	time.Sleep(3 * time.Second)
+	require.NoError(t, e.node.Shutdown(context.Background()))
+
+	// Stream removed by meta TTL must not be restored even without meta TTL.
+	e = testPersistentMemoryBroker(t, MemoryBrokerConfig{PersistenceDir: dir})
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+	pubs, restoredSp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	require.Equal(t, uint64(0), restoredSp.Offset)
+	require.NotEqual(t, sp.Epoch, restoredSp.Epoch)
+}
+
+func TestMemoryBrokerPersistenceImportTop(t *testing.T) {
+	for _, segmentSize := range []int64{0, 1} {
+		t.Run(strconv.FormatInt(segmentSize, 10), func(t *testing.T) {
+			dir := t.TempDir()
+			conf := MemoryBrokerConfig{PersistenceDir: dir, PersistenceSegmentSize: segmentSize}
+			e := testPersistentMemoryBroker(t, conf)
+			pubs := []*Publication{
+				{Offset: 1, Data: []byte("1")},
+				{Offset: 2, Data: []byte("2")},
+			}
+			sp := StreamPosition{Offset: 10, Epoch: "epoch"}
+			err := e.ImportHistory("channel", pubs, sp, PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			require.NoError(t, e.node.Shutdown(context.Background()))
+
+			e = testPersistentMemoryBroker(t, conf)
+			defer func() { _ = e.node.Shutdown(context.Background()) }()
+			restoredPubs, restoredSp, err := e.History("channel", HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Equal(t, sp, restoredSp)
+			require.Len(t, restoredPubs, 2)
+		})
+	}
+}
+
+func TestMemoryBrokerPersistenceCompactionKey(t *testing.T) {
+	dir := t.TempDir()
+	conf := MemoryBrokerConfig{PersistenceDir: dir, PersistenceSegmentSize: 1024}
+	e := testPersistentMemoryBroker(t, conf)
+
+	for i := 0; i < 100; i++ {
+		_, err := e.Publish("channel", []byte(strconv.Itoa(i)), PublishOptions{
+			HistorySize: 10, HistoryTTL: time.Minute, CompactionKey: strconv.Itoa(i % 4),
+		})
+		require.NoError(t, err)
+	}
+	pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 4)
+	require.NoError(t, e.node.Shutdown(context.Background()))
+
+	e = testPersistentMemoryBroker(t, conf)
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+	restoredPubs, restoredSp, err := e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, sp, restoredSp)
+	require.Equal(t, len(pubs), len(restoredPubs))
+	for i := range pubs {
+		require.Equal(t, pubs[i].Offset, restoredPubs[i].Offset)
+		require.Equal(t, pubs[i].CompactionKey, restoredPubs[i].CompactionKey)
+	}
+
+	_, err = e.Publish("channel", []byte("new"), PublishOptions{
+		HistorySize: 10, HistoryTTL: time.Minute, CompactionKey: "0",
+	})
+	require.NoError(t, err)
+	restoredPubs, _, err = e.History("channel", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, restoredPubs, 4)
+	require.Equal(t, []byte("new"), restoredPubs[3].Data)
+}
+
 func BenchmarkMemoryPublish_1Ch(b *testing.B) {
 	e := testMemoryBroker()
 	defer func() { _ = e.node.Shutdown(context.Background()) }()
@@ -559,3 +1079,54 @@ func BenchmarkMemoryBrokerHistoryIteration(b *testing.B) {
 		it.testHistoryIteration(b, e.node, startPosition)
 	}
 }
+
+func TestMemoryBrokerAllowRate(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	limit := RateLimit{Rate: 0.001, Burst: 2}
+	for i := 0; i < 2; i++ {
+		allowed, err := e.AllowRate("test", limit)
+		require.NoError(t, err)
+		require.True(t, allowed)
+	}
+	allowed, err := e.AllowRate("test", limit)
+	require.NoError(t, err)
+	require.False(t, allowed)
+}
+
+func TestMemoryBrokerPatternSubscribe(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	var numPubs int
+	patternPubs := map[string][]string{}
+	e.eventHandler = &testBrokerEventHandler{
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			numPubs++
+			return nil
+		},
+		HandlePatternPublicationFunc: func(pattern string, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+			patternPubs[pattern] = append(patternPubs[pattern], ch)
+			return nil
+		},
+	}
+
+	require.NoError(t, e.SubscribePattern("news.*"))
+	require.NoError(t, e.SubscribePattern("*.sport"))
+
+	_, err := e.Publish("news.sport", []byte("{}"), PublishOptions{})
+	require.NoError(t, err)
+	_, err = e.Publish("news.tech", []byte("{}"), PublishOptions{})
+	require.NoError(t, err)
+	_, err = e.Publish("other", []byte("{}"), PublishOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 3, numPubs)
+	require.Equal(t, []string{"news.sport", "news.tech"}, patternPubs["news.*"])
+	require.Equal(t, []string{"news.sport"}, patternPubs["*.sport"])
+
+	require.NoError(t, e.UnsubscribePattern("news.*"))
+	_, err = e.Publish("news.tech", []byte("{}"), PublishOptions{})
+	require.NoError(t, err)
+	require.Len(t, patternPubs["news.*"], 2)
+}
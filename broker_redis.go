@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"runtime"
 	"strconv"
 	"strings"
@@ -16,6 +18,7 @@ import (
 
 	"github.com/centrifugal/protocol"
 	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
 )
 
 const (
@@ -48,21 +51,25 @@ var _ Broker = (*RedisBroker)(nil)
 // Redis Clusters to scale PUB/SUB).
 // By default, Redis >= 5 required (due to the fact RedisBroker uses STREAM data structure).
 type RedisBroker struct {
-	controlRound           uint64 // Keep atomic on struct top for 32-bit architectures.
-	node                   *Node
-	sharding               bool
-	config                 RedisBrokerConfig
-	shards                 []*RedisShard
-	historyListScript      *redis.Script
-	historyStreamScript    *redis.Script
-	addHistoryListScript   *redis.Script
-	addHistoryStreamScript *redis.Script
-	messagePrefix          string
-	pingChannel            string
-	controlChannel         string
-	nodeChannel            string
-	closeOnce              sync.Once
-	closeCh                chan struct{}
+	controlRound            uint64 // Keep atomic on struct top for 32-bit architectures.
+	node                    *Node
+	sharding                bool
+	config                  RedisBrokerConfig
+	shards                  []*RedisShard
+	historyListScript       *redis.Script
+	historyStreamScript     *redis.Script
+	addHistoryListScript    *redis.Script
+	addHistoryStreamScript  *redis.Script
+	publishIdempotentScript *redis.Script
+	resetStreamScript       *redis.Script
+	importHistoryScript     *redis.Script
+	rateLimitScript         *redis.Script
+	messagePrefix           string
+	pingChannel             string
+	controlChannel          string
+	nodeChannel             string
+	closeOnce               sync.Once
+	closeCh                 chan struct{}
 }
 
 // DefaultRedisBrokerPrefix is a default value for RedisBrokerConfig.Prefix.
@@ -104,6 +111,16 @@ type RedisBrokerConfig struct {
 	// be started. By default, runtime.NumCPU() workers used.
 	PubSubNumWorkers int
 
+	// UseShardedPubSub enables Redis sharded PUB/SUB (SPUBLISH/SSUBSCRIBE, available
+	// since Redis 7.0) for channel publications when working with Redis Cluster. With
+	// classic PUB/SUB every message is broadcasted to all nodes of a cluster, so PUB/SUB
+	// throughput does not scale by adding more masters. With sharded PUB/SUB a message
+	// is propagated only inside a cluster shard which owns channel hash slot. RedisBroker
+	// then maintains a PUB/SUB connection to each cluster node which owns slots of
+	// subscribed channels. Control and node channels still use classic PUB/SUB. All
+	// shards must be Redis Cluster shards to use this option.
+	UseShardedPubSub bool
+
 	// Shards is a list of Redis shards to use. At least one shard must be provided.
 	Shards []*RedisShard
 }
@@ -118,20 +135,38 @@ func NewRedisBroker(n *Node, config RedisBrokerConfig) (*RedisBroker, error) {
 		n.Log(NewLogEntry(LogLevelInfo, fmt.Sprintf("broker: Redis sharding enabled: %d shards", len(config.Shards))))
 	}
 
+	if config.UseShardedPubSub {
+		for _, s := range config.Shards {
+			if !s.useCluster {
+				return nil, errors.New("broker: sharded PUB/SUB can only be used with Redis Cluster")
+			}
+		}
+	}
+
 	if config.Prefix == "" {
 		config.Prefix = DefaultRedisBrokerPrefix
 	}
 
+	// Scripts which publish messages use PUBLISH or SPUBLISH depending on mode.
+	publishCommandSource := publishCommandPublishSource
+	if config.UseShardedPubSub {
+		publishCommandSource = publishCommandSPublishSource
+	}
+
 	b := &RedisBroker{
-		node:                   n,
-		shards:                 config.Shards,
-		config:                 config,
-		sharding:               len(config.Shards) > 1,
-		historyListScript:      redis.NewScript(2, historyListSource),
-		historyStreamScript:    redis.NewScript(2, historyStreamSource),
-		addHistoryListScript:   redis.NewScript(2, addHistorySource),
-		addHistoryStreamScript: redis.NewScript(2, addHistoryStreamSource),
-		closeCh:                make(chan struct{}),
+		node:                    n,
+		shards:                  config.Shards,
+		config:                  config,
+		sharding:                len(config.Shards) > 1,
+		historyListScript:       redis.NewScript(2, historyListSource),
+		historyStreamScript:     redis.NewScript(2, historyStreamSource),
+		addHistoryListScript:    redis.NewScript(3, publishCommandSource+addHistorySource),
+		addHistoryStreamScript:  redis.NewScript(4, publishCommandSource+addHistoryStreamSource),
+		publishIdempotentScript: redis.NewScript(1, publishCommandSource+publishIdempotentSource),
+		resetStreamScript:       redis.NewScript(3, resetStreamSource),
+		importHistoryScript:     redis.NewScript(3, importHistorySource),
+		rateLimitScript:         redis.NewScript(1, rateLimitSource),
+		closeCh:                 make(chan struct{}),
 	}
 
 	for i := range config.Shards {
@@ -140,6 +175,10 @@ func NewRedisBroker(n *Node, config RedisBrokerConfig) (*RedisBroker, error) {
 			b.historyStreamScript,
 			b.addHistoryListScript,
 			b.addHistoryStreamScript,
+			b.publishIdempotentScript,
+			b.resetStreamScript,
+			b.importHistoryScript,
+			b.rateLimitScript,
 		)
 	}
 
@@ -151,16 +190,33 @@ func NewRedisBroker(n *Node, config RedisBrokerConfig) (*RedisBroker, error) {
 }
 
 const (
-	// Add to history and optionally publish.
+	// Sources defining publishCommand used by scripts which publish messages. One
+	// of them must be prepended to such script. Sharded channel must belong to the
+	// same hash slot as keys used by script – this is achieved by using the same
+	// hash tag in channel name and keys.
+	publishCommandPublishSource  = "local publishCommand = \"publish\"\n"
+	publishCommandSPublishSource = "local publishCommand = \"spublish\"\n"
+
+	// Add to history and optionally publish. Requires publishCommand.
 	// KEYS[1] - history list key
 	// KEYS[2] - sequence meta hash key
+	// KEYS[3] - idempotent result key
 	// ARGV[1] - message payload
 	// ARGV[2] - history size ltrim right bound
 	// ARGV[3] - history lifetime
 	// ARGV[4] - channel to publish message to if needed
 	// ARGV[5] - history meta key expiration time
 	// ARGV[6] - new epoch value if no epoch set yet
+	// ARGV[7] - publication time in milliseconds to put into meta, "0" to use meta without time
+	// ARGV[8] - idempotent result key expiration time
+	// ARGV[9] - PUB/SUB only message prefix (not saved to history)
 	addHistorySource = `
+if ARGV[8] ~= '0' then
+  local cachedResult = redis.call("hmget", KEYS[3], "e", "s")
+  if cachedResult[1] ~= false then
+    return {cachedResult[2], cachedResult[1], "1"}
+  end
+end
 local epoch
 if redis.call('exists', KEYS[2]) ~= 0 then
   epoch = redis.call("hget", KEYS[2], "e")
@@ -173,27 +229,60 @@ local offset = redis.call("hincrby", KEYS[2], "s", 1)
 if ARGV[5] ~= '0' then
 	redis.call("expire", KEYS[2], ARGV[5])
 end
-local payload = "__" .. "p1:" .. offset .. ":" .. epoch .. "__" .. ARGV[1]
+local payload
+if ARGV[7] ~= '0' then
+  payload = "__" .. "p2:" .. offset .. ":" .. ARGV[7] .. ":" .. epoch .. "__" .. ARGV[1]
+else
+  payload = "__" .. "p1:" .. offset .. ":" .. epoch .. "__" .. ARGV[1]
+end
 redis.call("lpush", KEYS[1], payload)
 redis.call("ltrim", KEYS[1], 0, ARGV[2])
 redis.call("expire", KEYS[1], ARGV[3])
 if ARGV[4] ~= '' then
-	redis.call("publish", ARGV[4], payload)
+	redis.call(publishCommand, ARGV[4], ARGV[9] .. payload)
+end
+if ARGV[8] ~= '0' then
+  redis.call("hset", KEYS[3], "e", epoch, "s", offset)
+  redis.call("expire", KEYS[3], ARGV[8])
 end
 return {offset, epoch}
 		`
 
 	// addHistoryStreamSource contains a Lua script to save data to Redis stream and
-	// publish it into channel.
+	// publish it into channel. Requires publishCommand.
 	// KEYS[1] - history stream key
 	// KEYS[2] - stream meta hash key
+	// KEYS[3] - stream compaction keys hash key
+	// KEYS[4] - idempotent result key
 	// ARGV[1] - message payload
 	// ARGV[2] - stream size
 	// ARGV[3] - stream lifetime
 	// ARGV[4] - channel to publish message to if needed
 	// ARGV[5] - history meta key expiration time
 	// ARGV[6] - new epoch value if no epoch set yet
+	// ARGV[7] - publication time in milliseconds
+	// ARGV[8] - compaction key
+	// ARGV[9] - idempotent result key expiration time
+	// ARGV[10] - max total size of publications in stream
+	// ARGV[11] - min publication time in milliseconds to keep in stream
+	// ARGV[12] - publication time in milliseconds to put into PUB/SUB meta, "0" to use meta without time
+	// ARGV[13] - PUB/SUB only message prefix (not saved to history)
 	addHistoryStreamSource = `
+local function field(entry, name)
+  local fields = entry[2]
+  for i = 1, #fields, 2 do
+    if fields[i] == name then
+      return fields[i + 1]
+    end
+  end
+  return nil
+end
+if ARGV[9] ~= '0' then
+  local cachedResult = redis.call("hmget", KEYS[4], "e", "s")
+  if cachedResult[1] ~= false then
+    return {cachedResult[2], cachedResult[1], "1"}
+  end
+end
 local epoch
 if redis.call('exists', KEYS[2]) ~= 0 then
   epoch = redis.call("hget", KEYS[2], "e")
@@ -206,15 +295,116 @@ local offset = redis.call("hincrby", KEYS[2], "s", 1)
 if ARGV[5] ~= '0' then
 	redis.call("expire", KEYS[2], ARGV[5])
 end
-redis.call("xadd", KEYS[1], "MAXLEN", ARGV[2], offset, "d", ARGV[1])
+local maxBytes = tonumber(ARGV[10])
+local minTime = tonumber(ARGV[11])
+local compacted = ARGV[8] ~= '' or redis.call("exists", KEYS[3]) ~= 0
+if compacted or maxBytes > 0 or minTime > 0 then
+  -- Trim stream manually to keep compaction keys hash and stream size consistent
+  -- and remember trimmed offset.
+  local streamBytes = 0
+  if maxBytes > 0 and redis.call("exists", KEYS[1]) ~= 0 then
+    local meta = redis.call("hmget", KEYS[2], "b", "bo")
+    if meta[1] and tonumber(meta[2]) == offset - 1 then
+      streamBytes = tonumber(meta[1])
+    else
+      -- Stream size is unknown since stream was modified without size tracking.
+      for _, entry in ipairs(redis.call("xrange", KEYS[1], "-", "+")) do
+        streamBytes = streamBytes + #field(entry, "d")
+      end
+    end
+  end
+  if ARGV[8] ~= '' then
+    local prevOffset = redis.call("hget", KEYS[3], ARGV[8])
+    if prevOffset then
+      if maxBytes > 0 then
+        local prev = redis.call("xrange", KEYS[1], prevOffset, prevOffset)[1]
+        if prev then
+          streamBytes = streamBytes - #field(prev, "d")
+        end
+      end
+      redis.call("xdel", KEYS[1], prevOffset)
+    end
+    redis.call("hset", KEYS[3], ARGV[8], offset)
+  end
+  if compacted then
+    redis.call("expire", KEYS[3], ARGV[3])
+  end
+  redis.call("xadd", KEYS[1], offset, "d", ARGV[1], "t", ARGV[7], "k", ARGV[8])
+  streamBytes = streamBytes + #ARGV[1]
+  local length = redis.call("xlen", KEYS[1])
+  local size = tonumber(ARGV[2])
+  local keepFrom = nil
+  local trimmedOffset = nil
+  local cursor = "-"
+  while keepFrom == nil do
+    local entries = redis.call("xrange", KEYS[1], cursor, "+", "COUNT", 100)
+    if #entries == 0 then
+      break
+    end
+    for _, entry in ipairs(entries) do
+      local entryOffset = string.match(entry[1], "^(%d+)")
+      local remove = length > size
+      if not remove and tonumber(entryOffset) ~= offset then
+        -- The latest publication is always kept.
+        remove = (maxBytes > 0 and streamBytes > maxBytes) or (minTime > 0 and tonumber(field(entry, "t") or "0") < minTime)
+      end
+      if not remove then
+        keepFrom = entry[1]
+        break
+      end
+      length = length - 1
+      streamBytes = streamBytes - #field(entry, "d")
+      local key = field(entry, "k")
+      if key and key ~= '' and redis.call("hget", KEYS[3], key) == entryOffset then
+        redis.call("hdel", KEYS[3], key)
+      end
+      trimmedOffset = entryOffset
+    end
+    cursor = string.match(entries[#entries][1], "^(%d+)") .. "-1"
+  end
+  if trimmedOffset then
+    redis.call("xtrim", KEYS[1], "MINID", keepFrom)
+    if compacted then
+      redis.call("hset", KEYS[2], "w", trimmedOffset)
+    end
+  end
+  if maxBytes > 0 then
+    redis.call("hset", KEYS[2], "b", streamBytes, "bo", offset)
+  end
+else
+  redis.call("xadd", KEYS[1], "MAXLEN", ARGV[2], offset, "d", ARGV[1], "t", ARGV[7])
+end
 redis.call("expire", KEYS[1], ARGV[3])
 if ARGV[4] ~= '' then
-	local payload = "__" .. "p1:" .. offset .. ":" .. epoch .. "__" .. ARGV[1]
-	redis.call("publish", ARGV[4], payload)
+	local payload
+	if ARGV[12] ~= '0' then
+		payload = "__" .. "p2:" .. offset .. ":" .. ARGV[12] .. ":" .. epoch .. "__" .. ARGV[1]
+	else
+		payload = "__" .. "p1:" .. offset .. ":" .. epoch .. "__" .. ARGV[1]
+	end
+	redis.call(publishCommand, ARGV[4], ARGV[13] .. payload)
+end
+if ARGV[9] ~= '0' then
+  redis.call("hset", KEYS[4], "e", epoch, "s", offset)
+  redis.call("expire", KEYS[4], ARGV[9])
 end
 return {offset, epoch}
 	`
 
+	// publishIdempotentSource contains a Lua script to publish message into channel
+	// only once during idempotent result key lifetime. Requires publishCommand.
+	// KEYS[1] - idempotent result key
+	// ARGV[1] - channel to publish message to
+	// ARGV[2] - message payload
+	// ARGV[3] - idempotent result key expiration time
+	publishIdempotentSource = `
+if redis.call("set", KEYS[1], "", "EX", ARGV[3], "NX") == false then
+  return 0
+end
+redis.call(publishCommand, ARGV[1], ARGV[2])
+return 1
+	`
+
 	// Retrieve channel history information.
 	// KEYS[1] - history list key
 	// KEYS[2] - list meta hash key
@@ -251,6 +441,7 @@ return {offset, epoch, pubs}
 	// ARGV[4] - reverse
 	// ARGV[5] - stream meta hash key expiration time
 	// ARGV[6] - new epoch value if no epoch set yet
+	// Returns offset, epoch, publications and the largest offset trimmed from compacted stream.
 	historyStreamSource = `
 local offset = redis.call("hget", KEYS[2], "s")
 local epoch
@@ -264,7 +455,7 @@ end
 if ARGV[5] ~= '0' then
 	redis.call("expire", KEYS[2], ARGV[5])
 end
-local pubs = nil
+local pubs = false
 if ARGV[1] ~= "0" then
   if ARGV[3] ~= "0" then
 	if ARGV[4] == '0' then
@@ -290,7 +481,102 @@ if ARGV[1] ~= "0" then
 	end
   end
 end
-return {offset, epoch, pubs}
+return {offset, epoch, pubs, redis.call("hget", KEYS[2], "w")}
+	`
+
+	// KEYS[1] - history key (stream or list)
+	// KEYS[2] - stream meta hash key
+	// KEYS[3] - compaction hash key
+	// ARGV[1] - stream epoch
+	// ARGV[2] - stream top offset
+	// ARGV[3] - stream lifetime
+	// ARGV[4] - stream meta hash key expiration time
+	// ARGV[5] - "1" if history kept in stream, otherwise in list
+	// ARGV[6] - trimmed offset
+	// ARGV[7...] - offset, time in milliseconds, compaction key and payload of each publication,
+	// for list time "0" means using meta without time
+	importHistorySource = `
+redis.call("del", KEYS[1], KEYS[2], KEYS[3])
+local compacted = false
+for i = 7, #ARGV, 4 do
+  local offset = ARGV[i]
+  if ARGV[5] == '1' then
+    if ARGV[i + 2] ~= '' then
+      redis.call("xadd", KEYS[1], offset, "d", ARGV[i + 3], "t", ARGV[i + 1], "k", ARGV[i + 2])
+      redis.call("hset", KEYS[3], ARGV[i + 2], offset)
+      compacted = true
+    else
+      redis.call("xadd", KEYS[1], offset, "d", ARGV[i + 3], "t", ARGV[i + 1])
+    end
+  else
+    if ARGV[i + 1] ~= '0' then
+      redis.call("lpush", KEYS[1], "__" .. "p2:" .. offset .. ":" .. ARGV[i + 1] .. ":" .. ARGV[1] .. "__" .. ARGV[i + 3])
+    else
+      redis.call("lpush", KEYS[1], "__" .. "p1:" .. offset .. ":" .. ARGV[1] .. "__" .. ARGV[i + 3])
+    end
+  end
+end
+if #ARGV >= 7 then
+  redis.call("expire", KEYS[1], ARGV[3])
+end
+redis.call("hset", KEYS[2], "e", ARGV[1])
+redis.call("hset", KEYS[2], "s", ARGV[2])
+if compacted then
+  redis.call("expire", KEYS[3], ARGV[3])
+  if ARGV[6] ~= '0' then
+    redis.call("hset", KEYS[2], "w", ARGV[6])
+  end
+end
+if ARGV[4] ~= '0' then
+	redis.call("expire", KEYS[2], ARGV[4])
+end
+return ARGV[1]
+	`
+
+	// KEYS[1] - history key (stream or list)
+	// KEYS[2] - stream meta hash key
+	// KEYS[3] - compaction hash key
+	// ARGV[1] - new stream epoch
+	// ARGV[2] - stream meta hash key expiration time
+	resetStreamSource = `
+redis.call("del", KEYS[1], KEYS[2], KEYS[3])
+redis.call("hset", KEYS[2], "e", ARGV[1])
+redis.call("hset", KEYS[2], "s", 0)
+if ARGV[2] ~= '0' then
+	redis.call("expire", KEYS[2], ARGV[2])
+end
+return ARGV[1]
+	`
+
+	// KEYS[1] - token bucket hash key
+	// ARGV[1] - refill rate in tokens per second
+	// ARGV[2] - bucket capacity
+	// ARGV[3] - bucket key expiration time in milliseconds
+	// Current time is taken from Redis so buckets do not depend on node clocks.
+	rateLimitSource = `
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("time")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local bucket = redis.call("hmget", KEYS[1], "t", "u")
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+elseif now > updated then
+	tokens = math.min(burst, tokens + (now - updated) * rate / 1000)
+	updated = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("hset", KEYS[1], "t", tostring(tokens), "u", tostring(updated))
+redis.call("pexpire", KEYS[1], ARGV[3])
+return allowed
 	`
 )
 
@@ -366,7 +652,11 @@ func (b *RedisBroker) runShard(shard *RedisShard, h BrokerEventHandler) error {
 		b.runPubSubPing(shard)
 	})
 	go b.runForever(func() {
-		b.runPubSub(shard, h)
+		if b.config.UseShardedPubSub {
+			b.runShardedPubSub(shard, h)
+		} else {
+			b.runPubSub(shard, h)
+		}
 	})
 	go b.runForever(func() {
 		b.runControlPubSub(shard, h)
@@ -380,70 +670,121 @@ func (b *RedisBroker) Publish(ch string, data []byte, opts PublishOptions) (Stre
 }
 
 func (b *RedisBroker) publish(s *RedisShard, ch string, data []byte, opts PublishOptions) (StreamPosition, error) {
+	if opts.HistorySize <= 0 || opts.HistoryTTL <= 0 {
+		if idempotentResultTTLSeconds(opts) == 0 && !b.config.UseShardedPubSub {
+			return StreamPosition{}, b.publishNoHistory(s, ch, data, opts)
+		}
+	}
+	dr, withHistory, err := b.publishDataRequest(s, ch, data, opts)
+	if err != nil {
+		return StreamPosition{}, err
+	}
+	return publishStreamPosition(s.getDataResponse(dr, b.closeCh), withHistory)
+}
+
+// publishNoHistory is a fast path – publish without history over shard publish pipeline.
+func (b *RedisBroker) publishNoHistory(s *RedisShard, ch string, data []byte, opts PublishOptions) error {
+	byteMessage, err := publicationMessage(data, opts)
+	if err != nil {
+		return err
+	}
+	eChan := make(chan error, 1)
+
+	pr := pubRequest{
+		channel: b.messageChannelID(ch),
+		message: pubSubMessage(byteMessage, b.metaPublicationTime(time.Now().UnixMilli()), opts.ExcludeClients),
+		err:     eChan,
+	}
+	select {
+	case s.pubCh <- pr:
+	default:
+		timer := timers.AcquireTimer(s.readTimeout())
+		defer timers.ReleaseTimer(timer)
+		select {
+		case s.pubCh <- pr:
+		case <-b.closeCh:
+			return errRedisClosed
+		case <-timer.C:
+			return errRedisOpTimeout
+		}
+	}
+	select {
+	case err := <-eChan:
+		return err
+	case <-b.closeCh:
+		return errRedisClosed
+	}
+}
+
+func publicationMessage(data []byte, opts PublishOptions) ([]byte, error) {
 	protoPub := &protocol.Publication{
 		Data: data,
 		Info: infoToProto(opts.ClientInfo),
 		Tags: opts.Tags,
 	}
-	byteMessage, err := protoPub.MarshalVT()
+	return protoPub.MarshalVT()
+}
+
+// publishDataRequest prepares data request to publish into channel. Returned bool
+// is true when publication is added to history so reply contains stream position.
+func (b *RedisBroker) publishDataRequest(s *RedisShard, ch string, data []byte, opts PublishOptions) (*dataRequest, bool, error) {
+	byteMessage, err := publicationMessage(data, opts)
 	if err != nil {
-		return StreamPosition{}, err
+		return nil, false, err
 	}
+	publishTime := time.Now().UnixMilli()
 
 	publishChannel := b.messageChannelID(ch)
 
-	if opts.HistorySize <= 0 || opts.HistoryTTL <= 0 {
-		// Fast path – publish without history.
-		eChan := make(chan error, 1)
+	var resultKey channelID
+	resultTTLSeconds := idempotentResultTTLSeconds(opts)
+	if resultTTLSeconds > 0 {
+		resultKey = b.resultCacheKey(s, ch, opts.IdempotencyKey)
+	}
 
-		pr := pubRequest{
-			channel: publishChannel,
-			message: byteMessage,
-			err:     eChan,
-		}
-		select {
-		case s.pubCh <- pr:
-		default:
-			timer := timers.AcquireTimer(s.readTimeout())
-			defer timers.ReleaseTimer(timer)
-			select {
-			case s.pubCh <- pr:
-			case <-b.closeCh:
-				return StreamPosition{}, errRedisClosed
-			case <-timer.C:
-				return StreamPosition{}, errRedisOpTimeout
-			}
+	if opts.HistorySize <= 0 || opts.HistoryTTL <= 0 {
+		message := pubSubMessage(byteMessage, b.metaPublicationTime(publishTime), opts.ExcludeClients)
+		if resultTTLSeconds > 0 {
+			return s.newDataRequest("", b.publishIdempotentScript, resultKey, []interface{}{resultKey, publishChannel, message, resultTTLSeconds}), false, nil
 		}
-		select {
-		case err := <-eChan:
-			return StreamPosition{}, err
-		case <-b.closeCh:
-			return StreamPosition{}, errRedisClosed
+		command := "PUBLISH"
+		if b.config.UseShardedPubSub {
+			command = "SPUBLISH"
 		}
+		return s.newDataRequest(command, nil, publishChannel, []interface{}{publishChannel, message}), false, nil
 	}
 
 	historyMetaKey := b.historyMetaKey(s, ch)
 	historyMetaTTLSeconds := int(b.config.HistoryMetaTTL.Seconds())
 
-	var streamKey channelID
-	var size int
-	var script *redis.Script
 	if !b.config.UseLists {
-		streamKey = b.historyStreamKey(s, ch)
-		size = opts.HistorySize
-		script = b.addHistoryStreamScript
-	} else {
-		streamKey = b.historyListKey(s, ch)
-		size = opts.HistorySize - 1
-		script = b.addHistoryListScript
+		streamKey := b.historyStreamKey(s, ch)
+		compactionKey := b.historyCompactionKey(s, ch)
+		var minPublicationTime int64
+		if opts.HistoryMaxPublicationAge > 0 {
+			minPublicationTime = publishTime - opts.HistoryMaxPublicationAge.Milliseconds()
+		}
+		return s.newDataRequest("", b.addHistoryStreamScript, streamKey, []interface{}{streamKey, historyMetaKey, compactionKey, resultKey, byteMessage, opts.HistorySize, int(opts.HistoryTTL.Seconds()), publishChannel, historyMetaTTLSeconds, time.Now().Unix(), publishTime, opts.CompactionKey, resultTTLSeconds, opts.HistoryMaxBytes, minPublicationTime, b.metaPublicationTime(publishTime), pubSubExcludeClientsPrefix(opts.ExcludeClients)}), true, nil
 	}
-	dr := s.newDataRequest("", script, streamKey, []interface{}{streamKey, historyMetaKey, byteMessage, size, int(opts.HistoryTTL.Seconds()), publishChannel, historyMetaTTLSeconds, time.Now().Unix()})
-	resp := s.getDataResponse(dr, b.closeCh)
+	if opts.CompactionKey != "" {
+		return nil, false, errors.New("compaction key is not supported when using Redis lists for history")
+	}
+	if opts.HistoryMaxBytes > 0 || opts.HistoryMaxPublicationAge > 0 {
+		return nil, false, errors.New("history max bytes and max publication age are not supported when using Redis lists for history")
+	}
+	streamKey := b.historyListKey(s, ch)
+	return s.newDataRequest("", b.addHistoryListScript, streamKey, []interface{}{streamKey, historyMetaKey, resultKey, byteMessage, opts.HistorySize - 1, int(opts.HistoryTTL.Seconds()), publishChannel, historyMetaTTLSeconds, time.Now().Unix(), b.metaPublicationTime(publishTime), resultTTLSeconds, pubSubExcludeClientsPrefix(opts.ExcludeClients)}), true, nil
+}
+
+func publishStreamPosition(resp *dataResponse, withHistory bool) (StreamPosition, error) {
 	if resp.err != nil {
 		return StreamPosition{}, resp.err
 	}
+	if !withHistory {
+		return StreamPosition{}, nil
+	}
 	replies, ok := resp.reply.([]interface{})
-	if !ok || len(replies) != 2 {
+	if !ok || len(replies) < 2 {
 		return StreamPosition{}, errors.New("wrong Redis reply")
 	}
 	offset, err := redis.Uint64(replies[0], nil)
@@ -457,6 +798,157 @@ func (b *RedisBroker) publish(s *RedisShard, ch string, data []byte, opts Publis
 	return StreamPosition{Offset: offset, Epoch: epoch}, nil
 }
 
+// metaPublicationTime returns publication time to put into PUB/SUB and history
+// list meta or zero to use meta format without time. Time is only put into meta
+// when Config.PublicationTimeTag is set since nodes of previous versions can't
+// parse meta with time – so they must be upgraded before setting the option.
+func (b *RedisBroker) metaPublicationTime(publishTime int64) int64 {
+	if b.node.config.PublicationTimeTag == "" {
+		return 0
+	}
+	return publishTime
+}
+
+// pubSubMessage prepends publication time meta to message published without
+// history when time is not zero, and exclude clients prefix if needed.
+func pubSubMessage(byteMessage []byte, publishTime int64, excludeClients []string) []byte {
+	prefix := pubSubExcludeClientsPrefix(excludeClients)
+	if publishTime != 0 {
+		prefix += "__p2:0:" + strconv.FormatInt(publishTime, 10) + ":__"
+	}
+	if prefix == "" {
+		return byteMessage
+	}
+	return append([]byte(prefix), byteMessage...)
+}
+
+// pubSubExcludeClientsPrefix returns prefix of PUB/SUB message with a list of
+// client IDs publication must not be delivered to, or empty string if there are
+// no such clients. Prefix only used in PUB/SUB, so it's never saved to history.
+// Format is __e:length__ids where length is a byte length of ids.
+func pubSubExcludeClientsPrefix(excludeClients []string) string {
+	if len(excludeClients) == 0 {
+		return ""
+	}
+	ids := encodeExcludeClients(excludeClients)
+	return "__e:" + strconv.Itoa(len(ids)) + "__" + ids
+}
+
+var excludeClientsMetaPrefix = []byte("__e:")
+
+// extractPubSubExcludeClients returns PUB/SUB message without exclude clients
+// prefix and a list of excluded client IDs.
+func extractPubSubExcludeClients(data []byte) ([]byte, []string, bool) {
+	if !bytes.HasPrefix(data, excludeClientsMetaPrefix) {
+		return data, nil, true
+	}
+	rest := data[len(excludeClientsMetaPrefix):]
+	sepPos := bytes.Index(rest, metaSep)
+	if sepPos <= 0 {
+		return nil, nil, false
+	}
+	length, err := strconv.Atoi(string(rest[:sepPos]))
+	if err != nil || length < 0 || length > len(rest)-sepPos-len(metaSep) {
+		return nil, nil, false
+	}
+	rest = rest[sepPos+len(metaSep):]
+	return rest[length:], decodeExcludeClients(string(rest[:length])), true
+}
+
+var _ BatchPublisher = (*RedisBroker)(nil)
+
+// PublishMany - see BatchPublisher interface description. Requests are grouped
+// by shard and sent to Redis over shard data pipeline without waiting for each
+// reply, so many publications are combined into a few round trips. Publications
+// into the same channel are executed in order. In Redis Cluster mode keys of
+// different channels belong to different slots, so there publications into
+// different channels are sent concurrently and publications into the same
+// channel sequentially.
+func (b *RedisBroker) PublishMany(reqs []BrokerPublishRequest) []BrokerPublishResult {
+	results := make([]BrokerPublishResult, len(reqs))
+
+	shardRequests := make(map[*RedisShard][]int)
+	var shards []*RedisShard
+	for i, req := range reqs {
+		s := b.getShard(req.Channel)
+		if _, ok := shardRequests[s]; !ok {
+			shards = append(shards, s)
+		}
+		shardRequests[s] = append(shardRequests[s], i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for _, s := range shards {
+		go func(s *RedisShard, indexes []int) {
+			defer wg.Done()
+			if s.useCluster {
+				b.publishManyCluster(s, reqs, indexes, results)
+				return
+			}
+			b.publishManyPipelined(s, reqs, indexes, results)
+		}(s, shardRequests[s])
+	}
+	wg.Wait()
+	return results
+}
+
+func (b *RedisBroker) publishManyPipelined(s *RedisShard, reqs []BrokerPublishRequest, indexes []int, results []BrokerPublishResult) {
+	drs := make([]*dataRequest, len(indexes))
+	withHistory := make([]bool, len(indexes))
+	for j, i := range indexes {
+		req := reqs[i]
+		dr, history, err := b.publishDataRequest(s, req.Channel, req.Data, req.Options)
+		if err == nil {
+			err = s.sendDataRequest(dr, b.closeCh)
+		}
+		if err != nil {
+			results[i] = BrokerPublishResult{Error: err}
+			continue
+		}
+		drs[j] = dr
+		withHistory[j] = history
+	}
+	for j, i := range indexes {
+		if drs[j] == nil {
+			continue
+		}
+		sp, err := publishStreamPosition(drs[j].result(), withHistory[j])
+		results[i] = BrokerPublishResult{StreamPosition: sp, Error: err}
+	}
+}
+
+func (b *RedisBroker) publishManyCluster(s *RedisShard, reqs []BrokerPublishRequest, indexes []int, results []BrokerPublishResult) {
+	channelRequests := make(map[string][]int)
+	var channels []string
+	for _, i := range indexes {
+		ch := reqs[i].Channel
+		if _, ok := channelRequests[ch]; !ok {
+			channels = append(channels, ch)
+		}
+		channelRequests[ch] = append(channelRequests[ch], i)
+	}
+
+	sem := make(chan struct{}, redisPublishBatchLimit)
+	var wg sync.WaitGroup
+	wg.Add(len(channels))
+	for _, ch := range channels {
+		sem <- struct{}{}
+		go func(indexes []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			for _, i := range indexes {
+				req := reqs[i]
+				sp, err := b.publish(s, req.Channel, req.Data, req.Options)
+				results[i] = BrokerPublishResult{StreamPosition: sp, Error: err}
+			}
+		}(channelRequests[ch])
+	}
+	wg.Wait()
+}
+
 // PublishJoin - see Broker.PublishJoin.
 func (b *RedisBroker) PublishJoin(ch string, info *ClientInfo) error {
 	return b.publishJoin(b.getShard(ch), ch, info)
@@ -472,6 +964,10 @@ func (b *RedisBroker) publishJoin(s *RedisShard, ch string, info *ClientInfo) er
 
 	chID := b.messageChannelID(ch)
 
+	if b.config.UseShardedPubSub {
+		return b.shardedPublish(s, chID, append(joinTypePrefix, byteMessage...))
+	}
+
 	pr := pubRequest{
 		channel: chID,
 		message: append(joinTypePrefix, byteMessage...),
@@ -513,6 +1009,10 @@ func (b *RedisBroker) publishLeave(s *RedisShard, ch string, info *ClientInfo) e
 
 	chID := b.messageChannelID(ch)
 
+	if b.config.UseShardedPubSub {
+		return b.shardedPublish(s, chID, append(leaveTypePrefix, byteMessage...))
+	}
+
 	pr := pubRequest{
 		channel: chID,
 		message: append(leaveTypePrefix, byteMessage...),
@@ -539,6 +1039,14 @@ func (b *RedisBroker) publishLeave(s *RedisShard, ch string, info *ClientInfo) e
 	}
 }
 
+// shardedPublish publishes message into sharded channel. Publish pipeline is not
+// used here since SPUBLISH must be sent to a cluster node owning channel hash slot.
+func (b *RedisBroker) shardedPublish(s *RedisShard, chID channelID, message []byte) error {
+	dr := s.newDataRequest("SPUBLISH", nil, chID, []interface{}{chID, message})
+	resp := s.getDataResponse(dr, b.closeCh)
+	return resp.err
+}
+
 // PublishControl - see Broker.PublishControl.
 func (b *RedisBroker) PublishControl(data []byte, nodeID, _ string) error {
 	currentRound := atomic.AddUint64(&b.controlRound, 1)
@@ -607,16 +1115,111 @@ func (b *RedisBroker) unsubscribe(s *RedisShard, ch string) error {
 	return b.sendSubscribe(s, r)
 }
 
+var _ PatternSubscriber = (*RedisBroker)(nil)
+
+// SubscribePattern - see PatternSubscriber interface description. Node is
+// subscribed on pattern using PSUBSCRIBE in all Redis shards since channels
+// matching pattern may belong to any shard. Returns ErrorNotAvailable if
+// sharded PUB/SUB is used.
+func (b *RedisBroker) SubscribePattern(pattern string) error {
+	if b.config.UseShardedPubSub {
+		return ErrorNotAvailable
+	}
+	if b.node.LogEnabled(LogLevelDebug) {
+		b.node.Log(NewLogEntry(LogLevelDebug, "subscribe node on pattern", map[string]interface{}{"pattern": pattern}))
+	}
+	for _, s := range b.shards {
+		r := newPatternSubRequest([]channelID{b.patternChannelID(pattern)}, true)
+		if err := b.sendSubscribe(s, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnsubscribePattern - see PatternSubscriber interface description.
+func (b *RedisBroker) UnsubscribePattern(pattern string) error {
+	if b.config.UseShardedPubSub {
+		return ErrorNotAvailable
+	}
+	if b.node.LogEnabled(LogLevelDebug) {
+		b.node.Log(NewLogEntry(LogLevelDebug, "unsubscribe node from pattern", map[string]interface{}{"pattern": pattern}))
+	}
+	for _, s := range b.shards {
+		r := newPatternSubRequest([]channelID{b.patternChannelID(pattern)}, false)
+		if err := b.sendSubscribe(s, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // History - see Broker.History.
 func (b *RedisBroker) History(ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
 	return b.history(b.getShard(ch), ch, filter)
 }
 
 func (b *RedisBroker) history(s *RedisShard, ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
+	if !filter.HasPublicationFilter() || filter.Limit == 0 {
+		if !b.config.UseLists {
+			return b.historyStream(s, ch, filter)
+		}
+		return b.historyList(s, ch, filter)
+	}
 	if !b.config.UseLists {
-		return b.historyStream(s, ch, filter)
+		return b.historyStreamFiltered(s, ch, filter)
+	}
+	// Limit applies to matching publications so we need to read the whole list,
+	// it's bounded by history size anyway.
+	limit := filter.Limit
+	filter.Limit = -1
+	pubs, sp, err := b.historyList(s, ch, filter)
+	if err != nil {
+		return nil, StreamPosition{}, err
+	}
+	return filterPublications(pubs, filter, limit), sp, nil
+}
+
+// redisHistoryFilterPageSize is a number of stream entries read at once when
+// publications are filtered.
+const redisHistoryFilterPageSize = 100
+
+// historyStreamFiltered reads stream page by page until limit of matching
+// publications reached, so that stream is not read entirely when limit is set.
+func (b *RedisBroker) historyStreamFiltered(s *RedisShard, ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
+	limit := filter.Limit
+	pageSize := redisHistoryFilterPageSize
+	if limit > pageSize {
+		pageSize = limit
+	}
+	pageFilter := filter
+	pageFilter.Limit = pageSize
+
+	var (
+		result []*Publication
+		sp     StreamPosition
+	)
+	for {
+		pubs, pageSp, err := b.historyStream(s, ch, pageFilter)
+		if err != nil {
+			return nil, StreamPosition{}, err
+		}
+		if sp.Epoch != "" && pageSp.Epoch != sp.Epoch {
+			// Stream was reset while reading, publications read so far are not
+			// from the current stream.
+			return nil, pageSp, nil
+		}
+		sp = pageSp
+		remaining := -1
+		if limit > 0 {
+			remaining = limit - len(result)
+		}
+		result = append(result, filterPublications(pubs, filter, remaining)...)
+		if len(pubs) < pageSize || (limit > 0 && len(result) >= limit) {
+			return result, sp, nil
+		}
+		pageFilter.Since = &StreamPosition{Offset: pubs[len(pubs)-1].Offset, Epoch: sp.Epoch}
 	}
-	return b.historyList(s, ch, filter)
 }
 
 // RemoveHistory - see Broker.RemoveHistory.
@@ -626,20 +1229,196 @@ func (b *RedisBroker) RemoveHistory(ch string) error {
 
 func (b *RedisBroker) removeHistory(s *RedisShard, ch string) error {
 	var key channelID
+	args := make([]interface{}, 0, 2)
 	if !b.config.UseLists {
 		key = b.historyStreamKey(s, ch)
+		args = append(args, key, b.historyCompactionKey(s, ch))
 	} else {
 		key = b.historyListKey(s, ch)
+		args = append(args, key)
+	}
+	dr := s.newDataRequest("DEL", nil, key, args)
+	resp := s.getDataResponse(dr, b.closeCh)
+	return resp.err
+}
+
+var _ StreamResetter = (*RedisBroker)(nil)
+
+// ResetStream - see StreamResetter interface description.
+func (b *RedisBroker) ResetStream(ch string) (StreamPosition, error) {
+	return b.resetStream(b.getShard(ch), ch)
+}
+
+func (b *RedisBroker) resetStream(s *RedisShard, ch string) (StreamPosition, error) {
+	var historyKey channelID
+	if !b.config.UseLists {
+		historyKey = b.historyStreamKey(s, ch)
+	} else {
+		historyKey = b.historyListKey(s, ch)
+	}
+	historyMetaKey := b.historyMetaKey(s, ch)
+	// Epoch with nanosecond precision to differ from epochs set by other scripts.
+	epoch := strconv.FormatInt(time.Now().UnixNano(), 10)
+	historyMetaTTLSeconds := int(b.config.HistoryMetaTTL.Seconds())
+	dr := s.newDataRequest("", b.resetStreamScript, historyKey, []interface{}{historyKey, historyMetaKey, b.historyCompactionKey(s, ch), epoch, historyMetaTTLSeconds})
+	resp := s.getDataResponse(dr, b.closeCh)
+	if resp.err != nil {
+		return StreamPosition{}, resp.err
+	}
+	return StreamPosition{Offset: 0, Epoch: epoch}, nil
+}
+
+var _ RateLimiter = (*RedisBroker)(nil)
+
+// AllowRate - see RateLimiter interface description. Token bucket state is kept
+// in Redis and refilled according to Redis server time, so each call costs a
+// round trip to Redis.
+func (b *RedisBroker) AllowRate(key string, limit RateLimit) (bool, error) {
+	if limit.Rate <= 0 {
+		return true, nil
+	}
+	s := b.getShard(key)
+	rateKey := b.rateLimitKey(key)
+	// Bucket is full after this time so its key can be safely expired.
+	expireMs := int64(math.Ceil(float64(limit.burst()) * 1000 / limit.Rate))
+	dr := s.newDataRequest("", b.rateLimitScript, rateKey, []interface{}{rateKey, limit.Rate, limit.burst(), expireMs})
+	resp := s.getDataResponse(dr, b.closeCh)
+	if resp.err != nil {
+		return false, resp.err
+	}
+	allowed, err := redis.Int(resp.reply, nil)
+	if err != nil {
+		return false, err
+	}
+	return allowed == 1, nil
+}
+
+var _ HistoryImporter = (*RedisBroker)(nil)
+
+// ImportHistory - see HistoryImporter interface description. History size and
+// compaction are applied to imported publications, other retention options
+// (HistoryMaxBytes, HistoryMaxPublicationAge) are applied upon next publication.
+func (b *RedisBroker) ImportHistory(ch string, pubs []*Publication, sp StreamPosition, opts PublishOptions) error {
+	return b.importHistory(b.getShard(ch), ch, pubs, sp, opts)
+}
+
+func (b *RedisBroker) importHistory(s *RedisShard, ch string, pubs []*Publication, sp StreamPosition, opts PublishOptions) error {
+	if b.config.UseLists && (opts.HistoryMaxBytes > 0 || opts.HistoryMaxPublicationAge > 0) {
+		return errors.New("history max bytes and max publication age not supported with lists")
+	}
+	pubs = retainImportedPublications(pubs, opts.HistorySize, !b.config.UseLists)
+
+	var historyKey channelID
+	if !b.config.UseLists {
+		historyKey = b.historyStreamKey(s, ch)
+	} else {
+		historyKey = b.historyListKey(s, ch)
+	}
+	var trimmedOffset uint64
+	if len(pubs) > 0 {
+		trimmedOffset = pubs[0].Offset - 1
+	}
+	args := make([]interface{}, 0, 9+4*len(pubs))
+	args = append(args, historyKey, b.historyMetaKey(s, ch), b.historyCompactionKey(s, ch))
+	args = append(args, sp.Epoch, sp.Offset, int(opts.HistoryTTL.Seconds()), int(b.config.HistoryMetaTTL.Seconds()), !b.config.UseLists, trimmedOffset)
+	for _, pub := range pubs {
+		protoPub := &protocol.Publication{
+			Data: pub.Data,
+			Info: infoToProto(pub.Info),
+			Tags: pub.Tags,
+		}
+		byteMessage, err := protoPub.MarshalVT()
+		if err != nil {
+			return err
+		}
+		pubTime := pub.Time
+		if b.config.UseLists {
+			pubTime = b.metaPublicationTime(pub.Time)
+		}
+		args = append(args, pub.Offset, pubTime, pub.CompactionKey, byteMessage)
 	}
-	dr := s.newDataRequest("DEL", nil, key, []interface{}{key})
+	dr := s.newDataRequest("", b.importHistoryScript, historyKey, args)
 	resp := s.getDataResponse(dr, b.closeCh)
 	return resp.err
 }
 
+// retainImportedPublications returns publications which must stay in history
+// after import: only the latest publication with the same compaction key (if
+// compaction supported) and no more than size publications.
+func retainImportedPublications(pubs []*Publication, size int, compaction bool) []*Publication {
+	if compaction {
+		latest := make(map[string]uint64)
+		for _, pub := range pubs {
+			if pub.CompactionKey != "" {
+				latest[pub.CompactionKey] = pub.Offset
+			}
+		}
+		if len(latest) > 0 {
+			compacted := make([]*Publication, 0, len(pubs))
+			for _, pub := range pubs {
+				if pub.CompactionKey == "" || latest[pub.CompactionKey] == pub.Offset {
+					compacted = append(compacted, pub)
+				}
+			}
+			pubs = compacted
+		}
+	}
+	if size > 0 && len(pubs) > size {
+		pubs = pubs[len(pubs)-size:]
+	}
+	return pubs
+}
+
 func (b *RedisBroker) messageChannelID(ch string) channelID {
+	if b.config.UseShardedPubSub {
+		// Use the same hash tag as history keys use so sharded channel belongs
+		// to the same hash slot.
+		ch = "{" + ch + "}"
+	}
 	return channelID(b.messagePrefix + ch)
 }
 
+// patternChannelID returns Redis PSUBSCRIBE pattern for a pattern subscription.
+// Only * is a wildcard in pattern subscriptions, so other special characters of
+// Redis glob-style patterns are escaped.
+func (b *RedisBroker) patternChannelID(pattern string) channelID {
+	return channelID(escapeRedisPattern(b.messagePrefix, true) + escapeRedisPattern(pattern, false))
+}
+
+// extractPattern returns pattern subscription from Redis pattern.
+func (b *RedisBroker) extractPattern(patternID string) string {
+	return strings.TrimPrefix(unescapeRedisPattern(patternID), b.messagePrefix)
+}
+
+func escapeRedisPattern(s string, escapeWildcard bool) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		case channelPatternWildcard:
+			if escapeWildcard {
+				sb.WriteByte('\\')
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func unescapeRedisPattern(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
 func (b *RedisBroker) nodeChannelID(nodeID string) channelID {
 	return channelID(b.config.Prefix + redisNodeChannelPrefix + nodeID)
 }
@@ -658,43 +1437,415 @@ func (b *RedisBroker) historyStreamKey(s *RedisShard, ch string) channelID {
 	return channelID(b.config.Prefix + ".stream." + ch)
 }
 
-func (b *RedisBroker) historyMetaKey(s *RedisShard, ch string) channelID {
+func (b *RedisBroker) historyCompactionKey(s *RedisShard, ch string) channelID {
 	if s.useCluster {
 		ch = "{" + ch + "}"
 	}
-	if !b.config.UseLists {
-		return channelID(b.config.Prefix + ".stream.meta." + ch)
+	return channelID(b.config.Prefix + ".stream.keys." + ch)
+}
+
+func (b *RedisBroker) resultCacheKey(s *RedisShard, ch string, key string) channelID {
+	if s.useCluster {
+		ch = "{" + ch + "}"
+	}
+	// Channel length prefix prevents collisions between channel and key parts.
+	return channelID(b.config.Prefix + ".result." + strconv.Itoa(len(ch)) + ":" + ch + key)
+}
+
+// idempotentResultTTLSeconds returns idempotent result TTL rounded up to seconds,
+// zero means that result should not be saved.
+func idempotentResultTTLSeconds(opts PublishOptions) int {
+	if opts.IdempotencyKey == "" || opts.IdempotentResultTTL <= 0 {
+		return 0
+	}
+	return int((opts.IdempotentResultTTL + time.Second - 1) / time.Second)
+}
+
+func (b *RedisBroker) rateLimitKey(key string) channelID {
+	return channelID(b.config.Prefix + ".rate." + key)
+}
+
+func (b *RedisBroker) historyMetaKey(s *RedisShard, ch string) channelID {
+	if s.useCluster {
+		ch = "{" + ch + "}"
+	}
+	if !b.config.UseLists {
+		return channelID(b.config.Prefix + ".stream.meta." + ch)
+	}
+	return channelID(b.config.Prefix + ".list.meta." + ch)
+}
+
+func (b *RedisBroker) runPubSub(s *RedisShard, eventHandler BrokerEventHandler) {
+	numWorkers := b.config.PubSubNumWorkers
+	if numWorkers == 0 {
+		numWorkers = runtime.NumCPU()
+	}
+
+	b.node.Log(NewLogEntry(LogLevelDebug, fmt.Sprintf("running Redis PUB/SUB, num workers: %d", numWorkers), map[string]interface{}{"shard": s.string()}))
+	defer func() {
+		b.node.Log(NewLogEntry(LogLevelDebug, "stopping Redis PUB/SUB", map[string]interface{}{"shard": s.string()}))
+	}()
+
+	poolConn := s.pool.Get()
+	if poolConn.Err() != nil {
+		// At this moment test on borrow could already return an error,
+		// we can't work with broken connection.
+		_ = poolConn.Close()
+		return
+	}
+
+	var connMu sync.Mutex
+	conn := redis.PubSubConn{Conn: poolConn}
+	defer func() {
+		connMu.Lock()
+		_ = conn.Close()
+		connMu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	var doneOnce sync.Once
+	closeDoneOnce := func() {
+		doneOnce.Do(func() {
+			close(done)
+		})
+	}
+	defer closeDoneOnce()
+
+	connMu.Lock()
+	err := conn.Subscribe(b.pingChannel)
+	if err != nil {
+		connMu.Unlock()
+		b.node.Log(NewLogEntry(LogLevelError, "ping channel subscribe error", map[string]interface{}{"error": err.Error()}))
+		return
+	}
+	connMu.Unlock()
+
+	// Run subscriber goroutine.
+	go func() {
+		defer func() {
+			connMu.Lock()
+			// Error here automatically closes a connection in Redigo.
+			_ = conn.Unsubscribe()
+			connMu.Unlock()
+		}()
+		b.node.Log(NewLogEntry(LogLevelDebug, "starting RedisBroker Subscriber", map[string]interface{}{"shard": s.string()}))
+		defer func() {
+			b.node.Log(NewLogEntry(LogLevelDebug, "stopping RedisBroker Subscriber", map[string]interface{}{"shard": s.string()}))
+		}()
+		for {
+			select {
+			case <-b.closeCh:
+				closeDoneOnce()
+				return
+			case <-done:
+				return
+			case r := <-s.subCh:
+				isSubscribe := r.subscribe
+				isPattern := r.pattern
+				channelBatch := []subRequest{r}
+
+				chIDs := make([]interface{}, 0, len(r.channels))
+				for _, ch := range r.channels {
+					chIDs = append(chIDs, ch)
+				}
+
+				var otherR *subRequest
+
+			loop:
+				for len(chIDs) < redisSubscribeBatchLimit {
+					select {
+					case r := <-s.subCh:
+						if r.subscribe != isSubscribe || r.pattern != isPattern {
+							// We can not mix subscribe and unsubscribe (or channel and pattern)
+							// requests into one batch so must stop here. As we consumed a subRequest
+							// value from channel we should take care of it later.
+							otherR = &r
+							break loop
+						}
+						channelBatch = append(channelBatch, r)
+						for _, ch := range r.channels {
+							chIDs = append(chIDs, ch)
+						}
+					default:
+						break loop
+					}
+				}
+
+				opErr := redisPubSubOp(conn, isSubscribe, isPattern, chIDs)
+				if opErr != nil {
+					for _, r := range channelBatch {
+						r.done(opErr)
+					}
+					if otherR != nil {
+						otherR.done(opErr)
+					}
+					closeDoneOnce()
+					return
+				}
+				for _, r := range channelBatch {
+					r.done(nil)
+				}
+				if otherR != nil {
+					chIDs := make([]interface{}, 0, len(otherR.channels))
+					for _, ch := range otherR.channels {
+						chIDs = append(chIDs, ch)
+					}
+					opErr := redisPubSubOp(conn, otherR.subscribe, otherR.pattern, chIDs)
+					if opErr != nil {
+						otherR.done(opErr)
+						closeDoneOnce()
+						return
+					}
+					otherR.done(nil)
+				}
+			}
+		}
+	}()
+
+	// Run workers to spread received message processing work over worker goroutines.
+	workers := make(map[int]chan redis.Message)
+	for i := 0; i < numWorkers; i++ {
+		workerCh := make(chan redis.Message, redisPubSubWorkerChannelSize)
+		workers[i] = workerCh
+		go func(ch chan redis.Message) {
+			for {
+				select {
+				case <-done:
+					return
+				case n := <-ch:
+					switch {
+					case n.Channel == b.pingChannel:
+						// Do nothing - this message just maintains connection open.
+					case n.Pattern != "":
+						err := b.handleRedisClientPatternMessage(eventHandler, n.Pattern, channelID(n.Channel), n.Data)
+						if err != nil {
+							b.node.Log(NewLogEntry(LogLevelError, "error handling client pattern message", map[string]interface{}{"error": err.Error()}))
+							continue
+						}
+					default:
+						err := b.handleRedisClientMessage(eventHandler, channelID(n.Channel), n.Data)
+						if err != nil {
+							b.node.Log(NewLogEntry(LogLevelError, "error handling client message", map[string]interface{}{"error": err.Error()}))
+							continue
+						}
+					}
+				}
+			}
+		}(workerCh)
+	}
+
+	go func() {
+		err := b.resubscribeShardChannels(s)
+		if err != nil {
+			b.node.Log(NewLogEntry(LogLevelError, "error subscribing", map[string]interface{}{"error": err.Error()}))
+			closeDoneOnce()
+		}
+	}()
+
+	for {
+		switch n := conn.ReceiveWithTimeout(10 * time.Second).(type) {
+		case redis.Message:
+			// Add message to worker channel preserving message order - i.b. messages
+			// from the same channel will be processed in the same worker.
+			select {
+			case workers[index(n.Channel, numWorkers)] <- n:
+			case <-done:
+				return
+			}
+		case error:
+			b.node.Log(NewLogEntry(LogLevelError, "Redis PUB/SUB error", map[string]interface{}{"error": n.Error()}))
+			s.reloadPipeline()
+			return
+		case redis.Subscription:
+			// Zero count or unsubscribe from pingChannel signal exit from PUB/SUB routine.
+			if n.Count == 0 || (n.Kind == "unsubscribe" && n.Channel == b.pingChannel) {
+				return
+			}
+		default:
+		}
+	}
+}
+
+// redisPubSubOp subscribes or unsubscribes PUB/SUB connection from channels
+// or patterns.
+func redisPubSubOp(conn redis.PubSubConn, subscribe bool, pattern bool, chIDs []interface{}) error {
+	switch {
+	case subscribe && pattern:
+		return conn.PSubscribe(chIDs...)
+	case subscribe:
+		return conn.Subscribe(chIDs...)
+	case pattern:
+		return conn.PUnsubscribe(chIDs...)
+	default:
+		return conn.Unsubscribe(chIDs...)
+	}
+}
+
+// resubscribeShardChannels subscribes shard PUB/SUB on all channels of Hub
+// which belong to a shard and on all patterns of Hub.
+func (b *RedisBroker) resubscribeShardChannels(s *RedisShard) error {
+	channels := b.node.Hub().Channels()
+	chIDs := make([]channelID, 0, len(channels)/len(b.shards))
+	for _, ch := range channels {
+		if b.getShard(ch) == s {
+			chIDs = append(chIDs, b.messageChannelID(ch))
+		}
+	}
+
+	batch := make([]channelID, 0)
+
+	for i, ch := range chIDs {
+		if len(batch) > 0 && i%redisSubscribeBatchLimit == 0 {
+			r := newSubRequest(batch, true)
+			err := b.sendSubscribe(s, r)
+			if err != nil {
+				return err
+			}
+			batch = nil
+		}
+		batch = append(batch, ch)
+	}
+	if len(batch) > 0 {
+		r := newSubRequest(batch, true)
+		err := b.sendSubscribe(s, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	patterns := b.node.Hub().patterns()
+	for len(patterns) > 0 {
+		n := len(patterns)
+		if n > redisSubscribeBatchLimit {
+			n = redisSubscribeBatchLimit
+		}
+		patternIDs := make([]channelID, 0, n)
+		for _, pattern := range patterns[:n] {
+			patternIDs = append(patternIDs, b.patternChannelID(pattern))
+		}
+		err := b.sendSubscribe(s, newPatternSubRequest(patternIDs, true))
+		if err != nil {
+			return err
+		}
+		patterns = patterns[n:]
+	}
+	return nil
+}
+
+// redisClusterSlotRange describes a range of hash slots served by a cluster node.
+type redisClusterSlotRange struct {
+	start int
+	end   int
+	addr  string
+}
+
+type redisClusterSlots []redisClusterSlotRange
+
+// nodeAddr returns address of node which serves slot, empty string if not found.
+func (slots redisClusterSlots) nodeAddr(slot int) string {
+	for _, r := range slots {
+		if slot >= r.start && slot <= r.end {
+			return r.addr
+		}
+	}
+	return ""
+}
+
+func (b *RedisBroker) getClusterSlots(s *RedisShard) (redisClusterSlots, error) {
+	dr := s.newDataRequest("CLUSTER", nil, "", []interface{}{"SLOTS"})
+	resp := s.getDataResponse(dr, b.closeCh)
+	if resp.err != nil {
+		return nil, resp.err
+	}
+	return parseClusterSlots(resp.reply)
+}
+
+// parseClusterSlots parses CLUSTER SLOTS reply. Each element of reply contains
+// start slot, end slot, master node info and then replica nodes info.
+func parseClusterSlots(reply interface{}) (redisClusterSlots, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	slots := make(redisClusterSlots, 0, len(values))
+	for _, value := range values {
+		slotInfo, err := redis.Values(value, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(slotInfo) < 3 {
+			return nil, errors.New("malformed cluster slots reply")
+		}
+		start, err := redis.Int(slotInfo[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		end, err := redis.Int(slotInfo[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		nodeInfo, err := redis.Values(slotInfo[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(nodeInfo) < 2 {
+			return nil, errors.New("malformed cluster slots node info")
+		}
+		host, err := redis.String(nodeInfo[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		port, err := redis.Int(nodeInfo[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, redisClusterSlotRange{
+			start: start,
+			end:   end,
+			addr:  net.JoinHostPort(host, strconv.Itoa(port)),
+		})
+	}
+	return slots, nil
+}
+
+// shardedPubSubConn is a connection to Redis Cluster node used for sharded PUB/SUB.
+type shardedPubSubConn struct {
+	mu   sync.Mutex
+	conn redis.Conn
+}
+
+func (c *shardedPubSubConn) send(cmd string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.Send(cmd, args...); err != nil {
+		return err
 	}
-	return channelID(b.config.Prefix + ".list.meta." + ch)
+	return c.conn.Flush()
 }
 
-func (b *RedisBroker) runPubSub(s *RedisShard, eventHandler BrokerEventHandler) {
+// runShardedPubSub runs sharded PUB/SUB over Redis Cluster. SSUBSCRIBE only accepts
+// channels from the same hash slot, so subscriptions grouped by slot and sent over
+// a connection to a cluster node which owns slot – one connection per node. Upon
+// MOVED error or slot migration (Redis sends SUNSUBSCRIBE to subscribers of migrated
+// slot) the routine exits, so it will be restarted with actual cluster slots and all
+// channels will be resubscribed.
+func (b *RedisBroker) runShardedPubSub(s *RedisShard, eventHandler BrokerEventHandler) {
 	numWorkers := b.config.PubSubNumWorkers
 	if numWorkers == 0 {
 		numWorkers = runtime.NumCPU()
 	}
 
-	b.node.Log(NewLogEntry(LogLevelDebug, fmt.Sprintf("running Redis PUB/SUB, num workers: %d", numWorkers), map[string]interface{}{"shard": s.string()}))
+	b.node.Log(NewLogEntry(LogLevelDebug, fmt.Sprintf("running Redis sharded PUB/SUB, num workers: %d", numWorkers), map[string]interface{}{"shard": s.string()}))
 	defer func() {
-		b.node.Log(NewLogEntry(LogLevelDebug, "stopping Redis PUB/SUB", map[string]interface{}{"shard": s.string()}))
+		b.node.Log(NewLogEntry(LogLevelDebug, "stopping Redis sharded PUB/SUB", map[string]interface{}{"shard": s.string()}))
 	}()
 
-	poolConn := s.pool.Get()
-	if poolConn.Err() != nil {
-		// At this moment test on borrow could already return an error,
-		// we can't work with broken connection.
-		_ = poolConn.Close()
+	slots, err := b.getClusterSlots(s)
+	if err != nil {
+		b.node.Log(NewLogEntry(LogLevelError, "error getting Redis Cluster slots", map[string]interface{}{"error": err.Error()}))
 		return
 	}
 
-	var connMu sync.Mutex
-	conn := redis.PubSubConn{Conn: poolConn}
-	defer func() {
-		connMu.Lock()
-		_ = conn.Close()
-		connMu.Unlock()
-	}()
-
 	done := make(chan struct{})
 	var doneOnce sync.Once
 	closeDoneOnce := func() {
@@ -704,107 +1855,6 @@ func (b *RedisBroker) runPubSub(s *RedisShard, eventHandler BrokerEventHandler)
 	}
 	defer closeDoneOnce()
 
-	connMu.Lock()
-	err := conn.Subscribe(b.pingChannel)
-	if err != nil {
-		connMu.Unlock()
-		b.node.Log(NewLogEntry(LogLevelError, "ping channel subscribe error", map[string]interface{}{"error": err.Error()}))
-		return
-	}
-	connMu.Unlock()
-
-	// Run subscriber goroutine.
-	go func() {
-		defer func() {
-			connMu.Lock()
-			// Error here automatically closes a connection in Redigo.
-			_ = conn.Unsubscribe()
-			connMu.Unlock()
-		}()
-		b.node.Log(NewLogEntry(LogLevelDebug, "starting RedisBroker Subscriber", map[string]interface{}{"shard": s.string()}))
-		defer func() {
-			b.node.Log(NewLogEntry(LogLevelDebug, "stopping RedisBroker Subscriber", map[string]interface{}{"shard": s.string()}))
-		}()
-		for {
-			select {
-			case <-b.closeCh:
-				closeDoneOnce()
-				return
-			case <-done:
-				return
-			case r := <-s.subCh:
-				isSubscribe := r.subscribe
-				channelBatch := []subRequest{r}
-
-				chIDs := make([]interface{}, 0, len(r.channels))
-				for _, ch := range r.channels {
-					chIDs = append(chIDs, ch)
-				}
-
-				var otherR *subRequest
-
-			loop:
-				for len(chIDs) < redisSubscribeBatchLimit {
-					select {
-					case r := <-s.subCh:
-						if r.subscribe != isSubscribe {
-							// We can not mix subscribe and unsubscribe request into one batch
-							// so must stop here. As we consumed a subRequest value from channel
-							// we should take care of it later.
-							otherR = &r
-							break loop
-						}
-						channelBatch = append(channelBatch, r)
-						for _, ch := range r.channels {
-							chIDs = append(chIDs, ch)
-						}
-					default:
-						break loop
-					}
-				}
-
-				var opErr error
-				if isSubscribe {
-					opErr = conn.Subscribe(chIDs...)
-				} else {
-					opErr = conn.Unsubscribe(chIDs...)
-				}
-
-				if opErr != nil {
-					for _, r := range channelBatch {
-						r.done(opErr)
-					}
-					if otherR != nil {
-						otherR.done(opErr)
-					}
-					closeDoneOnce()
-					return
-				}
-				for _, r := range channelBatch {
-					r.done(nil)
-				}
-				if otherR != nil {
-					chIDs := make([]interface{}, 0, len(otherR.channels))
-					for _, ch := range otherR.channels {
-						chIDs = append(chIDs, ch)
-					}
-					var opErr error
-					if otherR.subscribe {
-						opErr = conn.Subscribe(chIDs...)
-					} else {
-						opErr = conn.Unsubscribe(chIDs...)
-					}
-					if opErr != nil {
-						otherR.done(opErr)
-						closeDoneOnce()
-						return
-					}
-					otherR.done(nil)
-				}
-			}
-		}
-	}()
-
 	// Run workers to spread received message processing work over worker goroutines.
 	workers := make(map[int]chan redis.Message)
 	for i := 0; i < numWorkers; i++ {
@@ -816,78 +1866,188 @@ func (b *RedisBroker) runPubSub(s *RedisShard, eventHandler BrokerEventHandler)
 				case <-done:
 					return
 				case n := <-ch:
-					switch n.Channel {
-					case b.pingChannel:
-						// Do nothing - this message just maintains connection open.
-					default:
-						err := b.handleRedisClientMessage(eventHandler, channelID(n.Channel), n.Data)
-						if err != nil {
-							b.node.Log(NewLogEntry(LogLevelError, "error handling client message", map[string]interface{}{"error": err.Error()}))
-							continue
-						}
+					err := b.handleRedisClientMessage(eventHandler, channelID(n.Channel), n.Data)
+					if err != nil {
+						b.node.Log(NewLogEntry(LogLevelError, "error handling client message", map[string]interface{}{"error": err.Error()}))
+						continue
 					}
 				}
 			}
 		}(workerCh)
 	}
 
-	go func() {
-		channels := b.node.Hub().Channels()
-		chIDs := make([]channelID, 0, len(channels)/len(b.shards))
-		for _, ch := range channels {
-			if b.getShard(ch) == s {
-				chIDs = append(chIDs, b.messageChannelID(ch))
-			}
+	// subscribed contains channels node wants to be subscribed to. Used to distinguish
+	// SUNSUBSCRIBE sent by Redis upon slot migration.
+	var subscribedMu sync.Mutex
+	subscribed := make(map[string]struct{})
+
+	var connsMu sync.Mutex
+	conns := make(map[string]*shardedPubSubConn)
+	defer func() {
+		connsMu.Lock()
+		for _, c := range conns {
+			_ = c.conn.Close()
 		}
+		connsMu.Unlock()
+	}()
 
-		batch := make([]channelID, 0)
+	receive := func(c *shardedPubSubConn, addr string) {
+		for {
+			reply, err := redis.ReceiveWithTimeout(c.conn, 10*time.Second)
+			if err != nil {
+				if redisc.ParseRedir(err) != nil {
+					b.node.Log(NewLogEntry(LogLevelInfo, "Redis Cluster slot moved, resubscribing", map[string]interface{}{"error": err.Error(), "addr": addr}))
+				} else {
+					b.node.Log(NewLogEntry(LogLevelError, "Redis sharded PUB/SUB error", map[string]interface{}{"error": err.Error(), "addr": addr}))
+				}
+				closeDoneOnce()
+				return
+			}
+			values, err := redis.Values(reply, nil)
+			if err != nil || len(values) < 2 {
+				continue
+			}
+			kind, _ := redis.String(values[0], nil)
+			switch kind {
+			case "smessage":
+				if len(values) < 3 {
+					continue
+				}
+				channel, _ := redis.String(values[1], nil)
+				data, _ := redis.Bytes(values[2], nil)
+				// Add message to worker channel preserving message order - i.e. messages
+				// from the same channel will be processed in the same worker.
+				select {
+				case workers[index(channel, numWorkers)] <- redis.Message{Channel: channel, Data: data}:
+				case <-done:
+					return
+				}
+			case "sunsubscribe":
+				channel, _ := redis.String(values[1], nil)
+				subscribedMu.Lock()
+				_, ok := subscribed[channel]
+				subscribedMu.Unlock()
+				if ok {
+					// Not initiated by us – slot was migrated to another node.
+					b.node.Log(NewLogEntry(LogLevelInfo, "Redis Cluster slot migrated, resubscribing", map[string]interface{}{"channel": channel, "addr": addr}))
+					closeDoneOnce()
+					return
+				}
+			}
+		}
+	}
 
-		for i, ch := range chIDs {
-			if len(batch) > 0 && i%redisSubscribeBatchLimit == 0 {
-				r := newSubRequest(batch, true)
-				err := b.sendSubscribe(s, r)
-				if err != nil {
-					b.node.Log(NewLogEntry(LogLevelError, "error subscribing", map[string]interface{}{"error": err.Error()}))
+	ping := func(c *shardedPubSubConn) {
+		pingTicker := time.NewTicker(time.Second)
+		defer pingTicker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-pingTicker.C:
+				// Maintain connection alive, PING allowed in subscribed state.
+				if err := c.send("PING"); err != nil {
 					closeDoneOnce()
 					return
 				}
-				batch = nil
 			}
-			batch = append(batch, ch)
 		}
-		if len(batch) > 0 {
-			r := newSubRequest(batch, true)
-			err := b.sendSubscribe(s, r)
+	}
+
+	getConn := func(addr string, chID channelID, create bool) (*shardedPubSubConn, error) {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+		if c, ok := conns[addr]; ok || !create {
+			return c, nil
+		}
+		conn := s.pool.Get()
+		if rc, ok := conn.(*redisc.Conn); ok {
+			// Bind connection to a node which owns channel slot.
+			if err := rc.Bind(string(chID)); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+		}
+		c := &shardedPubSubConn{conn: conn}
+		conns[addr] = c
+		go receive(c, addr)
+		go ping(c)
+		return c, nil
+	}
+
+	handleSubRequest := func(r subRequest) error {
+		// SSUBSCRIBE and SUNSUBSCRIBE require all channels to be in the same slot.
+		slotChannels := make(map[int][]interface{})
+		for _, chID := range r.channels {
+			slot := redisc.Slot(string(chID))
+			slotChannels[slot] = append(slotChannels[slot], chID)
+		}
+		for slot, chIDs := range slotChannels {
+			addr := slots.nodeAddr(slot)
+			if addr == "" {
+				return fmt.Errorf("no Redis Cluster node for slot %d", slot)
+			}
+			c, err := getConn(addr, chIDs[0].(channelID), r.subscribe)
 			if err != nil {
-				b.node.Log(NewLogEntry(LogLevelError, "error subscribing", map[string]interface{}{"error": err.Error()}))
-				closeDoneOnce()
-				return
+				return err
+			}
+			subscribedMu.Lock()
+			for _, chID := range chIDs {
+				if r.subscribe {
+					subscribed[string(chID.(channelID))] = struct{}{}
+				} else {
+					delete(subscribed, string(chID.(channelID)))
+				}
+			}
+			subscribedMu.Unlock()
+			if c == nil {
+				// Not subscribed to any channel on this node.
+				continue
+			}
+			cmd := "SSUBSCRIBE"
+			if !r.subscribe {
+				cmd = "SUNSUBSCRIBE"
+			}
+			if err := c.send(cmd, chIDs...); err != nil {
+				return err
 			}
 		}
-	}()
+		return nil
+	}
 
-	for {
-		switch n := conn.ReceiveWithTimeout(10 * time.Second).(type) {
-		case redis.Message:
-			// Add message to worker channel preserving message order - i.b. messages
-			// from the same channel will be processed in the same worker.
+	// Run subscriber goroutine.
+	go func() {
+		b.node.Log(NewLogEntry(LogLevelDebug, "starting RedisBroker sharded Subscriber", map[string]interface{}{"shard": s.string()}))
+		defer func() {
+			b.node.Log(NewLogEntry(LogLevelDebug, "stopping RedisBroker sharded Subscriber", map[string]interface{}{"shard": s.string()}))
+		}()
+		for {
 			select {
-			case workers[index(n.Channel, numWorkers)] <- n:
-			case <-done:
+			case <-b.closeCh:
+				closeDoneOnce()
 				return
-			}
-		case error:
-			b.node.Log(NewLogEntry(LogLevelError, "Redis PUB/SUB error", map[string]interface{}{"error": n.Error()}))
-			s.reloadPipeline()
-			return
-		case redis.Subscription:
-			// Zero count or unsubscribe from pingChannel signal exit from PUB/SUB routine.
-			if n.Count == 0 || (n.Kind == "unsubscribe" && n.Channel == b.pingChannel) {
+			case <-done:
 				return
+			case r := <-s.subCh:
+				err := handleSubRequest(r)
+				r.done(err)
+				if err != nil {
+					closeDoneOnce()
+					return
+				}
 			}
-		default:
 		}
-	}
+	}()
+
+	go func() {
+		err := b.resubscribeShardChannels(s)
+		if err != nil {
+			b.node.Log(NewLogEntry(LogLevelError, "error subscribing", map[string]interface{}{"error": err.Error()}))
+			closeDoneOnce()
+		}
+	}()
+
+	<-done
 }
 
 func (b *RedisBroker) runControlPubSub(s *RedisShard, eventHandler BrokerEventHandler) {
@@ -999,7 +2159,11 @@ func (b *RedisBroker) runControlPubSub(s *RedisShard, eventHandler BrokerEventHa
 }
 
 func (b *RedisBroker) extractChannel(chID channelID) string {
-	return strings.TrimPrefix(string(chID), b.messagePrefix)
+	ch := strings.TrimPrefix(string(chID), b.messagePrefix)
+	if b.config.UseShardedPubSub {
+		ch = strings.TrimSuffix(strings.TrimPrefix(ch, "{"), "}")
+	}
+	return ch
 }
 
 // Define prefixes to distinguish Join and Leave messages coming from PUB/SUB.
@@ -1009,24 +2173,21 @@ var (
 )
 
 func (b *RedisBroker) handleRedisClientMessage(eventHandler BrokerEventHandler, chID channelID, data []byte) error {
-	pushData, pushType, sp, ok := extractPushData(data)
+	message, excludeClients, ok := extractPubSubExcludeClients(data)
+	if !ok {
+		return fmt.Errorf("malformed PUB/SUB data: %s", data)
+	}
+	pushData, pushType, sp, publishTime, ok := extractPushData(message)
 	if !ok {
 		return fmt.Errorf("malformed PUB/SUB data: %s", data)
 	}
 	channel := b.extractChannel(chID)
 	if pushType == pubPushType {
-		var pub protocol.Publication
-		err := pub.UnmarshalVT(pushData)
+		publication, err := decodeRedisPublication(pushData, sp, publishTime)
 		if err != nil {
 			return err
 		}
-		if pub.Offset == 0 {
-			// When adding to history and publishing happens atomically in RedisBroker
-			// position info is prepended to Publication payload. In this case we should attach
-			// it to unmarshalled Publication.
-			pub.Offset = sp.Offset
-		}
-		_ = eventHandler.HandlePublication(channel, pubFromProto(&pub), sp)
+		_ = handleBrokerPublication(eventHandler, channel, publication, sp, excludeClients)
 	} else if pushType == joinPushType {
 		var info protocol.ClientInfo
 		err := info.UnmarshalVT(pushData)
@@ -1045,6 +2206,49 @@ func (b *RedisBroker) handleRedisClientMessage(eventHandler BrokerEventHandler,
 	return nil
 }
 
+// handleRedisClientPatternMessage handles message received over PSUBSCRIBE.
+// Only publications are delivered to pattern subscribers.
+func (b *RedisBroker) handleRedisClientPatternMessage(eventHandler BrokerEventHandler, patternID string, chID channelID, data []byte) error {
+	patternHandler, ok := eventHandler.(PatternBrokerEventHandler)
+	if !ok {
+		return nil
+	}
+	message, excludeClients, ok := extractPubSubExcludeClients(data)
+	if !ok {
+		return fmt.Errorf("malformed PUB/SUB data: %s", data)
+	}
+	pushData, pushType, sp, publishTime, ok := extractPushData(message)
+	if !ok {
+		return fmt.Errorf("malformed PUB/SUB data: %s", data)
+	}
+	if pushType != pubPushType {
+		return nil
+	}
+	publication, err := decodeRedisPublication(pushData, sp, publishTime)
+	if err != nil {
+		return err
+	}
+	_ = patternHandler.HandlePatternPublication(b.extractPattern(patternID), b.extractChannel(chID), publication, sp, excludeClients)
+	return nil
+}
+
+func decodeRedisPublication(pushData []byte, sp StreamPosition, publishTime int64) (*Publication, error) {
+	var pub protocol.Publication
+	err := pub.UnmarshalVT(pushData)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Offset == 0 {
+		// When adding to history and publishing happens atomically in RedisBroker
+		// position info is prepended to Publication payload. In this case we should attach
+		// it to unmarshalled Publication.
+		pub.Offset = sp.Offset
+	}
+	publication := pubFromProto(&pub)
+	publication.Time = publishTime
+	return publication, nil
+}
+
 func (b *RedisBroker) runPubSubPing(s *RedisShard) {
 	pingTicker := time.NewTicker(time.Second)
 	defer pingTicker.Stop()
@@ -1200,6 +2404,19 @@ func (b *RedisBroker) historyStream(s *RedisShard, ch string, filter HistoryFilt
 		return nil, StreamPosition{}, err
 	}
 
+	if filter.Since != nil && !filter.Reverse {
+		results := resp.reply.([]interface{})
+		if len(results) > 3 {
+			trimmed, _ := redis.Uint64(results[3], nil)
+			if filter.Since.Offset < trimmed {
+				// Some publications after since position were removed from compacted stream
+				// not due to compaction. Since compacted stream has gaps in offsets returning
+				// no publications here tells the caller about it.
+				return nil, latestPosition, nil
+			}
+		}
+	}
+
 	return publications, latestPosition, nil
 }
 
@@ -1294,16 +2511,17 @@ var (
 	contentSep = ":"
 )
 
-// See tests for supported format examples.
-func extractPushData(data []byte) ([]byte, pushType, StreamPosition, bool) {
+// See tests for supported format examples. Returns publication time in
+// milliseconds if it's present in meta (zero otherwise).
+func extractPushData(data []byte) ([]byte, pushType, StreamPosition, int64, bool) {
 	var offset uint64
 	var epoch string
 	if !bytes.HasPrefix(data, metaSep) {
-		return data, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, true
+		return data, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, true
 	}
 	nextMetaSepPos := bytes.Index(data[len(metaSep):], metaSep)
 	if nextMetaSepPos <= 0 {
-		return data, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, false
+		return data, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, false
 	}
 	content := data[len(metaSep) : len(metaSep)+nextMetaSepPos]
 	contentType := content[0]
@@ -1312,30 +2530,50 @@ func extractPushData(data []byte) ([]byte, pushType, StreamPosition, bool) {
 
 	switch contentType {
 	case 'j':
-		return rest, joinPushType, StreamPosition{}, true
+		return rest, joinPushType, StreamPosition{}, 0, true
 	case 'l':
-		return rest, leavePushType, StreamPosition{}, true
+		return rest, leavePushType, StreamPosition{}, 0, true
 	}
 
 	stringContent := string(content)
 
 	if contentType == 'p' {
-		// new format p1:offset:epoch
-		stringContent = stringContent[3:] // offset:epoch
-		epochDelimiterPos := strings.Index(stringContent, contentSep)
-		if epochDelimiterPos <= 0 {
-			return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, false
+		// new format p1:offset:epoch or p2:offset:time:epoch
+		if len(stringContent) < 3 {
+			return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, false
+		}
+		withTime := stringContent[1] == '2'
+		stringContent = stringContent[3:] // offset:epoch or offset:time:epoch
+		delimiterPos := strings.Index(stringContent, contentSep)
+		if delimiterPos <= 0 {
+			return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, false
 		}
 		var err error
-		offset, err = strconv.ParseUint(stringContent[:epochDelimiterPos], 10, 64)
-		epoch = stringContent[epochDelimiterPos+1:]
-		return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, err == nil
+		offset, err = strconv.ParseUint(stringContent[:delimiterPos], 10, 64)
+		if err != nil {
+			return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, false
+		}
+		stringContent = stringContent[delimiterPos+1:]
+		var publishTime int64
+		if withTime {
+			delimiterPos = strings.Index(stringContent, contentSep)
+			if delimiterPos <= 0 {
+				return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, false
+			}
+			publishTime, err = strconv.ParseInt(stringContent[:delimiterPos], 10, 64)
+			if err != nil {
+				return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, false
+			}
+			stringContent = stringContent[delimiterPos+1:]
+		}
+		epoch = stringContent
+		return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, publishTime, true
 	}
 
 	// old format with offset only: __offset__
 	var err error
 	offset, err = strconv.ParseUint(stringContent, 10, 64)
-	return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, err == nil
+	return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, 0, err == nil
 }
 
 func sliceOfPubsStream(result interface{}, err error) ([]*Publication, error) {
@@ -1378,8 +2616,31 @@ func sliceOfPubsStream(result interface{}, err error) ([]*Publication, error) {
 			return nil, errors.New("malformed reply: number of payloadElementValues less than 2")
 		}
 
-		pushData, ok := payloadElementValues[1].([]byte)
-		if !ok {
+		var pushData []byte
+		var publishTime int64
+		var compactionKey string
+		for j := 0; j+1 < len(payloadElementValues); j += 2 {
+			field, _ := payloadElementValues[j].([]byte)
+			switch string(field) {
+			case "d":
+				var ok bool
+				pushData, ok = payloadElementValues[j+1].([]byte)
+				if !ok {
+					return nil, errors.New("error getting []byte push data")
+				}
+			case "t":
+				publishTime, err = redis.Int64(payloadElementValues[j+1], nil)
+				if err != nil {
+					return nil, fmt.Errorf("error getting publication time: %v", err)
+				}
+			case "k":
+				compactionKey, err = redis.String(payloadElementValues[j+1], nil)
+				if err != nil {
+					return nil, fmt.Errorf("error getting publication compaction key: %v", err)
+				}
+			}
+		}
+		if pushData == nil {
 			return nil, errors.New("error getting []byte push data")
 		}
 
@@ -1389,7 +2650,10 @@ func sliceOfPubsStream(result interface{}, err error) ([]*Publication, error) {
 			return nil, fmt.Errorf("can not unmarshal value to Publication: %v", err)
 		}
 		pub.Offset = offset
-		pubs = append(pubs, pubFromProto(&pub))
+		publication := pubFromProto(&pub)
+		publication.Time = publishTime
+		publication.CompactionKey = compactionKey
+		pubs = append(pubs, publication)
 	}
 	return pubs, nil
 }
@@ -1407,7 +2671,7 @@ func sliceOfPubsList(result interface{}, err error) ([]*Publication, error) {
 			return nil, errors.New("error getting Message value")
 		}
 
-		pushData, _, sp, ok := extractPushData(value)
+		pushData, _, sp, publishTime, ok := extractPushData(value)
 		if !ok {
 			return nil, fmt.Errorf("malformed publication value: %s", value)
 		}
@@ -1418,7 +2682,9 @@ func sliceOfPubsList(result interface{}, err error) ([]*Publication, error) {
 			return nil, fmt.Errorf("can not unmarshal value to Pub: %v", err)
 		}
 		pub.Offset = sp.Offset
-		pubs = append(pubs, pubFromProto(&pub))
+		publication := pubFromProto(&pub)
+		publication.Time = publishTime
+		pubs = append(pubs, publication)
 	}
 	return pubs, nil
 }
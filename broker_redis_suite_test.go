@@ -0,0 +1,38 @@
+//go:build integration
+
+package centrifuge_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/centrifugal/centrifuge/internal/brokertest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisBrokerSuite(t *testing.T) {
+	for _, useStreams := range []bool{false, true} {
+		useStreams := useStreams
+		t.Run("streams_"+strconv.FormatBool(useStreams), func(t *testing.T) {
+			brokertest.Run(t, func(t *testing.T) centrifuge.Broker {
+				// Time is kept in history lists only with PublicationTimeTag set.
+				n := brokertest.NewNode(t, centrifuge.Config{PublicationTimeTag: "time"})
+				s, err := centrifuge.NewRedisShard(n, centrifuge.RedisShardConfig{
+					Address: "127.0.0.1:6379",
+					DB:      9,
+				})
+				require.NoError(t, err)
+				b, err := centrifuge.NewRedisBroker(n, centrifuge.RedisBrokerConfig{
+					Prefix:         "centrifuge-test-suite-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+					UseLists:       !useStreams,
+					HistoryMetaTTL: time.Hour,
+					Shards:         []*centrifuge.RedisShard{s},
+				})
+				require.NoError(t, err)
+				return b
+			})
+		})
+	}
+}
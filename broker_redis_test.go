@@ -3,11 +3,13 @@
 package centrifuge
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -635,7 +637,7 @@ func BenchmarkRedisExtractPushData(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _, sp, ok := extractPushData(data)
+		_, _, sp, _, ok := extractPushData(data)
 		if !ok {
 			b.Fatal("wrong data")
 		}
@@ -650,15 +652,36 @@ func BenchmarkRedisExtractPushData(b *testing.B) {
 
 func TestRedisExtractPushData(t *testing.T) {
 	data := []byte(`__p1:16901:xyz.123__\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	pushData, pushType, sp, ok := extractPushData(data)
+	pushData, pushType, sp, _, ok := extractPushData(data)
 	require.True(t, ok)
 	require.Equal(t, pubPushType, pushType)
 	require.Equal(t, uint64(16901), sp.Offset)
 	require.Equal(t, "xyz.123", sp.Epoch)
 	require.Equal(t, []byte(`\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`), pushData)
 
+	data = []byte(`__p2:16901:1650000000123:xyz.123__\x12\nchat:index`)
+	pushData, pushType, sp, publishTime, ok := extractPushData(data)
+	require.True(t, ok)
+	require.Equal(t, pubPushType, pushType)
+	require.Equal(t, uint64(16901), sp.Offset)
+	require.Equal(t, "xyz.123", sp.Epoch)
+	require.Equal(t, int64(1650000000123), publishTime)
+	require.Equal(t, []byte(`\x12\nchat:index`), pushData)
+
+	data = []byte(`__p2:0:1650000000123:__\x12\nchat:index`)
+	pushData, _, sp, publishTime, ok = extractPushData(data)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), sp.Offset)
+	require.Equal(t, "", sp.Epoch)
+	require.Equal(t, int64(1650000000123), publishTime)
+	require.Equal(t, []byte(`\x12\nchat:index`), pushData)
+
+	data = []byte(`__p2:16901:xyz__\x12\nchat:index`)
+	_, _, _, _, ok = extractPushData(data)
+	require.False(t, ok)
+
 	data = []byte(`__16901__\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	pushData, pushType, sp, ok = extractPushData(data)
+	pushData, pushType, sp, _, ok = extractPushData(data)
 	require.True(t, ok)
 	require.Equal(t, pubPushType, pushType)
 	require.Equal(t, uint64(16901), sp.Offset)
@@ -666,39 +689,39 @@ func TestRedisExtractPushData(t *testing.T) {
 	require.Equal(t, []byte(`\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`), pushData)
 
 	data = []byte(`\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	pushData, pushType, sp, ok = extractPushData(data)
+	pushData, pushType, sp, _, ok = extractPushData(data)
 	require.True(t, ok)
 	require.Equal(t, pubPushType, pushType)
 	require.Equal(t, uint64(0), sp.Offset)
 	require.Equal(t, []byte(`\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`), pushData)
 
 	data = []byte(`__4294967337__\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	pushData, pushType, sp, ok = extractPushData(data)
+	pushData, pushType, sp, _, ok = extractPushData(data)
 	require.True(t, ok)
 	require.Equal(t, pubPushType, pushType)
 	require.Equal(t, uint64(4294967337), sp.Offset)
 	require.Equal(t, []byte(`\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`), pushData)
 
 	data = []byte(`__j__\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	pushData, pushType, sp, ok = extractPushData(data)
+	pushData, pushType, sp, _, ok = extractPushData(data)
 	require.True(t, ok)
 	require.Equal(t, joinPushType, pushType)
 	require.Equal(t, uint64(0), sp.Offset)
 	require.Equal(t, []byte(`\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`), pushData)
 
 	data = []byte(`__l__\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	pushData, pushType, sp, ok = extractPushData(data)
+	pushData, pushType, sp, _, ok = extractPushData(data)
 	require.True(t, ok)
 	require.Equal(t, leavePushType, pushType)
 	require.Equal(t, uint64(0), sp.Offset)
 	require.Equal(t, []byte(`\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`), pushData)
 
 	data = []byte(`____\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	_, _, _, ok = extractPushData(data)
+	_, _, _, _, ok = extractPushData(data)
 	require.False(t, ok)
 
 	data = []byte(`__a__\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
-	_, _, _, ok = extractPushData(data)
+	_, _, _, _, ok = extractPushData(data)
 	require.False(t, ok)
 }
 
@@ -1289,6 +1312,38 @@ func testRedisClientSubscribeRecover(t *testing.T, tt recoverTest, useStreams bo
 	require.Equal(t, tt.Recovered, recovered)
 }
 
+func TestRedisClientSubscribeLatestPublication(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := nodeWithRedisBroker(t, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			channel := "test_latest_redis_" + randString(10)
+			for i := 1; i <= 5; i++ {
+				_, err := node.Publish(channel, []byte(`{"n": `+strconv.Itoa(i)+`}`), WithHistory(10, time.Minute))
+				require.NoError(t, err)
+			}
+
+			client := newTestClient(t, node, "42")
+			connectClient(t, client)
+
+			rwWrapper := testReplyWriterWrapper()
+			subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+				Channel: channel,
+			}, SubscribeReply{
+				Options: SubscribeOptions{
+					EnablePositioning:       true,
+					EnableLatestPublication: true,
+				},
+			}, &protocol.Command{}, false, rwWrapper.rw)
+			require.Nil(t, subCtx.disconnect)
+			require.Len(t, subCtx.result.Publications, 1)
+			require.Equal(t, uint64(5), subCtx.result.Publications[0].Offset)
+			require.Equal(t, protocol.Raw(`{"n": 5}`), subCtx.result.Publications[0].Data)
+		})
+	}
+}
+
 func TestRedisClientSubscribeRecoverStreams(t *testing.T) {
 	for _, tt := range recoverTests {
 		t.Run(tt.Name, func(t *testing.T) {
@@ -1350,6 +1405,621 @@ func TestRedisHistoryIterationReverse(t *testing.T) {
 	}
 }
 
+func TestRedisHistoryTagsFilter(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			for i := 0; i < 10; i++ {
+				_, err := e.Publish("channel", []byte("{}"), PublishOptions{
+					HistorySize: 10,
+					HistoryTTL:  time.Minute,
+					Tags:        map[string]string{"i": strconv.Itoa(i)},
+				})
+				require.NoError(t, err)
+			}
+			filter := MustParseTagsFilter(`i in (2, 5, 7)`)
+			pubs, _, err := e.History("channel", HistoryFilter{Limit: -1, TagsFilter: filter})
+			require.NoError(t, err)
+			require.Len(t, pubs, 3)
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: 2, TagsFilter: filter})
+			require.NoError(t, err)
+			require.Len(t, pubs, 2)
+			require.Equal(t, uint64(3), pubs[0].Offset)
+			require.Equal(t, uint64(6), pubs[1].Offset)
+		})
+	}
+}
+
+func TestRedisHistoryTagsFilterLimitPaging(t *testing.T) {
+	for _, tt := range redisTests {
+		if !tt.UseStreams {
+			continue
+		}
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			numPubs := 3*redisHistoryFilterPageSize + 10
+			for i := 0; i < numPubs; i++ {
+				_, err := e.Publish("channel", []byte("{}"), PublishOptions{
+					HistorySize: numPubs,
+					HistoryTTL:  time.Minute,
+					Tags:        map[string]string{"late": strconv.FormatBool(i >= 2*redisHistoryFilterPageSize)},
+				})
+				require.NoError(t, err)
+			}
+			filter := MustParseTagsFilter(`late = true`)
+			// Matching publications start on the third page.
+			pubs, sp, err := e.History("channel", HistoryFilter{Limit: 5, TagsFilter: filter})
+			require.NoError(t, err)
+			require.Equal(t, uint64(numPubs), sp.Offset)
+			require.Len(t, pubs, 5)
+			require.Equal(t, uint64(2*redisHistoryFilterPageSize+1), pubs[0].Offset)
+			require.Equal(t, uint64(2*redisHistoryFilterPageSize+5), pubs[4].Offset)
+
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: 5, Reverse: true, TagsFilter: MustParseTagsFilter(`late = false`)})
+			require.NoError(t, err)
+			require.Len(t, pubs, 5)
+			require.Equal(t, uint64(2*redisHistoryFilterPageSize), pubs[0].Offset)
+
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, TagsFilter: filter})
+			require.NoError(t, err)
+			require.Len(t, pubs, redisHistoryFilterPageSize+10)
+
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: 5, TagsFilter: MustParseTagsFilter(`late = none`)})
+			require.NoError(t, err)
+			require.Len(t, pubs, 0)
+		})
+	}
+}
+
+func TestRedisHistoryTimeFilter(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			// Time is kept in history lists only with PublicationTimeTag set.
+			node.config.PublicationTimeTag = "time"
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			started := time.Now()
+			_, err := e.Publish("channel", []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			time.Sleep(5 * time.Millisecond)
+			middle := time.Now()
+			time.Sleep(5 * time.Millisecond)
+			_, err = e.Publish("channel", []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+
+			pubs, _, err := e.History("channel", HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 2)
+			require.GreaterOrEqual(t, pubs[0].Time, started.UnixMilli())
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, SinceTime: middle})
+			require.NoError(t, err)
+			require.Len(t, pubs, 1)
+			require.Equal(t, uint64(2), pubs[0].Offset)
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, UntilTime: middle})
+			require.NoError(t, err)
+			require.Len(t, pubs, 1)
+			require.Equal(t, uint64(1), pubs[0].Offset)
+		})
+	}
+}
+
+func TestRedisHistoryCompaction(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			if !tt.UseStreams {
+				_, err := e.Publish("channel", []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute, CompactionKey: "key"})
+				require.Error(t, err)
+				return
+			}
+			for i := 0; i < 9; i++ {
+				_, err := e.Publish("channel", []byte("{}"), PublishOptions{
+					HistorySize: 5, HistoryTTL: time.Minute, CompactionKey: "key" + strconv.Itoa(i%3),
+				})
+				require.NoError(t, err)
+			}
+			pubs, sp, err := e.History("channel", HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Equal(t, uint64(9), sp.Offset)
+			require.Len(t, pubs, 3)
+			require.Equal(t, uint64(7), pubs[0].Offset)
+			require.Equal(t, "key0", pubs[0].CompactionKey)
+
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, Since: &StreamPosition{Offset: 2, Epoch: sp.Epoch}})
+			require.NoError(t, err)
+			require.Len(t, pubs, 3)
+
+			// Trim stream by size, so some keys lost.
+			for i := 0; i < 5; i++ {
+				_, err := e.Publish("channel", []byte("{}"), PublishOptions{
+					HistorySize: 5, HistoryTTL: time.Minute, CompactionKey: "new" + strconv.Itoa(i),
+				})
+				require.NoError(t, err)
+			}
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 5)
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, Since: &StreamPosition{Offset: 8, Epoch: sp.Epoch}})
+			require.NoError(t, err)
+			require.Len(t, pubs, 0)
+			pubs, _, err = e.History("channel", HistoryFilter{Limit: -1, Since: &StreamPosition{Offset: 9, Epoch: sp.Epoch}})
+			require.NoError(t, err)
+			require.Len(t, pubs, 5)
+		})
+	}
+}
+
+func TestRedisHistoryMaxBytesAndAge(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			if !tt.UseStreams {
+				_, err := e.Publish("channel", []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxBytes: 100})
+				require.Error(t, err)
+				return
+			}
+			channel := "channel" + randString(10)
+			for i := 0; i < 10; i++ {
+				_, err := e.Publish(channel, []byte("0123456789"), PublishOptions{
+					HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxBytes: 40,
+				})
+				require.NoError(t, err)
+			}
+			pubs, sp, err := e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Equal(t, uint64(10), sp.Offset)
+			// Each publication takes 12 bytes in encoded form.
+			require.Len(t, pubs, 3)
+			require.Equal(t, uint64(8), pubs[0].Offset)
+
+			// Size tracking restored after publications without bytes limit.
+			_, err = e.Publish(channel, []byte("0123456789"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			_, err = e.Publish(channel, []byte("0123456789"), PublishOptions{
+				HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxBytes: 40,
+			})
+			require.NoError(t, err)
+			pubs, _, err = e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 3)
+			require.Equal(t, uint64(10), pubs[0].Offset)
+
+			time.Sleep(200 * time.Millisecond)
+			_, err = e.Publish(channel, []byte("{}"), PublishOptions{
+				HistorySize: 10, HistoryTTL: time.Minute, HistoryMaxPublicationAge: 100 * time.Millisecond,
+			})
+			require.NoError(t, err)
+			pubs, _, err = e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 1)
+			require.Equal(t, uint64(13), pubs[0].Offset)
+		})
+	}
+}
+
+func TestRedisResetStream(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			channel := "channel" + randString(10)
+			for i := 0; i < 3; i++ {
+				_, err := e.Publish(channel, []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+				require.NoError(t, err)
+			}
+			_, sp, err := e.History(channel, HistoryFilter{})
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), sp.Offset)
+
+			resetSP, err := e.ResetStream(channel)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), resetSP.Offset)
+			require.NotEqual(t, sp.Epoch, resetSP.Epoch)
+
+			pubs, sp, err := e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 0)
+			require.Equal(t, resetSP, sp)
+
+			pos, err := e.Publish(channel, []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			require.Equal(t, StreamPosition{Offset: 1, Epoch: resetSP.Epoch}, pos)
+		})
+	}
+}
+
+func TestRedisImportHistory(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			channel := "channel" + randString(10)
+			pubs := []*Publication{
+				{Offset: 3, Data: []byte(`{"n": 3}`), Time: 1000, Tags: map[string]string{"k": "v"}},
+				{Offset: 5, Data: []byte(`{"n": 5}`), Time: 2000, Info: &ClientInfo{ClientID: "client", UserID: "42"}},
+			}
+			sp := StreamPosition{Offset: 5, Epoch: "imported"}
+			err := e.ImportHistory(channel, pubs, sp, PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+
+			history, historySP, err := e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Equal(t, sp, historySP)
+			require.Equal(t, pubs, history)
+
+			pos, err := e.Publish(channel, []byte("{}"), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			require.Equal(t, StreamPosition{Offset: 6, Epoch: sp.Epoch}, pos)
+		})
+	}
+}
+
+func TestRedisAllowRate(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			key := "rpc:" + randString(10)
+			limit := RateLimit{Rate: 0.001, Burst: 2}
+			for i := 0; i < 2; i++ {
+				allowed, err := e.AllowRate(key, limit)
+				require.NoError(t, err)
+				require.True(t, allowed)
+			}
+			allowed, err := e.AllowRate(key, limit)
+			require.NoError(t, err)
+			require.False(t, allowed)
+
+			// Other keys have separate buckets.
+			allowed, err = e.AllowRate(key+"_other", limit)
+			require.NoError(t, err)
+			require.True(t, allowed)
+		})
+	}
+}
+
+func TestRedisIdempotentPublish(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			channel := "channel" + randString(10)
+			opts := PublishOptions{
+				HistorySize: 10, HistoryTTL: time.Minute, IdempotencyKey: "test", IdempotentResultTTL: time.Minute,
+			}
+			sp1, err := e.Publish(channel, []byte("{}"), opts)
+			require.NoError(t, err)
+			sp2, err := e.Publish(channel, []byte("{}"), opts)
+			require.NoError(t, err)
+			require.Equal(t, sp1, sp2)
+
+			pubs, sp, err := e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 1)
+			require.Equal(t, sp1, sp)
+
+			opts.IdempotencyKey = "test2"
+			sp3, err := e.Publish(channel, []byte("{}"), opts)
+			require.NoError(t, err)
+			require.Equal(t, sp1.Offset+1, sp3.Offset)
+
+			// Without history.
+			opts = PublishOptions{IdempotencyKey: "test_no_history", IdempotentResultTTL: time.Minute}
+			_, err = e.Publish(channel, []byte("{}"), opts)
+			require.NoError(t, err)
+			_, err = e.Publish(channel, []byte("{}"), opts)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRedisIdempotentPublishKeyCollision(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			channel := "channel" + randString(10)
+			require.NotEqual(t,
+				e.resultCacheKey(e.shards[0], channel+".a", "b"),
+				e.resultCacheKey(e.shards[0], channel, "a.b"),
+			)
+
+			opts := PublishOptions{
+				HistorySize: 10, HistoryTTL: time.Minute, IdempotencyKey: "b", IdempotentResultTTL: time.Minute,
+			}
+			_, err := e.Publish(channel+".a", []byte("{}"), opts)
+			require.NoError(t, err)
+			opts.IdempotencyKey = "a.b"
+			_, err = e.Publish(channel, []byte("{}"), opts)
+			require.NoError(t, err)
+
+			pubs, _, err := e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 1)
+		})
+	}
+}
+
+func TestRedisPublishMany(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			channel1 := "channel" + randString(10)
+			channel2 := "channel" + randString(10)
+			opts := PublishOptions{HistorySize: 10, HistoryTTL: time.Minute}
+
+			var reqs []BrokerPublishRequest
+			for i := 0; i < 10; i++ {
+				reqs = append(reqs, BrokerPublishRequest{Channel: channel1, Data: []byte("{}"), Options: opts})
+				reqs = append(reqs, BrokerPublishRequest{Channel: channel2, Data: []byte("{}"), Options: opts})
+				reqs = append(reqs, BrokerPublishRequest{Channel: channel2, Data: []byte("{}")})
+			}
+			results := e.PublishMany(reqs)
+			require.Len(t, results, len(reqs))
+			for i := 0; i < 10; i++ {
+				require.NoError(t, results[i*3].Error)
+				require.EqualValues(t, i+1, results[i*3].StreamPosition.Offset)
+				require.NoError(t, results[i*3+1].Error)
+				require.EqualValues(t, i+1, results[i*3+1].StreamPosition.Offset)
+				require.NoError(t, results[i*3+2].Error)
+				require.Zero(t, results[i*3+2].StreamPosition.Offset)
+			}
+
+			pubs, _, err := e.History(channel1, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 10)
+
+			// Idempotent publications in one batch are executed in order.
+			idempotentOpts := opts
+			idempotentOpts.IdempotencyKey = "key"
+			results = e.PublishMany([]BrokerPublishRequest{
+				{Channel: channel1, Data: []byte("{}"), Options: idempotentOpts},
+				{Channel: channel1, Data: []byte("{}"), Options: idempotentOpts},
+			})
+			require.NoError(t, results[0].Error)
+			require.NoError(t, results[1].Error)
+			require.EqualValues(t, 11, results[0].StreamPosition.Offset)
+			require.Equal(t, results[0].StreamPosition, results[1].StreamPosition)
+		})
+	}
+}
+
+func TestRedisBrokerShardedPubSubNoCluster(t *testing.T) {
+	node := testNode(t)
+	s, err := NewRedisShard(node, testRedisConf())
+	require.NoError(t, err)
+	_, err = NewRedisBroker(node, RedisBrokerConfig{
+		UseShardedPubSub: true,
+		Shards:           []*RedisShard{s},
+	})
+	require.Error(t, err)
+}
+
+func TestRedisBrokerShardedPubSub(t *testing.T) {
+	for _, useStreams := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streams_%v", useStreams), func(t *testing.T) {
+			node := testNode(t)
+			s, err := NewRedisShard(node, RedisShardConfig{
+				ClusterAddresses: []string{"localhost:7000", "localhost:7001", "localhost:7002"},
+				Password:         testRedisPassword,
+				ReadTimeout:      100 * time.Second,
+			})
+			require.NoError(t, err)
+			e, err := NewRedisBroker(node, RedisBrokerConfig{
+				Prefix:           getUniquePrefix(),
+				UseLists:         !useStreams,
+				UseShardedPubSub: true,
+				Shards:           []*RedisShard{s},
+			})
+			require.NoError(t, err)
+			defer func() { _ = e.Close(context.Background()) }()
+
+			numChannels := 20
+			pubCh := make(chan string, numChannels*2)
+			joinCh := make(chan string, numChannels)
+			leaveCh := make(chan string, numChannels)
+			require.NoError(t, e.Run(&testBrokerEventHandler{
+				HandleControlFunc: func(bytes []byte) error {
+					return nil
+				},
+				HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+					pubCh <- ch
+					return nil
+				},
+				HandleJoinFunc: func(ch string, info *ClientInfo) error {
+					joinCh <- ch
+					return nil
+				},
+				HandleLeaveFunc: func(ch string, info *ClientInfo) error {
+					leaveCh <- ch
+					return nil
+				},
+			}))
+
+			// Channels belong to different slots so subscriptions go to different nodes.
+			channels := make(map[string]struct{}, numChannels)
+			for i := 0; i < numChannels; i++ {
+				ch := "channel" + randString(10)
+				channels[ch] = struct{}{}
+				require.NoError(t, e.Subscribe(ch))
+			}
+			for ch := range channels {
+				_, err := e.Publish(ch, []byte(`{}`), PublishOptions{})
+				require.NoError(t, err)
+				_, err = e.Publish(ch, []byte(`{}`), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+				require.NoError(t, err)
+				require.NoError(t, e.PublishJoin(ch, &ClientInfo{}))
+				require.NoError(t, e.PublishLeave(ch, &ClientInfo{}))
+			}
+			for i := 0; i < numChannels*2; i++ {
+				select {
+				case ch := <-pubCh:
+					require.Contains(t, channels, ch)
+				case <-time.After(5 * time.Second):
+					require.Fail(t, "timeout waiting for sharded PUB/SUB message")
+				}
+			}
+			for i := 0; i < numChannels; i++ {
+				select {
+				case ch := <-joinCh:
+					require.Contains(t, channels, ch)
+				case <-time.After(5 * time.Second):
+					require.Fail(t, "timeout waiting for sharded PUB/SUB join message")
+				}
+				select {
+				case ch := <-leaveCh:
+					require.Contains(t, channels, ch)
+				case <-time.After(5 * time.Second):
+					require.Fail(t, "timeout waiting for sharded PUB/SUB leave message")
+				}
+			}
+			for ch := range channels {
+				require.NoError(t, e.Unsubscribe(ch))
+			}
+		})
+	}
+}
+
+// testRedisClusterMasters returns addresses of Redis Cluster master nodes by
+// node ID and ID of node serving slot.
+func testRedisClusterMasters(t *testing.T, slot int64) (map[string]string, string) {
+	conn, err := redis.Dial("tcp", "localhost:7000", redis.DialPassword(testRedisPassword))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	require.NoError(t, err)
+	masters := map[string]string{}
+	var owner string
+	for _, r := range ranges {
+		values, err := redis.Values(r, nil)
+		require.NoError(t, err)
+		start, _ := redis.Int64(values[0], nil)
+		end, _ := redis.Int64(values[1], nil)
+		master, err := redis.Values(values[2], nil)
+		require.NoError(t, err)
+		port, _ := redis.Int64(master[1], nil)
+		id, _ := redis.String(master[2], nil)
+		masters[id] = "localhost:" + strconv.FormatInt(port, 10)
+		if slot >= start && slot <= end {
+			owner = id
+		}
+	}
+	require.NotEmpty(t, owner)
+	return masters, owner
+}
+
+// testRedisClusterMoveSlot assigns empty slot to another master node.
+func testRedisClusterMoveSlot(t *testing.T, slot int64, masters map[string]string, from string, to string) {
+	do := func(addr string, args ...interface{}) {
+		conn, err := redis.Dial("tcp", addr, redis.DialPassword(testRedisPassword))
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = conn.Do("CLUSTER", args...)
+		require.NoError(t, err)
+	}
+	do(masters[to], "SETSLOT", slot, "IMPORTING", from)
+	do(masters[from], "SETSLOT", slot, "MIGRATING", to)
+	do(masters[to], "SETSLOT", slot, "NODE", to)
+	do(masters[from], "SETSLOT", slot, "NODE", to)
+	for id, addr := range masters {
+		if id != from && id != to {
+			do(addr, "SETSLOT", slot, "NODE", to)
+		}
+	}
+}
+
+func TestRedisBrokerShardedPubSubSlotMigration(t *testing.T) {
+	node := testNode(t)
+	s, err := NewRedisShard(node, RedisShardConfig{
+		ClusterAddresses: []string{"localhost:7000", "localhost:7001", "localhost:7002"},
+		Password:         testRedisPassword,
+		ReadTimeout:      100 * time.Second,
+	})
+	require.NoError(t, err)
+	e, err := NewRedisBroker(node, RedisBrokerConfig{
+		Prefix:           getUniquePrefix(),
+		UseShardedPubSub: true,
+		Shards:           []*RedisShard{s},
+	})
+	require.NoError(t, err)
+	defer func() { _ = e.Close(context.Background()) }()
+
+	pubCh := make(chan struct{}, 128)
+	require.NoError(t, e.Run(&testBrokerEventHandler{
+		HandleControlFunc: func(bytes []byte) error {
+			return nil
+		},
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			pubCh <- struct{}{}
+			return nil
+		},
+	}))
+
+	channel := "channel" + randString(10)
+	require.NoError(t, e.Subscribe(channel))
+
+	conn := s.pool.Get()
+	slot, err := redis.Int64(conn.Do("CLUSTER", "KEYSLOT", string(e.messageChannelID(channel))))
+	_ = conn.Close()
+	require.NoError(t, err)
+	masters, owner := testRedisClusterMasters(t, slot)
+	require.True(t, len(masters) > 1)
+	var target string
+	for id := range masters {
+		if id != owner {
+			target = id
+			break
+		}
+	}
+
+	waitPublication := func() {
+		// Resubscription after slot migration is asynchronous, so keep publishing.
+		require.Eventually(t, func() bool {
+			_, err := e.Publish(channel, []byte(`{}`), PublishOptions{})
+			if err != nil {
+				return false
+			}
+			select {
+			case <-pubCh:
+				return true
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	waitPublication()
+	testRedisClusterMoveSlot(t, slot, masters, owner, target)
+	defer testRedisClusterMoveSlot(t, slot, masters, target, owner)
+	// Drop publications received before migration.
+	for len(pubCh) > 0 {
+		<-pubCh
+	}
+	waitPublication()
+}
+
 func BenchmarkRedisHistoryIteration(b *testing.B) {
 	for _, tt := range benchRedisTests {
 		b.Run(tt.Name, func(b *testing.B) {
@@ -1365,3 +2035,226 @@ func BenchmarkRedisHistoryIteration(b *testing.B) {
 		})
 	}
 }
+
+func TestRedisBrokerPatternSubscribe(t *testing.T) {
+	node := testNode(t)
+	s, err := NewRedisShard(node, testRedisConf())
+	require.NoError(t, err)
+	e, err := NewRedisBroker(node, RedisBrokerConfig{
+		Prefix: getUniquePrefix(),
+		Shards: []*RedisShard{s},
+	})
+	require.NoError(t, err)
+	defer func() { _ = e.Close(context.Background()) }()
+
+	pubCh := make(chan string, 10)
+	patternPubCh := make(chan string, 10)
+	require.NoError(t, e.Run(&testBrokerEventHandler{
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			pubCh <- ch
+			return nil
+		},
+		HandlePatternPublicationFunc: func(pattern string, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+			patternPubCh <- pattern + " " + ch
+			return nil
+		},
+	}))
+
+	// Only * is a wildcard, ? must match literally.
+	require.NoError(t, e.SubscribePattern("news.*.?"))
+	_, err = e.Publish("news.sport.a", []byte(`{}`), PublishOptions{})
+	require.NoError(t, err)
+	_, err = e.Publish("news.sport.?", []byte(`{}`), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	require.NoError(t, e.PublishJoin("news.sport.?", &ClientInfo{}))
+
+	select {
+	case msg := <-patternPubCh:
+		require.Equal(t, "news.*.? news.sport.?", msg)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timeout waiting for pattern publication")
+	}
+	select {
+	case msg := <-patternPubCh:
+		require.Fail(t, "unexpected pattern publication", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Node is not subscribed on channels.
+	require.Len(t, pubCh, 0)
+
+	require.NoError(t, e.UnsubscribePattern("news.*.?"))
+}
+
+func TestRedisPatternEscape(t *testing.T) {
+	node := testNode(t)
+	e := NewTestRedisBrokerWithPrefix(t, node, "pre[fix]*", false)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	patternID := e.patternChannelID(`news.*.?[\]`)
+	require.Equal(t, `pre\[fix\]\*.client.news.*.\?\[\\\]`, string(patternID))
+	require.Equal(t, `news.*.?[\]`, e.extractPattern(string(patternID)))
+}
+
+// extractPushDataV1 is extractPushData of versions without publication time
+// support. Used to check that such nodes still understand pushes of current
+// version during rolling upgrade.
+func extractPushDataV1(data []byte) ([]byte, pushType, StreamPosition, bool) {
+	var offset uint64
+	var epoch string
+	if !bytes.HasPrefix(data, metaSep) {
+		return data, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, true
+	}
+	nextMetaSepPos := bytes.Index(data[len(metaSep):], metaSep)
+	if nextMetaSepPos <= 0 {
+		return data, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, false
+	}
+	content := data[len(metaSep) : len(metaSep)+nextMetaSepPos]
+	contentType := content[0]
+
+	rest := data[len(metaSep)+nextMetaSepPos+len(metaSep):]
+
+	switch contentType {
+	case 'j':
+		return rest, joinPushType, StreamPosition{}, true
+	case 'l':
+		return rest, leavePushType, StreamPosition{}, true
+	}
+
+	stringContent := string(content)
+
+	if contentType == 'p' {
+		stringContent = stringContent[3:]
+		epochDelimiterPos := strings.Index(stringContent, contentSep)
+		if epochDelimiterPos <= 0 {
+			return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, false
+		}
+		var err error
+		offset, err = strconv.ParseUint(stringContent[:epochDelimiterPos], 10, 64)
+		epoch = stringContent[epochDelimiterPos+1:]
+		return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, err == nil
+	}
+
+	var err error
+	offset, err = strconv.ParseUint(stringContent, 10, 64)
+	return rest, pubPushType, StreamPosition{Epoch: epoch, Offset: offset}, err == nil
+}
+
+func TestRedisPublicationMetaCompatibility(t *testing.T) {
+	for _, useStreams := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streams_%t", useStreams), func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisBroker(t, node, useStreams, false)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			if e.shards[0].useCluster {
+				t.Skip("Raw PUB/SUB connection is not supported when Redis Cluster is used")
+			}
+
+			psc := redis.PubSubConn{Conn: e.shards[0].pool.Get()}
+			defer func() { _ = psc.Close() }()
+			require.NoError(t, psc.Subscribe(string(e.messageChannelID("test"))))
+			_, ok := psc.Receive().(redis.Subscription)
+			require.True(t, ok)
+
+			receive := func() []byte {
+				msg, ok := psc.Receive().(redis.Message)
+				require.True(t, ok)
+				return msg.Data
+			}
+
+			// Without PublicationTimeTag nodes of previous versions must be able
+			// to parse everything published.
+			_, err := e.Publish("test", []byte(`{}`), PublishOptions{})
+			require.NoError(t, err)
+			pushData, pushType, sp, ok := extractPushDataV1(receive())
+			require.True(t, ok)
+			require.Equal(t, pubPushType, pushType)
+			require.Equal(t, StreamPosition{}, sp)
+			var pub protocol.Publication
+			require.NoError(t, pub.UnmarshalVT(pushData))
+			require.Equal(t, `{}`, string(pub.Data))
+
+			publishedSp, err := e.Publish("test", []byte(`{}`), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			pushData, _, sp, ok = extractPushDataV1(receive())
+			require.True(t, ok)
+			require.Equal(t, publishedSp, sp)
+			require.NoError(t, pub.UnmarshalVT(pushData))
+
+			if !useStreams {
+				conn := e.shards[0].pool.Get()
+				values, err := redis.ByteSlices(conn.Do("LRANGE", string(e.historyListKey(e.shards[0], "test")), 0, -1))
+				_ = conn.Close()
+				require.NoError(t, err)
+				require.Len(t, values, 1)
+				_, _, sp, ok = extractPushDataV1(values[0])
+				require.True(t, ok)
+				require.Equal(t, publishedSp, sp)
+			}
+
+			// With PublicationTimeTag time is delivered to current version nodes.
+			node.config.PublicationTimeTag = "time"
+			publishedSp, err = e.Publish("test", []byte(`{}`), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			_, _, sp, publishTime, ok := extractPushData(receive())
+			require.True(t, ok)
+			require.Equal(t, publishedSp, sp)
+			require.NotZero(t, publishTime)
+
+			_, err = e.Publish("test", []byte(`{}`), PublishOptions{})
+			require.NoError(t, err)
+			_, _, _, publishTime, ok = extractPushData(receive())
+			require.True(t, ok)
+			require.NotZero(t, publishTime)
+		})
+	}
+}
+
+func TestRedisBrokerPublishExcludeClients(t *testing.T) {
+	for _, useStreams := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streams_%v", useStreams), func(t *testing.T) {
+			node := testNode(t)
+			s, err := NewRedisShard(node, testRedisConf())
+			require.NoError(t, err)
+			e, err := NewRedisBroker(node, RedisBrokerConfig{
+				Prefix:   getUniquePrefix(),
+				UseLists: !useStreams,
+				Shards:   []*RedisShard{s},
+			})
+			require.NoError(t, err)
+			defer func() { _ = e.Close(context.Background()) }()
+
+			excludedCh := make(chan []string, 10)
+			require.NoError(t, e.Run(&testBrokerEventHandler{
+				HandlePublicationExcludeClientsFunc: func(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+					require.Equal(t, map[string]string{"k": "v"}, pub.Tags)
+					excludedCh <- excludeClients
+					return nil
+				},
+			}))
+			channel := "channel" + randString(10)
+			require.NoError(t, e.Subscribe(channel))
+
+			for _, opts := range []PublishOptions{
+				{Tags: map[string]string{"k": "v"}, ExcludeClients: []string{"1", "2"}},
+				{Tags: map[string]string{"k": "v"}, ExcludeClients: []string{"1", "2"}, HistorySize: 10, HistoryTTL: time.Minute},
+				{Tags: map[string]string{"k": "v"}, ExcludeClients: []string{"1", "2"}, HistorySize: 10, HistoryTTL: time.Minute, IdempotencyKey: "key"},
+			} {
+				_, err = e.Publish(channel, []byte(`{}`), opts)
+				require.NoError(t, err)
+				select {
+				case excluded := <-excludedCh:
+					require.Equal(t, []string{"1", "2"}, excluded)
+				case <-time.After(5 * time.Second):
+					require.Fail(t, "timeout waiting for publication")
+				}
+			}
+
+			pubs, _, err := e.History(channel, HistoryFilter{Limit: -1})
+			require.NoError(t, err)
+			require.Len(t, pubs, 2)
+			for _, pub := range pubs {
+				require.Equal(t, map[string]string{"k": "v"}, pub.Tags)
+			}
+		})
+	}
+}
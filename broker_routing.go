@@ -0,0 +1,313 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// RoutingBroker is a Broker which dispatches channels to different Brokers.
+// This allows, for example, keeping high-volume ephemeral channels in
+// MemoryBroker while using RedisBroker for channels which require durable
+// history and recovery – all inside one Node.
+//
+// Channel operations (Subscribe, Publish, History etc.) are routed to a Broker
+// returned by RoutingBrokerConfig.BrokerResolver. Control traffic of Node and
+// cluster-wide rate limits always go through RoutingBrokerConfig.ControlBroker.
+// Pattern subscriptions are made in all Brokers which implement PatternSubscriber
+// since pattern may match channels routed to different Brokers.
+type RoutingBroker struct {
+	node    *Node
+	config  RoutingBrokerConfig
+	brokers []Broker
+}
+
+var _ Broker = (*RoutingBroker)(nil)
+
+// RoutingBrokerConfig is a config for RoutingBroker.
+type RoutingBrokerConfig struct {
+	// Brokers is a list of Brokers to route channels to. All Brokers are started
+	// when RoutingBroker.Run called. At least one Broker must be provided.
+	Brokers []Broker
+	// BrokerResolver returns Broker to use for a channel. It must be fast and
+	// must return one of Brokers – operations with a channel for which other
+	// Broker returned fail with an error. Required.
+	BrokerResolver func(ch string) Broker
+	// ControlBroker is used to send control messages between nodes. Must be one
+	// of Brokers. By default, the first Broker in Brokers is used.
+	ControlBroker Broker
+}
+
+// NewRoutingBroker initializes RoutingBroker.
+func NewRoutingBroker(n *Node, config RoutingBrokerConfig) (*RoutingBroker, error) {
+	if len(config.Brokers) == 0 {
+		return nil, errors.New("routing broker: no brokers provided in configuration")
+	}
+	if config.BrokerResolver == nil {
+		return nil, errors.New("routing broker: broker resolver required")
+	}
+	var brokers []Broker
+	for _, b := range config.Brokers {
+		if b == nil {
+			return nil, errors.New("routing broker: nil broker in configuration")
+		}
+		if !containsBroker(brokers, b) {
+			brokers = append(brokers, b)
+		}
+	}
+	if config.ControlBroker == nil {
+		config.ControlBroker = brokers[0]
+	} else if !containsBroker(brokers, config.ControlBroker) {
+		return nil, errors.New("routing broker: control broker must be one of brokers")
+	}
+	return &RoutingBroker{
+		node:    n,
+		config:  config,
+		brokers: brokers,
+	}, nil
+}
+
+func containsBroker(brokers []Broker, b Broker) bool {
+	for _, broker := range brokers {
+		if broker == b {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *RoutingBroker) getBroker(ch string) (Broker, error) {
+	broker := b.config.BrokerResolver(ch)
+	if broker == nil {
+		return nil, fmt.Errorf("routing broker: no broker for channel %s", ch)
+	}
+	if !containsBroker(b.brokers, broker) {
+		return nil, fmt.Errorf("routing broker: unknown broker for channel %s", ch)
+	}
+	return broker, nil
+}
+
+// Run runs all Brokers with the same BrokerEventHandler.
+func (b *RoutingBroker) Run(h BrokerEventHandler) error {
+	for _, broker := range b.brokers {
+		if err := broker.Run(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all Brokers which implement Closer.
+func (b *RoutingBroker) Close(ctx context.Context) error {
+	var firstErr error
+	for _, broker := range b.brokers {
+		if closer, ok := broker.(Closer); ok {
+			if err := closer.Close(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Subscribe - see Broker interface description.
+func (b *RoutingBroker) Subscribe(ch string) error {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return err
+	}
+	return broker.Subscribe(ch)
+}
+
+// Unsubscribe - see Broker interface description.
+func (b *RoutingBroker) Unsubscribe(ch string) error {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return err
+	}
+	return broker.Unsubscribe(ch)
+}
+
+// Publish - see Broker interface description.
+func (b *RoutingBroker) Publish(ch string, data []byte, opts PublishOptions) (StreamPosition, error) {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return StreamPosition{}, err
+	}
+	return broker.Publish(ch, data, opts)
+}
+
+var _ BatchPublisher = (*RoutingBroker)(nil)
+
+// PublishMany - see BatchPublisher interface description. Requests are grouped
+// by Broker, Brokers which implement BatchPublisher receive their group in one call.
+func (b *RoutingBroker) PublishMany(reqs []BrokerPublishRequest) []BrokerPublishResult {
+	results := make([]BrokerPublishResult, len(reqs))
+
+	brokerRequests := make(map[Broker][]int)
+	var brokers []Broker
+	for i, req := range reqs {
+		broker, err := b.getBroker(req.Channel)
+		if err != nil {
+			results[i] = BrokerPublishResult{Error: err}
+			continue
+		}
+		if _, ok := brokerRequests[broker]; !ok {
+			brokers = append(brokers, broker)
+		}
+		brokerRequests[broker] = append(brokerRequests[broker], i)
+	}
+
+	for _, broker := range brokers {
+		indexes := brokerRequests[broker]
+		if batchPublisher, ok := broker.(BatchPublisher); ok {
+			brokerReqs := make([]BrokerPublishRequest, 0, len(indexes))
+			for _, i := range indexes {
+				brokerReqs = append(brokerReqs, reqs[i])
+			}
+			brokerResults := batchPublisher.PublishMany(brokerReqs)
+			for j, i := range indexes {
+				results[i] = brokerResults[j]
+			}
+			continue
+		}
+		for _, i := range indexes {
+			sp, err := broker.Publish(reqs[i].Channel, reqs[i].Data, reqs[i].Options)
+			results[i] = BrokerPublishResult{StreamPosition: sp, Error: err}
+		}
+	}
+	return results
+}
+
+// PublishJoin - see Broker interface description.
+func (b *RoutingBroker) PublishJoin(ch string, info *ClientInfo) error {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return err
+	}
+	return broker.PublishJoin(ch, info)
+}
+
+// PublishLeave - see Broker interface description.
+func (b *RoutingBroker) PublishLeave(ch string, info *ClientInfo) error {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return err
+	}
+	return broker.PublishLeave(ch, info)
+}
+
+// PublishControl publishes control data using ControlBroker.
+func (b *RoutingBroker) PublishControl(data []byte, nodeID, shardKey string) error {
+	return b.config.ControlBroker.PublishControl(data, nodeID, shardKey)
+}
+
+// History - see Broker interface description.
+func (b *RoutingBroker) History(ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return nil, StreamPosition{}, err
+	}
+	return broker.History(ch, filter)
+}
+
+// RemoveHistory - see Broker interface description.
+func (b *RoutingBroker) RemoveHistory(ch string) error {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return err
+	}
+	return broker.RemoveHistory(ch)
+}
+
+var _ StreamResetter = (*RoutingBroker)(nil)
+
+// ResetStream - see StreamResetter interface description. Returns
+// ErrorNotAvailable if Broker for a channel does not implement StreamResetter.
+func (b *RoutingBroker) ResetStream(ch string) (StreamPosition, error) {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return StreamPosition{}, err
+	}
+	resetter, ok := broker.(StreamResetter)
+	if !ok {
+		return StreamPosition{}, ErrorNotAvailable
+	}
+	return resetter.ResetStream(ch)
+}
+
+var _ HistoryImporter = (*RoutingBroker)(nil)
+
+// ImportHistory - see HistoryImporter interface description. Returns
+// ErrorNotAvailable if Broker for a channel does not implement HistoryImporter.
+func (b *RoutingBroker) ImportHistory(ch string, pubs []*Publication, sp StreamPosition, opts PublishOptions) error {
+	broker, err := b.getBroker(ch)
+	if err != nil {
+		return err
+	}
+	importer, ok := broker.(HistoryImporter)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	return importer.ImportHistory(ch, pubs, sp, opts)
+}
+
+var _ RateLimiter = (*RoutingBroker)(nil)
+
+// AllowRate - see RateLimiter interface description. Uses ControlBroker, returns
+// ErrorNotAvailable if ControlBroker does not implement RateLimiter.
+func (b *RoutingBroker) AllowRate(key string, limit RateLimit) (bool, error) {
+	limiter, ok := b.config.ControlBroker.(RateLimiter)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	return limiter.AllowRate(key, limit)
+}
+
+var _ PatternSubscriber = (*RoutingBroker)(nil)
+
+// SubscribePattern - see PatternSubscriber interface description. Subscribes
+// on pattern in all Brokers which implement PatternSubscriber, so publications
+// into channels routed to other Brokers do not match pattern. Returns
+// ErrorNotAvailable if no Broker implements PatternSubscriber.
+func (b *RoutingBroker) SubscribePattern(pattern string) error {
+	subscribers := b.patternSubscribers()
+	if len(subscribers) == 0 {
+		return ErrorNotAvailable
+	}
+	for i, subscriber := range subscribers {
+		if err := subscriber.SubscribePattern(pattern); err != nil {
+			for _, subscribed := range subscribers[:i] {
+				_ = subscribed.UnsubscribePattern(pattern)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// UnsubscribePattern - see PatternSubscriber interface description. Returns
+// ErrorNotAvailable if no Broker implements PatternSubscriber.
+func (b *RoutingBroker) UnsubscribePattern(pattern string) error {
+	subscribers := b.patternSubscribers()
+	if len(subscribers) == 0 {
+		return ErrorNotAvailable
+	}
+	var firstErr error
+	for _, subscriber := range subscribers {
+		if err := subscriber.UnsubscribePattern(pattern); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *RoutingBroker) patternSubscribers() []PatternSubscriber {
+	var subscribers []PatternSubscriber
+	for _, broker := range b.brokers {
+		if subscriber, ok := broker.(PatternSubscriber); ok {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	return subscribers
+}
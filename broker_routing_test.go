@@ -0,0 +1,245 @@
+package centrifuge
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testControlCountingBroker struct {
+	*MemoryBroker
+	numControl int
+}
+
+func (b *testControlCountingBroker) PublishControl(data []byte, nodeID, shardKey string) error {
+	b.numControl++
+	return b.MemoryBroker.PublishControl(data, nodeID, shardKey)
+}
+
+func newTestRoutingBroker(t *testing.T) (*RoutingBroker, *testControlCountingBroker, *testControlCountingBroker) {
+	n, _ := New(Config{
+		LogLevel:   LogLevelDebug,
+		LogHandler: func(entry LogEntry) {},
+	})
+	b1, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	b2, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	defaultBroker := &testControlCountingBroker{MemoryBroker: b1}
+	ephemeralBroker := &testControlCountingBroker{MemoryBroker: b2}
+	b, err := NewRoutingBroker(n, RoutingBrokerConfig{
+		Brokers: []Broker{defaultBroker, ephemeralBroker},
+		BrokerResolver: func(ch string) Broker {
+			if strings.HasPrefix(ch, "ephemeral:") {
+				return ephemeralBroker
+			}
+			return defaultBroker
+		},
+		ControlBroker: ephemeralBroker,
+	})
+	require.NoError(t, err)
+	return b, defaultBroker, ephemeralBroker
+}
+
+func TestNewRoutingBrokerErrors(t *testing.T) {
+	n, _ := New(Config{})
+	b, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	resolver := func(ch string) Broker { return b }
+
+	_, err = NewRoutingBroker(n, RoutingBrokerConfig{BrokerResolver: resolver})
+	require.Error(t, err)
+	_, err = NewRoutingBroker(n, RoutingBrokerConfig{Brokers: []Broker{b}})
+	require.Error(t, err)
+	other, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	_, err = NewRoutingBroker(n, RoutingBrokerConfig{Brokers: []Broker{b}, BrokerResolver: resolver, ControlBroker: other})
+	require.Error(t, err)
+
+	r, err := NewRoutingBroker(n, RoutingBrokerConfig{Brokers: []Broker{b, b}, BrokerResolver: resolver})
+	require.NoError(t, err)
+	require.Len(t, r.brokers, 1)
+	require.Equal(t, b, r.config.ControlBroker)
+}
+
+func TestRoutingBroker(t *testing.T) {
+	b, defaultBroker, ephemeralBroker := newTestRoutingBroker(t)
+
+	numPubs := map[string]int{}
+	numControl := 0
+	require.NoError(t, b.Run(&testBrokerEventHandler{
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			numPubs[ch]++
+			return nil
+		},
+		HandleControlFunc: func(data []byte) error {
+			numControl++
+			return nil
+		},
+	}))
+
+	opts := PublishOptions{HistorySize: 10, HistoryTTL: time.Minute}
+	_, err := b.Publish("ephemeral:test", []byte("{}"), opts)
+	require.NoError(t, err)
+	_, err = b.Publish("durable:test", []byte("{}"), opts)
+	require.NoError(t, err)
+	require.Equal(t, 1, numPubs["ephemeral:test"])
+	require.Equal(t, 1, numPubs["durable:test"])
+
+	pubs, _, err := ephemeralBroker.History("ephemeral:test", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	pubs, _, err = defaultBroker.History("ephemeral:test", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	pubs, _, err = b.History("durable:test", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+
+	require.NoError(t, b.RemoveHistory("durable:test"))
+	pubs, _, err = defaultBroker.History("durable:test", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+
+	require.NoError(t, b.PublishControl([]byte("{}"), "", ""))
+	require.Equal(t, 1, numControl)
+	require.Equal(t, 0, defaultBroker.numControl)
+	require.Equal(t, 1, ephemeralBroker.numControl)
+
+	require.NoError(t, b.Close(context.Background()))
+}
+
+func TestRoutingBrokerPublishMany(t *testing.T) {
+	b, defaultBroker, ephemeralBroker := newTestRoutingBroker(t)
+	require.NoError(t, b.Run(&testBrokerEventHandler{
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			return nil
+		},
+	}))
+
+	opts := PublishOptions{HistorySize: 10, HistoryTTL: time.Minute}
+	results := b.PublishMany([]BrokerPublishRequest{
+		{Channel: "ephemeral:test", Data: []byte("{}"), Options: opts},
+		{Channel: "durable:test", Data: []byte("{}"), Options: opts},
+		{Channel: "ephemeral:test", Data: []byte("{}"), Options: opts},
+	})
+	require.Len(t, results, 3)
+	for _, res := range results {
+		require.NoError(t, res.Error)
+	}
+	require.EqualValues(t, 1, results[0].StreamPosition.Offset)
+	require.EqualValues(t, 1, results[1].StreamPosition.Offset)
+	require.EqualValues(t, 2, results[2].StreamPosition.Offset)
+
+	pubs, _, err := ephemeralBroker.History("ephemeral:test", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	pubs, _, err = defaultBroker.History("durable:test", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+}
+
+func TestRoutingBrokerNode(t *testing.T) {
+	b, _, _ := newTestRoutingBroker(t)
+	n := b.node
+	n.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+	n.SetBroker(b)
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	client := newTestSubscribedClient(t, n, "42", "ephemeral:test")
+	transport := client.transport.(*testTransport)
+	transport.sink = make(chan []byte, 100)
+
+	_, err := n.Publish("ephemeral:test", []byte(`{"text": "routed"}`))
+	require.NoError(t, err)
+	for {
+		select {
+		case data := <-transport.sink:
+			if strings.Contains(string(data), "routed") {
+				return
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "timeout receiving publication")
+			return
+		}
+	}
+}
+
+func TestRoutingBrokerUnknownBroker(t *testing.T) {
+	n, _ := New(Config{})
+	b, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	other, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	r, err := NewRoutingBroker(n, RoutingBrokerConfig{
+		Brokers: []Broker{b},
+		BrokerResolver: func(ch string) Broker {
+			if ch == "other" {
+				return other
+			}
+			return b
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = r.Publish("other", []byte("{}"), PublishOptions{})
+	require.Error(t, err)
+	require.Error(t, r.Subscribe("other"))
+	_, _, err = r.History("other", HistoryFilter{})
+	require.Error(t, err)
+	results := r.PublishMany([]BrokerPublishRequest{{Channel: "other", Data: []byte("{}")}})
+	require.Error(t, results[0].Error)
+}
+
+func TestRoutingBrokerAllowRate(t *testing.T) {
+	b, defaultBroker, ephemeralBroker := newTestRoutingBroker(t)
+
+	// Rate limits shared by all channels are kept in ControlBroker.
+	limit := RateLimit{Rate: 0.001, Burst: 1}
+	allowed, err := b.AllowRate("test", limit)
+	require.NoError(t, err)
+	require.True(t, allowed)
+	allowed, err = ephemeralBroker.AllowRate("test", limit)
+	require.NoError(t, err)
+	require.False(t, allowed)
+	allowed, err = defaultBroker.AllowRate("test", limit)
+	require.NoError(t, err)
+	require.True(t, allowed)
+}
+
+func TestRoutingBrokerPatternSubscribe(t *testing.T) {
+	b, _, _ := newTestRoutingBroker(t)
+
+	patternPubs := map[string][]string{}
+	require.NoError(t, b.Run(&testBrokerEventHandler{
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			return nil
+		},
+		HandlePatternPublicationFunc: func(pattern string, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+			patternPubs[pattern] = append(patternPubs[pattern], ch)
+			return nil
+		},
+	}))
+
+	// Pattern matches channels routed to both Brokers, each publication
+	// delivered once.
+	require.NoError(t, b.SubscribePattern("*:test"))
+	_, err := b.Publish("ephemeral:test", []byte("{}"), PublishOptions{})
+	require.NoError(t, err)
+	_, err = b.Publish("durable:test", []byte("{}"), PublishOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ephemeral:test", "durable:test"}, patternPubs["*:test"])
+
+	require.NoError(t, b.UnsubscribePattern("*:test"))
+	_, err = b.Publish("durable:test", []byte("{}"), PublishOptions{})
+	require.NoError(t, err)
+	require.Len(t, patternPubs["*:test"], 2)
+}
@@ -0,0 +1,94 @@
+package centrifuge
+
+import (
+	"sync"
+)
+
+// channelPatternWildcard matches any sequence of characters in pattern
+// subscriptions.
+const channelPatternWildcard = '*'
+
+// matchChannelPattern reports whether channel matches pattern where * matches
+// any sequence of characters (including empty one).
+func matchChannelPattern(pattern string, channel string) bool {
+	var (
+		p, c int
+		// Position of the last wildcard in pattern and position in channel
+		// matched by it – used to backtrack.
+		starIdx  = -1
+		matchIdx int
+	)
+	for c < len(channel) {
+		if p < len(pattern) && pattern[p] == channelPatternWildcard {
+			starIdx = p
+			matchIdx = c
+			p++
+		} else if p < len(pattern) && pattern[p] == channel[c] {
+			p++
+			c++
+		} else if starIdx >= 0 {
+			p = starIdx + 1
+			matchIdx++
+			c = matchIdx
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == channelPatternWildcard {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// channelPatterns is a set of patterns Node subscribed to, used by brokers
+// which match publications against patterns in process memory.
+type channelPatterns struct {
+	mu       sync.RWMutex
+	patterns map[string]struct{}
+}
+
+func newChannelPatterns() *channelPatterns {
+	return &channelPatterns{
+		patterns: make(map[string]struct{}),
+	}
+}
+
+func (p *channelPatterns) add(pattern string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.patterns[pattern] = struct{}{}
+}
+
+func (p *channelPatterns) remove(pattern string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.patterns, pattern)
+}
+
+// match returns patterns matching channel.
+func (p *channelPatterns) match(ch string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var matched []string
+	for pattern := range p.patterns {
+		if matchChannelPattern(pattern, ch) {
+			matched = append(matched, pattern)
+		}
+	}
+	return matched
+}
+
+// handlePatternPublication passes publication to event handler once for each
+// pattern matching channel.
+func (p *channelPatterns) handlePatternPublication(h BrokerEventHandler, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+	patternHandler, ok := h.(PatternBrokerEventHandler)
+	if !ok {
+		return nil
+	}
+	for _, pattern := range p.match(ch) {
+		if err := patternHandler.HandlePatternPublication(pattern, ch, pub, sp, excludeClients); err != nil {
+			return err
+		}
+	}
+	return nil
+}
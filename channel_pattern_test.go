@@ -0,0 +1,181 @@
+package centrifuge
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchChannelPattern(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		channel string
+		match   bool
+	}{
+		{"news", "news", true},
+		{"news", "news.sport", false},
+		{"news.*", "news.sport", true},
+		{"news.*", "news.", true},
+		{"news.*", "news", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"*.sport", "news.sport", true},
+		{"*.sport", "news.sport.live", false},
+		{"news.*.live", "news.sport.live", true},
+		{"news.*.live", "news.sport.today.live", true},
+		{"news.*.live", "news.sport.lives", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"**", "news", true},
+		{"news.?", "news.a", false},
+		{"news.?", "news.?", true},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.match, matchChannelPattern(tc.pattern, tc.channel), "%s %s", tc.pattern, tc.channel)
+	}
+}
+
+func patternSubscribeNode(opts SubscribeOptions) *Node {
+	node := defaultNodeNoHandlers()
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			opts.Pattern = strings.Contains(e.Channel, "*")
+			cb(SubscribeReply{Options: opts}, nil)
+		})
+		client.OnHistory(func(e HistoryEvent, cb HistoryCallback) {
+			cb(HistoryReply{}, nil)
+		})
+	})
+	return node
+}
+
+func waitPatternPublication(t *testing.T, sink chan []byte, channel string) {
+	t.Helper()
+	for {
+		select {
+		case data := <-sink:
+			if strings.Contains(string(data), `"channel":"`+channel+`"`) {
+				return
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "timeout waiting publication", channel)
+		}
+	}
+}
+
+func TestClientSubscribePattern(t *testing.T) {
+	node := patternSubscribeNode(SubscribeOptions{})
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+	connectClient(t, client)
+	subscribeClient(t, client, "news.*")
+	require.True(t, client.isPatternSubscription("news.*"))
+	require.Equal(t, 1, node.hub.numPatternSubscribers("news.*"))
+	require.Equal(t, 0, node.hub.NumSubscribers("news.*"))
+
+	_, err := node.Publish("news.sport", []byte(`{"input":"goal"}`))
+	require.NoError(t, err)
+	waitPatternPublication(t, transport.sink, "news.sport")
+
+	// Publications into not matching channels are not delivered.
+	_, err = node.Publish("weather", []byte(`{}`))
+	require.NoError(t, err)
+	_, err = node.Publish("news.tech", []byte(`{}`))
+	require.NoError(t, err)
+	select {
+	case data := <-transport.sink:
+		require.Contains(t, string(data), `"channel":"news.tech"`)
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout waiting publication")
+	}
+
+	// History is not available for pattern subscription.
+	rwWrapper := testReplyWriterWrapper()
+	err = client.handleHistory(&protocol.HistoryRequest{Channel: "news.*"}, &protocol.Command{Id: 2}, time.Now(), rwWrapper.rw)
+	require.Equal(t, ErrorNotAvailable, err)
+
+	require.NoError(t, client.unsubscribe("news.*", unsubscribeClient, nil))
+	require.False(t, client.isPatternSubscription("news.*"))
+	require.Equal(t, 0, node.hub.numPatternSubscribers("news.*"))
+}
+
+func TestClientSubscribePatternAndChannel(t *testing.T) {
+	node := patternSubscribeNode(SubscribeOptions{})
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+	connectClient(t, client)
+	subscribeClient(t, client, "news.*")
+	subscribeClient(t, client, "news.sport")
+
+	_, err := node.Publish("news.sport", []byte(`{}`))
+	require.NoError(t, err)
+	// Publication delivered over both subscriptions.
+	waitPatternPublication(t, transport.sink, "news.sport")
+	waitPatternPublication(t, transport.sink, "news.sport")
+}
+
+func TestClientSubscribePatternRecoveryRejected(t *testing.T) {
+	node := patternSubscribeNode(SubscribeOptions{EnableRecovery: true})
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleSubscribe(&protocol.SubscribeRequest{
+		Channel: "news.*",
+	}, &protocol.Command{Id: 1}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Equal(t, ErrorNotAvailable.Code, rwWrapper.replies[0].Error.Code)
+	require.NotContains(t, client.channels, "news.*")
+	require.Equal(t, 0, node.hub.numPatternSubscribers("news.*"))
+}
+
+func TestClientSubscribePatternBrokerNotSupported(t *testing.T) {
+	node := patternSubscribeNode(SubscribeOptions{})
+	node.SetBroker(NewTestBroker())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleSubscribe(&protocol.SubscribeRequest{
+		Channel: "news.*",
+	}, &protocol.Command{Id: 1}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Equal(t, ErrorNotAvailable.Code, rwWrapper.replies[0].Error.Code)
+	require.NotContains(t, client.channels, "news.*")
+}
+
+func TestServerSideSubscribePattern(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+	connectClient(t, client)
+
+	err := node.Subscribe("42", "news.*", WithPattern(true))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return client.isPatternSubscription("news.*")
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = node.Publish("news.sport", []byte(`{}`))
+	require.NoError(t, err)
+	waitPatternPublication(t, transport.sink, "news.sport")
+}
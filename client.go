@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"time"
 
@@ -47,6 +48,10 @@ type clientEventHub struct {
 	presenceStatsHandler PresenceStatsHandler
 	historyHandler       HistoryHandler
 	stateSnapshotHandler StateSnapshotHandler
+	presenceInfoHandler  PresenceInfoHandler
+	presenceInfoPrefix   string
+	presencePageHandler  PresencePageHandler
+	presencePagePrefix   string
 }
 
 // OnAlive allows setting AliveHandler.
@@ -124,6 +129,39 @@ func (c *Client) OnHistory(h HistoryHandler) {
 	c.eventHub.historyHandler = h
 }
 
+// OnPresenceInfo allows setting PresenceInfoHandler.
+// PresenceInfoHandler called when client wants to update its presence info in
+// channel. Client sends such requests as RPC with method consisting of
+// methodPrefix chosen by application and channel name, RPC data is a new presence
+// info. RPCs with other methods are passed to RPCHandler as usual. Panics if
+// methodPrefix is empty.
+func (c *Client) OnPresenceInfo(methodPrefix string, h PresenceInfoHandler) {
+	if methodPrefix == "" {
+		panic("Client.OnPresenceInfo called with empty method prefix")
+	}
+	c.eventHub.presenceInfoPrefix = methodPrefix
+	c.eventHub.presenceInfoHandler = h
+}
+
+// OnPresencePage allows setting PresencePageHandler.
+// PresencePageHandler called when client requests a page of channel presence.
+// Client sends such requests as RPC with method consisting of methodPrefix chosen
+// by application and channel name. RPC data contains cursor and limit, RPC result
+// contains presence page and cursor of the next page – empty cursor means that
+// there are no more pages. For JSON protocol data is {"cursor": "", "limit": 0}
+// object and result is presence result object with "cursor" key. For Protobuf
+// protocol data is a message with string cursor field 1 and int32 limit field 2,
+// result is PresenceResult message with string cursor field 2. Limit is capped
+// to 1000 entries. RPCs with other methods are passed to RPCHandler as usual.
+// Panics if methodPrefix is empty.
+func (c *Client) OnPresencePage(methodPrefix string, h PresencePageHandler) {
+	if methodPrefix == "" {
+		panic("Client.OnPresencePage called with empty method prefix")
+	}
+	c.eventHub.presencePagePrefix = methodPrefix
+	c.eventHub.presencePageHandler = h
+}
+
 // OnStateSnapshot allows settings StateSnapshotHandler.
 // This API is EXPERIMENTAL and may be removed in the future versions.
 func (c *Client) OnStateSnapshot(h StateSnapshotHandler) {
@@ -134,13 +172,16 @@ const (
 	// flagSubscribed will be set upon successful Subscription to a channel.
 	// Until that moment channel exists in client Channels map only to track
 	// duplicate subscription requests.
-	flagSubscribed uint8 = 1 << iota
+	flagSubscribed uint16 = 1 << iota
 	flagEmitPresence
 	flagEmitJoinLeave
 	flagPushJoinLeave
 	flagPositioning
 	flagServerSide
 	flagClientSideRefresh
+	flagDelta
+	flagJoinLeaveUserLevel
+	flagPattern
 )
 
 // ChannelContext contains extra context for channel connection subscribed to.
@@ -150,11 +191,15 @@ type ChannelContext struct {
 	expireAt          int64
 	positionCheckTime int64
 	streamPosition    StreamPosition
-	flags             uint8
+	flags             uint16
 	Source            uint8
+	tagsFilter        *TagsFilter
+	// deltaReady is true when client received the previous channel publication
+	// so it can be used as a base to apply delta.
+	deltaReady bool
 }
 
-func channelHasFlag(flags, flag uint8) bool {
+func channelHasFlag(flags, flag uint16) bool {
 	return flags&flag != 0
 }
 
@@ -253,6 +298,13 @@ type Client struct {
 	lastPing          int64
 	eventHub          *clientEventHub
 	timer             *time.Timer
+	// rateLimiter keeps token buckets of Config.CommandRateLimit.ClientLimits.
+	rateLimiter            *rateLimiter
+	numRateLimitViolations int
+	rateLimitWindowStart   int64
+	// pendingCalls keeps Client.Call waiting for client reply.
+	callID       uint64
+	pendingCalls map[uint64]chan clientCallResult
 }
 
 // ClientCloseFunc must be called on Transport handler close to clean up Client.
@@ -287,6 +339,10 @@ func NewClient(ctx context.Context, n *Node, t Transport) (*Client, ClientCloseF
 		eventHub:   &clientEventHub{},
 	}
 
+	if len(n.config.CommandRateLimit.ClientLimits) > 0 {
+		client.rateLimiter = newRateLimiter()
+	}
+
 	messageWriterConf := writerConfig{
 		MaxQueueSize: n.config.ClientQueueMaxSize,
 		WriteFn: func(item queue.Item) error {
@@ -598,10 +654,11 @@ func (c *Client) transportEnqueue(data []byte) error {
 	return nil
 }
 
-// updateChannelPresence updates client presence info for channel so it
-// won't expire until client disconnect.
+// updateChannelPresence updates client presence info (and user connection
+// with user-level join/leave) for channel so it won't expire until client
+// disconnect.
 func (c *Client) updateChannelPresence(ch string, chCtx ChannelContext) error {
-	if !channelHasFlag(chCtx.flags, flagEmitPresence) {
+	if !channelHasFlag(chCtx.flags, flagEmitPresence) && !channelHasFlag(chCtx.flags, flagJoinLeaveUserLevel) {
 		return nil
 	}
 	c.mu.RLock()
@@ -610,6 +667,14 @@ func (c *Client) updateChannelPresence(ch string, chCtx ChannelContext) error {
 		return nil
 	}
 	c.mu.RUnlock()
+	if channelHasFlag(chCtx.flags, flagJoinLeaveUserLevel) {
+		if _, err := c.node.addUserConnection(ch, c.user, c.uid); err != nil {
+			return err
+		}
+	}
+	if !channelHasFlag(chCtx.flags, flagEmitPresence) {
+		return nil
+	}
 	return c.node.addPresence(ch, c.uid, &ClientInfo{
 		ClientID: c.uid,
 		UserID:   c.user,
@@ -618,6 +683,46 @@ func (c *Client) updateChannelPresence(ch string, chCtx ChannelContext) error {
 	})
 }
 
+// SetChannelPresenceInfo sets channel info of client subscription. This allows
+// keeping ephemeral per-channel state like "away" or "typing" status. New info
+// is saved to PresenceManager if presence enabled for subscription. If join/leave
+// messages enabled for subscription (also with JoinLeaveUserLevel) then channel
+// subscribers with PushJoinLeave receive a presence info push with updated
+// ClientInfo – it's a separate push, so clients can tell it from join. Presence
+// info updates are sent to other nodes over control channel. New info also
+// becomes ChanInfo of client publications in channel. Returns
+// ErrorPermissionDenied if client is not subscribed to channel.
+func (c *Client) SetChannelPresenceInfo(ch string, data []byte) error {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+
+	c.mu.Lock()
+	chCtx, ok := c.channels[ch]
+	if !ok || !channelHasFlag(chCtx.flags, flagSubscribed) {
+		c.mu.Unlock()
+		return ErrorPermissionDenied
+	}
+	chCtx.info = data
+	c.channels[ch] = chCtx
+	info := &ClientInfo{
+		ClientID: c.uid,
+		UserID:   c.user,
+		ConnInfo: c.info,
+		ChanInfo: data,
+	}
+	c.mu.Unlock()
+
+	if channelHasFlag(chCtx.flags, flagEmitPresence) {
+		if err := c.node.addPresence(ch, c.uid, info); err != nil {
+			return err
+		}
+	}
+	if channelHasFlag(chCtx.flags, flagEmitJoinLeave) {
+		return c.node.publishPresenceInfo(ch, info)
+	}
+	return nil
+}
+
 // Context returns client Context. This context will be canceled
 // as soon as client connection closes.
 func (c *Client) Context() context.Context {
@@ -995,6 +1100,8 @@ func (c *Client) close(disconnect Disconnect) error {
 	}
 	c.mu.Unlock()
 
+	c.failPendingCalls()
+
 	if len(channels) > 0 {
 		// Unsubscribe from all channels.
 		unsub := unsubscribeDisconnect
@@ -1198,6 +1305,13 @@ func (c *Client) dispatchCommandV2(cmd *protocol.Command) *Disconnect {
 		return nil
 	}
 
+	if !isConnect {
+		commandMethod := commandMethodV2(cmd)
+		if err := c.checkRateLimit(commandMethod); err != nil {
+			return c.handleRateLimitError(commandMethod, cmd, err)
+		}
+	}
+
 	var method protocol.Command_MethodType
 
 	started := time.Now()
@@ -1319,6 +1433,12 @@ func (c *Client) dispatchCommandV1(cmd *protocol.Command) *Disconnect {
 	}
 
 	method := cmd.Method
+	if !isConnect {
+		if err := c.checkRateLimit(method); err != nil {
+			return c.handleRateLimitError(method, cmd, err)
+		}
+	}
+
 	started := time.Now()
 
 	var handleErr error
@@ -1710,15 +1830,30 @@ func (c *Client) handleRefresh(req *protocol.RefreshRequest, cmd *protocol.Comma
 	return nil
 }
 
+// removeFailedUserConnection removes user connection added during subscription
+// which failed later.
+func (c *Client) removeFailedUserConnection(channel string, added bool) {
+	if !added {
+		return
+	}
+	if _, err := c.node.removeUserConnection(channel, c.user, c.uid); err != nil {
+		c.node.logger.log(newLogEntry(LogLevelError, "error removing user connection", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+	}
+}
+
 // onSubscribeError cleans up a channel from client channels if an error during subscribe happened.
 // Channel kept in a map during subscribe request to check for duplicate subscription attempts.
 func (c *Client) onSubscribeError(channel string) {
 	c.mu.Lock()
-	_, ok := c.channels[channel]
+	chCtx, ok := c.channels[channel]
 	delete(c.channels, channel)
 	c.mu.Unlock()
 	if ok {
-		_ = c.node.removeSubscription(channel, c)
+		if channelHasFlag(chCtx.flags, flagPattern) {
+			_ = c.node.removePatternSubscription(channel, c)
+		} else {
+			_ = c.node.removeSubscription(channel, c)
+		}
 	}
 }
 
@@ -1768,7 +1903,7 @@ func (c *Client) handleSubscribe(req *protocol.SubscribeRequest, cmd *protocol.C
 			return
 		}
 
-		if channelHasFlag(ctx.channelContext.flags, flagEmitJoinLeave) && ctx.clientInfo != nil {
+		if channelHasFlag(ctx.channelContext.flags, flagEmitJoinLeave) && ctx.clientInfo != nil && !ctx.skipJoin {
 			go func() { _ = c.node.publishJoin(req.Channel, ctx.clientInfo) }()
 		}
 	}
@@ -1947,10 +2082,15 @@ func (c *Client) handlePublish(req *protocol.PublishRequest, cmd *protocol.Comma
 		}
 
 		if reply.Result == nil {
+			excludeClients := reply.Options.ExcludeClients
+			if reply.ExcludePublisher {
+				excludeClients = append(excludeClients[:len(excludeClients):len(excludeClients)], c.uid)
+			}
 			_, err := c.node.Publish(
 				event.Channel, event.Data,
 				WithHistory(reply.Options.HistorySize, reply.Options.HistoryTTL),
 				WithClientInfo(reply.Options.ClientInfo),
+				WithExcludeClients(excludeClients...),
 			)
 			if err != nil {
 				c.logWriteInternalErrorFlush(protocol.Command_PUBLISH, cmd, err, "error publish", rw)
@@ -1994,6 +2134,9 @@ func (c *Client) handlePresence(req *protocol.PresenceRequest, cmd *protocol.Com
 	if channel == "" {
 		return c.logDisconnectBadRequest("channel required for presence")
 	}
+	if c.isPatternSubscription(channel) {
+		return ErrorNotAvailable
+	}
 
 	event := PresenceEvent{
 		Channel: channel,
@@ -2063,6 +2206,9 @@ func (c *Client) handlePresenceStats(req *protocol.PresenceStatsRequest, cmd *pr
 	if channel == "" {
 		return c.logDisconnectBadRequest("channel required for presence stats")
 	}
+	if c.isPatternSubscription(channel) {
+		return ErrorNotAvailable
+	}
 
 	event := PresenceStatsEvent{
 		Channel: channel,
@@ -2128,6 +2274,9 @@ func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Comma
 	if channel == "" {
 		return c.logDisconnectBadRequest("channel required for history")
 	}
+	if c.isPatternSubscription(channel) {
+		return ErrorNotAvailable
+	}
 
 	var filter HistoryFilter
 	if req.Since != nil {
@@ -2144,6 +2293,8 @@ func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Comma
 	}
 
 	filter.Reverse = req.Reverse
+	// Client subscribed with tags filter should not see other publications in history.
+	filter.TagsFilter = c.channelTagsFilter(channel)
 
 	event := HistoryEvent{
 		Channel: channel,
@@ -2163,7 +2314,14 @@ func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Comma
 		var offset uint64
 		var epoch string
 		if reply.Result == nil {
-			result, err := c.node.History(event.Channel, WithLimit(event.Filter.Limit), WithSince(event.Filter.Since), WithReverse(event.Filter.Reverse))
+			sinceTime, untilTime := event.Filter.SinceTime, event.Filter.UntilTime
+			if !reply.SinceTime.IsZero() {
+				sinceTime = reply.SinceTime
+			}
+			if !reply.UntilTime.IsZero() {
+				untilTime = reply.UntilTime
+			}
+			result, err := c.node.History(event.Channel, WithLimit(event.Filter.Limit), WithSince(event.Filter.Since), WithReverse(event.Filter.Reverse), WithFilter(event.Filter.TagsFilter), WithSinceTime(sinceTime), WithUntilTime(untilTime))
 			if err != nil {
 				c.logWriteInternalErrorFlush(protocol.Command_HISTORY, cmd, err, "error getting history", rw)
 				return
@@ -2179,7 +2337,7 @@ func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Comma
 
 		protoPubs := make([]*protocol.Publication, 0, len(pubs))
 		for _, pub := range pubs {
-			protoPub := pubToProto(pub)
+			protoPub := pubToProto(c.node.clientPublication(pub))
 			protoPubs = append(protoPubs, protoPub)
 		}
 
@@ -2242,6 +2400,12 @@ type replyWriter struct {
 }
 
 func (c *Client) handleRPC(req *protocol.RPCRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
+	if c.eventHub.presenceInfoHandler != nil && strings.HasPrefix(req.Method, c.eventHub.presenceInfoPrefix) {
+		return c.handlePresenceInfo(req, cmd, started, rw)
+	}
+	if c.eventHub.presencePageHandler != nil && strings.HasPrefix(req.Method, c.eventHub.presencePagePrefix) {
+		return c.handlePresencePage(req, cmd, started, rw)
+	}
 	if c.eventHub.rpcHandler == nil {
 		return ErrorNotAvailable
 	}
@@ -2274,6 +2438,109 @@ func (c *Client) handleRPC(req *protocol.RPCRequest, cmd *protocol.Command, star
 	return nil
 }
 
+func (c *Client) handlePresenceInfo(req *protocol.RPCRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
+	channel := strings.TrimPrefix(req.Method, c.eventHub.presenceInfoPrefix)
+	if channel == "" {
+		return c.logDisconnectBadRequest("channel required for presence info")
+	}
+
+	event := PresenceInfoEvent{
+		Channel: channel,
+		Data:    req.Data,
+	}
+
+	cb := func(reply PresenceInfoReply, err error) {
+		defer func() {
+			observeCommandDuration(protocol.Command_RPC, time.Since(started))
+		}()
+		if err != nil {
+			c.writeDisconnectOrErrorFlush(protocol.Command_RPC, cmd, err, rw)
+			return
+		}
+		info := event.Data
+		if len(reply.Info) > 0 {
+			info = reply.Info
+		}
+		if err := c.SetChannelPresenceInfo(channel, info); err != nil {
+			if _, ok := err.(*Error); !ok {
+				c.node.logger.log(newLogEntry(LogLevelError, "error setting presence info", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+			}
+			c.writeDisconnectOrErrorFlush(protocol.Command_RPC, cmd, err, rw)
+			return
+		}
+		rep, err := c.getRPCCommandReply(&protocol.RPCResult{})
+		if err != nil {
+			c.logWriteInternalErrorFlush(protocol.Command_RPC, cmd, err, "error encoding rpc", rw)
+			return
+		}
+		c.writeEncodedCommandReply(protocol.Command_RPC, cmd, rep, rw)
+	}
+
+	c.eventHub.presenceInfoHandler(event, cb)
+	return nil
+}
+
+func (c *Client) handlePresencePage(req *protocol.RPCRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
+	channel := strings.TrimPrefix(req.Method, c.eventHub.presencePagePrefix)
+	if channel == "" {
+		return c.logDisconnectBadRequest("channel required for presence page")
+	}
+	if c.isPatternSubscription(channel) {
+		return ErrorNotAvailable
+	}
+	protoType := c.transport.Protocol().toProto()
+	cursor, limit, err := decodePresencePageRequest(protoType, req.Data)
+	if err != nil {
+		return c.logDisconnectBadRequestWithError(err, "error decoding presence page")
+	}
+	if limit < 0 || limit > maxPresencePageLimit {
+		limit = maxPresencePageLimit
+	}
+
+	event := PresencePageEvent{
+		Channel: channel,
+		Cursor:  cursor,
+		Limit:   limit,
+	}
+
+	cb := func(reply PresencePageReply, err error) {
+		defer func() {
+			observeCommandDuration(protocol.Command_RPC, time.Since(started))
+		}()
+		if err != nil {
+			c.writeDisconnectOrErrorFlush(protocol.Command_RPC, cmd, err, rw)
+			return
+		}
+
+		var page PresencePageResult
+		if reply.Result == nil {
+			result, err := c.node.PresencePage(event.Channel, event.Cursor, event.Limit)
+			if err != nil {
+				c.logWriteInternalErrorFlush(protocol.Command_RPC, cmd, err, "error getting presence page", rw)
+				return
+			}
+			page = result
+		} else {
+			page = *reply.Result
+		}
+
+		data, err := encodePresencePageResult(protoType, page)
+		if err != nil {
+			c.logWriteInternalErrorFlush(protocol.Command_RPC, cmd, err, "error encoding presence page", rw)
+			return
+		}
+		rep, err := c.getRPCCommandReply(&protocol.RPCResult{Data: data})
+		if err != nil {
+			c.logWriteInternalErrorFlush(protocol.Command_RPC, cmd, err, "error encoding rpc", rw)
+			return
+		}
+		c.writeEncodedCommandReply(protocol.Command_RPC, cmd, rep, rw)
+	}
+
+	c.eventHub.presencePageHandler(event, cb)
+	return nil
+}
+
 func (c *Client) getRPCCommandReply(res *protocol.RPCResult) (*protocol.Reply, error) {
 	if c.transport.ProtocolVersion() == ProtocolVersion1 {
 		result, err := protocol.GetResultEncoder(c.transport.Protocol().toProto()).EncodeRPCResult(res)
@@ -2290,6 +2557,10 @@ func (c *Client) getRPCCommandReply(res *protocol.RPCResult) (*protocol.Reply, e
 }
 
 func (c *Client) handleSend(req *protocol.SendRequest, started time.Time) error {
+	if c.handleCallReply(req.Data) {
+		observeCommandDuration(protocol.Command_SEND, time.Since(started))
+		return nil
+	}
 	if c.eventHub.messageHandler == nil {
 		// send handler is a bit special since it is only one way
 		// request: client does not expect any reply.
@@ -2573,7 +2844,7 @@ func (c *Client) connectCmd(req *protocol.ConnectRequest, cmd *protocol.Command,
 	if len(subCtxMap) > 0 {
 		for channel, subCtx := range subCtxMap {
 			go func(channel string, subCtx subscribeContext) {
-				if channelHasFlag(subCtx.channelContext.flags, flagEmitJoinLeave) && subCtx.clientInfo != nil {
+				if channelHasFlag(subCtx.channelContext.flags, flagEmitJoinLeave) && subCtx.clientInfo != nil && !subCtx.skipJoin {
 					_ = c.node.publishJoin(channel, subCtx.clientInfo)
 				}
 			}(channel, subCtx)
@@ -2669,7 +2940,7 @@ func (c *Client) Subscribe(channel string, opts ...SubscribeOption) error {
 	if err != nil {
 		return err
 	}
-	if channelHasFlag(subCtx.channelContext.flags, flagEmitJoinLeave) && subCtx.clientInfo != nil {
+	if channelHasFlag(subCtx.channelContext.flags, flagEmitJoinLeave) && subCtx.clientInfo != nil && !subCtx.skipJoin {
 		_ = c.node.publishJoin(channel, subCtx.clientInfo)
 	}
 	return nil
@@ -2746,8 +3017,11 @@ func errorDisconnectContext(replyError *Error, disconnect *Disconnect) subscribe
 }
 
 type subscribeContext struct {
-	result         *protocol.SubscribeResult
-	clientInfo     *ClientInfo
+	result     *protocol.SubscribeResult
+	clientInfo *ClientInfo
+	// skipJoin is true when Join must not be published since user already had
+	// connections in channel (with user-level join/leave).
+	skipJoin       bool
 	err            *Error
 	disconnect     *Disconnect
 	channelContext ChannelContext
@@ -2762,13 +3036,17 @@ func isRecovered(historyResult HistoryResult, cmdOffset uint64, cmdEpoch string)
 		protoPub := pubToProto(pub)
 		recoveredPubs = append(recoveredPubs, protoPub)
 	}
+	// Compacted stream has gaps in offsets. Broker does not return publications
+	// from compacted stream at all if some of missed publications were lost.
+	compacted := hasCompactedPublications(historyResult.Publications)
 
 	nextOffset := cmdOffset + 1
 	var recovered bool
 	if len(recoveredPubs) == 0 {
 		recovered = latestOffset == cmdOffset && (cmdEpoch == "" || latestEpoch == cmdEpoch)
 	} else {
-		recovered = recoveredPubs[0].Offset == nextOffset &&
+		firstOffset := recoveredPubs[0].Offset
+		recovered = (firstOffset == nextOffset || (compacted && firstOffset > nextOffset)) &&
 			recoveredPubs[len(recoveredPubs)-1].Offset == latestOffset &&
 			(cmdEpoch == "" || latestEpoch == cmdEpoch)
 	}
@@ -2776,6 +3054,17 @@ func isRecovered(historyResult HistoryResult, cmdOffset uint64, cmdEpoch string)
 	return recoveredPubs, recovered
 }
 
+// hasCompactedPublications reports whether publications belong to a compacted
+// stream, i.e. may have gaps in offsets.
+func hasCompactedPublications(pubs []*Publication) bool {
+	for _, pub := range pubs {
+		if pub.CompactionKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // subscribeCmd handles subscribe command - clients send this when subscribe
 // on channel, if channel is private then we must validate provided sign here before
 // actually subscribe client on channel. Optionally we can send missed messages to
@@ -2801,6 +3090,10 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		res.Data = reply.Options.Data
 	}
 
+	if reply.Options.Pattern {
+		return c.subscribePatternCmd(req, reply, res, cmd, serverSide, rw)
+	}
+
 	channel := req.Channel
 
 	info := &ClientInfo{
@@ -2810,7 +3103,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		ChanInfo: reply.Options.ChannelInfo,
 	}
 
-	needPubSubSync := reply.Options.EnablePositioning || reply.Options.EnableRecovery
+	needPubSubSync := reply.Options.EnablePositioning || reply.Options.EnableRecovery || reply.Options.EnableLatestPublication
 	if needPubSubSync {
 		// Start syncing recovery and PUB/SUB.
 		// The important thing is to call StopBuffering for this channel
@@ -2818,7 +3111,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		c.pubSubSync.StartBuffering(channel)
 	}
 
-	err := c.node.addSubscription(channel, c)
+	err := c.node.addSubscription(channel, c, reply.Options.TagsFilter)
 	if err != nil {
 		c.node.logger.log(newLogEntry(LogLevelError, "error adding subscription", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
 		c.pubSubSync.StopBuffering(channel)
@@ -2839,14 +3132,36 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		}
 	}
 
+	// userConnectionAdded is true when user connection must be removed if
+	// subscription fails later. Otherwise it would break join/leave of user
+	// until connection expires.
+	var userConnectionAdded bool
+	if reply.Options.EmitJoinLeave && reply.Options.JoinLeaveUserLevel {
+		joined, err := c.node.addUserConnection(channel, c.user, c.uid)
+		if err != nil {
+			c.node.logger.log(newLogEntry(LogLevelError, "error adding user connection", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+			c.pubSubSync.StopBuffering(channel)
+			ctx.disconnect = &DisconnectServerError
+			return ctx
+		}
+		ctx.skipJoin = !joined
+		userConnectionAdded = true
+	}
+
 	var (
 		latestOffset  uint64
 		latestEpoch   string
 		recoveredPubs []*protocol.Publication
+		// withLatest is true when the latest publication loaded into recoveredPubs.
+		withLatest bool
+		// compacted is true when recoveredPubs loaded from compacted stream.
+		compacted bool
 	)
 
-	if reply.Options.EnablePositioning || reply.Options.EnableRecovery {
-		res.Positioned = true
+	if needPubSubSync {
+		if reply.Options.EnablePositioning || reply.Options.EnableRecovery {
+			res.Positioned = true
+		}
 		if reply.Options.EnableRecovery {
 			res.Recoverable = true
 		}
@@ -2873,6 +3188,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 				} else {
 					c.node.logger.log(newLogEntry(LogLevelError, "error on recover", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
 					c.pubSubSync.StopBuffering(channel)
+					c.removeFailedUserConnection(channel, userConnectionAdded)
 					if clientErr, ok := err.(*Error); ok && clientErr != ErrorInternal {
 						return errorDisconnectContext(clientErr, nil)
 					}
@@ -2883,15 +3199,43 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 				latestOffset = historyResult.Offset
 				latestEpoch = historyResult.Epoch
 				var recovered bool
+				if c.node.config.PublicationTimeTag != "" {
+					// History result may be shared between callers, so not modifying it in place.
+					pubs := make([]*Publication, 0, len(historyResult.Publications))
+					for _, pub := range historyResult.Publications {
+						pubs = append(pubs, c.node.clientPublication(pub))
+					}
+					historyResult.Publications = pubs
+				}
 				recoveredPubs, recovered = isRecovered(historyResult, cmdOffset, cmdEpoch)
+				compacted = hasCompactedPublications(historyResult.Publications)
 				res.Recovered = recovered
 				incRecover(res.Recovered)
 			}
+		} else if reply.Options.EnableLatestPublication {
+			historyResult, err := c.node.latestPublication(channel)
+			if err != nil {
+				c.node.logger.log(newLogEntry(LogLevelError, "error getting latest publication for channel", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+				c.pubSubSync.StopBuffering(channel)
+				c.removeFailedUserConnection(channel, userConnectionAdded)
+				if clientErr, ok := err.(*Error); ok && clientErr != ErrorInternal {
+					return errorDisconnectContext(clientErr, nil)
+				}
+				ctx.disconnect = &DisconnectServerError
+				return ctx
+			}
+			latestOffset = historyResult.Offset
+			latestEpoch = historyResult.Epoch
+			for _, pub := range historyResult.Publications {
+				recoveredPubs = append(recoveredPubs, pubToProto(c.node.clientPublication(pub)))
+			}
+			withLatest = true
 		} else {
 			streamTop, err := c.node.streamTop(channel)
 			if err != nil {
 				c.node.logger.log(newLogEntry(LogLevelError, "error getting stream state for channel", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
 				c.pubSubSync.StopBuffering(channel)
+				c.removeFailedUserConnection(channel, userConnectionAdded)
 				if clientErr, ok := err.(*Error); ok && clientErr != ErrorInternal {
 					return errorDisconnectContext(clientErr, nil)
 				}
@@ -2907,9 +3251,10 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 
 		bufferedPubs := c.pubSubSync.LockBufferAndReadBuffered(channel)
 		var okMerge bool
-		recoveredPubs, okMerge = recovery.MergePublications(recoveredPubs, bufferedPubs)
+		recoveredPubs, okMerge = recovery.MergePublications(recoveredPubs, bufferedPubs, compacted)
 		if !okMerge {
 			c.pubSubSync.StopBuffering(channel)
+			c.removeFailedUserConnection(channel, userConnectionAdded)
 			ctx.disconnect = &DisconnectInsufficientState
 			return ctx
 		}
@@ -2926,12 +3271,29 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		}
 	}
 
+	if reply.Options.TagsFilter != nil && len(recoveredPubs) > 0 {
+		// Filter only after merge since merge relies on offset continuity.
+		filteredPubs := make([]*protocol.Publication, 0, len(recoveredPubs))
+		for _, pub := range recoveredPubs {
+			if reply.Options.TagsFilter.Match(pub.Tags) {
+				filteredPubs = append(filteredPubs, pub)
+			}
+		}
+		recoveredPubs = filteredPubs
+	}
+
+	if len(recoveredPubs) > 0 {
+		recoveredPubs = c.transformPublications(channel, recoveredPubs)
+	}
+
 	if c.transport.ProtocolVersion() == ProtocolVersion1 {
-		if req.Recover {
+		if req.Recover || withLatest {
 			res.Publications = recoveredPubs
 		}
 	} else {
-		if res.Recovered {
+		if withLatest {
+			res.Publications = recoveredPubs
+		} else if res.Recovered {
 			// Only append recovered publications in case continuity in a channel can be achieved.
 			res.Publications = recoveredPubs
 			// In case of successful recovery attach stream position from request to subscribe response.
@@ -2953,6 +3315,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 				// Will be called later in case of server side sub.
 				c.pubSubSync.StopBuffering(channel)
 			}
+			c.removeFailedUserConnection(channel, userConnectionAdded)
 			ctx.disconnect = &DisconnectServerError
 			return ctx
 		}
@@ -2962,7 +3325,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		c.writeEncodedCommandReply(protocol.Command_SUBSCRIBE, cmd, rep, rw)
 	}
 
-	var channelFlags uint8
+	var channelFlags uint16
 	channelFlags |= flagSubscribed
 	if serverSide {
 		channelFlags |= flagServerSide
@@ -2982,6 +3345,12 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 	if reply.Options.PushJoinLeave {
 		channelFlags |= flagPushJoinLeave
 	}
+	if reply.Options.EmitJoinLeave && reply.Options.JoinLeaveUserLevel {
+		channelFlags |= flagJoinLeaveUserLevel
+	}
+	if reply.Options.DeltaType == DeltaTypeFossil {
+		channelFlags |= flagDelta
+	}
 
 	channelContext := ChannelContext{
 		info:     reply.Options.ChannelInfo,
@@ -2991,7 +3360,8 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 			Offset: latestOffset,
 			Epoch:  latestEpoch,
 		},
-		Source: reply.Options.Source,
+		Source:     reply.Options.Source,
+		tagsFilter: reply.Options.TagsFilter,
 	}
 	if reply.Options.EnableRecovery || reply.Options.EnablePositioning {
 		channelContext.positionCheckTime = time.Now().Unix()
@@ -3017,6 +3387,92 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 	return ctx
 }
 
+// subscribePatternCmd subscribes client on pattern. Stream related features are
+// not supported for pattern subscriptions, so subscription with such options is
+// rejected.
+func (c *Client) subscribePatternCmd(req *protocol.SubscribeRequest, reply SubscribeReply, res *protocol.SubscribeResult, cmd *protocol.Command, serverSide bool, rw *replyWriter) subscribeContext {
+	ctx := subscribeContext{}
+	pattern := req.Channel
+
+	opts := reply.Options
+	if opts.EnableRecovery || opts.EnablePositioning || opts.RecoverSince != nil || opts.EnableLatestPublication ||
+		opts.DeltaType != DeltaTypeNone || opts.EmitPresence || opts.EmitJoinLeave || opts.PushJoinLeave || req.Recover {
+		c.node.logger.log(newLogEntry(LogLevelInfo, "pattern subscription does not support history, recovery, positioning, delta, presence and join/leave", map[string]interface{}{"pattern": pattern, "user": c.user, "client": c.uid}))
+		return errorDisconnectContext(ErrorNotAvailable, nil)
+	}
+
+	c.mu.Lock()
+	if chCtx, ok := c.channels[pattern]; ok {
+		// Make sure onSubscribeError removes pattern subscription.
+		chCtx.flags |= flagPattern
+		c.channels[pattern] = chCtx
+	}
+	c.mu.Unlock()
+
+	err := c.node.addPatternSubscription(pattern, c, opts.TagsFilter)
+	if err != nil {
+		c.node.logger.log(newLogEntry(LogLevelError, "error adding pattern subscription", map[string]interface{}{"pattern": pattern, "user": c.user, "client": c.uid, "error": err.Error()}))
+		if clientErr, ok := err.(*Error); ok && clientErr != ErrorInternal {
+			return errorDisconnectContext(clientErr, nil)
+		}
+		ctx.disconnect = &DisconnectServerError
+		return ctx
+	}
+
+	if !serverSide {
+		rep, err := c.getSubscribeCommandReply(res)
+		if err != nil {
+			c.node.logger.log(newLogEntry(LogLevelError, "error encoding subscribe", map[string]interface{}{"error": err.Error()}))
+			ctx.disconnect = &DisconnectServerError
+			return ctx
+		}
+		c.writeEncodedCommandReply(protocol.Command_SUBSCRIBE, cmd, rep, rw)
+	}
+
+	channelFlags := flagSubscribed | flagPattern
+	if serverSide {
+		channelFlags |= flagServerSide
+	}
+	if reply.ClientSideRefresh {
+		channelFlags |= flagClientSideRefresh
+	}
+	channelContext := ChannelContext{
+		info:       opts.ChannelInfo,
+		flags:      channelFlags,
+		expireAt:   opts.ExpireAt,
+		Source:     opts.Source,
+		tagsFilter: opts.TagsFilter,
+	}
+	if !serverSide {
+		// In case of server-side sub this will be done later by the caller.
+		c.mu.Lock()
+		c.channels[pattern] = channelContext
+		c.mu.Unlock()
+	}
+
+	if c.node.logger.enabled(LogLevelDebug) {
+		c.node.logger.log(newLogEntry(LogLevelDebug, "client subscribed to pattern", map[string]interface{}{"client": c.uid, "user": c.user, "pattern": pattern}))
+	}
+
+	ctx.result = res
+	ctx.clientInfo = &ClientInfo{
+		ClientID: c.uid,
+		UserID:   c.user,
+		ConnInfo: c.info,
+		ChanInfo: opts.ChannelInfo,
+	}
+	ctx.channelContext = channelContext
+	return ctx
+}
+
+// isPatternSubscription reports whether client subscribed on channel as on pattern.
+func (c *Client) isPatternSubscription(channel string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	chCtx, ok := c.channels[channel]
+	return ok && channelHasFlag(chCtx.flags, flagPattern)
+}
+
 func (c *Client) getSubscribeCommandReply(res *protocol.SubscribeResult) (*protocol.Reply, error) {
 	if c.transport.ProtocolVersion() == ProtocolVersion1 {
 		result, err := protocol.GetResultEncoder(c.transport.Protocol().toProto()).EncodeSubscribeResult(res)
@@ -3061,15 +3517,26 @@ func (c *Client) handleAsyncUnsubscribe(ch string, unsub Unsubscribe) {
 	}
 }
 
-func (c *Client) writePublicationUpdatePosition(ch string, pub *protocol.Publication, data []byte, sp StreamPosition) error {
+// writePublicationUpdatePosition updates client position in a stream and writes
+// publication data to connection. Nil data means that publication must not be sent
+// to a client (filtered out) – only position is updated in this case.
+func (c *Client) writePublicationUpdatePosition(ch string, pub *protocol.Publication, data []byte, delta bool, sp StreamPosition) error {
 	c.mu.Lock()
 	channelContext, ok := c.channels[ch]
 	if !ok || !channelHasFlag(channelContext.flags, flagSubscribed) {
 		c.mu.Unlock()
 		return nil
 	}
+	deltaEnabled := channelHasFlag(channelContext.flags, flagDelta)
+	if deltaEnabled && !c.updateDeltaReady(ch, &channelContext, data, delta) {
+		c.mu.Unlock()
+		return nil
+	}
 	if !channelHasFlag(channelContext.flags, flagPositioning) {
-		if hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
+		if deltaEnabled {
+			c.channels[ch] = channelContext
+		}
+		if data == nil || hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
 			c.mu.Unlock()
 			return nil
 		}
@@ -3103,25 +3570,148 @@ func (c *Client) writePublicationUpdatePosition(ch string, pub *protocol.Publica
 	channelContext.streamPosition.Offset = pub.Offset
 	c.channels[ch] = channelContext
 	c.mu.Unlock()
-	if hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
+	if data == nil || hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
 		return nil
 	}
 	return c.transportEnqueue(data)
 }
 
+// handleStreamReset makes positioned subscription resubscribe upon channel
+// stream reset since client position is not valid anymore. Subscriptions which
+// already have position in a new stream epoch are not affected.
+func (c *Client) handleStreamReset(ch string, sp StreamPosition) {
+	c.mu.RLock()
+	channelContext, ok := c.channels[ch]
+	if !ok || !channelHasFlag(channelContext.flags, flagSubscribed) || !channelHasFlag(channelContext.flags, flagPositioning) {
+		c.mu.RUnlock()
+		return
+	}
+	if channelContext.streamPosition.Epoch == sp.Epoch {
+		c.mu.RUnlock()
+		return
+	}
+	serverSide := channelHasFlag(channelContext.flags, flagServerSide)
+	c.mu.RUnlock()
+	if c.node.logger.enabled(LogLevelDebug) {
+		c.node.logger.log(newLogEntry(LogLevelDebug, "client insufficient state due to stream reset", map[string]interface{}{"channel": ch, "user": c.user, "client": c.uid, "epoch": sp.Epoch}))
+	}
+	go func() { c.handleInsufficientState(ch, serverSide) }()
+}
+
+// updateDeltaReady updates delta state of channel subscription upon writing publication
+// data. Returns false if delta data can not be applied by client since it has no base
+// publication – this is possible upon concurrent resubscribe, in this case client
+// state is considered insufficient. Lock must be held outside.
+func (c *Client) updateDeltaReady(ch string, channelContext *ChannelContext, data []byte, delta bool) bool {
+	if delta && !channelContext.deltaReady {
+		if c.node.logger.enabled(LogLevelDebug) {
+			c.node.logger.log(newLogEntry(LogLevelDebug, "client has no delta base", map[string]interface{}{"channel": ch, "user": c.user, "client": c.uid}))
+		}
+		serverSide := channelHasFlag(channelContext.flags, flagServerSide)
+		go func() { c.handleInsufficientState(ch, serverSide) }()
+		return false
+	}
+	channelContext.deltaReady = data != nil && !hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication)
+	return true
+}
+
+// channelDeltaState returns whether delta compression is enabled for channel
+// subscription and whether client can receive delta at the moment.
+func (c *Client) channelDeltaState(ch string) (bool, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	channelContext, ok := c.channels[ch]
+	if !ok || !channelHasFlag(channelContext.flags, flagDelta) {
+		return false, false
+	}
+	return true, channelContext.deltaReady
+}
+
+// channelTagsFilter returns TagsFilter of channel subscription, nil if not set.
+func (c *Client) channelTagsFilter(ch string) *TagsFilter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.channels[ch].tagsFilter
+}
+
+// transformPublications applies PublicationTransformHandler to publications sent
+// to client in subscribe reply.
+func (c *Client) transformPublications(ch string, pubs []*protocol.Publication) []*protocol.Publication {
+	handler := c.node.clientEvents.publicationTransformHandler
+	if handler == nil {
+		return pubs
+	}
+	transformed := make([]*protocol.Publication, 0, len(pubs))
+	for _, pub := range pubs {
+		reply := handler(c, PublicationTransformEvent{Channel: ch, Publication: pubFromProto(pub)})
+		if reply.VariantKey == "" {
+			transformed = append(transformed, pub)
+			continue
+		}
+		transformed = append(transformed, variantPublication(pub, reply.Data))
+	}
+	return transformed
+}
+
+// writePublication writes publication to a client. Nil data means that publication
+// was filtered out for a client – it's still passed here to keep stream position.
 func (c *Client) writePublication(ch string, pub *protocol.Publication, data []byte, sp StreamPosition) error {
 	if pub.Offset == 0 {
-		if hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
+		if data == nil || hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
+			return nil
+		}
+		return c.transportEnqueue(data)
+	}
+	c.pubSubSync.SyncPublication(ch, pub, func() {
+		_ = c.writePublicationUpdatePosition(ch, pub, data, false, sp)
+	})
+	return nil
+}
+
+// writeDeltaPublication writes publication to a client subscribed with delta
+// compression. Delta argument means that data contains delta against the previous
+// channel publication.
+func (c *Client) writeDeltaPublication(ch string, pub *protocol.Publication, data []byte, delta bool, sp StreamPosition) error {
+	if pub.Offset == 0 {
+		c.mu.Lock()
+		channelContext, ok := c.channels[ch]
+		if !ok || !channelHasFlag(channelContext.flags, flagSubscribed) {
+			c.mu.Unlock()
+			return nil
+		}
+		if !c.updateDeltaReady(ch, &channelContext, data, delta) {
+			c.mu.Unlock()
+			return nil
+		}
+		c.channels[ch] = channelContext
+		c.mu.Unlock()
+		if data == nil || hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
 			return nil
 		}
 		return c.transportEnqueue(data)
 	}
 	c.pubSubSync.SyncPublication(ch, pub, func() {
-		_ = c.writePublicationUpdatePosition(ch, pub, data, sp)
+		_ = c.writePublicationUpdatePosition(ch, pub, data, delta, sp)
 	})
 	return nil
 }
 
+// writePatternPublication writes publication received over pattern subscription,
+// data contains publication encoded with concrete channel.
+func (c *Client) writePatternPublication(pattern string, data []byte) error {
+	if hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
+		return nil
+	}
+	c.mu.RLock()
+	channelContext, ok := c.channels[pattern]
+	if !ok || !channelHasFlag(channelContext.flags, flagSubscribed) || !channelHasFlag(channelContext.flags, flagPattern) {
+		c.mu.RUnlock()
+		return nil
+	}
+	c.mu.RUnlock()
+	return c.transportEnqueue(data)
+}
+
 func (c *Client) writeJoin(ch string, data []byte) error {
 	if hasFlag(c.transport.DisabledPushFlags(), PushFlagJoin) {
 		return nil
@@ -3182,10 +3772,25 @@ func (c *Client) unsubscribe(channel string, unsubscribe Unsubscribe, disconnect
 	}
 
 	if channelHasFlag(chCtx.flags, flagEmitJoinLeave) && channelHasFlag(chCtx.flags, flagSubscribed) {
-		_ = c.node.publishLeave(channel, info)
+		left := true
+		if channelHasFlag(chCtx.flags, flagJoinLeaveUserLevel) {
+			var err error
+			left, err = c.node.removeUserConnection(channel, c.user, c.uid)
+			if err != nil {
+				c.node.logger.log(newLogEntry(LogLevelError, "error removing user connection", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+			}
+		}
+		if left {
+			_ = c.node.publishLeave(channel, info)
+		}
 	}
 
-	if err := c.node.removeSubscription(channel, c); err != nil {
+	if channelHasFlag(chCtx.flags, flagPattern) {
+		if err := c.node.removePatternSubscription(channel, c); err != nil {
+			c.node.logger.log(newLogEntry(LogLevelError, "error removing pattern subscription", map[string]interface{}{"pattern": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+			return err
+		}
+	} else if err := c.node.removeSubscription(channel, c); err != nil {
 		c.node.logger.log(newLogEntry(LogLevelError, "error removing subscription", map[string]interface{}{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
 		return err
 	}
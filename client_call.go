@@ -0,0 +1,312 @@
+package centrifuge
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultClientCallTimeout used when context passed to Client.Call or
+// Node.CallClient has no deadline.
+const defaultClientCallTimeout = 10 * time.Second
+
+const clientCallOp = "centrifuge_client_call"
+
+// Survey reply codes of clientCallOp.
+const (
+	clientCallCodeNotFound uint32 = 1
+	clientCallCodeError    uint32 = 2
+	clientCallCodeTimeout  uint32 = 3
+)
+
+// clientCallReplyReserve returns a part of CallClient timeout reserved for
+// delivering reply from a remote Node, so remote call times out before Survey.
+func clientCallReplyReserve(timeout time.Duration) time.Duration {
+	reserve := timeout / 5
+	if reserve > time.Second {
+		reserve = time.Second
+	}
+	return reserve
+}
+
+// clientCall is sent to a client inside message push:
+// {"call":{"id":1,"method":"method","data":{}}}. For Protobuf transports
+// data is sent base64 encoded in b64data field.
+type clientCall struct {
+	ID      uint64          `json:"id"`
+	Method  string          `json:"method"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	B64Data string          `json:"b64data,omitempty"`
+}
+
+type clientCallEnvelope struct {
+	Call *clientCall `json:"call"`
+}
+
+// clientCallReply is expected from a client inside asynchronous message:
+// {"call_reply":{"id":1,"data":{}}} or {"call_reply":{"id":1,"error":{"code":400,"message":"oops"}}}.
+type clientCallReply struct {
+	ID      uint64           `json:"id"`
+	Data    json.RawMessage  `json:"data,omitempty"`
+	B64Data string           `json:"b64data,omitempty"`
+	Error   *clientCallError `json:"error,omitempty"`
+}
+
+type clientCallError struct {
+	Code    uint32 `json:"code"`
+	Message string `json:"message"`
+}
+
+type clientCallReplyEnvelope struct {
+	CallReply *clientCallReply `json:"call_reply"`
+}
+
+type clientCallResult struct {
+	data []byte
+	err  error
+}
+
+// Call sends a call to a client and waits for client reply. Call is sent as
+// an asynchronous message:
+//
+//	{"call":{"id":1,"method":"method","data":{}}}
+//
+// Client must answer with an asynchronous message (send command) containing
+// the same id:
+//
+//	{"call_reply":{"id":1,"data":{}}}
+//
+// or with an error:
+//
+//	{"call_reply":{"id":1,"error":{"code":400,"message":"oops"}}}
+//
+// For Protobuf transports data sent in b64data field as base64 string, and
+// client can reply using b64data field too. Call replies are not passed to
+// MessageHandler. Note, while client has calls in progress, asynchronous
+// messages which are JSON objects with call_reply field and id of a call made
+// to this client are considered call replies – so application messages must
+// not use call_reply field. Client error is returned as *Error,
+// ErrorNotAvailable is returned if client disconnected before replying. If ctx
+// has no deadline then call times out in 10 seconds.
+func (c *Client) Call(ctx context.Context, method string, data []byte) ([]byte, error) {
+	if hasFlag(c.transport.DisabledPushFlags(), PushFlagMessage) {
+		return nil, ErrorNotAvailable
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultClientCallTimeout)
+		defer cancel()
+	}
+
+	c.mu.Lock()
+	if c.status == statusClosed || !c.authenticated {
+		c.mu.Unlock()
+		return nil, ErrorNotAvailable
+	}
+	c.callID++
+	id := c.callID
+	resultCh := make(chan clientCallResult, 1)
+	if c.pendingCalls == nil {
+		c.pendingCalls = make(map[uint64]chan clientCallResult)
+	}
+	c.pendingCalls[id] = resultCh
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pendingCalls, id)
+		c.mu.Unlock()
+	}()
+
+	call := &clientCall{ID: id, Method: method}
+	if c.transport.Protocol() == ProtocolTypeJSON {
+		call.Data = data
+	} else {
+		call.B64Data = base64.StdEncoding.EncodeToString(data)
+	}
+	payload, err := json.Marshal(clientCallEnvelope{Call: call})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Send(payload); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result, ok := <-resultCh:
+		if !ok {
+			return nil, ErrorNotAvailable
+		}
+		return result.data, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var callReplyField = []byte(`"call_reply"`)
+
+// handleCallReply passes reply to a waiting Client.Call. Returns false if
+// data is not a call reply. Data is only decoded while client has calls in
+// progress, and only replies with id of a call made to this client are
+// consumed – other messages are passed to MessageHandler.
+func (c *Client) handleCallReply(data []byte) bool {
+	c.mu.RLock()
+	numPendingCalls := len(c.pendingCalls)
+	c.mu.RUnlock()
+	if numPendingCalls == 0 || !bytes.Contains(data, callReplyField) {
+		return false
+	}
+	var envelope clientCallReplyEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.CallReply == nil {
+		return false
+	}
+	reply := envelope.CallReply
+	c.mu.RLock()
+	issued := reply.ID > 0 && reply.ID <= c.callID
+	c.mu.RUnlock()
+	if !issued {
+		return false
+	}
+
+	var result clientCallResult
+	if reply.Error != nil {
+		result.err = &Error{Code: reply.Error.Code, Message: reply.Error.Message}
+	} else if reply.B64Data != "" {
+		result.data, result.err = base64.StdEncoding.DecodeString(reply.B64Data)
+	} else {
+		result.data = reply.Data
+	}
+
+	c.mu.Lock()
+	resultCh, ok := c.pendingCalls[reply.ID]
+	delete(c.pendingCalls, reply.ID)
+	c.mu.Unlock()
+	if ok {
+		resultCh <- result
+	}
+	// Late replies to timed out calls are dropped too.
+	return true
+}
+
+// failPendingCalls called on client close.
+func (c *Client) failPendingCalls() {
+	c.mu.Lock()
+	pendingCalls := c.pendingCalls
+	c.pendingCalls = nil
+	c.mu.Unlock()
+	for _, resultCh := range pendingCalls {
+		close(resultCh)
+	}
+}
+
+type clientCallRequest struct {
+	Client  string `json:"client"`
+	Method  string `json:"method"`
+	Data    []byte `json:"data,omitempty"`
+	Timeout int64  `json:"timeout"`
+}
+
+type clientCallResponse struct {
+	Data  []byte           `json:"data,omitempty"`
+	Error *clientCallError `json:"error,omitempty"`
+}
+
+// CallClient calls client with the given ID connected to any Node of a cluster
+// and waits for its reply – see Client.Call for details. If client is not
+// connected to the current Node then all running nodes are asked using Survey
+// and Node which owns the connection makes a call. In this case call timeout is
+// a bit shorter than ctx timeout to deliver reply in time. Returns
+// ErrorNotAvailable if client not found.
+func (n *Node) CallClient(ctx context.Context, clientID string, method string, data []byte) ([]byte, error) {
+	incActionCount("call_client")
+	if c, ok := n.hub.clientByID(clientID); ok {
+		return c.Call(ctx, method, data)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultClientCallTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	timeout := time.Until(deadline)
+	req, err := json.Marshal(clientCallRequest{
+		Client:  clientID,
+		Method:  method,
+		Data:    data,
+		Timeout: (timeout - clientCallReplyReserve(timeout)).Milliseconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	results, err := n.Survey(ctx, clientCallOp, req, "")
+	if err != nil {
+		return nil, err
+	}
+	for nodeID, result := range results {
+		switch result.Code {
+		case 0:
+			var resp clientCallResponse
+			if err := json.Unmarshal(result.Data, &resp); err != nil {
+				return nil, fmt.Errorf("client call: error decoding reply from node %s: %w", nodeID, err)
+			}
+			if resp.Error != nil {
+				return nil, &Error{Code: resp.Error.Code, Message: resp.Error.Message}
+			}
+			return resp.Data, nil
+		case clientCallCodeNotFound:
+		case clientCallCodeTimeout:
+			return nil, context.DeadlineExceeded
+		case clientCallCodeError:
+			return nil, errors.New(string(result.Data))
+		default:
+			return nil, fmt.Errorf("client call: unexpected reply code %d from node %s", result.Code, nodeID)
+		}
+	}
+	return nil, ErrorNotAvailable
+}
+
+// handleClientCallSurvey calls client if it's connected to current Node.
+func (n *Node) handleClientCallSurvey(e SurveyEvent, cb SurveyCallback) {
+	var req clientCallRequest
+	if err := json.Unmarshal(e.Data, &req); err != nil {
+		n.logger.log(newLogEntry(LogLevelError, "error decoding client call request", map[string]interface{}{"error": err.Error()}))
+		cb(SurveyReply{Code: clientCallCodeError, Data: []byte(err.Error())})
+		return
+	}
+	c, ok := n.hub.clientByID(req.Client)
+	if !ok {
+		cb(SurveyReply{Code: clientCallCodeNotFound})
+		return
+	}
+	// Call may take a while, do not block control message processing.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Timeout)*time.Millisecond)
+		defer cancel()
+		var resp clientCallResponse
+		data, err := c.Call(ctx, req.Method, req.Data)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				cb(SurveyReply{Code: clientCallCodeTimeout})
+				return
+			}
+			var clientErr *Error
+			if !errors.As(err, &clientErr) {
+				cb(SurveyReply{Code: clientCallCodeError, Data: []byte(err.Error())})
+				return
+			}
+			resp.Error = &clientCallError{Code: clientErr.Code, Message: clientErr.Message}
+		} else {
+			resp.Data = data
+		}
+		replyData, err := json.Marshal(resp)
+		if err != nil {
+			cb(SurveyReply{Code: clientCallCodeError, Data: []byte(err.Error())})
+			return
+		}
+		cb(SurveyReply{Data: replyData})
+	}()
+}
@@ -0,0 +1,209 @@
+package centrifuge
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+var clientCallIDRe = regexp.MustCompile(`"call":{"id":(\d+)`)
+
+func newTestCallClient(t *testing.T, node *Node, userID string) (*Client, *testTransport) {
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client, err := newClient(SetCredentials(context.Background(), &Credentials{UserID: userID}), node, transport)
+	require.NoError(t, err)
+	connectClient(t, client)
+	return client, transport
+}
+
+// answerCalls replies to all calls sent to client with the given call_reply
+// content (without id).
+func answerCalls(client *Client, transport *testTransport, reply string) {
+	go func() {
+		for data := range transport.sink {
+			for _, match := range clientCallIDRe.FindAllStringSubmatch(string(data), -1) {
+				params := []byte(`{"data":{"call_reply":{"id":` + match[1] + `,` + reply + `}}}`)
+				_ = client.dispatchCommand(&protocol.Command{Method: protocol.Command_SEND, Params: params})
+			}
+		}
+	}()
+}
+
+func TestClientCall(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	var messageReceived bool
+	node.OnConnect(func(client *Client) {
+		client.OnMessage(func(event MessageEvent) {
+			messageReceived = true
+		})
+	})
+
+	client, transport := newTestCallClient(t, node, "42")
+	answerCalls(client, transport, `"data":{"state":"ok"}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		data, err := client.Call(ctx, "capture", []byte(`{"editor":"main"}`))
+		require.NoError(t, err)
+		require.JSONEq(t, `{"state":"ok"}`, string(data))
+	}
+	require.False(t, messageReceived)
+	require.Len(t, client.pendingCalls, 0)
+}
+
+func TestClientCallError(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client, transport := newTestCallClient(t, node, "42")
+	answerCalls(client, transport, `"error":{"code":400,"message":"oops"}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.Call(ctx, "capture", nil)
+	require.Equal(t, &Error{Code: 400, Message: "oops"}, err)
+}
+
+func TestClientCallTimeout(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client, _ := newTestCallClient(t, node, "42")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Call(ctx, "capture", nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, client.pendingCalls, 0)
+}
+
+func TestClientCallClientClosed(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client, _ := newTestCallClient(t, node, "42")
+
+	go func() {
+		require.Eventually(t, func() bool {
+			client.mu.RLock()
+			defer client.mu.RUnlock()
+			return len(client.pendingCalls) == 1
+		}, time.Second, time.Millisecond)
+		_ = client.close(DisconnectForceNoReconnect)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.Call(ctx, "capture", nil)
+	require.Equal(t, ErrorNotAvailable, err)
+
+	_, err = client.Call(ctx, "capture", nil)
+	require.Equal(t, ErrorNotAvailable, err)
+}
+
+func TestNodeCallClient(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client, transport := newTestCallClient(t, node, "42")
+	answerCalls(client, transport, `"data":{"state":"ok"}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := node.CallClient(ctx, client.ID(), "capture", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"state":"ok"}`, string(data))
+
+	_, err = node.CallClient(ctx, "unknown", "capture", nil)
+	require.Equal(t, ErrorNotAvailable, err)
+}
+
+func TestNodeCallClientTwoNodes(t *testing.T) {
+	cluster := &testCluster{}
+	node1 := newTestClusterNode(t, cluster)
+	node2 := newTestClusterNode(t, cluster)
+
+	require.Eventually(t, func() bool {
+		return node1.nodes.size() == 2 && node2.nodes.size() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client, transport := newTestCallClient(t, node2, "42")
+	answerCalls(client, transport, `"data":{"state":"ok"}`)
+	errClient, errTransport := newTestCallClient(t, node2, "43")
+	answerCalls(errClient, errTransport, `"error":{"code":400,"message":"oops"}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := node1.CallClient(ctx, client.ID(), "capture", []byte(`{}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"state":"ok"}`, string(data))
+
+	_, err = node1.CallClient(ctx, errClient.ID(), "capture", nil)
+	require.Equal(t, &Error{Code: 400, Message: "oops"}, err)
+
+	_, err = node1.CallClient(ctx, "unknown", "capture", nil)
+	require.Equal(t, ErrorNotAvailable, err)
+}
+
+func TestClientCallReplyUnknownIDPassedToMessageHandler(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	messages := make(chan []byte, 1)
+	node.OnConnect(func(client *Client) {
+		client.OnMessage(func(event MessageEvent) {
+			messages <- event.Data
+		})
+	})
+
+	client, _ := newTestCallClient(t, node, "42")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go func() {
+		require.Eventually(t, func() bool {
+			client.mu.RLock()
+			defer client.mu.RUnlock()
+			return len(client.pendingCalls) == 1
+		}, time.Second, time.Millisecond)
+		params := []byte(`{"data":{"call_reply":{"id":100}}}`)
+		_ = client.dispatchCommand(&protocol.Command{Method: protocol.Command_SEND, Params: params})
+	}()
+	_, err := client.Call(ctx, "capture", nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	select {
+	case data := <-messages:
+		require.JSONEq(t, `{"call_reply":{"id":100}}`, string(data))
+	case <-time.After(time.Second):
+		require.Fail(t, "message not passed to handler")
+	}
+}
+
+func TestNodeCallClientTwoNodesTimeout(t *testing.T) {
+	cluster := &testCluster{}
+	node1 := newTestClusterNode(t, cluster)
+	node2 := newTestClusterNode(t, cluster)
+
+	require.Eventually(t, func() bool {
+		return node1.nodes.size() == 2 && node2.nodes.size() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Client never replies.
+	client, _ := newTestCallClient(t, node2, "42")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := node1.CallClient(ctx, client.ID(), "capture", nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	// Remote call timed out earlier than survey, so its reply was received.
+	require.NoError(t, ctx.Err())
+}
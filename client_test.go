@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -746,7 +748,7 @@ func testUnexpectedOffsetEpoch(t *testing.T, offset uint64, epoch string) {
 
 	err = node.handlePublication("test", &Publication{
 		Offset: offset,
-	}, StreamPosition{offset, epoch})
+	}, StreamPosition{offset, epoch}, nil)
 	require.NoError(t, err)
 
 	select {
@@ -786,7 +788,7 @@ func testUnexpectedOffsetEpochProtocolV2(t *testing.T, offset uint64, epoch stri
 
 	err = node.handlePublication("test", &Publication{
 		Offset: offset,
-	}, StreamPosition{offset, epoch})
+	}, StreamPosition{offset, epoch}, nil)
 	require.NoError(t, err)
 
 	select {
@@ -974,6 +976,294 @@ func TestClientSubscribeReceivePublicationWithOffset(t *testing.T) {
 	}
 }
 
+func TestClientSubscribeTagsFilter(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	ctx := context.Background()
+	newCtx := SetCredentials(ctx, &Credentials{UserID: "42"})
+	client, _ := newClient(newCtx, node, transport)
+
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnablePositioning: true,
+			TagsFilter:        MustParseTagsFilter(`kind = a`),
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.Nil(t, rwWrapper.replies[0].Error)
+
+	done := make(chan struct{})
+	go func() {
+		for data := range transport.sink {
+			if strings.Contains(string(data), "test message 2") {
+				require.Fail(t, "filtered publication received")
+			}
+			if strings.Contains(string(data), "test message 3") {
+				close(done)
+			}
+		}
+	}()
+
+	_, err := node.Publish("test", []byte(`{"text": "test message 1"}`), WithHistory(10, time.Minute), WithTags(map[string]string{"kind": "a"}))
+	require.NoError(t, err)
+	_, err = node.Publish("test", []byte(`{"text": "test message 2"}`), WithHistory(10, time.Minute), WithTags(map[string]string{"kind": "b"}))
+	require.NoError(t, err)
+	_, err = node.Publish("test", []byte(`{"text": "test message 3"}`), WithHistory(10, time.Minute), WithTags(map[string]string{"kind": "a"}))
+	require.NoError(t, err)
+
+	select {
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout receiving publications")
+	case <-done:
+	}
+
+	client.mu.RLock()
+	require.Equal(t, uint64(3), client.channels["test"].streamPosition.Offset)
+	client.mu.RUnlock()
+}
+
+func TestClientSubscribeRecoverTagsFilter(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	for i := 0; i < 5; i++ {
+		_, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute), WithTags(map[string]string{"n": strconv.Itoa(i)}))
+		require.NoError(t, err)
+	}
+	res, err := node.History("test")
+	require.NoError(t, err)
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+		Recover: true,
+		Epoch:   res.Epoch,
+		Offset:  0,
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnableRecovery: true,
+			TagsFilter:     MustParseTagsFilter(`n in (1, 3)`),
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.True(t, subCtx.result.Recovered)
+	require.Len(t, subCtx.result.Publications, 2)
+	require.Equal(t, uint64(2), subCtx.result.Publications[0].Offset)
+	require.Equal(t, uint64(4), subCtx.result.Publications[1].Offset)
+	require.Equal(t, uint64(5), subCtx.channelContext.streamPosition.Offset)
+}
+
+func TestClientSubscribeRecoverCompacted(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	// Offsets 1-6 with keys a, b, c, a, b, c – only 4, 5, 6 kept in history.
+	for i := 0; i < 6; i++ {
+		_, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute), WithCompactionKey(string(rune('a'+i%3))))
+		require.NoError(t, err)
+	}
+	res, err := node.History("test")
+	require.NoError(t, err)
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+		Recover: true,
+		Epoch:   res.Epoch,
+		Offset:  1,
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnableRecovery: true,
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.True(t, subCtx.result.Recovered)
+	require.Len(t, subCtx.result.Publications, 3)
+	require.Equal(t, uint64(4), subCtx.result.Publications[0].Offset)
+	require.Equal(t, uint64(6), subCtx.channelContext.streamPosition.Offset)
+}
+
+func TestClientSubscribeRecoverCompactedTrimmed(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	// History size 2 makes publications with offsets 1-3 lost.
+	for i := 0; i < 5; i++ {
+		_, err := node.Publish("test", []byte(`{}`), WithHistory(2, time.Minute), WithCompactionKey(strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+	res, err := node.History("test")
+	require.NoError(t, err)
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+		Recover: true,
+		Epoch:   res.Epoch,
+		Offset:  1,
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnableRecovery: true,
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.False(t, subCtx.result.Recovered)
+	require.Equal(t, uint64(5), subCtx.channelContext.streamPosition.Offset)
+}
+
+func TestClientSubscribeRecoverTrimmedByBytes(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	// Bytes limit allows keeping only a couple of publications so offsets 1-3 lost.
+	for i := 0; i < 5; i++ {
+		_, err := node.Publish("test", []byte(`{"data": "publication"}`), WithHistory(10, time.Minute), WithHistoryMaxBytes(60))
+		require.NoError(t, err)
+	}
+	res, err := node.History("test", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 2)
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+		Recover: true,
+		Epoch:   res.Epoch,
+		Offset:  1,
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnableRecovery: true,
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.False(t, subCtx.result.Recovered)
+	require.Equal(t, uint64(5), subCtx.channelContext.streamPosition.Offset)
+
+	client = newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	subCtx = client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+		Recover: true,
+		Epoch:   res.Epoch,
+		Offset:  3,
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnableRecovery: true,
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.True(t, subCtx.result.Recovered)
+	require.Len(t, subCtx.result.Publications, 2)
+}
+
+func TestClientSubscribeLatestPublication(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	for i := 0; i < 5; i++ {
+		_, err := node.Publish("test", []byte(`{"n": `+strconv.Itoa(i)+`}`), WithHistory(10, time.Minute))
+		require.NoError(t, err)
+	}
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnablePositioning:       true,
+			EnableLatestPublication: true,
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.True(t, subCtx.result.Positioned)
+	require.Len(t, subCtx.result.Publications, 1)
+	require.Equal(t, uint64(5), subCtx.result.Publications[0].Offset)
+	require.Equal(t, protocol.Raw(`{"n": 4}`), subCtx.result.Publications[0].Data)
+	require.Equal(t, uint64(5), subCtx.result.Offset)
+	require.Equal(t, uint64(5), subCtx.channelContext.streamPosition.Offset)
+}
+
+func TestClientSubscribeLatestPublicationTransform(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.OnPublicationTransform(func(client *Client, e PublicationTransformEvent) PublicationTransformReply {
+		return PublicationTransformReply{VariantKey: "redacted", Data: []byte(`{}`)}
+	})
+
+	_, err := node.Publish("test", []byte(`{"n": 1}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnablePositioning:       true,
+			EnableLatestPublication: true,
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.Len(t, subCtx.result.Publications, 1)
+	require.Equal(t, uint64(1), subCtx.result.Publications[0].Offset)
+	require.Equal(t, protocol.Raw(`{}`), subCtx.result.Publications[0].Data)
+}
+
+func TestClientSubscribeLatestPublicationEmptyChannel(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+		Channel: "test",
+	}, SubscribeReply{
+		Options: SubscribeOptions{
+			EnableLatestPublication: true,
+		},
+	}, &protocol.Command{}, false, rwWrapper.rw)
+	require.Nil(t, subCtx.disconnect)
+	require.False(t, subCtx.result.Positioned)
+	require.Len(t, subCtx.result.Publications, 0)
+}
+
 func TestUserConnectionLimit(t *testing.T) {
 	node := defaultTestNode()
 	node.config.UserConnectionLimit = 1
@@ -1564,12 +1854,18 @@ func TestClientPublishNotAvailable(t *testing.T) {
 type testBrokerEventHandler struct {
 	// Publication must register callback func to handle Publications received.
 	HandlePublicationFunc func(ch string, pub *Publication, sp StreamPosition) error
+	// PublicationExcludeClients must register callback func to handle Publications
+	// received with a list of excluded clients. HandlePublicationFunc used if not set.
+	HandlePublicationExcludeClientsFunc func(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error
 	// Join must register callback func to handle Join messages received.
 	HandleJoinFunc func(ch string, info *ClientInfo) error
 	// Leave must register callback func to handle Leave messages received.
 	HandleLeaveFunc func(ch string, info *ClientInfo) error
 	// Control must register callback func to handle Control data received.
 	HandleControlFunc func([]byte) error
+	// PatternPublication must register callback func to handle Publications
+	// received over pattern subscriptions.
+	HandlePatternPublicationFunc func(pattern string, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error
 }
 
 func (b *testBrokerEventHandler) HandlePublication(ch string, pub *Publication, sp StreamPosition) error {
@@ -1579,6 +1875,13 @@ func (b *testBrokerEventHandler) HandlePublication(ch string, pub *Publication,
 	return nil
 }
 
+func (b *testBrokerEventHandler) HandlePublicationExcludeClients(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+	if b.HandlePublicationExcludeClientsFunc != nil {
+		return b.HandlePublicationExcludeClientsFunc(ch, pub, sp, excludeClients)
+	}
+	return b.HandlePublication(ch, pub, sp)
+}
+
 func (b *testBrokerEventHandler) HandleJoin(ch string, info *ClientInfo) error {
 	if b.HandleJoinFunc != nil {
 		return b.HandleJoinFunc(ch, info)
@@ -1593,6 +1896,13 @@ func (b *testBrokerEventHandler) HandleLeave(ch string, info *ClientInfo) error
 	return nil
 }
 
+func (b *testBrokerEventHandler) HandlePatternPublication(pattern string, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+	if b.HandlePatternPublicationFunc != nil {
+		return b.HandlePatternPublicationFunc(pattern, ch, pub, sp, excludeClients)
+	}
+	return nil
+}
+
 func (b *testBrokerEventHandler) HandleControl(data []byte) error {
 	if b.HandleControlFunc != nil {
 		return b.HandleControlFunc(data)
@@ -1697,6 +2007,175 @@ func TestClientPublishHandler(t *testing.T) {
 	}
 }
 
+func TestClientJoinLeaveUserLevel(t *testing.T) {
+	t.Parallel()
+	node := nodeWithTestBroker()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	testBroker := node.broker.(*TestBroker)
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EmitJoinLeave: true, JoinLeaveUserLevel: true}}, nil)
+		})
+	})
+
+	client1 := newTestClient(t, node, "42")
+	connectClient(t, client1)
+	subscribeClient(t, client1, "test")
+	client2 := newTestClient(t, node, "42")
+	connectClient(t, client2)
+	subscribeClient(t, client2, "test")
+	client3 := newTestClient(t, node, "43")
+	connectClient(t, client3)
+	subscribeClient(t, client3, "test")
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&testBroker.publishJoinCount) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client1.unsubscribe("test", unsubscribeClient, nil))
+	require.EqualValues(t, 0, atomic.LoadInt32(&testBroker.publishLeaveCount))
+	require.NoError(t, client2.unsubscribe("test", unsubscribeClient, nil))
+	require.EqualValues(t, 1, atomic.LoadInt32(&testBroker.publishLeaveCount))
+	require.NoError(t, client3.unsubscribe("test", unsubscribeClient, nil))
+	require.EqualValues(t, 2, atomic.LoadInt32(&testBroker.publishLeaveCount))
+	require.EqualValues(t, 2, atomic.LoadInt32(&testBroker.publishJoinCount))
+}
+
+func TestClientJoinLeaveUserLevelSubscribeError(t *testing.T) {
+	t.Parallel()
+	node := nodeWithTestBroker()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	testBroker := node.broker.(*TestBroker)
+	testBroker.errorOnHistory = true
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{
+				EmitJoinLeave:      true,
+				JoinLeaveUserLevel: true,
+				EnablePositioning:  true,
+			}}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleSubscribe(&protocol.SubscribeRequest{
+		Channel: "test",
+	}, &protocol.Command{Id: 1}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, client.Channels(), 0)
+	// User connection of failed subscription must be removed.
+	presenceHub := node.presenceManager.(*MemoryPresenceManager).presenceHub
+	presenceHub.RLock()
+	require.Len(t, presenceHub.users, 0)
+	presenceHub.RUnlock()
+
+	// So the next subscription of user is a join.
+	testBroker.errorOnHistory = false
+	subscribeClient(t, client, "test")
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&testBroker.publishJoinCount) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, client.unsubscribe("test", unsubscribeClient, nil))
+	require.EqualValues(t, 1, atomic.LoadInt32(&testBroker.publishLeaveCount))
+}
+
+func TestClientJoinLeaveUserLevelNotAvailable(t *testing.T) {
+	t.Parallel()
+	node := nodeWithPresenceManager(NewTestPresenceManager())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EmitJoinLeave: true, JoinLeaveUserLevel: true}}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleSubscribe(&protocol.SubscribeRequest{
+		Channel: "test",
+	}, &protocol.Command{Id: 1}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, client.Channels(), 0)
+}
+
+func TestClientPublishExcludePublisher(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	newSinkClient := func(userID string) (*Client, *testTransport) {
+		transport := newTestTransport(func() {})
+		transport.sink = make(chan []byte, 100)
+		newCtx := SetCredentials(context.Background(), &Credentials{UserID: userID})
+		client, _ := newClient(newCtx, node, transport)
+		connectClient(t, client)
+		rwWrapper := testReplyWriterWrapper()
+		subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+			Channel: "test",
+		}, SubscribeReply{
+			Options: SubscribeOptions{EnablePositioning: true},
+		}, &protocol.Command{}, false, rwWrapper.rw)
+		require.Nil(t, subCtx.disconnect)
+		return client, transport
+	}
+
+	publisher, publisherTransport := newSinkClient("42")
+	_, otherTransport := newSinkClient("43")
+
+	publisher.eventHub.publishHandler = func(e PublishEvent, cb PublishCallback) {
+		cb(PublishReply{
+			Options:          PublishOptions{HistorySize: 10, HistoryTTL: time.Minute},
+			ExcludePublisher: true,
+		}, nil)
+	}
+
+	rwWrapper := testReplyWriterWrapper()
+	err := publisher.handlePublish(&protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte(`{"text": "test message 1"}`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Nil(t, rwWrapper.replies[0].Error)
+
+	_, err = node.Publish("test", []byte(`{"text": "test message 2"}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	waitMessage := func(transport *testTransport, expected string) {
+		for {
+			select {
+			case data := <-transport.sink:
+				if strings.Contains(string(data), "test message 1") && transport == publisherTransport {
+					require.Fail(t, "excluded publication received")
+				}
+				if strings.Contains(string(data), expected) {
+					return
+				}
+			case <-time.After(time.Second):
+				require.Fail(t, "timeout receiving publications")
+				return
+			}
+		}
+	}
+	waitMessage(otherTransport, "test message 1")
+	waitMessage(publisherTransport, "test message 2")
+
+	publisher.mu.RLock()
+	require.Equal(t, uint64(2), publisher.channels["test"].streamPosition.Offset)
+	publisher.mu.RUnlock()
+
+	// Exclusion is not visible in history.
+	res, err := node.History("test", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 2)
+	require.Nil(t, res.Publications[0].Tags)
+}
+
 func TestClientPublishError(t *testing.T) {
 	broker := NewTestBroker()
 	broker.errorOnPublish = true
@@ -1790,6 +2269,150 @@ func TestClientPresence(t *testing.T) {
 	require.Nil(t, rwWrapper.replies[0].Error)
 }
 
+func TestClientPresencePage(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EmitPresence: true}}, nil)
+		})
+		client.OnPresence(func(e PresenceEvent, cb PresenceCallback) {
+			page, err := node.PresencePage(e.Channel, "", 1)
+			require.NoError(t, err)
+			cb(PresenceReply{
+				Result: &PresenceResult{Presence: page.Presence},
+			}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+	subscribeClient(t, client, "test")
+	otherClient := newTestClient(t, node, "43")
+	connectClient(t, otherClient)
+	subscribeClient(t, otherClient, "test")
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handlePresence(&protocol.PresenceRequest{
+		Channel: "test",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Nil(t, rwWrapper.replies[0].Error)
+	var result protocol.PresenceResult
+	err = json.Unmarshal(rwWrapper.replies[0].Result, &result)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(result.Presence))
+}
+
+func TestClientPresencePageRPC(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	var rpcHandlerCalled bool
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EmitPresence: true}}, nil)
+		})
+		client.OnRPC(func(event RPCEvent, cb RPCCallback) {
+			rpcHandlerCalled = true
+			cb(RPCReply{}, nil)
+		})
+		client.OnPresencePage("presence_page:", func(event PresencePageEvent, cb PresencePageCallback) {
+			require.Equal(t, "test", event.Channel)
+			if event.Cursor == "forbidden" {
+				cb(PresencePageReply{}, ErrorPermissionDenied)
+				return
+			}
+			cb(PresencePageReply{}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+	subscribeClient(t, client, "test")
+	expected := map[string]struct{}{client.ID(): {}}
+	for i := 0; i < 2; i++ {
+		otherClient := newTestClient(t, node, "43")
+		connectClient(t, otherClient)
+		subscribeClient(t, otherClient, "test")
+		expected[otherClient.ID()] = struct{}{}
+	}
+
+	presence := map[string]struct{}{}
+	var cursor string
+	for i := 0; ; i++ {
+		require.Less(t, i, len(expected), "too many pages")
+		data, err := json.Marshal(map[string]interface{}{"cursor": cursor, "limit": 1})
+		require.NoError(t, err)
+		rwWrapper := testReplyWriterWrapper()
+		err = client.handleRPC(&protocol.RPCRequest{
+			Method: "presence_page:test",
+			Data:   data,
+		}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+		require.NoError(t, err)
+		require.Len(t, rwWrapper.replies, 1)
+		require.Nil(t, rwWrapper.replies[0].Error)
+		var rpcResult struct {
+			Data struct {
+				Presence map[string]json.RawMessage `json:"presence"`
+				Cursor   string                     `json:"cursor"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(rwWrapper.replies[0].Result, &rpcResult))
+		require.Len(t, rpcResult.Data.Presence, 1)
+		for clientID := range rpcResult.Data.Presence {
+			require.NotContains(t, presence, clientID)
+			presence[clientID] = struct{}{}
+		}
+		cursor = rpcResult.Data.Cursor
+		if cursor == "" {
+			break
+		}
+	}
+	require.Equal(t, expected, presence)
+	require.False(t, rpcHandlerCalled)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleRPC(&protocol.RPCRequest{
+		Method: "presence_page:test",
+		Data:   []byte(`{"cursor":"forbidden"}`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Equal(t, ErrorPermissionDenied.Code, rwWrapper.replies[0].Error.Code)
+
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRPC(&protocol.RPCRequest{
+		Method: "presence_page:test",
+		Data:   []byte(`{"limit":"1"}`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.Equal(t, DisconnectBadRequest, err)
+
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRPC(&protocol.RPCRequest{
+		Method: "presence_page:",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.Equal(t, DisconnectBadRequest, err)
+
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRPC(&protocol.RPCRequest{
+		Method: "other",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.True(t, rpcHandlerCalled)
+}
+
+func TestClientOnPresencePageEmptyPrefix(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	client := newTestClient(t, node, "42")
+	require.Panics(t, func() {
+		client.OnPresencePage("", func(event PresencePageEvent, cb PresencePageCallback) {})
+	})
+}
+
 func TestClientPresenceTakeover(t *testing.T) {
 	node := defaultNodeNoHandlers()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -2050,6 +2673,48 @@ func TestClientHistoryWithSinceAndLimit(t *testing.T) {
 	require.NotZero(t, result.Epoch)
 }
 
+func TestClientHistoryTimeRange(t *testing.T) {
+	node := defaultTestNode()
+	node.config.PublicationTimeTag = "time"
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+
+	for i := 0; i < 3; i++ {
+		_, _ = node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	}
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, _ = node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	}
+
+	client.OnHistory(func(e HistoryEvent, cb HistoryCallback) {
+		cb(HistoryReply{SinceTime: since}, nil)
+	})
+
+	connectClient(t, client)
+	subscribeClient(t, client, "test")
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleHistory(&protocol.HistoryRequest{
+		Channel: "test",
+		Limit:   -1,
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Nil(t, rwWrapper.replies[0].Error)
+	var result protocol.HistoryResult
+	err = json.Unmarshal(rwWrapper.replies[0].Result, &result)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(result.Publications))
+	require.Equal(t, uint64(4), result.Publications[0].Offset)
+	publishTime, err := strconv.ParseInt(result.Publications[0].Tags["time"], 10, 64)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, publishTime, since.UnixMilli())
+}
+
 func TestClientHistoryTakeover(t *testing.T) {
 	node := defaultTestNode()
 	node.config.HistoryMaxPublicationLimit = 2
@@ -2679,6 +3344,143 @@ func TestClientHandleRPC(t *testing.T) {
 	require.True(t, rpcHandlerCalled)
 }
 
+func TestClientSetChannelPresenceInfo(t *testing.T) {
+	t.Parallel()
+	for _, userLevel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("user_level_%t", userLevel), func(t *testing.T) {
+			node := defaultTestNode()
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			node.OnConnect(func(client *Client) {
+				client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+					cb(SubscribeReply{Options: SubscribeOptions{
+						EmitPresence:       true,
+						EmitJoinLeave:      true,
+						PushJoinLeave:      true,
+						JoinLeaveUserLevel: userLevel,
+						ChannelInfo:        []byte(`{"status":"online"}`),
+					}}, nil)
+				})
+			})
+
+			client := newTestClient(t, node, "42")
+			connectClient(t, client)
+			require.Equal(t, ErrorPermissionDenied, client.SetChannelPresenceInfo("test", []byte(`{}`)))
+			subscribeClient(t, client, "test")
+
+			transport := newTestTransport(func() {})
+			transport.sink = make(chan []byte, 100)
+			newCtx := SetCredentials(context.Background(), &Credentials{UserID: "43"})
+			otherClient, _ := newClient(newCtx, node, transport)
+			connectClient(t, otherClient)
+			subscribeClient(t, otherClient, "test")
+			// Presence info push is only sent to ProtocolVersion2 clients.
+			transport.setProtocolVersion(ProtocolVersion2)
+
+			done := make(chan string)
+			go func() {
+				for data := range transport.sink {
+					if strings.Contains(string(data), "away") {
+						done <- string(data)
+						return
+					}
+				}
+			}()
+
+			require.NoError(t, client.SetChannelPresenceInfo("test", []byte(`{"status":"away"}`)))
+
+			// Update is sent in both modes as presence info push, not as join.
+			select {
+			case <-time.After(time.Second):
+				require.Fail(t, "timeout receiving presence update")
+			case data := <-done:
+				require.Contains(t, data, `"presence_info":`)
+				require.NotContains(t, data, `"join":`)
+				require.Contains(t, data, `"client":"`+client.ID()+`"`)
+			}
+
+			res, err := node.Presence("test")
+			require.NoError(t, err)
+			require.Equal(t, []byte(`{"status":"away"}`), res.Presence[client.ID()].ChanInfo)
+			require.Equal(t, []byte(`{"status":"online"}`), res.Presence[otherClient.ID()].ChanInfo)
+			require.Equal(t, []byte(`{"status":"away"}`), client.ChannelsWithContext()["test"].info)
+		})
+	}
+}
+
+func TestClientHandlePresenceInfo(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	var rpcHandlerCalled bool
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EmitPresence: true}}, nil)
+		})
+		client.OnRPC(func(event RPCEvent, cb RPCCallback) {
+			rpcHandlerCalled = true
+			cb(RPCReply{}, nil)
+		})
+		client.OnPresenceInfo("presence:", func(event PresenceInfoEvent, cb PresenceInfoCallback) {
+			require.Equal(t, "test", event.Channel)
+			if string(event.Data) == `"forbidden"` {
+				cb(PresenceInfoReply{}, ErrorPermissionDenied)
+				return
+			}
+			cb(PresenceInfoReply{Info: []byte(`{"status":` + string(event.Data) + `}`)}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+	subscribeClient(t, client, "test")
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleRPC(&protocol.RPCRequest{
+		Method: "presence:test",
+		Data:   []byte(`"typing"`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Nil(t, rwWrapper.replies[0].Error)
+	require.False(t, rpcHandlerCalled)
+
+	res, err := node.Presence("test")
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"status":"typing"}`), res.Presence[client.ID()].ChanInfo)
+
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRPC(&protocol.RPCRequest{
+		Method: "presence:test",
+		Data:   []byte(`"forbidden"`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Equal(t, ErrorPermissionDenied.Code, rwWrapper.replies[0].Error.Code)
+
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRPC(&protocol.RPCRequest{
+		Method: "presence:",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.Equal(t, DisconnectBadRequest, err)
+
+	// Other methods still go to RPC handler.
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRPC(&protocol.RPCRequest{
+		Method: "other:test",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.True(t, rpcHandlerCalled)
+}
+
+func TestClientOnPresenceInfoEmptyPrefix(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	client := newTestClient(t, node, "42")
+	require.Panics(t, func() {
+		client.OnPresenceInfo("", func(event PresenceInfoEvent, cb PresenceInfoCallback) {})
+	})
+}
+
 func TestClientHandleSendNoHandlerSet(t *testing.T) {
 	node := defaultTestNode()
 	defer func() { _ = node.Shutdown(context.Background()) }()
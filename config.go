@@ -75,9 +75,23 @@ type Config struct {
 	// restored during the automatic recovery process. See also HistoryMaxPublicationLimit.
 	// By default, no limit used.
 	RecoveryMaxPublicationLimit int
+	// PublicationTimeTag when set makes Node deliver Publication.Time to clients
+	// inside Publication tags under this key (as a string with Unix time in
+	// milliseconds). Client protocol has no dedicated field for publication time
+	// so this is the way to expose it. Applied to real-time publications, history
+	// and recovered publications. By default, time is not sent to clients.
+	// With RedisBroker this option also makes publication time a part of PUB/SUB
+	// and history list message meta which nodes of previous versions can't parse,
+	// so set it only after all nodes were upgraded. Without it publications in
+	// Redis history lists have no time (Redis streams keep it anyway).
+	PublicationTimeTag string
 	// UseSingleFlight allows turning on mode where singleflight will be automatically used for
 	// Node.History (including recovery) and Node.Presence/Node.PresenceStats calls.
 	UseSingleFlight bool
+	// CommandRateLimit allows limiting the rate of commands sent by clients.
+	// Throttled commands get ErrorTooManyRequests in reply. By default, commands
+	// are not rate limited.
+	CommandRateLimit CommandRateLimitConfig
 }
 
 const (
@@ -0,0 +1,97 @@
+package centrifuge
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/centrifugal/protocol"
+	fdelta "github.com/shadowspore/fossil-delta"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DeltaType represents a type of delta compression applied to publications
+// sent to a subscriber.
+type DeltaType string
+
+const (
+	// DeltaTypeNone means publications are always sent with full payload.
+	DeltaTypeNone DeltaType = ""
+	// DeltaTypeFossil means publications may be sent as Fossil delta
+	// (https://fossil-scm.org/home/doc/tip/www/delta_format.wiki) against
+	// the previous publication payload in a channel.
+	DeltaTypeFossil DeltaType = "fossil"
+)
+
+// Publications sent to a client as a delta against the previous publication in
+// a channel have delta field set to true. Publications without it contain full
+// payload and must be used as a base for the following deltas. For JSON protocol
+// delta is encoded as a JSON string.
+//
+// Client protocol used here does not contain delta field in Publication message
+// yet, so it's added on encoding in a way compatible with later protocol versions:
+// as field 8 of Publication message for Protobuf and as "delta" key of
+// publication object for JSON.
+const publicationDeltaFieldNumber protowire.Number = 8
+
+var (
+	// publicationDeltaField is a Protobuf encoded delta field set to true.
+	publicationDeltaField = protowire.AppendVarint(protowire.AppendTag(nil, publicationDeltaFieldNumber, protowire.VarintType), 1)
+	// jsonDeltaField is put at the beginning of JSON publication object.
+	jsonDeltaField = []byte(`"delta":true,`)
+	// jsonPubPrefixV1 and jsonPubPrefixV2 precede publication object inside
+	// JSON push for ProtocolVersion1 and ProtocolVersion2.
+	jsonPubPrefixV1 = []byte(`"data":{`)
+	jsonPubPrefixV2 = []byte(`"pub":{`)
+)
+
+// makeDeltaPublications creates publications with a delta against previous
+// publication data for JSON and Protobuf protocols. Returns nil publications
+// if delta is not applicable for protocol type or does not reduce payload size.
+func makeDeltaPublications(prevPub, pub *protocol.Publication) (*protocol.Publication, *protocol.Publication) {
+	delta := fdelta.Create(prevPub.Data, pub.Data)
+	if len(delta) >= len(pub.Data) {
+		return nil, nil
+	}
+	protobufPub := deltaPublication(pub, delta)
+	protobufPub.ProtoReflect().SetUnknown(publicationDeltaField)
+	var jsonPub *protocol.Publication
+	// Fossil delta operates on bytes, so it's only possible to pass it as JSON
+	// string when its literal parts do not split UTF-8 sequences.
+	if utf8.Valid(delta) {
+		jsonDelta, err := json.Marshal(string(delta))
+		if err == nil && len(jsonDelta) < len(pub.Data) {
+			jsonPub = deltaPublication(pub, jsonDelta)
+		}
+	}
+	return jsonPub, protobufPub
+}
+
+func deltaPublication(pub *protocol.Publication, data []byte) *protocol.Publication {
+	return &protocol.Publication{
+		Offset: pub.Offset,
+		Data:   data,
+		Info:   pub.Info,
+		Tags:   pub.Tags,
+	}
+}
+
+// markJSONDelta sets delta field of publication inside JSON encoded push or
+// reply with push. Channel is encoded before publication and can't contain
+// unescaped quotes, so the first occurrence of prefix is a start of publication
+// object. Delta publication always has data, so it's followed by other fields.
+func markJSONDelta(data []byte, version ProtocolVersion) []byte {
+	prefix := jsonPubPrefixV2
+	if version == ProtocolVersion1 {
+		prefix = jsonPubPrefixV1
+	}
+	i := bytes.Index(data, prefix)
+	if i < 0 {
+		return data
+	}
+	i += len(prefix)
+	result := make([]byte, 0, len(data)+len(jsonDeltaField))
+	result = append(result, data[:i]...)
+	result = append(result, jsonDeltaField...)
+	return append(result, data[i:]...)
+}
@@ -0,0 +1,66 @@
+package centrifuge
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeDeltaPublications(t *testing.T) {
+	payload := strings.Repeat("x", 1000)
+	prevPub := &protocol.Publication{Data: []byte(`"` + payload + `1"`)}
+	pub := &protocol.Publication{Data: []byte(`"` + payload + `2"`), Offset: 2, Tags: map[string]string{"k": "v"}}
+
+	jsonPub, protobufPub := makeDeltaPublications(prevPub, pub)
+	require.NotNil(t, jsonPub)
+	require.NotNil(t, protobufPub)
+	require.Equal(t, uint64(2), protobufPub.Offset)
+	require.Equal(t, map[string]string{"k": "v"}, protobufPub.Tags)
+	require.Equal(t, []byte(publicationDeltaField), []byte(protobufPub.ProtoReflect().GetUnknown()))
+	require.Nil(t, pub.ProtoReflect().GetUnknown())
+
+	// Delta field is a part of Protobuf publication encoding.
+	data, err := protobufPub.MarshalVT()
+	require.NoError(t, err)
+	var decodedPub protocol.Publication
+	require.NoError(t, decodedPub.UnmarshalVT(data))
+	require.Equal(t, []byte(publicationDeltaField), []byte(decodedPub.ProtoReflect().GetUnknown()))
+
+	// Delta does not reduce size.
+	jsonPub, protobufPub = makeDeltaPublications(prevPub, &protocol.Publication{Data: []byte(`{}`)})
+	require.Nil(t, jsonPub)
+	require.Nil(t, protobufPub)
+}
+
+func TestPreparedPublicationJSONDelta(t *testing.T) {
+	pub := &protocol.Publication{Data: []byte(`"delta"`), Offset: 2, Tags: map[string]string{"delta": "user"}}
+	for _, version := range []ProtocolVersion{ProtocolVersion1, ProtocolVersion2} {
+		for _, unidirectional := range []bool{false, true} {
+			prepared := &preparedPublication{channel: `"pub":{"data":{`, jsonPub: pub, protobufPub: pub, delta: true}
+			data, err := prepared.encode(protocol.TypeJSON, version, unidirectional)
+			require.NoError(t, err)
+
+			var decoded map[string]interface{}
+			require.NoError(t, json.Unmarshal(data, &decoded))
+			if !unidirectional {
+				key := "push"
+				if version == ProtocolVersion1 {
+					key = "result"
+				}
+				decoded = decoded[key].(map[string]interface{})
+			}
+			require.Equal(t, `"pub":{"data":{`, decoded["channel"])
+			key := "pub"
+			if version == ProtocolVersion1 {
+				key = "data"
+			}
+			decodedPub := decoded[key].(map[string]interface{})
+			require.Equal(t, true, decodedPub["delta"])
+			require.Equal(t, "delta", decodedPub["data"])
+			require.Equal(t, map[string]interface{}{"delta": "user"}, decodedPub["tags"])
+		}
+	}
+}
@@ -172,6 +172,13 @@ var (
 		Reason:    "no pong",
 		Reconnect: true,
 	}
+	// DisconnectTooManyRequests issued when client exceeds command rate limits
+	// more times than allowed by CommandRateLimitConfig.DisconnectAfter.
+	DisconnectTooManyRequests = Disconnect{
+		Code:      3013,
+		Reason:    "too many requests",
+		Reconnect: true,
+	}
 )
 
 // The codes below are built-in terminal codes.
@@ -2,6 +2,7 @@ package centrifuge
 
 import (
 	"context"
+	"time"
 
 	"github.com/centrifugal/protocol"
 )
@@ -190,6 +191,10 @@ type PublishReply struct {
 	// want to make sure message successfully published to Broker on server
 	// side (otherwise only client will get an error).
 	Result *PublishResult
+
+	// ExcludePublisher if set prevents delivering publication back to a client
+	// which published it. Client IDs from Options.ExcludeClients are excluded too.
+	ExcludePublisher bool
 }
 
 // PublishCallback should be called with PublishReply or error.
@@ -256,6 +261,55 @@ type RPCCallback func(RPCReply, error)
 // RPCHandler must handle incoming command from client.
 type RPCHandler func(RPCEvent, RPCCallback)
 
+// PresenceInfoEvent contains fields related to client request to update its
+// channel presence info.
+type PresenceInfoEvent struct {
+	// Channel to update presence info in.
+	Channel string
+	// Data contains new presence info sent by client.
+	Data []byte
+}
+
+// PresenceInfoReply contains fields determining the reaction on presence info update.
+type PresenceInfoReply struct {
+	// Info allows setting presence info different from the one sent by client.
+	// Zero value means that event Data will be used.
+	Info []byte
+}
+
+// PresenceInfoCallback should be called as soon as handler decides what to do
+// with PresenceInfoEvent.
+type PresenceInfoCallback func(PresenceInfoReply, error)
+
+// PresenceInfoHandler called when client wants to update its presence info in
+// channel. See Client.OnPresenceInfo for the format of such requests.
+type PresenceInfoHandler func(PresenceInfoEvent, PresenceInfoCallback)
+
+// PresencePageEvent contains fields related to client request of presence page.
+type PresencePageEvent struct {
+	// Channel to get presence page for.
+	Channel string
+	// Cursor sent by client, empty for the first page.
+	Cursor string
+	// Limit sent by client, zero value means default limit of Node.PresencePage.
+	Limit int
+}
+
+// PresencePageReply contains fields determining the reaction on presence page request.
+type PresencePageReply struct {
+	// Result allows setting presence page sent to client. Zero value means that
+	// page returned by Node.PresencePage for event Cursor and Limit will be used.
+	Result *PresencePageResult
+}
+
+// PresencePageCallback should be called as soon as handler decides what to do
+// with PresencePageEvent.
+type PresencePageCallback func(PresencePageReply, error)
+
+// PresencePageHandler called when client requests a page of channel presence.
+// See Client.OnPresencePage for the format of such requests.
+type PresencePageHandler func(PresencePageEvent, PresencePageCallback)
+
 // MessageEvent contains fields related to message request.
 type MessageEvent struct {
 	// Data contains message untouched payload.
@@ -272,6 +326,9 @@ type PresenceEvent struct {
 
 // PresenceReply contains fields determining the reaction on presence request.
 type PresenceReply struct {
+	// Result allows setting presence sent to client instead of full channel
+	// presence. For channels with huge number of connections consider allowing
+	// clients to request presence by pages, see Client.OnPresencePage.
 	Result *PresenceResult
 }
 
@@ -306,6 +363,11 @@ type HistoryEvent struct {
 // HistoryReply contains fields determining the reaction on history request.
 type HistoryReply struct {
 	Result *HistoryResult
+	// SinceTime and UntilTime allow restricting publications returned to a client
+	// by publication time. Client protocol has no fields to pass time range so it's
+	// up to the handler to set it. Not used if Result is set.
+	SinceTime time.Time
+	UntilTime time.Time
 }
 
 // HistoryCallback should be called with HistoryReply or error.
@@ -376,6 +438,43 @@ type TransportWriteEvent struct {
 // filtering based on data content but rather tracing stuff.
 type TransportWriteHandler func(*Client, TransportWriteEvent) bool
 
+// PublicationTransformEvent contains Publication which is going to be sent to a
+// channel subscriber.
+type PublicationTransformEvent struct {
+	// Channel publication belongs to.
+	Channel string
+	// Publication to transform. Publication is shared between all subscribers
+	// and must not be modified.
+	Publication *Publication
+}
+
+// PublicationTransformReply describes a variant of Publication sent to a
+// subscriber.
+type PublicationTransformReply struct {
+	// VariantKey identifies publication variant. All subscribers with the same
+	// VariantKey get the same Data, so each variant encoded only once for all
+	// subscribers using the same protocol. Empty VariantKey means that original
+	// Publication is sent.
+	VariantKey string
+	// Data of publication variant. Ignored if VariantKey is empty. Data sent to
+	// subscribers using JSON protocol must be valid JSON – otherwise such
+	// subscribers are disconnected with DisconnectInappropriateProtocol, same as
+	// for non-JSON data of original Publication. Full Publication is not sent
+	// instead since variants are usually used to hide some data.
+	Data []byte
+}
+
+// PublicationTransformHandler allows sending different publication data to
+// different channel subscribers – for example to redact some fields depending on
+// user role. Handler is called for every subscriber receiving a publication from
+// inside Hub broadcast (without holding Hub locks), so it must be fast and must
+// not block. Since subscribers may get different data delta compression
+// (SubscribeOptions.DeltaType) is not applied to publications when handler is
+// set – subscribers with delta negotiated receive full publications. Publications
+// recovered upon subscription are transformed too, History calls are under
+// application control and are not transformed.
+type PublicationTransformHandler func(*Client, PublicationTransformEvent) PublicationTransformReply
+
 // CommandReadEvent contains protocol.Command processed by Client.
 type CommandReadEvent struct {
 	Command *protocol.Command
@@ -0,0 +1,36 @@
+package centrifuge
+
+import "strings"
+
+// handleBrokerPublication passes Publication received by Broker to event handler
+// along with a list of client IDs publication must not be delivered to.
+func handleBrokerPublication(h BrokerEventHandler, ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+	if len(excludeClients) > 0 {
+		if excludeHandler, ok := h.(ExcludeClientsBrokerEventHandler); ok {
+			return excludeHandler.HandlePublicationExcludeClients(ch, pub, sp, excludeClients)
+		}
+	}
+	return h.HandlePublication(ch, pub, sp)
+}
+
+// encodeExcludeClients encodes a list of client IDs to pass it over PUB/SUB
+// along with publication. Client IDs generated by Node never contain commas.
+func encodeExcludeClients(excludeClients []string) string {
+	return strings.Join(excludeClients, ",")
+}
+
+func decodeExcludeClients(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func isExcludedClient(excludeClients []string, clientID string) bool {
+	for _, id := range excludeClients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
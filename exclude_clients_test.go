@@ -0,0 +1,112 @@
+package centrifuge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPublicationHandler struct {
+	handlePublicationFunc func(ch string, pub *Publication, sp StreamPosition) error
+}
+
+func (h *testPublicationHandler) HandlePublication(ch string, pub *Publication, sp StreamPosition) error {
+	return h.handlePublicationFunc(ch, pub, sp)
+}
+
+func (h *testPublicationHandler) HandleJoin(string, *ClientInfo) error  { return nil }
+func (h *testPublicationHandler) HandleLeave(string, *ClientInfo) error { return nil }
+func (h *testPublicationHandler) HandleControl([]byte) error            { return nil }
+
+func TestHandleBrokerPublication(t *testing.T) {
+	var excluded []string
+	var numPublications int
+	h := &testBrokerEventHandler{
+		HandlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			numPublications++
+			return nil
+		},
+		HandlePublicationExcludeClientsFunc: func(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+			excluded = excludeClients
+			return nil
+		},
+	}
+	require.NoError(t, handleBrokerPublication(h, "test", &Publication{}, StreamPosition{}, nil))
+	require.Equal(t, 1, numPublications)
+	require.Nil(t, excluded)
+	require.NoError(t, handleBrokerPublication(h, "test", &Publication{}, StreamPosition{}, []string{"1"}))
+	require.Equal(t, 1, numPublications)
+	require.Equal(t, []string{"1"}, excluded)
+
+	// Handler which does not support exclusions still receives publication.
+	var handled bool
+	require.NoError(t, handleBrokerPublication(&testPublicationHandler{
+		handlePublicationFunc: func(ch string, pub *Publication, sp StreamPosition) error {
+			handled = true
+			return nil
+		},
+	}, "test", &Publication{}, StreamPosition{}, []string{"1"}))
+	require.True(t, handled)
+}
+
+func TestEncodeExcludeClients(t *testing.T) {
+	require.Nil(t, decodeExcludeClients(encodeExcludeClients(nil)))
+	excludeClients := decodeExcludeClients(encodeExcludeClients([]string{"1", "2"}))
+	require.Equal(t, []string{"1", "2"}, excludeClients)
+	require.True(t, isExcludedClient(excludeClients, "2"))
+	require.False(t, isExcludedClient(excludeClients, "3"))
+}
+
+func TestRedisPubSubExcludeClients(t *testing.T) {
+	data, excludeClients, ok := extractPubSubExcludeClients(pubSubMessage([]byte("__data"), 0, nil))
+	require.True(t, ok)
+	require.Nil(t, excludeClients)
+	require.Equal(t, "__data", string(data))
+
+	data, excludeClients, ok = extractPubSubExcludeClients(pubSubMessage([]byte("__data"), 100, []string{"1", "2"}))
+	require.True(t, ok)
+	require.Equal(t, []string{"1", "2"}, excludeClients)
+	require.Equal(t, "__p2:0:100:__"+"__data", string(data))
+
+	data, excludeClients, ok = extractPubSubExcludeClients([]byte(pubSubExcludeClientsPrefix([]string{"1"}) + "__p1:1:xyz__data"))
+	require.True(t, ok)
+	require.Equal(t, []string{"1"}, excludeClients)
+	require.Equal(t, "__p1:1:xyz__data", string(data))
+
+	for _, malformed := range []string{"__e:", "__e:1", "__e:x__1", "__e:5__1", "__e:-1__1"} {
+		_, _, ok = extractPubSubExcludeClients([]byte(malformed))
+		require.False(t, ok, malformed)
+	}
+}
+
+func TestMemoryBrokerPublishExcludeClients(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	var excluded []string
+	var tags map[string]string
+	e.eventHandler = &testBrokerEventHandler{
+		HandlePublicationExcludeClientsFunc: func(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+			excluded = excludeClients
+			tags = pub.Tags
+			return nil
+		},
+	}
+
+	_, err := e.Publish("test", []byte(`{}`), PublishOptions{
+		HistorySize:    10,
+		HistoryTTL:     time.Minute,
+		Tags:           map[string]string{"_exclude_clients": "user"},
+		ExcludeClients: []string{"1", "2"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2"}, excluded)
+	require.Equal(t, map[string]string{"_exclude_clients": "user"}, tags)
+
+	pubs, _, err := e.History("test", HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, map[string]string{"_exclude_clients": "user"}, pubs[0].Tags)
+}
@@ -12,6 +12,7 @@ require (
 	github.com/igm/sockjs-go/v3 v3.0.2
 	github.com/mna/redisc v1.3.2
 	github.com/prometheus/client_golang v1.13.0
+	github.com/shadowspore/fossil-delta v0.0.0-20240102155221-e3a8590b820b
 	github.com/stretchr/testify v1.8.0
 	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
 	google.golang.org/protobuf v1.28.1
@@ -0,0 +1,193 @@
+package centrifuge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// historyRecordJSON is a single line of NDJSON history export.
+type historyRecordJSON struct {
+	Channel string                 `json:"channel"`
+	Epoch   string                 `json:"epoch"`
+	Offset  uint64                 `json:"offset"`
+	Data    []byte                 `json:"data"`
+	Info    *historyRecordInfoJSON `json:"info,omitempty"`
+	Tags    map[string]string      `json:"tags,omitempty"`
+	Time    int64                  `json:"time,omitempty"`
+	Key     string                 `json:"key,omitempty"`
+}
+
+type historyRecordInfoJSON struct {
+	Client   string `json:"client"`
+	User     string `json:"user"`
+	ConnInfo []byte `json:"conn_info,omitempty"`
+	ChanInfo []byte `json:"chan_info,omitempty"`
+}
+
+func historyRecordFromPublication(ch string, epoch string, pub *Publication) historyRecordJSON {
+	r := historyRecordJSON{
+		Channel: ch,
+		Epoch:   epoch,
+		Offset:  pub.Offset,
+		Data:    pub.Data,
+		Tags:    pub.Tags,
+		Time:    pub.Time,
+		Key:     pub.CompactionKey,
+	}
+	if pub.Info != nil {
+		r.Info = &historyRecordInfoJSON{
+			Client:   pub.Info.ClientID,
+			User:     pub.Info.UserID,
+			ConnInfo: pub.Info.ConnInfo,
+			ChanInfo: pub.Info.ChanInfo,
+		}
+	}
+	return r
+}
+
+func (r historyRecordJSON) publication() *Publication {
+	pub := &Publication{
+		Offset:        r.Offset,
+		Data:          r.Data,
+		Tags:          r.Tags,
+		Time:          r.Time,
+		CompactionKey: r.Key,
+	}
+	if r.Info != nil {
+		pub.Info = &ClientInfo{
+			ClientID: r.Info.Client,
+			UserID:   r.Info.User,
+			ConnInfo: r.Info.ConnInfo,
+			ChanInfo: r.Info.ChanInfo,
+		}
+	}
+	return pub
+}
+
+// ExportHistory writes history of channels to w in NDJSON format. Each line is
+// a JSON object with channel, epoch, offset, data, info, tags, time and key
+// fields describing one publication. Binary fields (data, conn_info, chan_info)
+// are base64 encoded. Publications of a channel are written in offset order.
+func (n *Node) ExportHistory(ctx context.Context, channels []string, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	for _, ch := range channels {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result, err := n.History(ch, WithLimit(NoLimit))
+		if err != nil {
+			return fmt.Errorf("history export: error getting history of channel %s: %w", ch, err)
+		}
+		for _, pub := range result.Publications {
+			if err := encoder.Encode(historyRecordFromPublication(ch, result.Epoch, pub)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var errHistoryImportNoHistory = errors.New("history import: history size and ttl required")
+
+// ImportHistory reads history in NDJSON format produced by ExportHistory from r
+// and saves it to a Broker. Lines of one channel must go one after another in
+// offset order. History options must be passed using WithHistory, other history
+// retention options (WithHistoryMaxBytes etc.) are respected too.
+//
+// If Broker implements HistoryImporter then channel history is replaced by
+// imported publications keeping their offsets and epoch, subscribers of imported
+// channels with positioning or recovery are forced to resubscribe. Otherwise
+// publications are published into channels one by one getting new offsets.
+func (n *Node) ImportHistory(ctx context.Context, r io.Reader, opts ...PublishOption) error {
+	pubOpts := &PublishOptions{}
+	for _, opt := range opts {
+		opt(pubOpts)
+	}
+	if pubOpts.HistorySize <= 0 || pubOpts.HistoryTTL <= 0 {
+		return errHistoryImportNoHistory
+	}
+
+	decoder := json.NewDecoder(r)
+
+	var (
+		channel string
+		epoch   string
+		pubs    []*Publication
+	)
+	imported := map[string]struct{}{}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var record historyRecordJSON
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("history import: error decoding record: %w", err)
+		}
+		if record.Channel == "" {
+			return errors.New("history import: record without channel")
+		}
+		if record.Channel != channel {
+			if channel != "" {
+				if err := n.importChannelHistory(channel, pubs, epoch, *pubOpts); err != nil {
+					return err
+				}
+			}
+			if _, ok := imported[record.Channel]; ok {
+				return fmt.Errorf("history import: records of channel %s are not contiguous", record.Channel)
+			}
+			imported[record.Channel] = struct{}{}
+			channel = record.Channel
+			epoch = record.Epoch
+			pubs = pubs[:0]
+		} else if record.Epoch != epoch {
+			return fmt.Errorf("history import: records of channel %s have different epochs", channel)
+		}
+		if record.Offset == 0 {
+			return fmt.Errorf("history import: record of channel %s without offset", channel)
+		}
+		if len(pubs) > 0 && record.Offset <= pubs[len(pubs)-1].Offset {
+			return fmt.Errorf("history import: records of channel %s are not ordered by offset", channel)
+		}
+		pubs = append(pubs, record.publication())
+	}
+	if channel != "" {
+		return n.importChannelHistory(channel, pubs, epoch, *pubOpts)
+	}
+	return nil
+}
+
+func (n *Node) importChannelHistory(ch string, pubs []*Publication, epoch string, opts PublishOptions) error {
+	importer, ok := n.broker.(HistoryImporter)
+	if !ok {
+		for _, pub := range pubs {
+			pubOpts := opts
+			pubOpts.ClientInfo = pub.Info
+			pubOpts.Tags = pub.Tags
+			pubOpts.CompactionKey = pub.CompactionKey
+			incMessagesSent("publication")
+			if _, err := n.broker.Publish(ch, pub.Data, pubOpts); err != nil {
+				return fmt.Errorf("history import: error publishing into channel %s: %w", ch, err)
+			}
+		}
+		return nil
+	}
+	incActionCount("history_import")
+	var top uint64
+	if len(pubs) > 0 {
+		top = pubs[len(pubs)-1].Offset
+	}
+	sp := StreamPosition{Offset: top, Epoch: epoch}
+	if err := importer.ImportHistory(ch, pubs, sp, opts); err != nil {
+		return fmt.Errorf("history import: error importing channel %s: %w", ch, err)
+	}
+	n.hub.resetStream(ch, sp)
+	return n.pubResetStream(ch, sp)
+}
@@ -0,0 +1,113 @@
+package centrifuge
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeExportImportHistory(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	info := &ClientInfo{ClientID: "client", UserID: "42", ConnInfo: []byte(`{}`)}
+	for i := 0; i < 3; i++ {
+		_, err := node.Publish("test1", []byte(`{"n": 1}`), WithHistory(10, time.Minute), WithClientInfo(info))
+		require.NoError(t, err)
+	}
+	_, err := node.Publish("test2", []byte{0x01, 0x02}, WithHistory(10, time.Minute), WithTags(map[string]string{"k": "v"}))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = node.ExportHistory(context.Background(), []string{"test1", "test2", "test3"}, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 4, strings.Count(buf.String(), "\n"))
+
+	res1, err := node.History("test1", WithLimit(NoLimit))
+	require.NoError(t, err)
+	res2, err := node.History("test2", WithLimit(NoLimit))
+	require.NoError(t, err)
+
+	importNode := defaultNodeNoHandlers()
+	defer func() { _ = importNode.Shutdown(context.Background()) }()
+
+	err = importNode.ImportHistory(context.Background(), &buf, WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	imported1, err := importNode.History("test1", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Equal(t, res1.StreamPosition, imported1.StreamPosition)
+	require.Equal(t, res1.Publications, imported1.Publications)
+
+	imported2, err := importNode.History("test2", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Equal(t, res2.StreamPosition, imported2.StreamPosition)
+	require.Equal(t, res2.Publications, imported2.Publications)
+
+	// Publishing continues imported stream.
+	pubRes, err := importNode.Publish("test1", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, StreamPosition{Offset: 4, Epoch: res1.Epoch}, pubRes.StreamPosition)
+}
+
+func TestNodeImportHistoryNotImporter(t *testing.T) {
+	node := nodeWithTestBroker()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	data := `{"channel":"test","epoch":"xyz","offset":1,"data":"e30="}
+{"channel":"test","epoch":"xyz","offset":2,"data":"e30="}
+`
+	err := node.ImportHistory(context.Background(), strings.NewReader(data), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, node.broker.(*TestBroker).publishCount)
+}
+
+func TestNodeImportHistoryErrors(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	err := node.ImportHistory(context.Background(), strings.NewReader(""))
+	require.ErrorIs(t, err, errHistoryImportNoHistory)
+
+	testCases := []struct {
+		Name string
+		Data string
+	}{
+		{"Malformed", `{"channel":`},
+		{"NoChannel", `{"epoch":"xyz","offset":1}`},
+		{"NoOffset", `{"channel":"test","epoch":"xyz"}`},
+		{"NotOrdered", `{"channel":"test","epoch":"xyz","offset":2}
+{"channel":"test","epoch":"xyz","offset":1}`},
+		{"DifferentEpochs", `{"channel":"test","epoch":"xyz","offset":1}
+{"channel":"test","epoch":"abc","offset":2}`},
+		{"NotContiguous", `{"channel":"test","epoch":"xyz","offset":1}
+{"channel":"other","epoch":"xyz","offset":1}
+{"channel":"test","epoch":"xyz","offset":2}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := node.ImportHistory(context.Background(), strings.NewReader(tc.Data), WithHistory(10, time.Minute))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRetainImportedPublications(t *testing.T) {
+	pubs := []*Publication{
+		{Offset: 1, CompactionKey: "a"},
+		{Offset: 2},
+		{Offset: 3, CompactionKey: "a"},
+		{Offset: 4, CompactionKey: "b"},
+	}
+	retained := retainImportedPublications(pubs, 10, true)
+	require.Len(t, retained, 3)
+	require.Equal(t, uint64(2), retained[0].Offset)
+
+	retained = retainImportedPublications(pubs, 2, false)
+	require.Len(t, retained, 2)
+	require.Equal(t, uint64(3), retained[0].Offset)
+}
@@ -37,6 +37,19 @@ func (h *Hub) clientBySession(session string) (*Client, bool) {
 	return c, ok
 }
 
+// clientByID looks for a connection with the given client ID in all shards.
+func (h *Hub) clientByID(clientID string) (*Client, bool) {
+	for _, shard := range h.connShards {
+		shard.mu.RLock()
+		c, ok := shard.conns[clientID]
+		shard.mu.RUnlock()
+		if ok {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
 // shutdown unsubscribes users from all channels and disconnects them.
 func (h *Hub) shutdown(ctx context.Context) error {
 	// Limit concurrency here to prevent resource usage burst on shutdown.
@@ -118,8 +131,8 @@ func (h *Hub) disconnect(userID string, disconnect Disconnect, clientID, session
 	return h.connShards[index(userID, numHubShards)].disconnect(userID, disconnect, clientID, sessionID, whitelist)
 }
 
-func (h *Hub) addSub(ch string, c *Client) (bool, error) {
-	return h.subShards[index(ch, numHubShards)].addSub(ch, c)
+func (h *Hub) addSub(ch string, c *Client, filter *TagsFilter) (bool, error) {
+	return h.subShards[index(ch, numHubShards)].addSub(ch, c, filter)
 }
 
 // removeSub removes connection from clientHub subscriptions registry.
@@ -127,13 +140,35 @@ func (h *Hub) removeSub(ch string, c *Client) (bool, error) {
 	return h.subShards[index(ch, numHubShards)].removeSub(ch, c)
 }
 
+func (h *Hub) addPatternSub(pattern string, c *Client, filter *TagsFilter) (bool, error) {
+	return h.subShards[index(pattern, numHubShards)].addPatternSub(pattern, c, filter)
+}
+
+// removePatternSub removes connection from clientHub pattern subscriptions registry.
+func (h *Hub) removePatternSub(pattern string, c *Client) (bool, error) {
+	return h.subShards[index(pattern, numHubShards)].removePatternSub(pattern, c)
+}
+
 // BroadcastPublication sends message to all clients subscribed on a channel on the current Node.
 // Usually this is NOT what you need since in most cases you should use Node.Publish method which
 // uses a Broker to deliver publications to all Nodes in a cluster and maintains publication history
 // in a channel with incremental offset. By calling BroadcastPublication messages will only be sent
 // to the current node subscribers without any defined offset semantics.
 func (h *Hub) BroadcastPublication(ch string, pub *Publication, sp StreamPosition) error {
-	return h.subShards[index(ch, numHubShards)].broadcastPublication(ch, pubToProto(pub), sp)
+	return h.subShards[index(ch, numHubShards)].broadcastPublication(ch, pubToProto(pub), sp, nil)
+}
+
+// broadcastPublication sends publication to all channel subscribers on the current
+// Node except clients with IDs from excludeClients.
+func (h *Hub) broadcastPublication(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+	return h.subShards[index(ch, numHubShards)].broadcastPublication(ch, pubToProto(pub), sp, excludeClients)
+}
+
+// broadcastPatternPublication sends publication published to channel ch to all
+// clients subscribed on matching pattern on the current Node except clients with
+// IDs from excludeClients.
+func (h *Hub) broadcastPatternPublication(pattern string, ch string, pub *Publication, excludeClients []string) error {
+	return h.subShards[index(pattern, numHubShards)].broadcastPatternPublication(pattern, ch, pubToProto(pub), excludeClients)
 }
 
 // broadcastJoin sends message to all clients subscribed on channel.
@@ -145,11 +180,35 @@ func (h *Hub) broadcastLeave(ch string, info *ClientInfo) error {
 	return h.subShards[index(ch, numHubShards)].broadcastLeave(ch, &protocol.Leave{Info: infoToProto(info)})
 }
 
+// broadcastPresenceInfo sends presence info update to all clients subscribed on channel.
+func (h *Hub) broadcastPresenceInfo(ch string, info *ClientInfo) error {
+	return h.subShards[index(ch, numHubShards)].broadcastPresenceInfo(ch, &protocol.Join{Info: infoToProto(info)})
+}
+
+// resetStream handles channel stream reset for subscribers on the current Node.
+func (h *Hub) resetStream(ch string, sp StreamPosition) {
+	h.subShards[index(ch, numHubShards)].resetStream(ch, sp)
+}
+
 // NumSubscribers returns number of current subscribers for a given channel.
 func (h *Hub) NumSubscribers(ch string) int {
 	return h.subShards[index(ch, numHubShards)].NumSubscribers(ch)
 }
 
+// numPatternSubscribers returns number of current subscribers for a given pattern.
+func (h *Hub) numPatternSubscribers(pattern string) int {
+	return h.subShards[index(pattern, numHubShards)].numPatternSubscribers(pattern)
+}
+
+// patterns returns a slice of all patterns with subscribers.
+func (h *Hub) patterns() []string {
+	var patterns []string
+	for i := 0; i < numHubShards; i++ {
+		patterns = append(patterns, h.subShards[i].patterns()...)
+	}
+	return patterns
+}
+
 // Channels returns a slice of all active channels.
 func (h *Hub) Channels() []string {
 	channels := make([]string, 0, h.NumChannels())
@@ -473,19 +532,56 @@ func (h *connShard) NumUsers() int {
 type subShard struct {
 	mu sync.RWMutex
 	// registry to hold active subscriptions of clients to channels.
-	subs   map[string]map[string]*Client
-	logger *logger
+	subs map[string]map[string]*Client
+	// patternSubs holds pattern subscriptions of clients.
+	patternSubs map[string]map[string]*Client
+	// tagsFilters and patternTagsFilters hold tags filters of subscriptions by
+	// client ID. Only channels with at least one filter are present here, so
+	// broadcast does not look up filters of each subscriber otherwise.
+	tagsFilters        map[string]map[string]*TagsFilter
+	patternTagsFilters map[string]map[string]*TagsFilter
+	logger             *logger
+
+	deltaMu sync.Mutex
+	// deltaBases keep the last publication in channels with delta subscribers.
+	deltaBases map[string]*protocol.Publication
 }
 
 func newSubShard(logger *logger) *subShard {
 	return &subShard{
-		subs:   make(map[string]map[string]*Client),
-		logger: logger,
+		subs:               make(map[string]map[string]*Client),
+		patternSubs:        make(map[string]map[string]*Client),
+		tagsFilters:        make(map[string]map[string]*TagsFilter),
+		patternTagsFilters: make(map[string]map[string]*TagsFilter),
+		logger:             logger,
+		deltaBases:         make(map[string]*protocol.Publication),
+	}
+}
+
+func setTagsFilter(filters map[string]map[string]*TagsFilter, ch string, uid string, filter *TagsFilter) {
+	if filter == nil {
+		deleteTagsFilter(filters, ch, uid)
+		return
+	}
+	if _, ok := filters[ch]; !ok {
+		filters[ch] = make(map[string]*TagsFilter)
+	}
+	filters[ch][uid] = filter
+}
+
+func deleteTagsFilter(filters map[string]map[string]*TagsFilter, ch string, uid string) {
+	channelFilters, ok := filters[ch]
+	if !ok {
+		return
+	}
+	delete(channelFilters, uid)
+	if len(channelFilters) == 0 {
+		delete(filters, ch)
 	}
 }
 
 // addSub adds connection into clientHub subscriptions registry.
-func (h *subShard) addSub(ch string, c *Client) (bool, error) {
+func (h *subShard) addSub(ch string, c *Client, filter *TagsFilter) (bool, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -496,6 +592,7 @@ func (h *subShard) addSub(ch string, c *Client) (bool, error) {
 		h.subs[ch] = make(map[string]*Client)
 	}
 	h.subs[ch][uid] = c
+	setTagsFilter(h.tagsFilters, ch, uid, filter)
 	if !ok {
 		return true, nil
 	}
@@ -519,164 +616,348 @@ func (h *subShard) removeSub(ch string, c *Client) (bool, error) {
 
 	// actually remove subscription from hub.
 	delete(h.subs[ch], uid)
+	deleteTagsFilter(h.tagsFilters, ch, uid)
 
 	// clean up subs map if it's needed.
 	if len(h.subs[ch]) == 0 {
 		delete(h.subs, ch)
+		h.setDeltaBase(ch, nil)
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// addPatternSub adds connection into clientHub pattern subscriptions registry.
+// Returns true if this is the first subscriber of pattern.
+func (h *subShard) addPatternSub(pattern string, c *Client, filter *TagsFilter) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.patternSubs[pattern]
+	if !ok {
+		h.patternSubs[pattern] = make(map[string]*Client)
+	}
+	h.patternSubs[pattern][c.ID()] = c
+	setTagsFilter(h.patternTagsFilters, pattern, c.ID(), filter)
+	return !ok, nil
+}
+
+// removePatternSub removes connection from clientHub pattern subscriptions
+// registry. Returns true if pattern has no subscribers left.
+func (h *subShard) removePatternSub(pattern string, c *Client) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscribers, ok := h.patternSubs[pattern]
+	if !ok {
+		return true, nil
+	}
+	delete(subscribers, c.ID())
+	deleteTagsFilter(h.patternTagsFilters, pattern, c.ID())
+	if len(subscribers) == 0 {
+		delete(h.patternSubs, pattern)
+		return true, nil
+	}
+	return false, nil
+}
+
 type encodeError struct {
 	client string
 	user   string
 	error  error
 }
 
+// preparedPublication lazily encodes Publication for different client protocol
+// types and versions, so Publication encoded only once for all channel subscribers
+// using the same protocol.
+type preparedPublication struct {
+	channel     string
+	jsonPub     *protocol.Publication
+	protobufPub *protocol.Publication
+	// delta is set when publication contains delta against the previous one.
+	delta bool
+	// jsonEncodeFailed is set when publication can't be encoded to JSON.
+	jsonEncodeFailed bool
+	// data contains encoded Publication: first 4 elements for Protobuf, next
+	// 4 for JSON. Inside each group: ProtocolVersion1 reply and push, then
+	// ProtocolVersion2 reply and push.
+	data [8][]byte
+}
+
+func (p *preparedPublication) publication(protoType protocol.Type) *protocol.Publication {
+	if protoType == protocol.TypeJSON {
+		return p.jsonPub
+	}
+	return p.protobufPub
+}
+
+func (p *preparedPublication) encode(protoType protocol.Type, version ProtocolVersion, unidirectional bool) ([]byte, error) {
+	var index int
+	if protoType == protocol.TypeJSON {
+		index += 4
+	}
+	if version != ProtocolVersion1 {
+		index += 2
+	}
+	if unidirectional {
+		index++
+	}
+	if p.data[index] != nil {
+		return p.data[index], nil
+	}
+	pub := p.publication(protoType)
+	var (
+		data []byte
+		err  error
+	)
+	if version == ProtocolVersion1 {
+		data, err = protocol.EncodePublicationPush(protoType, p.channel, pub)
+		if err == nil && !unidirectional {
+			data, err = protocol.GetReplyEncoder(protoType).Encode(&protocol.Reply{Result: data})
+		}
+	} else {
+		push := &protocol.Push{Channel: p.channel, Pub: pub}
+		if unidirectional {
+			data, err = protocol.GetPushEncoder(protoType).Encode(push)
+		} else {
+			data, err = protocol.GetReplyEncoder(protoType).Encode(&protocol.Reply{Push: push})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.delta && protoType == protocol.TypeJSON {
+		// Protobuf delta publication already contains delta field.
+		data = markJSONDelta(data, version)
+	}
+	p.data[index] = data
+	return data, nil
+}
+
+// publicationVariants keeps publication variants returned by
+// PublicationTransformHandler during a broadcast, so each variant encoded only
+// once for all subscribers with the same variant key.
+type publicationVariants struct {
+	channel  string
+	pub      *protocol.Publication
+	eventPub *Publication
+	variants map[string]*preparedPublication
+}
+
+// prepared returns publication to be sent to client. The second value is false
+// if PublicationTransformHandler not set – fullPub returned in this case.
+func (v *publicationVariants) prepared(c *Client, fullPub *preparedPublication) (*preparedPublication, bool) {
+	handler := c.node.clientEvents.publicationTransformHandler
+	if handler == nil {
+		return fullPub, false
+	}
+	if v.eventPub == nil {
+		v.eventPub = pubFromProto(v.pub)
+	}
+	reply := handler(c, PublicationTransformEvent{Channel: v.channel, Publication: v.eventPub})
+	if reply.VariantKey == "" {
+		return fullPub, true
+	}
+	prepared, ok := v.variants[reply.VariantKey]
+	if !ok {
+		variantPub := variantPublication(v.pub, reply.Data)
+		prepared = &preparedPublication{channel: v.channel, jsonPub: variantPub, protobufPub: variantPub}
+		if v.variants == nil {
+			v.variants = make(map[string]*preparedPublication)
+		}
+		v.variants[reply.VariantKey] = prepared
+	}
+	return prepared, true
+}
+
+func variantPublication(pub *protocol.Publication, data []byte) *protocol.Publication {
+	return &protocol.Publication{
+		Offset: pub.Offset,
+		Data:   data,
+		Info:   pub.Info,
+		Tags:   pub.Tags,
+	}
+}
+
+// hasPublicationTransform returns true if PublicationTransformHandler is set.
+func hasPublicationTransform(subscribers map[string]*Client) bool {
+	for _, c := range subscribers {
+		return c.node.clientEvents.publicationTransformHandler != nil
+	}
+	return false
+}
+
+// copySubscribers copies subscribers and their tags filters so they can be used
+// without holding subShard lock. Lock must be held outside.
+func copySubscribers(subscribers map[string]*Client, tagsFilters map[string]*TagsFilter) (map[string]*Client, map[string]*TagsFilter) {
+	subscribersCopy := make(map[string]*Client, len(subscribers))
+	for uid, c := range subscribers {
+		subscribersCopy[uid] = c
+	}
+	var tagsFiltersCopy map[string]*TagsFilter
+	if tagsFilters != nil {
+		tagsFiltersCopy = make(map[string]*TagsFilter, len(tagsFilters))
+		for uid, filter := range tagsFilters {
+			tagsFiltersCopy[uid] = filter
+		}
+	}
+	return subscribersCopy, tagsFiltersCopy
+}
+
 // broadcastPublication sends message to all clients subscribed on channel.
-func (h *subShard) broadcastPublication(channel string, pub *protocol.Publication, sp StreamPosition) error {
+func (h *subShard) broadcastPublication(channel string, pub *protocol.Publication, sp StreamPosition, excludeClients []string) error {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-
 	channelSubscribers, ok := h.subs[channel]
 	if !ok {
+		h.mu.RUnlock()
 		return nil
 	}
+	tagsFilters := h.tagsFilters[channel]
+	if hasPublicationTransform(channelSubscribers) {
+		// PublicationTransformHandler is called for each subscriber, so broadcast
+		// works with a copy of subscribers to not block subscribe/unsubscribe.
+		channelSubscribers, tagsFilters = copySubscribers(channelSubscribers, tagsFilters)
+		h.mu.RUnlock()
+	} else {
+		defer h.mu.RUnlock()
+	}
 
 	var (
-		jsonReplyV1     []byte
-		protobufReplyV1 []byte
-		jsonReplyV2     []byte
-		protobufReplyV2 []byte
+		fullPub  = &preparedPublication{channel: channel, jsonPub: pub, protobufPub: pub}
+		deltaPub *preparedPublication
+		variants = &publicationVariants{channel: channel, pub: pub}
 
-		jsonPushV1     []byte
-		protobufPushV1 []byte
-		jsonPushV2     []byte
-		protobufPushV2 []byte
+		prevPub             = h.deltaBase(channel)
+		hasDeltaSubscribers bool
 
 		jsonEncodeErr *encodeError
 	)
 
 	for _, c := range channelSubscribers {
+		deltaEnabled, deltaReady := c.channelDeltaState(channel)
+		if deltaEnabled {
+			hasDeltaSubscribers = true
+		}
+		if isExcludedClient(excludeClients, c.uid) || (tagsFilters != nil && !tagsFilters[c.uid].Match(pub.Tags)) {
+			// Client not interested in this publication, but its position in
+			// a stream still must be updated.
+			if deltaEnabled {
+				_ = c.writeDeltaPublication(channel, pub, nil, false, sp)
+			} else {
+				_ = c.writePublication(channel, pub, nil, sp)
+			}
+			continue
+		}
 		protoType := c.Transport().Protocol().toProto()
-		if protoType == protocol.TypeJSON {
-			if jsonEncodeErr != nil {
-				go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
-				continue
+		prepared, transformed := variants.prepared(c, fullPub)
+		if protoType == protocol.TypeJSON && prepared.jsonEncodeFailed {
+			go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
+			continue
+		}
+		isDelta := false
+		// Subscribers may get different variants of publications, so delta
+		// against the previous publication can't be made when transforming.
+		if deltaReady && prevPub != nil && !transformed {
+			if deltaPub == nil {
+				jsonDeltaPub, protobufDeltaPub := makeDeltaPublications(prevPub, pub)
+				deltaPub = &preparedPublication{channel: channel, jsonPub: jsonDeltaPub, protobufPub: protobufDeltaPub, delta: true}
 			}
-			if c.transport.ProtocolVersion() == ProtocolVersion1 {
-				if c.transport.Unidirectional() {
-					if jsonPushV1 == nil {
-						pushBytes, err := protocol.EncodePublicationPush(protoType, channel, pub)
-						if err != nil {
-							jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
-							go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
-							continue
-						}
-						jsonPushV1 = pushBytes
-					}
-					_ = c.writePublication(channel, pub, jsonPushV1, sp)
-				} else {
-					if jsonReplyV1 == nil {
-						pushBytes, err := protocol.EncodePublicationPush(protoType, channel, pub)
-						if err != nil {
-							jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
-							go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
-							continue
-						}
-						reply := &protocol.Reply{Result: pushBytes}
-						jsonReplyV1, err = protocol.DefaultJsonReplyEncoder.Encode(reply)
-						if err != nil {
-							jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
-							go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
-							continue
-						}
-					}
-					_ = c.writePublication(channel, pub, jsonReplyV1, sp)
-				}
-			} else {
-				if c.transport.Unidirectional() {
-					if jsonPushV2 == nil {
-						push := &protocol.Push{Channel: channel, Pub: pub}
-						var err error
-						jsonPushV2, err = protocol.DefaultJsonPushEncoder.Encode(push)
-						if err != nil {
-							jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
-							go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
-							continue
-						}
-					}
-					_ = c.writePublication(channel, pub, jsonPushV2, sp)
-				} else {
-					if jsonReplyV2 == nil {
-						push := &protocol.Push{Channel: channel, Pub: pub}
-						var err error
-						jsonReplyV2, err = protocol.DefaultJsonReplyEncoder.Encode(&protocol.Reply{Push: push})
-						if err != nil {
-							jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
-							go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
-							continue
-						}
-					}
-					_ = c.writePublication(channel, pub, jsonReplyV2, sp)
-				}
+			if deltaPub.publication(protoType) != nil {
+				prepared = deltaPub
+				isDelta = true
 			}
-		} else if protoType == protocol.TypeProtobuf {
-			if c.transport.ProtocolVersion() == ProtocolVersion1 {
-				if c.transport.Unidirectional() {
-					if protobufPushV1 == nil {
-						pushBytes, err := protocol.EncodePublicationPush(protoType, channel, pub)
-						if err != nil {
-							return err
-						}
-						protobufPushV1 = pushBytes
-					}
-					_ = c.writePublication(channel, pub, protobufPushV1, sp)
-				} else {
-					if protobufReplyV1 == nil {
-						pushBytes, err := protocol.EncodePublicationPush(protoType, channel, pub)
-						if err != nil {
-							return err
-						}
-						reply := &protocol.Reply{Result: pushBytes}
-						protobufReplyV1, err = protocol.DefaultProtobufReplyEncoder.Encode(reply)
-						if err != nil {
-							return err
-						}
-					}
-					_ = c.writePublication(channel, pub, protobufReplyV1, sp)
+		}
+		data, err := prepared.encode(protoType, c.transport.ProtocolVersion(), c.transport.Unidirectional())
+		if err != nil {
+			if protoType == protocol.TypeJSON {
+				prepared.jsonEncodeFailed = true
+				if jsonEncodeErr == nil {
+					jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 				}
-			} else {
-				if c.transport.Unidirectional() {
-					if protobufPushV2 == nil {
-						push := &protocol.Push{Channel: channel, Pub: pub}
-						var err error
-						protobufPushV2, err = protocol.DefaultProtobufPushEncoder.Encode(push)
-						if err != nil {
-							return err
-						}
-					}
-					_ = c.writePublication(channel, pub, protobufPushV2, sp)
-				} else {
-					if protobufReplyV2 == nil {
-						push := &protocol.Push{Channel: channel, Pub: pub}
-						var err error
-						protobufReplyV2, err = protocol.DefaultProtobufReplyEncoder.Encode(&protocol.Reply{Push: push})
-						if err != nil {
-							return err
-						}
-					}
-					_ = c.writePublication(channel, pub, protobufReplyV2, sp)
+				go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
+				continue
+			}
+			// Subscribers may have different state now, so next delta can't be made.
+			h.setDeltaBase(channel, nil)
+			return err
+		}
+		if deltaEnabled {
+			_ = c.writeDeltaPublication(channel, pub, data, isDelta, sp)
+		} else {
+			_ = c.writePublication(channel, pub, data, sp)
+		}
+	}
+	if hasDeltaSubscribers {
+		h.setDeltaBase(channel, pub)
+	} else if prevPub != nil {
+		h.setDeltaBase(channel, nil)
+	}
+	if jsonEncodeErr != nil && h.logger.enabled(LogLevelWarn) {
+		// Log that we had clients with inappropriate protocol, and point to the first such client.
+		h.logger.log(NewLogEntry(LogLevelWarn, "inappropriate protocol publication", map[string]interface{}{
+			"channel": channel,
+			"user":    jsonEncodeErr.user,
+			"client":  jsonEncodeErr.client,
+			"error":   jsonEncodeErr.error,
+		}))
+	}
+	return nil
+}
+
+// broadcastPatternPublication sends publication published to channel to all
+// clients subscribed on pattern. Pattern subscriptions have no stream position
+// and delta compression, so publication is just encoded with concrete channel.
+func (h *subShard) broadcastPatternPublication(pattern string, channel string, pub *protocol.Publication, excludeClients []string) error {
+	h.mu.RLock()
+	patternSubscribers, ok := h.patternSubs[pattern]
+	if !ok {
+		h.mu.RUnlock()
+		return nil
+	}
+	tagsFilters := h.patternTagsFilters[pattern]
+	if hasPublicationTransform(patternSubscribers) {
+		patternSubscribers, tagsFilters = copySubscribers(patternSubscribers, tagsFilters)
+		h.mu.RUnlock()
+	} else {
+		defer h.mu.RUnlock()
+	}
+
+	var (
+		fullPub       = &preparedPublication{channel: channel, jsonPub: pub, protobufPub: pub}
+		variants      = &publicationVariants{channel: channel, pub: pub}
+		jsonEncodeErr *encodeError
+	)
+
+	for _, c := range patternSubscribers {
+		if isExcludedClient(excludeClients, c.uid) || (tagsFilters != nil && !tagsFilters[c.uid].Match(pub.Tags)) {
+			continue
+		}
+		protoType := c.Transport().Protocol().toProto()
+		prepared, _ := variants.prepared(c, fullPub)
+		if protoType == protocol.TypeJSON && prepared.jsonEncodeFailed {
+			go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
+			continue
+		}
+		data, err := prepared.encode(protoType, c.transport.ProtocolVersion(), c.transport.Unidirectional())
+		if err != nil {
+			if protoType == protocol.TypeJSON {
+				prepared.jsonEncodeFailed = true
+				if jsonEncodeErr == nil {
+					jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 				}
+				go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
+				continue
 			}
+			return err
 		}
+		_ = c.writePatternPublication(pattern, data)
 	}
 	if jsonEncodeErr != nil && h.logger.enabled(LogLevelWarn) {
 		// Log that we had clients with inappropriate protocol, and point to the first such client.
 		h.logger.log(NewLogEntry(LogLevelWarn, "inappropriate protocol publication", map[string]interface{}{
 			"channel": channel,
+			"pattern": pattern,
 			"user":    jsonEncodeErr.user,
 			"client":  jsonEncodeErr.client,
 			"error":   jsonEncodeErr.error,
@@ -685,6 +966,37 @@ func (h *subShard) broadcastPublication(channel string, pub *protocol.Publicatio
 	return nil
 }
 
+// deltaBase returns the previous channel publication which is used as a base
+// for delta compression.
+func (h *subShard) deltaBase(channel string) *protocol.Publication {
+	h.deltaMu.Lock()
+	defer h.deltaMu.Unlock()
+	return h.deltaBases[channel]
+}
+
+// setDeltaBase saves channel publication to be used as a base for delta
+// compression, nil publication removes base.
+func (h *subShard) setDeltaBase(channel string, pub *protocol.Publication) {
+	h.deltaMu.Lock()
+	defer h.deltaMu.Unlock()
+	if pub == nil {
+		delete(h.deltaBases, channel)
+		return
+	}
+	h.deltaBases[channel] = pub
+}
+
+// resetStream removes delta base of channel and lets positioned subscribers
+// resubscribe to get state in a new stream epoch.
+func (h *subShard) resetStream(channel string, sp StreamPosition) {
+	h.setDeltaBase(channel, nil)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, c := range h.subs[channel] {
+		c.handleStreamReset(channel, sp)
+	}
+}
+
 // broadcastJoin sends message to all clients subscribed on channel.
 func (h *subShard) broadcastJoin(channel string, join *protocol.Join) error {
 	h.mu.RLock()
@@ -835,6 +1147,67 @@ func (h *subShard) broadcastJoin(channel string, join *protocol.Join) error {
 	return nil
 }
 
+// broadcastPresenceInfo sends presence info update to all clients subscribed on
+// channel. Like joins it's only delivered to clients with PushJoinLeave.
+func (h *subShard) broadcastPresenceInfo(channel string, join *protocol.Join) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	channelSubscribers, ok := h.subs[channel]
+	if !ok {
+		return nil
+	}
+
+	var (
+		// Encoded push: JSON and Protobuf, each for bidirectional and
+		// unidirectional transports.
+		encoded       [4][]byte
+		jsonEncodeErr *encodeError
+	)
+
+	for _, c := range channelSubscribers {
+		if c.transport.ProtocolVersion() == ProtocolVersion1 {
+			continue
+		}
+		protoType := c.Transport().Protocol().toProto()
+		unidirectional := c.transport.Unidirectional()
+		var variant int
+		if protoType == protocol.TypeJSON {
+			if jsonEncodeErr != nil {
+				go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
+				continue
+			}
+			variant += 2
+		}
+		if unidirectional {
+			variant++
+		}
+		if encoded[variant] == nil {
+			data, err := encodePresenceInfoPush(protoType, channel, join, unidirectional)
+			if err != nil {
+				if protoType == protocol.TypeJSON {
+					jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
+					go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
+					continue
+				}
+				return err
+			}
+			encoded[variant] = data
+		}
+		_ = c.writeJoin(channel, encoded[variant])
+	}
+	if jsonEncodeErr != nil && h.logger.enabled(LogLevelWarn) {
+		// Log that we had clients with inappropriate protocol, and point to the first such client.
+		h.logger.log(NewLogEntry(LogLevelWarn, "inappropriate protocol presence info", map[string]interface{}{
+			"channel": channel,
+			"user":    jsonEncodeErr.user,
+			"client":  jsonEncodeErr.client,
+			"error":   jsonEncodeErr.error,
+		}))
+	}
+	return nil
+}
+
 // broadcastLeave sends message to all clients subscribed on channel.
 func (h *subShard) broadcastLeave(channel string, leave *protocol.Leave) error {
 	h.mu.RLock()
@@ -1016,6 +1389,24 @@ func (h *subShard) Channels() []string {
 	return channels
 }
 
+// numPatternSubscribers returns number of current subscribers for a given pattern.
+func (h *subShard) numPatternSubscribers(pattern string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.patternSubs[pattern])
+}
+
+// patterns returns a slice of all patterns with subscribers.
+func (h *subShard) patterns() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	patterns := make([]string, 0, len(h.patternSubs))
+	for pattern := range h.patternSubs {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
 // NumSubscribers returns number of current subscribers for a given channel.
 func (h *subShard) NumSubscribers(ch string) int {
 	h.mu.RLock()
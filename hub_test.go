@@ -1,7 +1,9 @@
 package centrifuge
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"strconv"
@@ -10,6 +12,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/centrifugal/protocol"
+	fdelta "github.com/shadowspore/fossil-delta"
 	"github.com/stretchr/testify/require"
 )
 
@@ -499,6 +503,304 @@ func TestHubBroadcastPublication(t *testing.T) {
 	}
 }
 
+func TestHubBroadcastPublicationDelta(t *testing.T) {
+	tcs := []struct {
+		name         string
+		protocolType ProtocolType
+	}{
+		{name: "JSON", protocolType: ProtocolTypeJSON},
+		{name: "Protobuf", protocolType: ProtocolTypeProtobuf},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			n := defaultTestNode()
+			defer func() { _ = n.Shutdown(context.Background()) }()
+
+			subscribe := func(deltaType DeltaType) chan []byte {
+				transport := newTestTransport(func() {})
+				transport.sink = make(chan []byte, 100)
+				transport.setProtocolType(tc.protocolType)
+				transport.setProtocolVersion(ProtocolVersion2)
+				client := newTestConnectedClientWithTransport(t, context.Background(), n, transport, "42")
+				rwWrapper := testReplyWriterWrapper()
+				subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+					Channel: "test",
+				}, SubscribeReply{
+					Options: SubscribeOptions{
+						EnablePositioning: true,
+						DeltaType:         deltaType,
+					},
+				}, &protocol.Command{}, false, rwWrapper.rw)
+				require.Nil(t, subCtx.disconnect)
+				return transport.sink
+			}
+
+			deltaSink := subscribe(DeltaTypeFossil)
+			fullSink := subscribe(DeltaTypeNone)
+
+			payload := strings.Repeat("some long data ", 100)
+			var payloads [][]byte
+			for i := 0; i < 3; i++ {
+				data := []byte(`{"n": ` + strconv.Itoa(i) + `, "payload": "` + payload + `"}`)
+				payloads = append(payloads, data)
+				_, err := n.Publish("test", data, WithHistory(10, time.Minute), WithTags(map[string]string{"k": "v"}))
+				require.NoError(t, err)
+			}
+
+			readPub := func(sink chan []byte) (*protocol.Publication, bool) {
+				for {
+					select {
+					case data := <-sink:
+						var reply protocol.Reply
+						if tc.protocolType == ProtocolTypeJSON {
+							require.NoError(t, json.Unmarshal(data, &reply))
+						} else {
+							require.NoError(t, reply.UnmarshalVT(data))
+						}
+						if reply.Push == nil || reply.Push.Pub == nil {
+							// Skip connect and subscribe replies.
+							continue
+						}
+						return reply.Push.Pub, testReplyPubDelta(t, tc.protocolType, data, reply.Push.Pub)
+					case <-time.After(2 * time.Second):
+						require.Fail(t, "timeout receiving publication")
+						return nil, false
+					}
+				}
+			}
+
+			var prevData []byte
+			for i := 0; i < 3; i++ {
+				pub, isDelta := readPub(deltaSink)
+				require.Equal(t, uint64(i+1), pub.Offset)
+				require.Equal(t, "v", pub.Tags["k"])
+				if i == 0 {
+					// First publication after subscribe must be full.
+					require.False(t, isDelta)
+					require.Equal(t, payloads[i], []byte(pub.Data))
+				} else {
+					require.True(t, isDelta)
+					delta := []byte(pub.Data)
+					if tc.protocolType == ProtocolTypeJSON {
+						var s string
+						require.NoError(t, json.Unmarshal(pub.Data, &s))
+						delta = []byte(s)
+					}
+					require.True(t, len(delta) < len(payloads[i]))
+					data, err := fdelta.Apply(prevData, delta)
+					require.NoError(t, err)
+					require.Equal(t, payloads[i], data)
+				}
+				prevData = payloads[i]
+
+				pub, isDelta = readPub(fullSink)
+				require.False(t, isDelta)
+				require.Equal(t, payloads[i], []byte(pub.Data))
+			}
+		})
+	}
+}
+
+// testReplyPubDelta reports whether publication push in encoded reply is
+// marked as delta.
+func testReplyPubDelta(t *testing.T, protocolType ProtocolType, data []byte, pub *protocol.Publication) bool {
+	if protocolType == ProtocolTypeJSON {
+		var reply struct {
+			Push struct {
+				Pub struct {
+					Delta bool `json:"delta"`
+				} `json:"pub"`
+			} `json:"push"`
+		}
+		require.NoError(t, json.Unmarshal(data, &reply))
+		return reply.Push.Pub.Delta
+	}
+	return bytes.Equal(publicationDeltaField, pub.ProtoReflect().GetUnknown())
+}
+
+func TestHubBroadcastPublicationTransform(t *testing.T) {
+	tcs := []struct {
+		name         string
+		protocolType ProtocolType
+	}{
+		{name: "JSON", protocolType: ProtocolTypeJSON},
+		{name: "Protobuf", protocolType: ProtocolTypeProtobuf},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			n := defaultTestNode()
+			defer func() { _ = n.Shutdown(context.Background()) }()
+
+			var mu sync.Mutex
+			numCalls := 0
+			n.OnPublicationTransform(func(client *Client, e PublicationTransformEvent) PublicationTransformReply {
+				mu.Lock()
+				numCalls++
+				mu.Unlock()
+				require.Equal(t, "test", e.Channel)
+				if client.UserID() == "free" {
+					return PublicationTransformReply{VariantKey: "free", Data: []byte(`{"price":null}`)}
+				}
+				return PublicationTransformReply{}
+			})
+
+			subscribe := func(userID string, deltaType DeltaType) chan []byte {
+				transport := newTestTransport(func() {})
+				transport.sink = make(chan []byte, 100)
+				transport.setProtocolType(tc.protocolType)
+				transport.setProtocolVersion(ProtocolVersion2)
+				client := newTestConnectedClientWithTransport(t, context.Background(), n, transport, userID)
+				rwWrapper := testReplyWriterWrapper()
+				subCtx := client.subscribeCmd(&protocol.SubscribeRequest{
+					Channel: "test",
+				}, SubscribeReply{
+					Options: SubscribeOptions{
+						EnablePositioning: true,
+						DeltaType:         deltaType,
+					},
+				}, &protocol.Command{}, false, rwWrapper.rw)
+				require.Nil(t, subCtx.disconnect)
+				return transport.sink
+			}
+
+			freeSinks := []chan []byte{subscribe("free", DeltaTypeNone), subscribe("free", DeltaTypeFossil)}
+			paidSink := subscribe("paid", DeltaTypeFossil)
+
+			readPub := func(sink chan []byte) (*protocol.Publication, bool) {
+				for {
+					select {
+					case data := <-sink:
+						var reply protocol.Reply
+						if tc.protocolType == ProtocolTypeJSON {
+							require.NoError(t, json.Unmarshal(data, &reply))
+						} else {
+							require.NoError(t, reply.UnmarshalVT(data))
+						}
+						if reply.Push == nil || reply.Push.Pub == nil {
+							// Skip connect and subscribe replies.
+							continue
+						}
+						return reply.Push.Pub, testReplyPubDelta(t, tc.protocolType, data, reply.Push.Pub)
+					case <-time.After(2 * time.Second):
+						require.Fail(t, "timeout receiving publication")
+						return nil, false
+					}
+				}
+			}
+
+			payload := strings.Repeat("some long data ", 100)
+			for i := 0; i < 2; i++ {
+				data := []byte(`{"price":` + strconv.Itoa(i) + `,"payload":"` + payload + `"}`)
+				_, err := n.Publish("test", data, WithHistory(10, time.Minute))
+				require.NoError(t, err)
+
+				for _, sink := range freeSinks {
+					pub, _ := readPub(sink)
+					require.Equal(t, uint64(i+1), pub.Offset)
+					require.Equal(t, `{"price":null}`, string(pub.Data))
+				}
+				// Delta is not used when publications are transformed.
+				pub, isDelta := readPub(paidSink)
+				require.Equal(t, uint64(i+1), pub.Offset)
+				require.False(t, isDelta)
+				require.Equal(t, data, []byte(pub.Data))
+			}
+			mu.Lock()
+			require.Equal(t, 6, numCalls)
+			mu.Unlock()
+		})
+	}
+}
+
+func TestHubBroadcastPublicationTransformNoLock(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	other := newTestConnectedClient(t, n, "other")
+	n.OnPublicationTransform(func(client *Client, e PublicationTransformEvent) PublicationTransformReply {
+		// Would deadlock if handler was called under subShard lock.
+		_, _ = n.hub.addSub("test", other, nil)
+		return PublicationTransformReply{}
+	})
+
+	client := newTestConnectedClient(t, n, "42")
+	subscribeClient(t, client, "test")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- n.hub.broadcastPublication("test", &Publication{Data: []byte(`{}`)}, StreamPosition{}, nil)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "broadcast blocked")
+	}
+	require.Equal(t, 2, n.hub.NumSubscribers("test"))
+}
+
+func TestHubBroadcastPublicationTransformInvalidJSON(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	n.OnPublicationTransform(func(client *Client, e PublicationTransformEvent) PublicationTransformReply {
+		return PublicationTransformReply{VariantKey: "binary", Data: []byte("\x00")}
+	})
+
+	closed := make(chan struct{})
+	transport := newTestTransport(func() { close(closed) })
+	transport.setProtocolType(ProtocolTypeJSON)
+	client := newTestConnectedClientWithTransport(t, context.Background(), n, transport, "42")
+	subscribeClient(t, client, "test")
+
+	err := n.hub.broadcastPublication("test", &Publication{Data: []byte(`{}`)}, StreamPosition{}, nil)
+	require.NoError(t, err)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "client not disconnected")
+	}
+}
+
+func TestPublicationVariants(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	pub := &protocol.Publication{Offset: 1, Data: []byte(`{"price":1}`), Tags: map[string]string{"tag": "1"}}
+	fullPub := &preparedPublication{channel: "test", jsonPub: pub, protobufPub: pub}
+	variants := &publicationVariants{channel: "test", pub: pub}
+
+	freeClient := newTestConnectedClient(t, n, "free")
+	paidClient := newTestConnectedClient(t, n, "paid")
+
+	prepared, transformed := variants.prepared(freeClient, fullPub)
+	require.False(t, transformed)
+	require.Equal(t, fullPub, prepared)
+
+	n.OnPublicationTransform(func(client *Client, e PublicationTransformEvent) PublicationTransformReply {
+		require.Equal(t, `{"price":1}`, string(e.Publication.Data))
+		if client.UserID() == "free" {
+			return PublicationTransformReply{VariantKey: "free", Data: []byte(`{}`)}
+		}
+		return PublicationTransformReply{}
+	})
+
+	prepared, transformed = variants.prepared(paidClient, fullPub)
+	require.True(t, transformed)
+	require.Equal(t, fullPub, prepared)
+
+	prepared, transformed = variants.prepared(freeClient, fullPub)
+	require.True(t, transformed)
+	require.Equal(t, `{}`, string(prepared.jsonPub.Data))
+	require.Equal(t, uint64(1), prepared.jsonPub.Offset)
+	require.Equal(t, pub.Tags, prepared.jsonPub.Tags)
+	// Variant prepared only once.
+	otherPrepared, _ := variants.prepared(newTestConnectedClient(t, n, "free"), fullPub)
+	require.Same(t, prepared, otherPrepared)
+}
+
 func TestHubBroadcastJoin(t *testing.T) {
 	tcs := []struct {
 		name            string
@@ -627,13 +929,39 @@ func TestHubShutdown(t *testing.T) {
 	require.EqualError(t, err, "context canceled")
 }
 
+func TestHubSubscriptionsTagsFilters(t *testing.T) {
+	h := newHub(nil)
+	node := defaultTestNode()
+	c1, err := newClient(context.Background(), node, newTestTransport(func() {}))
+	require.NoError(t, err)
+	c2, err := newClient(context.Background(), node, newTestTransport(func() {}))
+	require.NoError(t, err)
+
+	shard := h.subShards[index("test", numHubShards)]
+	_, _ = h.addSub("test", c1, nil)
+	require.NotContains(t, shard.tagsFilters, "test")
+	filter := MustParseTagsFilter(`a = b`)
+	_, _ = h.addSub("test", c2, filter)
+	require.Equal(t, map[string]*TagsFilter{c2.uid: filter}, shard.tagsFilters["test"])
+
+	_, _ = h.removeSub("test", c2)
+	require.NotContains(t, shard.tagsFilters, "test")
+	_, _ = h.removeSub("test", c1)
+
+	patternShard := h.subShards[index("test.*", numHubShards)]
+	_, _ = h.addPatternSub("test.*", c1, filter)
+	require.Contains(t, patternShard.patternTagsFilters, "test.*")
+	_, _ = h.removePatternSub("test.*", c1)
+	require.NotContains(t, patternShard.patternTagsFilters, "test.*")
+}
+
 func TestHubSubscriptions(t *testing.T) {
 	h := newHub(nil)
 	c, err := newClient(context.Background(), defaultTestNode(), newTestTransport(func() {}))
 	require.NoError(t, err)
 
-	_, _ = h.addSub("test1", c)
-	_, _ = h.addSub("test2", c)
+	_, _ = h.addSub("test1", c, nil)
+	_, _ = h.addSub("test2", c, nil)
 	require.Equal(t, 2, h.NumChannels())
 	require.Contains(t, h.Channels(), "test1")
 	require.Contains(t, h.Channels(), "test2")
@@ -698,7 +1026,7 @@ func TestHubSharding(t *testing.T) {
 			require.NoError(t, err)
 			_ = n.hub.add(c)
 			for _, ch := range channels {
-				_, _ = n.hub.addSub(ch, c)
+				_, _ = n.hub.addSub(ch, c, nil)
 			}
 		}
 	}
@@ -738,7 +1066,7 @@ func BenchmarkHub_Contention(b *testing.B) {
 		_ = n.hub.add(c)
 		clients = append(clients, c)
 		for _, ch := range channels {
-			_, _ = n.hub.addSub(ch, c)
+			_, _ = n.hub.addSub(ch, c, nil)
 		}
 	}
 
@@ -758,7 +1086,7 @@ func BenchmarkHub_Contention(b *testing.B) {
 				defer wg.Done()
 				_ = n.hub.BroadcastPublication(channels[(i+numChannels/2)%numChannels], pub, streamPosition)
 			}()
-			_, _ = n.hub.addSub(channels[i%numChannels], clients[i%numClients])
+			_, _ = n.hub.addSub(channels[i%numChannels], clients[i%numClients], nil)
 			wg.Wait()
 		}
 	})
@@ -800,7 +1128,7 @@ func BenchmarkHub_MassiveBroadcast(b *testing.B) {
 				require.NoError(b, err)
 				_ = n.hub.add(c)
 				for _, ch := range channels {
-					_, _ = n.hub.addSub(ch, c)
+					_, _ = n.hub.addSub(ch, c, nil)
 				}
 			}
 
@@ -0,0 +1,472 @@
+// Package brokertest contains behavioral tests every Broker implementation must
+// pass. Tests are shared by Broker implementations of this repository.
+package brokertest
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/stretchr/testify/require"
+)
+
+// NewBroker creates Broker with a new Node. Broker must not be running – tests
+// call Broker.Run with their own BrokerEventHandler. Brokers created by one
+// NewBroker must not share channels with each other.
+type NewBroker func(t *testing.T) centrifuge.Broker
+
+// NewNode creates Node to pass to Broker constructor in NewBroker.
+func NewNode(t *testing.T, config centrifuge.Config) *centrifuge.Node {
+	config.LogLevel = centrifuge.LogLevelDebug
+	config.LogHandler = func(entry centrifuge.LogEntry) {}
+	node, err := centrifuge.New(config)
+	require.NoError(t, err)
+	return node
+}
+
+// Run runs all Broker tests, each test uses a separate Broker created by newBroker.
+func Run(t *testing.T, newBroker NewBroker) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, b centrifuge.Broker, h *eventHandler)
+	}{
+		{"PublishHistory", testPublishHistory},
+		{"SubscribeUnsubscribe", testSubscribeUnsubscribe},
+		{"ExcludeClients", testExcludeClients},
+		{"Recover", testRecover},
+		{"HistoryTagsFilter", testHistoryTagsFilter},
+		{"HistoryTimeFilter", testHistoryTimeFilter},
+		{"HistoryIteration", testHistoryIteration},
+		{"HistoryIterationReverse", testHistoryIterationReverse},
+		{"IdempotentPublish", testIdempotentPublish},
+		{"ResetStream", testResetStream},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBroker(t)
+			h := newEventHandler()
+			require.NoError(t, b.Run(h))
+			if closer, ok := b.(centrifuge.Closer); ok {
+				t.Cleanup(func() { _ = closer.Close(context.Background()) })
+			}
+			tt.test(t, b, h)
+		})
+	}
+}
+
+type publication struct {
+	channel        string
+	pub            *centrifuge.Publication
+	sp             centrifuge.StreamPosition
+	excludeClients []string
+}
+
+// eventHandler passes events received from Broker to channels.
+type eventHandler struct {
+	publications chan publication
+	joins        chan *centrifuge.ClientInfo
+	leaves       chan *centrifuge.ClientInfo
+}
+
+var _ centrifuge.ExcludeClientsBrokerEventHandler = (*eventHandler)(nil)
+
+func newEventHandler() *eventHandler {
+	return &eventHandler{
+		publications: make(chan publication, 1024),
+		joins:        make(chan *centrifuge.ClientInfo, 1024),
+		leaves:       make(chan *centrifuge.ClientInfo, 1024),
+	}
+}
+
+func (h *eventHandler) HandlePublication(ch string, pub *centrifuge.Publication, sp centrifuge.StreamPosition) error {
+	h.publications <- publication{channel: ch, pub: pub, sp: sp}
+	return nil
+}
+
+func (h *eventHandler) HandlePublicationExcludeClients(ch string, pub *centrifuge.Publication, sp centrifuge.StreamPosition, excludeClients []string) error {
+	h.publications <- publication{channel: ch, pub: pub, sp: sp, excludeClients: excludeClients}
+	return nil
+}
+
+func (h *eventHandler) HandleJoin(_ string, info *centrifuge.ClientInfo) error {
+	h.joins <- info
+	return nil
+}
+
+func (h *eventHandler) HandleLeave(_ string, info *centrifuge.ClientInfo) error {
+	h.leaves <- info
+	return nil
+}
+
+func (h *eventHandler) HandleControl(_ []byte) error {
+	return nil
+}
+
+const waitTimeout = 5 * time.Second
+
+func (h *eventHandler) waitPublication(t *testing.T) publication {
+	t.Helper()
+	select {
+	case p := <-h.publications:
+		return p
+	case <-time.After(waitTimeout):
+		require.Fail(t, "timeout waiting for publication")
+		return publication{}
+	}
+}
+
+func historyOptions(size int) centrifuge.PublishOptions {
+	return centrifuge.PublishOptions{HistorySize: size, HistoryTTL: time.Minute}
+}
+
+var data = []byte(`{}`)
+
+func testPublishHistory(t *testing.T, b centrifuge.Broker, _ *eventHandler) {
+	_, err := b.Publish("channel", data, centrifuge.PublishOptions{})
+	require.NoError(t, err)
+	require.NoError(t, b.PublishJoin("channel", &centrifuge.ClientInfo{}))
+	require.NoError(t, b.PublishLeave("channel", &centrifuge.ClientInfo{}))
+
+	sp, err := b.Publish("channel", data, historyOptions(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sp.Offset)
+	require.NotEmpty(t, sp.Epoch)
+	pubs, streamTop, err := b.History("channel", centrifuge.HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Equal(t, sp, streamTop)
+	require.Len(t, pubs, 1)
+	require.Equal(t, data, pubs[0].Data)
+	require.Equal(t, uint64(1), pubs[0].Offset)
+
+	// History limit.
+	for i := 0; i < 3; i++ {
+		_, err = b.Publish("channel", data, historyOptions(4))
+		require.NoError(t, err)
+	}
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+
+	// History limit greater than history size.
+	for i := 0; i < 3; i++ {
+		_, err = b.Publish("channel", data, historyOptions(1))
+		require.NoError(t, err)
+	}
+	pubs, streamTop, err = b.History("channel", centrifuge.HistoryFilter{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, uint64(7), pubs[0].Offset)
+	require.Equal(t, centrifuge.StreamPosition{Offset: 7, Epoch: sp.Epoch}, streamTop)
+
+	// Channel without history.
+	pubs, streamTop, err = b.History("other", centrifuge.HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	require.Zero(t, streamTop.Offset)
+}
+
+func testSubscribeUnsubscribe(t *testing.T, b centrifuge.Broker, h *eventHandler) {
+	require.NoError(t, b.Subscribe("channel"))
+
+	sp, err := b.Publish("channel", data, centrifuge.PublishOptions{
+		HistorySize: 10,
+		HistoryTTL:  time.Minute,
+		Tags:        map[string]string{"k": "v"},
+		ClientInfo:  &centrifuge.ClientInfo{ClientID: "1", UserID: "42"},
+	})
+	require.NoError(t, err)
+	p := h.waitPublication(t)
+	require.Equal(t, "channel", p.channel)
+	require.Equal(t, sp, p.sp)
+	require.Equal(t, sp.Offset, p.pub.Offset)
+	require.Equal(t, data, p.pub.Data)
+	require.Equal(t, "v", p.pub.Tags["k"])
+	require.Equal(t, "42", p.pub.Info.UserID)
+	require.NotZero(t, p.pub.Time)
+	require.Nil(t, p.excludeClients)
+
+	_, err = b.Publish("channel", data, centrifuge.PublishOptions{})
+	require.NoError(t, err)
+	p = h.waitPublication(t)
+	require.Zero(t, p.sp.Offset)
+
+	require.NoError(t, b.PublishJoin("channel", &centrifuge.ClientInfo{ClientID: "1", UserID: "42"}))
+	select {
+	case info := <-h.joins:
+		require.Equal(t, "42", info.UserID)
+	case <-time.After(waitTimeout):
+		require.Fail(t, "timeout waiting for join")
+	}
+
+	require.NoError(t, b.PublishLeave("channel", &centrifuge.ClientInfo{ClientID: "1", UserID: "42"}))
+	select {
+	case info := <-h.leaves:
+		require.Equal(t, "1", info.ClientID)
+	case <-time.After(waitTimeout):
+		require.Fail(t, "timeout waiting for leave")
+	}
+
+	require.NoError(t, b.Unsubscribe("channel"))
+}
+
+func testExcludeClients(t *testing.T, b centrifuge.Broker, h *eventHandler) {
+	require.NoError(t, b.Subscribe("channel"))
+
+	tags := map[string]string{"k": "v"}
+	for _, opts := range []centrifuge.PublishOptions{
+		{Tags: tags, ExcludeClients: []string{"1", "2"}},
+		{Tags: tags, ExcludeClients: []string{"1", "2"}, HistorySize: 10, HistoryTTL: time.Minute},
+	} {
+		_, err := b.Publish("channel", data, opts)
+		require.NoError(t, err)
+		p := h.waitPublication(t)
+		require.Equal(t, []string{"1", "2"}, p.excludeClients)
+		require.Equal(t, tags, p.pub.Tags)
+	}
+
+	pubs, _, err := b.History("channel", centrifuge.HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, tags, pubs[0].Tags)
+}
+
+func testRecover(t *testing.T, b centrifuge.Broker, _ *eventHandler) {
+	for i := 0; i < 5; i++ {
+		_, err := b.Publish("channel", data, historyOptions(10))
+		require.NoError(t, err)
+	}
+
+	_, streamTop, err := b.History("channel", centrifuge.HistoryFilter{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), streamTop.Offset)
+
+	pubs, _, err := b.History("channel", centrifuge.HistoryFilter{
+		Limit: -1,
+		Since: &centrifuge.StreamPosition{Offset: 2, Epoch: streamTop.Epoch},
+	})
+	require.NoError(t, err)
+	require.Len(t, pubs, 3)
+	require.Equal(t, uint64(3), pubs[0].Offset)
+	require.Equal(t, uint64(4), pubs[1].Offset)
+	require.Equal(t, uint64(5), pubs[2].Offset)
+
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{
+		Limit:   2,
+		Since:   &centrifuge.StreamPosition{Offset: 4, Epoch: streamTop.Epoch},
+		Reverse: true,
+	})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	require.Equal(t, uint64(3), pubs[0].Offset)
+	require.Equal(t, uint64(2), pubs[1].Offset)
+
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{
+		Limit: -1,
+		Since: &centrifuge.StreamPosition{Offset: 5, Epoch: streamTop.Epoch},
+	})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+
+	for i := 0; i < 10; i++ {
+		_, err := b.Publish("channel", data, historyOptions(10))
+		require.NoError(t, err)
+	}
+
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{
+		Limit: -1,
+		Since: &centrifuge.StreamPosition{Offset: 0, Epoch: streamTop.Epoch},
+	})
+	require.NoError(t, err)
+	require.Len(t, pubs, 10)
+	require.Equal(t, uint64(6), pubs[0].Offset)
+
+	require.NoError(t, b.RemoveHistory("channel"))
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{
+		Limit: -1,
+		Since: &centrifuge.StreamPosition{Offset: 2, Epoch: streamTop.Epoch},
+	})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+}
+
+func testHistoryTagsFilter(t *testing.T, b centrifuge.Broker, _ *eventHandler) {
+	for i := 0; i < 10; i++ {
+		opts := historyOptions(10)
+		opts.Tags = map[string]string{"parity": "even"}
+		if i%2 == 1 {
+			opts.Tags["parity"] = "odd"
+		}
+		_, err := b.Publish("channel", data, opts)
+		require.NoError(t, err)
+	}
+
+	filter := centrifuge.MustParseTagsFilter(`parity = odd`)
+	pubs, sp, err := b.History("channel", centrifuge.HistoryFilter{Limit: -1, TagsFilter: filter})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), sp.Offset)
+	require.Len(t, pubs, 5)
+
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{Limit: 2, TagsFilter: filter})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	require.Equal(t, uint64(2), pubs[0].Offset)
+	require.Equal(t, uint64(4), pubs[1].Offset)
+
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{Limit: 2, Reverse: true, TagsFilter: filter})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+	require.Equal(t, uint64(10), pubs[0].Offset)
+	require.Equal(t, uint64(8), pubs[1].Offset)
+}
+
+func testHistoryTimeFilter(t *testing.T, b centrifuge.Broker, _ *eventHandler) {
+	for i := 0; i < 2; i++ {
+		_, err := b.Publish("channel", data, historyOptions(10))
+		require.NoError(t, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		_, err := b.Publish("channel", data, historyOptions(10))
+		require.NoError(t, err)
+	}
+
+	pubs, _, err := b.History("channel", centrifuge.HistoryFilter{Limit: -1, SinceTime: middle})
+	require.NoError(t, err)
+	require.Len(t, pubs, 3)
+	require.Equal(t, uint64(3), pubs[0].Offset)
+
+	pubs, _, err = b.History("channel", centrifuge.HistoryFilter{Limit: -1, UntilTime: middle})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+}
+
+const (
+	iterationNumPublications = 1000
+	iterationLimit           = 100
+)
+
+func publishIteration(t *testing.T, b centrifuge.Broker) {
+	for i := 0; i < iterationNumPublications; i++ {
+		_, err := b.Publish("channel", []byte(`{"n":`+strconv.Itoa(i)+`}`), historyOptions(iterationNumPublications))
+		require.NoError(t, err)
+	}
+}
+
+func testHistoryIteration(t *testing.T, b centrifuge.Broker, _ *eventHandler) {
+	publishIteration(t, b)
+	_, sp, err := b.History("channel", centrifuge.HistoryFilter{})
+	require.NoError(t, err)
+
+	var offset uint64
+	var n int
+	for {
+		pubs, _, err := b.History("channel", centrifuge.HistoryFilter{
+			Since: &centrifuge.StreamPosition{Offset: offset, Epoch: sp.Epoch},
+			Limit: iterationLimit,
+		})
+		require.NoError(t, err)
+		if len(pubs) == 0 {
+			break
+		}
+		for _, pub := range pubs {
+			require.Equal(t, offset+1, pub.Offset)
+			offset = pub.Offset
+		}
+		n += len(pubs)
+	}
+	require.Equal(t, iterationNumPublications, n)
+}
+
+func testHistoryIterationReverse(t *testing.T, b centrifuge.Broker, _ *eventHandler) {
+	publishIteration(t, b)
+	_, sp, err := b.History("channel", centrifuge.HistoryFilter{})
+	require.NoError(t, err)
+
+	var since *centrifuge.StreamPosition
+	offset := sp.Offset + 1
+	var n int
+	for {
+		pubs, _, err := b.History("channel", centrifuge.HistoryFilter{
+			Since:   since,
+			Limit:   iterationLimit,
+			Reverse: true,
+		})
+		require.NoError(t, err)
+		if len(pubs) == 0 {
+			break
+		}
+		for _, pub := range pubs {
+			require.Equal(t, offset-1, pub.Offset)
+			offset = pub.Offset
+		}
+		n += len(pubs)
+		since = &centrifuge.StreamPosition{Offset: offset, Epoch: sp.Epoch}
+	}
+	require.Equal(t, iterationNumPublications, n)
+}
+
+func testIdempotentPublish(t *testing.T, b centrifuge.Broker, h *eventHandler) {
+	require.NoError(t, b.Subscribe("channel"))
+
+	opts := historyOptions(10)
+	opts.IdempotencyKey = "test"
+	opts.IdempotentResultTTL = time.Minute
+	sp1, err := b.Publish("channel", data, opts)
+	require.NoError(t, err)
+	sp2, err := b.Publish("channel", data, opts)
+	require.NoError(t, err)
+	require.Equal(t, sp1, sp2)
+
+	pubs, sp, err := b.History("channel", centrifuge.HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 1)
+	require.Equal(t, sp1, sp)
+
+	// Without history.
+	opts = centrifuge.PublishOptions{IdempotencyKey: "test_no_history", IdempotentResultTTL: time.Minute}
+	_, err = b.Publish("channel", data, opts)
+	require.NoError(t, err)
+	_, err = b.Publish("channel", data, opts)
+	require.NoError(t, err)
+	// Publication with other data makes sure all previous publications processed.
+	_, err = b.Publish("channel", []byte(`{"last":true}`), centrifuge.PublishOptions{})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, data, h.waitPublication(t).pub.Data)
+	}
+	require.Equal(t, []byte(`{"last":true}`), h.waitPublication(t).pub.Data)
+}
+
+func testResetStream(t *testing.T, b centrifuge.Broker, _ *eventHandler) {
+	resetter, ok := b.(centrifuge.StreamResetter)
+	if !ok {
+		t.Skip("Broker does not implement StreamResetter")
+	}
+	for i := 0; i < 3; i++ {
+		_, err := b.Publish("channel", data, historyOptions(10))
+		require.NoError(t, err)
+	}
+	_, sp, err := b.History("channel", centrifuge.HistoryFilter{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), sp.Offset)
+
+	resetSP, err := resetter.ResetStream("channel")
+	require.NoError(t, err)
+	require.Zero(t, resetSP.Offset)
+	require.NotEqual(t, sp.Epoch, resetSP.Epoch)
+
+	pubs, sp, err := b.History("channel", centrifuge.HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	require.Equal(t, resetSP, sp)
+
+	pos, err := b.Publish("channel", data, historyOptions(10))
+	require.NoError(t, err)
+	require.Equal(t, centrifuge.StreamPosition{Offset: 1, Epoch: resetSP.Epoch}, pos)
+}
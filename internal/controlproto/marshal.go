@@ -13,6 +13,8 @@ type Encoder interface {
 	EncodeSurveyResponse(request *controlpb.SurveyResponse) ([]byte, error)
 	EncodeNotification(request *controlpb.Notification) ([]byte, error)
 	EncodeRefresh(refresh *controlpb.Refresh) ([]byte, error)
+	EncodeResetStream(resetStream *controlpb.ResetStream) ([]byte, error)
+	EncodePresenceInfo(presenceInfo *controlpb.PresenceInfo) ([]byte, error)
 }
 
 var _ Encoder = (*ProtobufEncoder)(nil)
@@ -69,3 +71,13 @@ func (e *ProtobufEncoder) EncodeNotification(cmd *controlpb.Notification) ([]byt
 func (e *ProtobufEncoder) EncodeRefresh(cmd *controlpb.Refresh) ([]byte, error) {
 	return cmd.MarshalVT()
 }
+
+// EncodeResetStream ...
+func (e *ProtobufEncoder) EncodeResetStream(cmd *controlpb.ResetStream) ([]byte, error) {
+	return cmd.MarshalVT()
+}
+
+// EncodePresenceInfo ...
+func (e *ProtobufEncoder) EncodePresenceInfo(cmd *controlpb.PresenceInfo) ([]byte, error) {
+	return cmd.MarshalVT()
+}
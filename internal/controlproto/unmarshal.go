@@ -13,6 +13,8 @@ type Decoder interface {
 	DecodeSurveyResponse([]byte) (*controlpb.SurveyResponse, error)
 	DecodeNotification([]byte) (*controlpb.Notification, error)
 	DecodeRefresh([]byte) (*controlpb.Refresh, error)
+	DecodeResetStream([]byte) (*controlpb.ResetStream, error)
+	DecodePresenceInfo([]byte) (*controlpb.PresenceInfo, error)
 }
 
 var _ Decoder = (*ProtobufDecoder)(nil)
@@ -114,3 +116,23 @@ func (e *ProtobufDecoder) DecodeRefresh(data []byte) (*controlpb.Refresh, error)
 	}
 	return &cmd, nil
 }
+
+// DecodeResetStream ...
+func (e *ProtobufDecoder) DecodeResetStream(data []byte) (*controlpb.ResetStream, error) {
+	var cmd controlpb.ResetStream
+	err := cmd.UnmarshalVT(data)
+	if err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+// DecodePresenceInfo ...
+func (e *ProtobufDecoder) DecodePresenceInfo(data []byte) (*controlpb.PresenceInfo, error) {
+	var cmd controlpb.PresenceInfo
+	err := cmd.UnmarshalVT(data)
+	if err != nil {
+		return nil, err
+	}
+	return &cmd, nil
+}
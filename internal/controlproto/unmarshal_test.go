@@ -6,6 +6,7 @@ import (
 	"github.com/centrifugal/centrifuge/internal/controlpb"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestDecoder(t *testing.T) {
@@ -60,8 +61,13 @@ func TestDecoder(t *testing.T) {
 	require.Equal(t, disconnect, decodedDisconnect)
 
 	sub := &controlpb.Subscribe{
-		User:    "test",
-		Channel: "test channel",
+		User:       "test",
+		Channel:    "test channel",
+		TagsFilter: "type = trade",
+		DeltaType:  "fossil",
+
+		LatestPublication:  true,
+		JoinLeaveUserLevel: true,
 	}
 	d, err = encoder.EncodeSubscribe(sub)
 	require.NoError(t, err)
@@ -120,6 +126,38 @@ func TestDecoder(t *testing.T) {
 	decodedNotification, err := decoder.DecodeNotification(d)
 	require.NoError(t, err)
 	require.Equal(t, notification, decodedNotification)
+
+	resetStream := &controlpb.ResetStream{
+		Channel:  "test",
+		Position: &controlpb.StreamPosition{Offset: 0, Epoch: "xyz"},
+	}
+	d, err = encoder.EncodeResetStream(resetStream)
+	require.NoError(t, err)
+	require.NotNil(t, d)
+
+	decodedResetStream, err := decoder.DecodeResetStream(d)
+	require.NoError(t, err)
+	require.Equal(t, resetStream.Channel, decodedResetStream.Channel)
+	require.Equal(t, resetStream.Position.Epoch, decodedResetStream.Position.Epoch)
+
+	presenceInfo := &controlpb.PresenceInfo{
+		Channel:  "test",
+		User:     "user",
+		Client:   "client",
+		ConnInfo: []byte(`{"name":"alex"}`),
+		ChanInfo: []byte(`{"status":"away"}`),
+	}
+	d, err = encoder.EncodePresenceInfo(presenceInfo)
+	require.NoError(t, err)
+	require.NotNil(t, d)
+	// Must be compatible with standard protobuf encoding.
+	expected, err := proto.Marshal(presenceInfo)
+	require.NoError(t, err)
+	require.Equal(t, expected, d)
+
+	decodedPresenceInfo, err := decoder.DecodePresenceInfo(d)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(presenceInfo, decodedPresenceInfo))
 }
 
 func TestDecoderError(t *testing.T) {
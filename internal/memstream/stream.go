@@ -29,6 +29,32 @@ type Item struct {
 	Value  interface{}
 }
 
+// element is kept in stream list.
+type element struct {
+	Item
+	bytes int
+	time  int64
+}
+
+// AddOptions define how item is added to stream and which limits applied to
+// stream after that.
+type AddOptions struct {
+	// Key if not empty makes stream keep only the latest item with the same key.
+	Key string
+	// Size is a max number of items in stream.
+	Size int
+	// Bytes is a size of item. Only used when MaxBytes set.
+	Bytes int
+	// MaxBytes if set limits total size of items in stream. The latest item
+	// is always kept in stream even if its size exceeds MaxBytes.
+	MaxBytes int
+	// Time of item in Unix milliseconds. Only used when MaxAge set.
+	Time int64
+	// MaxAge if set makes stream remove items older than MaxAge (compared to Time
+	// of added item). The latest item is always kept in stream.
+	MaxAge time.Duration
+}
+
 // Stream is a non-thread safe in-memory data structure that
 // maintains a stream of values limited by size and provides
 // methods to access a range of values from provided position.
@@ -37,6 +63,23 @@ type Stream struct {
 	list  *list.List
 	index map[uint64]*list.Element
 	epoch string
+	// keys and offsetKeys maintain the latest item offset for compaction keys.
+	keys       map[string]uint64
+	offsetKeys map[uint64]string
+	compacted  bool
+	trimmed    uint64
+	bytes      int
+	limits     Limits
+}
+
+// Limits describe retention limits of a stream.
+type Limits struct {
+	// Size is a max number of items in stream.
+	Size int
+	// MaxBytes limits total size of items in stream.
+	MaxBytes int
+	// MaxAge limits age of items in stream.
+	MaxAge time.Duration
 }
 
 // New creates new Stream.
@@ -48,24 +91,115 @@ func New() *Stream {
 	}
 }
 
+// Restore creates new empty Stream with provided epoch and top offset. This is
+// useful to recreate stream state loaded from external storage. Items up to top
+// are considered trimmed.
+func Restore(epoch string, top uint64) *Stream {
+	return &Stream{
+		top:     top,
+		list:    list.New(),
+		index:   make(map[uint64]*list.Element),
+		epoch:   epoch,
+		trimmed: top,
+	}
+}
+
 // Add item to stream.
 func (s *Stream) Add(v interface{}, size int) (uint64, error) {
+	return s.AddKeyed(v, "", size)
+}
+
+// AddKeyed adds item to stream removing previous item with the same key (if
+// key is not empty) – i.e. only the latest item for a key is kept in stream.
+// Offsets of items stay monotonic, so stream may contain gaps after that.
+func (s *Stream) AddKeyed(v interface{}, key string, size int) (uint64, error) {
+	return s.AddWithOptions(v, AddOptions{Key: key, Size: size})
+}
+
+// AddWithOptions adds item to stream according to AddOptions.
+func (s *Stream) AddWithOptions(v interface{}, opts AddOptions) (uint64, error) {
 	s.top++
-	item := Item{
-		Offset: s.top,
-		Value:  v,
+	item := element{
+		Item: Item{
+			Offset: s.top,
+			Value:  v,
+		},
+		bytes: opts.Bytes,
+		time:  opts.Time,
+	}
+	if key := opts.Key; key != "" {
+		if s.keys == nil {
+			s.keys = make(map[string]uint64)
+			s.offsetKeys = make(map[uint64]string)
+		}
+		if prevOffset, ok := s.keys[key]; ok {
+			if el, ok := s.index[prevOffset]; ok {
+				s.bytes -= el.Value.(element).bytes
+				s.list.Remove(el)
+				delete(s.index, prevOffset)
+			}
+			delete(s.offsetKeys, prevOffset)
+		}
+		s.keys[key] = item.Offset
+		s.offsetKeys[item.Offset] = key
+		s.compacted = true
 	}
 	el := s.list.PushBack(item)
 	s.index[item.Offset] = el
-	for s.list.Len() > size {
-		el := s.list.Front()
-		item := el.Value.(Item)
-		s.list.Remove(el)
-		delete(s.index, item.Offset)
+	s.bytes += item.bytes
+	s.limits = Limits{Size: opts.Size, MaxBytes: opts.MaxBytes, MaxAge: opts.MaxAge}
+	for s.list.Len() > opts.Size {
+		s.trimFront()
+	}
+	for s.list.Len() > 1 && opts.MaxBytes > 0 && s.bytes > opts.MaxBytes {
+		s.trimFront()
+	}
+	if opts.MaxAge > 0 {
+		minTime := item.time - opts.MaxAge.Milliseconds()
+		for s.list.Len() > 1 && s.list.Front().Value.(element).time < minTime {
+			s.trimFront()
+		}
 	}
 	return s.top, nil
 }
 
+func (s *Stream) trimFront() {
+	el := s.list.Front()
+	item := el.Value.(element)
+	s.list.Remove(el)
+	delete(s.index, item.Offset)
+	s.bytes -= item.bytes
+	s.trimmed = item.Offset
+	if key, ok := s.offsetKeys[item.Offset]; ok {
+		delete(s.keys, key)
+		delete(s.offsetKeys, item.Offset)
+	}
+}
+
+// Advance moves stream top forward without adding items. This is useful to
+// restore streams with gaps in offsets (i.e. compacted streams).
+func (s *Stream) Advance(top uint64) {
+	if top > s.top {
+		s.top = top
+	}
+}
+
+// Compacted reports whether stream ever contained items added with key.
+func (s *Stream) Compacted() bool {
+	return s.compacted
+}
+
+// Trimmed returns the largest offset of item removed from stream due to size,
+// bytes or age limits. Items removed due to compaction are not taken into account.
+func (s *Stream) Trimmed() uint64 {
+	return s.trimmed
+}
+
+// Limits returns retention limits the latest item was added to stream with.
+func (s *Stream) Limits() Limits {
+	return s.limits
+}
+
 // Top returns top of stream.
 func (s *Stream) Top() uint64 {
 	return s.top
@@ -87,6 +221,10 @@ func (s *Stream) Reset() {
 func (s *Stream) Clear() {
 	s.list = list.New()
 	s.index = make(map[uint64]*list.Element)
+	s.keys = nil
+	s.offsetKeys = nil
+	s.trimmed = s.top
+	s.bytes = 0
 }
 
 // Get items since provided position.
@@ -101,10 +239,20 @@ func (s *Stream) Get(offset uint64, useOffset bool, limit int, reverse bool) ([]
 		var ok bool
 		el, ok = s.index[offset]
 		if !ok {
+			// Offset may be missing since it was trimmed or compacted, find the
+			// closest element in requested direction.
 			if reverse {
-				el = nil
+				if front := s.list.Front(); front != nil && front.Value.(element).Offset < offset {
+					el = s.list.Back()
+					for el != nil && el.Value.(element).Offset > offset {
+						el = el.Prev()
+					}
+				}
 			} else {
 				el = s.list.Front()
+				for el != nil && el.Value.(element).Offset < offset {
+					el = el.Next()
+				}
 			}
 		}
 	} else {
@@ -132,7 +280,7 @@ func (s *Stream) Get(offset uint64, useOffset bool, limit int, reverse bool) ([]
 	result := make([]Item, 0, resultCap)
 
 	if reverse {
-		item := el.Value.(Item)
+		item := el.Value.(element).Item
 		result = append(result, item)
 		i := 1
 		for e := el.Prev(); e != nil; e = e.Prev() {
@@ -140,11 +288,11 @@ func (s *Stream) Get(offset uint64, useOffset bool, limit int, reverse bool) ([]
 				break
 			}
 			i++
-			item := e.Value.(Item)
+			item := e.Value.(element).Item
 			result = append(result, item)
 		}
 	} else {
-		item := el.Value.(Item)
+		item := el.Value.(element).Item
 		result = append(result, item)
 		i := 1
 		for e := el.Next(); e != nil; e = e.Next() {
@@ -152,7 +300,7 @@ func (s *Stream) Get(offset uint64, useOffset bool, limit int, reverse bool) ([]
 				break
 			}
 			i++
-			item := e.Value.(Item)
+			item := e.Value.(element).Item
 			result = append(result, item)
 		}
 	}
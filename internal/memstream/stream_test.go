@@ -3,6 +3,7 @@ package memstream
 import (
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -173,3 +174,119 @@ func TestStreamNoLimitWithMiddle(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, items, 6)
 }
+
+func TestStreamRestore(t *testing.T) {
+	s := Restore("xyz", 10)
+	require.Equal(t, uint64(10), s.Top())
+	require.Equal(t, "xyz", s.Epoch())
+	seq, err := s.Add([]byte("11"), 5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), seq)
+	items, _, err := s.Get(11, true, -1, false)
+	require.NoError(t, err)
+	require.Equal(t, []Item{{11, []byte("11")}}, items)
+}
+
+func TestStreamAddKeyed(t *testing.T) {
+	s := New()
+	for i := 0; i < 6; i++ {
+		key := strconv.Itoa(i % 3)
+		_, err := s.AddKeyed([]byte(strconv.Itoa(i+1)), key, 10)
+		require.NoError(t, err)
+	}
+	_, err := s.Add([]byte("7"), 10)
+	require.NoError(t, err)
+	require.True(t, s.Compacted())
+	require.Equal(t, uint64(0), s.Trimmed())
+
+	items, streamTop, err := s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), streamTop)
+	require.Equal(t, []Item{{4, []byte("4")}, {5, []byte("5")}, {6, []byte("6")}, {7, []byte("7")}}, items)
+
+	// Compacted offsets point to the next existing item.
+	items, _, err = s.Get(2, true, 1, false)
+	require.NoError(t, err)
+	require.Equal(t, []Item{{4, []byte("4")}}, items)
+	items, _, err = s.Get(3, true, 1, true)
+	require.NoError(t, err)
+	require.Len(t, items, 0)
+
+	_, err = s.AddKeyed([]byte("8"), "0", 3)
+	require.NoError(t, err)
+	items, _, err = s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Equal(t, []Item{{6, []byte("6")}, {7, []byte("7")}, {8, []byte("8")}}, items)
+	require.Equal(t, uint64(5), s.Trimmed())
+
+	items, _, err = s.Get(7, true, 1, true)
+	require.NoError(t, err)
+	require.Equal(t, []Item{{7, []byte("7")}}, items)
+}
+
+func TestStreamAdvance(t *testing.T) {
+	s := Restore("xyz", 10)
+	s.Advance(15)
+	require.Equal(t, uint64(15), s.Top())
+	s.Advance(12)
+	require.Equal(t, uint64(15), s.Top())
+	seq, err := s.Add([]byte("16"), 5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), seq)
+}
+
+func TestStreamAddMaxBytes(t *testing.T) {
+	s := New()
+	for i := 0; i < 5; i++ {
+		_, err := s.AddWithOptions([]byte("elem"), AddOptions{Size: 10, Bytes: 4, MaxBytes: 12})
+		require.NoError(t, err)
+	}
+	items, _, err := s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	require.Equal(t, uint64(3), items[0].Offset)
+	require.Equal(t, uint64(2), s.Trimmed())
+
+	// Latest item kept even if it exceeds limit.
+	_, err = s.AddWithOptions([]byte("large"), AddOptions{Size: 10, Bytes: 20, MaxBytes: 12})
+	require.NoError(t, err)
+	items, _, err = s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, uint64(6), items[0].Offset)
+	require.Equal(t, uint64(5), s.Trimmed())
+}
+
+func TestStreamAddMaxAge(t *testing.T) {
+	s := New()
+	now := time.Now().UnixMilli()
+	for i := 0; i < 3; i++ {
+		_, err := s.AddWithOptions([]byte("old"), AddOptions{Size: 10, Time: now - 10000})
+		require.NoError(t, err)
+	}
+	_, err := s.AddWithOptions([]byte("new"), AddOptions{Size: 10, Time: now - 1000, MaxAge: 5 * time.Second})
+	require.NoError(t, err)
+	_, err = s.AddWithOptions([]byte("new"), AddOptions{Size: 10, Time: now, MaxAge: 5 * time.Second})
+	require.NoError(t, err)
+	items, _, err := s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, uint64(4), items[0].Offset)
+	require.Equal(t, uint64(3), s.Trimmed())
+	require.Equal(t, Limits{Size: 10, MaxAge: 5 * time.Second}, s.Limits())
+}
+
+func TestStreamAddKeyedMaxBytes(t *testing.T) {
+	s := New()
+	_, err := s.AddWithOptions([]byte("a"), AddOptions{Key: "a", Size: 10, Bytes: 4, MaxBytes: 8})
+	require.NoError(t, err)
+	_, err = s.AddWithOptions([]byte("b"), AddOptions{Key: "b", Size: 10, Bytes: 4, MaxBytes: 8})
+	require.NoError(t, err)
+	// Replacing item with the same key releases its bytes.
+	_, err = s.AddWithOptions([]byte("a"), AddOptions{Key: "a", Size: 10, Bytes: 4, MaxBytes: 8})
+	require.NoError(t, err)
+	items, _, err := s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, uint64(0), s.Trimmed())
+}
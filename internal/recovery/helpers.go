@@ -22,8 +22,17 @@ func uniquePublications(s []*protocol.Publication) []*protocol.Publication {
 
 // MergePublications allows to merge recovered pubs with buffered pubs
 // collected during extracting recovered so result is ordered and with
-// duplicates removed.
-func MergePublications(recoveredPubs []*protocol.Publication, bufferedPubs []*protocol.Publication) ([]*protocol.Publication, bool) {
+// duplicates removed. If compacted is true recovered pubs may contain gaps in
+// offsets, but merged pubs must be sequential after them.
+func MergePublications(recoveredPubs []*protocol.Publication, bufferedPubs []*protocol.Publication, compacted bool) ([]*protocol.Publication, bool) {
+	var lastRecoveredOffset uint64
+	if compacted {
+		for _, p := range recoveredPubs {
+			if p.Offset > lastRecoveredOffset {
+				lastRecoveredOffset = p.Offset
+			}
+		}
+	}
 	if len(bufferedPubs) > 0 {
 		recoveredPubs = append(recoveredPubs, bufferedPubs...)
 	}
@@ -37,7 +46,7 @@ func MergePublications(recoveredPubs []*protocol.Publication, bufferedPubs []*pr
 		prevOffset := recoveredPubs[0].Offset
 		for _, p := range recoveredPubs[1:] {
 			pubOffset := p.Offset
-			isWrongOffset := pubOffset != prevOffset+1
+			isWrongOffset := pubOffset != prevOffset+1 && pubOffset > lastRecoveredOffset
 			if isWrongOffset {
 				return nil, false
 			}
@@ -25,7 +25,7 @@ func TestMergePublicationsNoBuffered(t *testing.T) {
 		{Offset: 1},
 		{Offset: 2},
 	}
-	pubs, ok := MergePublications(recoveredPubs, nil)
+	pubs, ok := MergePublications(recoveredPubs, nil, false)
 	require.True(t, ok)
 	require.Len(t, pubs, 2)
 }
@@ -38,7 +38,45 @@ func TestMergePublicationsBuffered(t *testing.T) {
 	bufferedPubs := []*protocol.Publication{
 		{Offset: 3},
 	}
-	pubs, ok := MergePublications(recoveredPubs, bufferedPubs)
+	pubs, ok := MergePublications(recoveredPubs, bufferedPubs, false)
 	require.True(t, ok)
 	require.Len(t, pubs, 3)
 }
+
+func TestMergePublicationsGap(t *testing.T) {
+	recoveredPubs := []*protocol.Publication{
+		{Offset: 2},
+		{Offset: 5},
+	}
+	bufferedPubs := []*protocol.Publication{
+		{Offset: 5},
+		{Offset: 6},
+	}
+	// Gap in not compacted stream means that publications were lost.
+	_, ok := MergePublications(recoveredPubs, bufferedPubs, false)
+	require.False(t, ok)
+}
+
+func TestMergePublicationsCompacted(t *testing.T) {
+	recoveredPubs := []*protocol.Publication{
+		{Offset: 2},
+		{Offset: 5},
+	}
+	bufferedPubs := []*protocol.Publication{
+		{Offset: 5},
+		{Offset: 6},
+	}
+	pubs, ok := MergePublications(recoveredPubs, bufferedPubs, true)
+	require.True(t, ok)
+	require.Len(t, pubs, 3)
+
+	recoveredPubs = []*protocol.Publication{
+		{Offset: 2},
+		{Offset: 5},
+	}
+	bufferedPubs = []*protocol.Publication{
+		{Offset: 7},
+	}
+	_, ok = MergePublications(recoveredPubs, bufferedPubs, true)
+	require.False(t, ok)
+}
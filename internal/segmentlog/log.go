@@ -0,0 +1,264 @@
+// Package segmentlog implements a simple append-only log of opaque records
+// stored in a directory as a sequence of segment files.
+package segmentlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	segmentExt    = ".seg"
+	tmpExt        = ".tmp"
+	headerSize    = 8
+	maxRecordSize = 512 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupted returned when non-tail part of a log can't be decoded.
+var ErrCorrupted = errors.New("segmentlog: corrupted segment")
+
+// Log is a non-thread safe append-only log. Each record is framed with its
+// length and CRC32 checksum. Records appended to the log are written into
+// active segment (the one with the greatest sequence number). Rotate and
+// WriteSnapshot replace all segments before active one with a single snapshot
+// segment.
+type Log struct {
+	dir  string
+	seq  uint64
+	file *os.File
+	size int64
+}
+
+// Open opens log in provided directory (creating directory if required) and
+// calls fn for every record found in segments in the order records were
+// appended. A partially written record at the end of the last segment (for
+// example, after a crash during write) is silently truncated.
+func Open(dir string, fn func(data []byte) error) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir}
+	for i, seq := range seqs {
+		last := i == len(seqs)-1
+		validSize, err := readSegment(l.segmentPath(seq), fn)
+		if err != nil {
+			if !errors.Is(err, errTorn) {
+				return nil, err
+			}
+			if !last {
+				return nil, ErrCorrupted
+			}
+			if err := os.Truncate(l.segmentPath(seq), validSize); err != nil {
+				return nil, err
+			}
+		}
+		if last {
+			l.seq = seq
+			l.size = validSize
+		}
+	}
+	if len(seqs) == 0 {
+		l.seq = 1
+	}
+	f, err := os.OpenFile(l.segmentPath(l.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+// Append writes record into active segment.
+func (l *Log) Append(data []byte) error {
+	buf := frame(data)
+	n, err := l.file.Write(buf)
+	l.size += int64(n)
+	return err
+}
+
+// Size of active segment in bytes.
+func (l *Log) Size() int64 {
+	return l.size
+}
+
+// Sync commits active segment contents to stable storage.
+func (l *Log) Sync() error {
+	return l.file.Sync()
+}
+
+// Rotate closes active segment and starts a new one. It returns a sequence
+// number reserved for a snapshot segment which goes before the new active
+// segment – see WriteSnapshot.
+func (l *Log) Rotate() (uint64, error) {
+	snapshotSeq := l.seq + 1
+	nextSeq := l.seq + 2
+	newFile, err := os.OpenFile(l.segmentPath(nextSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.file.Sync(); err != nil {
+		_ = newFile.Close()
+		_ = os.Remove(l.segmentPath(nextSeq))
+		return 0, err
+	}
+	_ = l.file.Close()
+	l.file = newFile
+	l.size = 0
+	l.seq = nextSeq
+	return snapshotSeq, nil
+}
+
+// WriteSnapshot creates a segment with sequence number obtained from Rotate
+// filled with records provided by write func and removes all segments before
+// it. Segment is first written into temporary file and then atomically renamed
+// so an interrupted snapshot leaves log in its previous state. It does not
+// touch active segment so may be called concurrently with Append. Returns
+// size of written segment.
+func (l *Log) WriteSnapshot(seq uint64, write func(add func(data []byte) error) error) (int64, error) {
+	tmpPath := filepath.Join(l.dir, segmentName(seq)+tmpExt)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	err = write(func(data []byte) error {
+		n, err := f.Write(frame(data))
+		size += int64(n)
+		return err
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, l.segmentPath(seq)); err != nil {
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+	seqs, err := listSegments(l.dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range seqs {
+		if s < seq {
+			if err := os.Remove(l.segmentPath(s)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return size, nil
+}
+
+// Close syncs and closes active segment.
+func (l *Log) Close() error {
+	if err := l.file.Sync(); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+func (l *Log) segmentPath(seq uint64) string {
+	return filepath.Join(l.dir, segmentName(seq))
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentExt)
+}
+
+func frame(data []byte) []byte {
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[headerSize:], data)
+	return buf
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, tmpExt) {
+			// Leftover of interrupted compaction.
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+var errTorn = errors.New("torn record")
+
+// readSegment calls fn for each valid record in segment and returns size of
+// valid segment part.
+func readSegment(path string, fn func(data []byte) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		_, err := io.ReadFull(f, header)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, fmt.Errorf("%w: %v", errTorn, err)
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxRecordSize {
+			return offset, fmt.Errorf("%w: record too large", errTorn)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(f, data); err != nil {
+			return offset, fmt.Errorf("%w: %v", errTorn, err)
+		}
+		if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, fmt.Errorf("%w: checksum mismatch", errTorn)
+		}
+		if err := fn(data); err != nil {
+			return offset, err
+		}
+		offset += headerSize + int64(length)
+	}
+}
@@ -0,0 +1,130 @@
+package segmentlog
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, dir string) (*Log, []string) {
+	var records []string
+	l, err := Open(dir, func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	require.NoError(t, err)
+	return l, records
+}
+
+func TestLogAppendReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, records := readAll(t, dir)
+	require.Len(t, records, 0)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Append([]byte(strconv.Itoa(i))))
+	}
+	require.Equal(t, int64(10*(headerSize+1)), l.Size())
+	require.NoError(t, l.Close())
+
+	l, records = readAll(t, dir)
+	require.Len(t, records, 10)
+	require.Equal(t, "9", records[9])
+	require.NoError(t, l.Append([]byte("10")))
+	require.NoError(t, l.Close())
+
+	l, records = readAll(t, dir)
+	require.Len(t, records, 11)
+	require.NoError(t, l.Close())
+}
+
+func TestLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := readAll(t, dir)
+	require.NoError(t, l.Append([]byte("first")))
+	require.NoError(t, l.Append([]byte("second")))
+	require.NoError(t, l.Close())
+
+	path := filepath.Join(dir, segmentName(1))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-2))
+
+	l, records := readAll(t, dir)
+	require.Equal(t, []string{"first"}, records)
+	require.NoError(t, l.Append([]byte("third")))
+	require.NoError(t, l.Close())
+
+	l, records = readAll(t, dir)
+	require.Equal(t, []string{"first", "third"}, records)
+	require.NoError(t, l.Close())
+}
+
+func TestLogSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := readAll(t, dir)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Append([]byte(strconv.Itoa(i))))
+	}
+	seq, err := l.Rotate()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), l.Size())
+	// Appended while snapshot is being written.
+	require.NoError(t, l.Append([]byte("during")))
+	size, err := l.WriteSnapshot(seq, func(add func(data []byte) error) error {
+		return add([]byte("snapshot"))
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(headerSize+len("snapshot")), size)
+	require.NoError(t, l.Append([]byte("after")))
+	require.NoError(t, l.Close())
+
+	seqs, err := listSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, seqs)
+
+	l, records := readAll(t, dir)
+	require.Equal(t, []string{"snapshot", "during", "after"}, records)
+	require.NoError(t, l.Close())
+}
+
+func TestLogRotateWithoutSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := readAll(t, dir)
+	require.NoError(t, l.Append([]byte("before")))
+	_, err := l.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, l.Append([]byte("after")))
+	require.NoError(t, l.Close())
+
+	l, records := readAll(t, dir)
+	require.Equal(t, []string{"before", "after"}, records)
+	require.NoError(t, l.Close())
+}
+
+func TestLogInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := readAll(t, dir)
+	require.NoError(t, l.Append([]byte("record")))
+	require.NoError(t, l.Close())
+
+	tmpPath := filepath.Join(dir, segmentName(2)+tmpExt)
+	require.NoError(t, os.WriteFile(tmpPath, frame([]byte("partial")), 0644))
+
+	l, records := readAll(t, dir)
+	require.Equal(t, []string{"record"}, records)
+	require.NoError(t, l.Close())
+	_, err := os.Stat(tmpPath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLogCorruptedSegment(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(1)), []byte("garbage"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segmentName(2)), frame([]byte("ok")), 0644))
+	_, err := Open(dir, func(data []byte) error { return nil })
+	require.ErrorIs(t, err, ErrCorrupted)
+}
@@ -0,0 +1,117 @@
+// Package skiplist provides sorted set of strings based on skip list.
+package skiplist
+
+import "time"
+
+// maxLevel allows keeping O(log n) operations for up to 4^maxLevel keys.
+const maxLevel = 24
+
+type node struct {
+	key  string
+	next []*node
+}
+
+// Set is a sorted set of strings with O(log n) inserts, deletes and seeks on
+// average. Set is not safe for concurrent use.
+type Set struct {
+	head   *node
+	level  int
+	length int
+	// seed is a state of xorshift generator used to choose levels of nodes.
+	seed uint64
+}
+
+// New creates empty Set.
+func New() *Set {
+	return &Set{
+		head:  &node{next: make([]*node, maxLevel)},
+		level: 1,
+		seed:  uint64(time.Now().UnixNano()) | 1,
+	}
+}
+
+// Len returns number of keys in Set.
+func (s *Set) Len() int {
+	return s.length
+}
+
+// randomLevel returns level of a new node, each next level is chosen with
+// probability 1/4.
+func (s *Set) randomLevel() int {
+	s.seed ^= s.seed << 13
+	s.seed ^= s.seed >> 7
+	s.seed ^= s.seed << 17
+	level := 1
+	for x := s.seed; level < maxLevel && x&3 == 0; x >>= 2 {
+		level++
+	}
+	return level
+}
+
+// findPrev fills update with the last nodes on each level which keys are less
+// than key.
+func (s *Set) findPrev(key string, update *[maxLevel]*node) *node {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return x.next[0]
+}
+
+// Insert adds key to Set. Returns false if key already exists.
+func (s *Set) Insert(key string) bool {
+	var update [maxLevel]*node
+	if n := s.findPrev(key, &update); n != nil && n.key == key {
+		return false
+	}
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+	n := &node{key: key, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	s.length++
+	return true
+}
+
+// Delete removes key from Set. Returns false if there was no such key.
+func (s *Set) Delete(key string) bool {
+	var update [maxLevel]*node
+	n := s.findPrev(key, &update)
+	if n == nil || n.key != key {
+		return false
+	}
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	return true
+}
+
+// AscendAfter calls fn for keys greater than after in ascending order until
+// fn returns false.
+func (s *Set) AscendAfter(after string, fn func(key string) bool) {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key <= after {
+			x = x.next[i]
+		}
+	}
+	for n := x.next[0]; n != nil; n = n.next[0] {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
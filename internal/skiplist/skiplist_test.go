@@ -0,0 +1,79 @@
+package skiplist
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func keysAfter(s *Set, after string, limit int) []string {
+	var keys []string
+	s.AscendAfter(after, func(key string) bool {
+		keys = append(keys, key)
+		return limit <= 0 || len(keys) < limit
+	})
+	return keys
+}
+
+func TestSet(t *testing.T) {
+	s := New()
+	require.Equal(t, 0, s.Len())
+	require.Nil(t, keysAfter(s, "", 0))
+
+	for _, key := range []string{"c", "a", "e", "b", "d"} {
+		require.True(t, s.Insert(key))
+	}
+	require.False(t, s.Insert("c"))
+	require.Equal(t, 5, s.Len())
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, keysAfter(s, "", 0))
+	require.Equal(t, []string{"c", "d"}, keysAfter(s, "b", 2))
+	require.Equal(t, []string{"c", "d", "e"}, keysAfter(s, "bb", 0))
+	require.Nil(t, keysAfter(s, "e", 0))
+
+	require.True(t, s.Delete("c"))
+	require.False(t, s.Delete("c"))
+	require.False(t, s.Delete("x"))
+	require.Equal(t, 4, s.Len())
+	require.Equal(t, []string{"d", "e"}, keysAfter(s, "b", 0))
+}
+
+func TestSetRandom(t *testing.T) {
+	s := New()
+	model := map[string]struct{}{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(r.Intn(1000))
+		_, exists := model[key]
+		if r.Intn(3) == 0 {
+			require.Equal(t, exists, s.Delete(key))
+			delete(model, key)
+		} else {
+			require.Equal(t, !exists, s.Insert(key))
+			model[key] = struct{}{}
+		}
+	}
+	expected := make([]string, 0, len(model))
+	for key := range model {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+	require.Equal(t, len(expected), s.Len())
+	require.Equal(t, expected, keysAfter(s, "", 0))
+	after := expected[len(expected)/2]
+	require.Equal(t, expected[len(expected)/2+1:], keysAfter(s, after, 0))
+}
+
+func BenchmarkSetInsert(b *testing.B) {
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = strconv.FormatInt(rand.Int63(), 36)
+	}
+	s := New()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Insert(keys[i])
+	}
+}
@@ -0,0 +1,354 @@
+// Package tagsfilter implements a small expression language to match
+// string key-value tags.
+//
+// Grammar:
+//
+//	expr       = and { ("or" | "||") and }
+//	and        = operand { ("and" | "&&") operand }
+//	operand    = "(" expr ")" | comparison
+//	comparison = key ("=" | "==" | "!=") value
+//	           | key "in" "(" value { "," value } ")"
+//	           | key "prefix" value
+//
+// Keys and values are either bare words consisting of letters, digits and
+// symbols "_", "-", ".", ":", "/", "*" or quoted strings (double or single
+// quotes, backslash escapes the next character). Keywords are case-insensitive.
+// A missing tag is never equal to any value, so "key != value" matches tags
+// without key.
+package tagsfilter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Filter is a compiled filter expression. Filter is immutable and safe for
+// concurrent use.
+type Filter struct {
+	root node
+}
+
+// Parse compiles filter expression.
+func Parse(expr string) (*Filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("tagsfilter: empty expression")
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("tagsfilter: unexpected %q at position %d", p.tokens[p.pos].text, p.tokens[p.pos].offset)
+	}
+	return &Filter{root: root}, nil
+}
+
+// Match reports whether tags satisfy filter.
+func (f *Filter) Match(tags map[string]string) bool {
+	return f.root.match(tags)
+}
+
+type node interface {
+	match(tags map[string]string) bool
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n andNode) match(tags map[string]string) bool {
+	return n.left.match(tags) && n.right.match(tags)
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n orNode) match(tags map[string]string) bool {
+	return n.left.match(tags) || n.right.match(tags)
+}
+
+type eqNode struct {
+	key   string
+	value string
+	not   bool
+}
+
+func (n eqNode) match(tags map[string]string) bool {
+	v, ok := tags[n.key]
+	return (ok && v == n.value) != n.not
+}
+
+type inNode struct {
+	key    string
+	values map[string]struct{}
+}
+
+func (n inNode) match(tags map[string]string) bool {
+	v, ok := tags[n.key]
+	if !ok {
+		return false
+	}
+	_, ok = n.values[v]
+	return ok
+}
+
+type prefixNode struct {
+	key    string
+	prefix string
+}
+
+func (n prefixNode) match(tags map[string]string) bool {
+	v, ok := tags[n.key]
+	return ok && strings.HasPrefix(v, n.prefix)
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenEq
+	tokenNotEq
+	tokenAnd
+	tokenOr
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == ':' || c == '/' || c == '*'
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		case c == '=':
+			if i+1 < len(expr) && expr[i+1] == '=' {
+				tokens = append(tokens, token{tokenEq, "==", i})
+				i += 2
+			} else {
+				tokens = append(tokens, token{tokenEq, "=", i})
+				i++
+			}
+		case c == '!' && i+1 < len(expr) && expr[i+1] == '=':
+			tokens = append(tokens, token{tokenNotEq, "!=", i})
+			i += 2
+		case c == '&' && i+1 < len(expr) && expr[i+1] == '&':
+			tokens = append(tokens, token{tokenAnd, "&&", i})
+			i += 2
+		case c == '|' && i+1 < len(expr) && expr[i+1] == '|':
+			tokens = append(tokens, token{tokenOr, "||", i})
+			i += 2
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(expr) {
+				if expr[i] == '\\' && i+1 < len(expr) {
+					sb.WriteByte(expr[i+1])
+					i += 2
+					continue
+				}
+				if expr[i] == c {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(expr[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("tagsfilter: unterminated string at position %d", start)
+			}
+			tokens = append(tokens, token{tokenString, sb.String(), start})
+		case isWordChar(c):
+			start := i
+			for i < len(expr) && isWordChar(expr[i]) {
+				i++
+			}
+			word := expr[start:i]
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, token{tokenAnd, word, start})
+			case "or":
+				tokens = append(tokens, token{tokenOr, word, start})
+			default:
+				tokens = append(tokens, token{tokenWord, word, start})
+			}
+		default:
+			return nil, fmt.Errorf("tagsfilter: unexpected character %q at position %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	position := -1
+	if t, ok := p.peek(); ok {
+		position = t.offset
+	}
+	if position < 0 {
+		return fmt.Errorf("tagsfilter: "+format+" at end of expression", args...)
+	}
+	return fmt.Errorf("tagsfilter: "+format+" at position %d", append(args, position)...)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != tokenOr {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != tokenAnd {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t, ok := p.peek()
+	if ok && t.kind == tokenLParen {
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != tokenRParen {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return n, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseValue() (string, error) {
+	t, ok := p.peek()
+	if !ok || (t.kind != tokenWord && t.kind != tokenString) {
+		return "", p.errorf("expected value")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *parser) parseComparison() (node, error) {
+	key, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peek()
+	if !ok {
+		return nil, p.errorf("expected operator")
+	}
+	switch {
+	case op.kind == tokenEq || op.kind == tokenNotEq:
+		p.pos++
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return eqNode{key: key, value: value, not: op.kind == tokenNotEq}, nil
+	case op.kind == tokenWord && strings.EqualFold(op.text, "prefix"):
+		p.pos++
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return prefixNode{key: key, prefix: value}, nil
+	case op.kind == tokenWord && strings.EqualFold(op.text, "in"):
+		p.pos++
+		if t, ok := p.peek(); !ok || t.kind != tokenLParen {
+			return nil, p.errorf("expected (")
+		}
+		p.pos++
+		values := map[string]struct{}{}
+		for {
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values[value] = struct{}{}
+			t, ok := p.peek()
+			if ok && t.kind == tokenComma {
+				p.pos++
+				continue
+			}
+			if ok && t.kind == tokenRParen {
+				p.pos++
+				break
+			}
+			return nil, p.errorf("expected , or )")
+		}
+		return inNode{key: key, values: values}, nil
+	default:
+		return nil, p.errorf("expected operator")
+	}
+}
@@ -0,0 +1,80 @@
+package tagsfilter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterMatch(t *testing.T) {
+	tags := map[string]string{
+		"type":   "trade",
+		"ticker": "BTC-USD",
+		"venue":  "binance",
+		"quoted": "a b",
+	}
+	testCases := []struct {
+		expr  string
+		match bool
+	}{
+		{`type = trade`, true},
+		{`type == "trade"`, true},
+		{`type = quote`, false},
+		{`type != quote`, true},
+		{`missing != quote`, true},
+		{`missing = ""`, false},
+		{`quoted = 'a b'`, true},
+		{`ticker prefix BTC`, true},
+		{`ticker PREFIX "ETH"`, false},
+		{`missing prefix ""`, false},
+		{`venue in (binance, kraken)`, true},
+		{`venue in ("kraken")`, false},
+		{`missing in (binance)`, false},
+		{`type = trade and venue = kraken`, false},
+		{`type = trade AND venue = binance`, true},
+		{`type = quote or venue = binance`, true},
+		{`type = quote || venue = kraken`, false},
+		{`type = trade && (venue = kraken || ticker prefix BTC)`, true},
+		{`(type = quote or venue = binance) and ticker prefix ETH`, false},
+		{`type = quote or venue = binance and ticker prefix ETH`, false},
+		{`type = trade or venue = kraken and ticker prefix ETH`, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			f, err := Parse(tc.expr)
+			require.NoError(t, err)
+			require.Equal(t, tc.match, f.Match(tags))
+		})
+	}
+}
+
+func TestFilterMatchNilTags(t *testing.T) {
+	f, err := Parse(`a != b`)
+	require.NoError(t, err)
+	require.True(t, f.Match(nil))
+	f, err = Parse(`a = b`)
+	require.NoError(t, err)
+	require.False(t, f.Match(nil))
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`type`,
+		`type =`,
+		`type = "trade`,
+		`type = trade and`,
+		`(type = trade`,
+		`type = trade)`,
+		`type in trade`,
+		`type in (trade`,
+		`type in ()`,
+		`type ~ trade`,
+		`type > trade`,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			_, err := Parse(expr)
+			require.Error(t, err)
+		})
+	}
+}
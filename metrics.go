@@ -27,6 +27,7 @@ var (
 	numChannelsGauge       prometheus.Gauge
 	numNodesGauge          prometheus.Gauge
 	replyErrorCount        *prometheus.CounterVec
+	commandThrottledCount  *prometheus.CounterVec
 	serverDisconnectCount  *prometheus.CounterVec
 	commandDurationSummary *prometheus.SummaryVec
 	surveyDurationSummary  *prometheus.SummaryVec
@@ -50,11 +51,19 @@ var (
 	actionCountRemoveSub        prometheus.Counter
 	actionCountAddPresence      prometheus.Counter
 	actionCountRemovePresence   prometheus.Counter
+	actionCountAddUserConn      prometheus.Counter
+	actionCountRemoveUserConn   prometheus.Counter
 	actionCountPresence         prometheus.Counter
+	actionCountPresencePage     prometheus.Counter
+	actionCountUserStatus       prometheus.Counter
+	actionCountCallClient       prometheus.Counter
 	actionCountPresenceStats    prometheus.Counter
 	actionCountHistory          prometheus.Counter
 	actionCountHistoryRecover   prometheus.Counter
 	actionCountHistoryStreamTop prometheus.Counter
+	actionCountHistoryLatest    prometheus.Counter
+	actionCountResetStream      prometheus.Counter
+	actionCountHistoryImport    prometheus.Counter
 	actionCountHistoryRemove    prometheus.Counter
 	actionCountSurvey           prometheus.Counter
 	actionCountNotify           prometheus.Counter
@@ -173,6 +182,13 @@ func incReplyError(method protocol.Command_MethodType, code uint32) {
 	replyErrorCount.WithLabelValues(strings.ToLower(protocol.Command_MethodType_name[int32(method)]), strconv.FormatUint(uint64(code), 10)).Inc()
 }
 
+func incCommandThrottled(method protocol.Command_MethodType, scope string) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	commandThrottledCount.WithLabelValues(strings.ToLower(protocol.Command_MethodType_name[int32(method)]), scope).Inc()
+}
+
 func incRecover(success bool) {
 	registryMu.RLock()
 	defer registryMu.RUnlock()
@@ -298,8 +314,18 @@ func incActionCount(action string) {
 		actionCountAddPresence.Inc()
 	case "remove_presence":
 		actionCountRemovePresence.Inc()
+	case "add_user_connection":
+		actionCountAddUserConn.Inc()
+	case "remove_user_connection":
+		actionCountRemoveUserConn.Inc()
 	case "presence":
 		actionCountPresence.Inc()
+	case "presence_page":
+		actionCountPresencePage.Inc()
+	case "user_status":
+		actionCountUserStatus.Inc()
+	case "call_client":
+		actionCountCallClient.Inc()
 	case "presence_stats":
 		actionCountPresenceStats.Inc()
 	case "history":
@@ -308,6 +334,12 @@ func incActionCount(action string) {
 		actionCountHistoryRecover.Inc()
 	case "history_stream_top":
 		actionCountHistoryStreamTop.Inc()
+	case "history_latest":
+		actionCountHistoryLatest.Inc()
+	case "reset_stream":
+		actionCountResetStream.Inc()
+	case "history_import":
+		actionCountHistoryImport.Inc()
 	case "history_remove":
 		actionCountHistoryRemove.Inc()
 	case "survey":
@@ -412,6 +444,13 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 		Help:      "Number of errors in replies sent to clients.",
 	}, []string{"method", "code"})
 
+	commandThrottledCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "num_throttled_commands",
+		Help:      "Number of client commands throttled by rate limits.",
+	}, []string{"method", "scope"})
+
 	serverDisconnectCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: metricsNamespace,
 		Subsystem: "client",
@@ -464,11 +503,19 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 	actionCountRemoveSub = actionCount.WithLabelValues("remove_subscription")
 	actionCountAddPresence = actionCount.WithLabelValues("add_presence")
 	actionCountRemovePresence = actionCount.WithLabelValues("remove_presence")
+	actionCountAddUserConn = actionCount.WithLabelValues("add_user_connection")
+	actionCountRemoveUserConn = actionCount.WithLabelValues("remove_user_connection")
 	actionCountPresence = actionCount.WithLabelValues("presence")
+	actionCountPresencePage = actionCount.WithLabelValues("presence_page")
+	actionCountUserStatus = actionCount.WithLabelValues("user_status")
+	actionCountCallClient = actionCount.WithLabelValues("call_client")
 	actionCountPresenceStats = actionCount.WithLabelValues("presence_stats")
 	actionCountHistory = actionCount.WithLabelValues("history")
 	actionCountHistoryRecover = actionCount.WithLabelValues("history_recover")
 	actionCountHistoryStreamTop = actionCount.WithLabelValues("history_stream_top")
+	actionCountHistoryLatest = actionCount.WithLabelValues("history_latest")
+	actionCountResetStream = actionCount.WithLabelValues("reset_stream")
+	actionCountHistoryImport = actionCount.WithLabelValues("history_import")
 	actionCountHistoryRemove = actionCount.WithLabelValues("history_remove")
 	actionCountSurvey = actionCount.WithLabelValues("survey")
 	actionCountNotify = actionCount.WithLabelValues("notify")
@@ -534,6 +581,9 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 	if err := registry.Register(replyErrorCount); err != nil {
 		return err
 	}
+	if err := registry.Register(commandThrottledCount); err != nil {
+		return err
+	}
 	if err := registry.Register(serverDisconnectCount); err != nil {
 		return err
 	}
@@ -0,0 +1,793 @@
+// Package natsbroker defines NATS Broker for Centrifuge library.
+package natsbroker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/centrifugal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// NatsBroker is a Broker on top of NATS server. Live messages go over core NATS
+// PUB/SUB, channel history streams are kept in NATS JetStream.
+//
+// Each channel with history has its own JetStream stream created upon first
+// publication with history. Publication offset is a sequence of message in
+// JetStream stream, stream epoch is saved into stream description. History
+// options of PublishOptions are mapped to stream limits: HistorySize to MaxMsgs,
+// HistoryTTL and HistoryMaxPublicationAge to MaxAge, HistoryMaxBytes to MaxBytes.
+// Note that unlike other Broker implementations HistoryTTL applies to each
+// publication in stream, and stream itself is kept with its epoch and offset
+// after all publications expired – until ResetStream called. Stream limits are
+// updated when publishing with different history options. For channels without
+// stream History returns empty StreamPosition.
+//
+// IdempotencyKey for publications with history is passed to JetStream message
+// deduplication (IdempotentResultTTL sets stream duplicate window), without
+// history results are only kept in memory of the current Node. CompactionKey
+// is not supported.
+//
+// Publication with history is saved to JetStream stream and then sent to
+// subscribers over core NATS. If sending fails Publish returns an error, but
+// publication stays in history – positioned subscribers restore it from
+// history upon next publication in channel.
+//
+// Publishing with history is serialized inside a Node, but publications of the
+// same channel sent from different Nodes concurrently may be delivered to
+// subscribers not in offset order – in this case positioned subscribers will
+// resubscribe to restore their state from history.
+type NatsBroker struct {
+	node         *centrifuge.Node
+	config       Config
+	nc           *nats.Conn
+	js           nats.JetStreamContext
+	eventHandler centrifuge.BrokerEventHandler
+	resultCache  *resultCache
+
+	subsMu sync.Mutex
+	subs   map[string]*nats.Subscription
+
+	// pubLocks serialize publishing with history into a channel stream.
+	pubLocks []sync.Mutex
+
+	streamsMu sync.Mutex
+	streams   map[string]*natsStream
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+var _ centrifuge.Broker = (*NatsBroker)(nil)
+
+// Config is a config for NatsBroker.
+type Config struct {
+	// URL is a NATS server URL, several URLs may be separated by comma.
+	// By default, nats.DefaultURL.
+	URL string
+	// Prefix to use for NATS subjects and JetStream stream names. Only
+	// letters, digits, "_" and "-" allowed. By default, "centrifuge".
+	Prefix string
+	// StreamStorage is a storage type of JetStream streams. By default,
+	// nats.FileStorage.
+	StreamStorage nats.StorageType
+	// StreamReplicas is a number of JetStream stream replicas. By default, 1.
+	StreamReplicas int
+	// Options are additional options for NATS connection.
+	Options []nats.Option
+}
+
+const (
+	defaultNatsPrefix = "centrifuge"
+	// defaultNatsDuplicates is a JetStream default duplicate window.
+	defaultNatsDuplicates = 2 * time.Minute
+	// natsStreamCacheTTL is a time cached stream state of a channel kept after
+	// last publication.
+	natsStreamCacheTTL = time.Minute
+	// natsHistoryReadTimeout is a maximum time to wait for next stream message
+	// while reading history.
+	natsHistoryReadTimeout = 5 * time.Second
+	numPubLocks            = 4096
+)
+
+var natsPrefixRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// New initializes NatsBroker.
+func New(n *centrifuge.Node, config Config) (*NatsBroker, error) {
+	if config.URL == "" {
+		config.URL = nats.DefaultURL
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultNatsPrefix
+	}
+	if !natsPrefixRe.MatchString(config.Prefix) {
+		return nil, fmt.Errorf("nats broker: malformed prefix %q", config.Prefix)
+	}
+	if config.StreamReplicas <= 0 {
+		config.StreamReplicas = 1
+	}
+	return &NatsBroker{
+		node:        n,
+		config:      config,
+		resultCache: newResultCache(),
+		subs:        make(map[string]*nats.Subscription),
+		pubLocks:    make([]sync.Mutex, numPubLocks),
+		streams:     make(map[string]*natsStream),
+		closeCh:     make(chan struct{}),
+	}, nil
+}
+
+const (
+	natsTypeHeader   = "Centrifuge-Type"
+	natsOffsetHeader = "Centrifuge-Offset"
+	natsEpochHeader  = "Centrifuge-Epoch"
+	natsTimeHeader   = "Centrifuge-Time"
+	// natsExcludeClientsHeader is only set in core NATS messages, so exclusion
+	// list never gets into JetStream history.
+	natsExcludeClientsHeader = "Centrifuge-Exclude-Clients"
+)
+
+const (
+	natsJoinType  = "j"
+	natsLeaveType = "l"
+)
+
+func (b *NatsBroker) controlSubject() string {
+	return b.config.Prefix + ".control"
+}
+
+func (b *NatsBroker) nodeSubject(nodeID string) string {
+	return b.config.Prefix + ".node." + nodeID
+}
+
+// resetSubject used to notify all NatsBroker instances that channel stream was
+// reset so cached stream state must be reloaded.
+func (b *NatsBroker) resetSubject() string {
+	return b.config.Prefix + ".reset"
+}
+
+// clientSubject is a subject for live channel messages. Channel is hex encoded
+// since it may contain symbols not allowed in NATS subjects.
+func (b *NatsBroker) clientSubject(ch string) string {
+	return b.config.Prefix + ".client." + hex.EncodeToString([]byte(ch))
+}
+
+func (b *NatsBroker) historySubject(ch string) string {
+	return b.config.Prefix + ".history." + hex.EncodeToString([]byte(ch))
+}
+
+// streamName returns JetStream stream name for a channel. Channel is hashed to
+// fit stream name length limits.
+func (b *NatsBroker) streamName(ch string) string {
+	hash := sha256.Sum256([]byte(ch))
+	return b.config.Prefix + "_" + hex.EncodeToString(hash[:])
+}
+
+// Run connects to NATS server and subscribes to control subjects.
+func (b *NatsBroker) Run(h centrifuge.BrokerEventHandler) error {
+	b.eventHandler = h
+	opts := append([]nats.Option{nats.MaxReconnects(-1)}, b.config.Options...)
+	nc, err := nats.Connect(b.config.URL, opts...)
+	if err != nil {
+		return fmt.Errorf("error connecting to NATS: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("error creating JetStream context: %w", err)
+	}
+	b.nc = nc
+	b.js = js
+	handleControl := func(msg *nats.Msg) {
+		if err := h.HandleControl(msg.Data); err != nil {
+			b.node.Log(centrifuge.NewLogEntry(centrifuge.LogLevelError, "error handling control message", map[string]interface{}{"error": err.Error()}))
+		}
+	}
+	if _, err := nc.Subscribe(b.controlSubject(), handleControl); err != nil {
+		return err
+	}
+	if _, err := nc.Subscribe(b.nodeSubject(b.node.ID()), handleControl); err != nil {
+		return err
+	}
+	if _, err := nc.Subscribe(b.resetSubject(), func(msg *nats.Msg) {
+		b.removeStream(string(msg.Data))
+	}); err != nil {
+		return err
+	}
+	go b.resultCache.expireResults(b.closeCh)
+	go b.expireStreams()
+	return nil
+}
+
+// Close closes connection to NATS server and stops background jobs.
+func (b *NatsBroker) Close(_ context.Context) error {
+	b.closeOnce.Do(func() {
+		close(b.closeCh)
+	})
+	if b.nc != nil {
+		b.nc.Close()
+	}
+	return nil
+}
+
+// Publish - see centrifuge.Broker interface description.
+func (b *NatsBroker) Publish(ch string, data []byte, opts centrifuge.PublishOptions) (centrifuge.StreamPosition, error) {
+	if opts.CompactionKey != "" {
+		return centrifuge.StreamPosition{}, errors.New("compaction key is not supported by NatsBroker")
+	}
+	protoPub := &protocol.Publication{
+		Data: data,
+		Info: infoToProto(opts.ClientInfo),
+		Tags: opts.Tags,
+	}
+	byteMessage, err := protoPub.MarshalVT()
+	if err != nil {
+		return centrifuge.StreamPosition{}, err
+	}
+	publishTime := time.Now().UnixMilli()
+
+	if opts.HistorySize <= 0 || opts.HistoryTTL <= 0 {
+		useIdempotency := opts.IdempotencyKey != "" && opts.IdempotentResultTTL > 0
+		if useIdempotency {
+			if res, ok := b.resultCache.get(ch, opts.IdempotencyKey); ok {
+				return res, nil
+			}
+		}
+		err := b.publishPublication(ch, byteMessage, centrifuge.StreamPosition{}, publishTime, opts.ExcludeClients)
+		if err == nil && useIdempotency {
+			b.resultCache.set(ch, opts.IdempotencyKey, centrifuge.StreamPosition{}, opts.IdempotentResultTTL)
+		}
+		return centrifuge.StreamPosition{}, err
+	}
+
+	mu := b.pubLock(ch)
+	mu.Lock()
+	defer mu.Unlock()
+	s := b.getStream(ch)
+	sp, duplicate, err := b.addToStream(ch, s, byteMessage, publishTime, opts)
+	if err != nil || duplicate {
+		return sp, err
+	}
+	if err := b.publishPublication(ch, byteMessage, sp, publishTime, opts.ExcludeClients); err != nil {
+		return centrifuge.StreamPosition{}, fmt.Errorf("publication saved to history but not sent to subscribers: %w", err)
+	}
+	return sp, nil
+}
+
+func (b *NatsBroker) pubLock(ch string) *sync.Mutex {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(ch))
+	return &b.pubLocks[hash.Sum64()%numPubLocks]
+}
+
+func (b *NatsBroker) publishPublication(ch string, data []byte, sp centrifuge.StreamPosition, publishTime int64, excludeClients []string) error {
+	msg := nats.NewMsg(b.clientSubject(ch))
+	msg.Data = data
+	msg.Header.Set(natsTimeHeader, strconv.FormatInt(publishTime, 10))
+	if len(excludeClients) > 0 {
+		msg.Header.Set(natsExcludeClientsHeader, strings.Join(excludeClients, ","))
+	}
+	if sp.Offset > 0 {
+		msg.Header.Set(natsOffsetHeader, strconv.FormatUint(sp.Offset, 10))
+		msg.Header.Set(natsEpochHeader, sp.Epoch)
+	}
+	return b.nc.PublishMsg(msg)
+}
+
+// addToStream saves publication to channel JetStream stream. Must be called
+// with channel pubLock held.
+func (b *NatsBroker) addToStream(ch string, s *natsStream, data []byte, publishTime int64, opts centrifuge.PublishOptions) (centrifuge.StreamPosition, bool, error) {
+	for attempt := 0; ; attempt++ {
+		if err := b.ensureStream(ch, s, &opts); err != nil {
+			return centrifuge.StreamPosition{}, false, err
+		}
+		msg := nats.NewMsg(b.historySubject(ch))
+		msg.Data = data
+		msg.Header.Set(natsTimeHeader, strconv.FormatInt(publishTime, 10))
+		var pubOpts []nats.PubOpt
+		if opts.IdempotencyKey != "" {
+			pubOpts = append(pubOpts, nats.MsgId(opts.IdempotencyKey))
+		}
+		ack, err := b.js.PublishMsg(msg, pubOpts...)
+		if err != nil {
+			if attempt == 0 && errors.Is(err, nats.ErrNoStreamResponse) {
+				// Stream was deleted (reset by another Node), re-create it.
+				s.invalidate()
+				continue
+			}
+			return centrifuge.StreamPosition{}, false, err
+		}
+		if ack.Duplicate {
+			return centrifuge.StreamPosition{Offset: ack.Sequence, Epoch: s.epoch}, true, nil
+		}
+		if ack.Sequence <= s.lastSeq && attempt == 0 {
+			// Sequence moved back so stream was re-created by another Node and we
+			// don't know its epoch. Message is already saved, load stream state.
+			s.invalidate()
+			if err := b.ensureStream(ch, s, nil); err != nil {
+				return centrifuge.StreamPosition{}, false, err
+			}
+		}
+		s.lastSeq = ack.Sequence
+		return centrifuge.StreamPosition{Offset: ack.Sequence, Epoch: s.epoch}, false, nil
+	}
+}
+
+// PublishJoin - see centrifuge.Broker interface description.
+func (b *NatsBroker) PublishJoin(ch string, info *centrifuge.ClientInfo) error {
+	return b.publishInfo(ch, natsJoinType, info)
+}
+
+// PublishLeave - see centrifuge.Broker interface description.
+func (b *NatsBroker) PublishLeave(ch string, info *centrifuge.ClientInfo) error {
+	return b.publishInfo(ch, natsLeaveType, info)
+}
+
+func (b *NatsBroker) publishInfo(ch string, msgType string, info *centrifuge.ClientInfo) error {
+	data, err := infoToProto(info).MarshalVT()
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(b.clientSubject(ch))
+	msg.Data = data
+	msg.Header.Set(natsTypeHeader, msgType)
+	return b.nc.PublishMsg(msg)
+}
+
+// PublishControl - see centrifuge.Broker interface description.
+func (b *NatsBroker) PublishControl(data []byte, nodeID, _ string) error {
+	if nodeID == "" {
+		return b.nc.Publish(b.controlSubject(), data)
+	}
+	return b.nc.Publish(b.nodeSubject(nodeID), data)
+}
+
+// Subscribe - see centrifuge.Broker interface description.
+func (b *NatsBroker) Subscribe(ch string) error {
+	if b.node.LogEnabled(centrifuge.LogLevelDebug) {
+		b.node.Log(centrifuge.NewLogEntry(centrifuge.LogLevelDebug, "subscribe node on channel", map[string]interface{}{"channel": ch}))
+	}
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		return nil
+	}
+	sub, err := b.nc.Subscribe(b.clientSubject(ch), func(msg *nats.Msg) {
+		if err := b.handleClientMessage(ch, msg); err != nil {
+			b.node.Log(centrifuge.NewLogEntry(centrifuge.LogLevelError, "error handling client message", map[string]interface{}{"channel": ch, "error": err.Error()}))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	b.subs[ch] = sub
+	return nil
+}
+
+// Unsubscribe - see centrifuge.Broker interface description.
+func (b *NatsBroker) Unsubscribe(ch string) error {
+	if b.node.LogEnabled(centrifuge.LogLevelDebug) {
+		b.node.Log(centrifuge.NewLogEntry(centrifuge.LogLevelDebug, "unsubscribe node from channel", map[string]interface{}{"channel": ch}))
+	}
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	sub, ok := b.subs[ch]
+	if !ok {
+		return nil
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		return err
+	}
+	delete(b.subs, ch)
+	return nil
+}
+
+func (b *NatsBroker) handleClientMessage(ch string, msg *nats.Msg) error {
+	switch msg.Header.Get(natsTypeHeader) {
+	case natsJoinType, natsLeaveType:
+		var info protocol.ClientInfo
+		if err := info.UnmarshalVT(msg.Data); err != nil {
+			return err
+		}
+		if msg.Header.Get(natsTypeHeader) == natsJoinType {
+			return b.eventHandler.HandleJoin(ch, infoFromProto(&info))
+		}
+		return b.eventHandler.HandleLeave(ch, infoFromProto(&info))
+	}
+	pub, err := natsPublicationFromMsg(msg.Header, msg.Data)
+	if err != nil {
+		return err
+	}
+	var sp centrifuge.StreamPosition
+	if offset := msg.Header.Get(natsOffsetHeader); offset != "" {
+		pub.Offset, err = strconv.ParseUint(offset, 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed offset: %w", err)
+		}
+		sp = centrifuge.StreamPosition{Offset: pub.Offset, Epoch: msg.Header.Get(natsEpochHeader)}
+	}
+	if excludeClients := msg.Header.Get(natsExcludeClientsHeader); excludeClients != "" {
+		if h, ok := b.eventHandler.(centrifuge.ExcludeClientsBrokerEventHandler); ok {
+			return h.HandlePublicationExcludeClients(ch, pub, sp, strings.Split(excludeClients, ","))
+		}
+	}
+	return b.eventHandler.HandlePublication(ch, pub, sp)
+}
+
+func natsPublicationFromMsg(header nats.Header, data []byte) (*centrifuge.Publication, error) {
+	var protoPub protocol.Publication
+	if err := protoPub.UnmarshalVT(data); err != nil {
+		return nil, err
+	}
+	pub := pubFromProto(&protoPub)
+	if t := header.Get(natsTimeHeader); t != "" {
+		publishTime, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed time: %w", err)
+		}
+		pub.Time = publishTime
+	}
+	return pub, nil
+}
+
+// History - see centrifuge.Broker interface description.
+func (b *NatsBroker) History(ch string, filter centrifuge.HistoryFilter) ([]*centrifuge.Publication, centrifuge.StreamPosition, error) {
+	limit := filter.Limit
+	if filter.HasPublicationFilter() && limit > 0 {
+		// Limit applies to matching publications so we need to read the whole range.
+		filter.Limit = -1
+	}
+
+	info, err := b.js.StreamInfo(b.streamName(ch))
+	if err != nil {
+		if isNatsStreamNotFound(err) {
+			// Nothing was published into channel with history yet.
+			return nil, centrifuge.StreamPosition{}, nil
+		}
+		return nil, centrifuge.StreamPosition{}, err
+	}
+	state := info.State
+	streamPosition := centrifuge.StreamPosition{Offset: state.LastSeq, Epoch: info.Config.Description}
+
+	if filter.Limit == 0 || state.Msgs == 0 {
+		return nil, streamPosition, nil
+	}
+
+	first, last := state.FirstSeq, state.LastSeq
+	if since := filter.Since; since != nil {
+		if !filter.Reverse {
+			if since.Offset+1 > first {
+				first = since.Offset + 1
+			}
+		} else {
+			if since.Offset == 0 {
+				return nil, streamPosition, nil
+			}
+			if since.Offset-1 < last {
+				last = since.Offset - 1
+			}
+		}
+	}
+	if first > last {
+		return nil, streamPosition, nil
+	}
+	readLimit := filter.Limit
+	if filter.Reverse && filter.Limit > 0 && last-first+1 > uint64(filter.Limit) {
+		first = last - uint64(filter.Limit) + 1
+		readLimit = -1
+	}
+
+	pubs, err := b.readStream(ch, first, last, readLimit)
+	if err != nil {
+		return nil, centrifuge.StreamPosition{}, err
+	}
+	if filter.Reverse {
+		for i, j := 0, len(pubs)-1; i < j; i, j = i+1, j-1 {
+			pubs[i], pubs[j] = pubs[j], pubs[i]
+		}
+	}
+	return filterPublications(pubs, filter, limit), streamPosition, nil
+}
+
+// readStream reads channel stream messages with sequences in range [first, last]
+// using ordered consumer. Reading stops after limit messages if limit is positive.
+func (b *NatsBroker) readStream(ch string, first, last uint64, limit int) ([]*centrifuge.Publication, error) {
+	sub, err := b.js.SubscribeSync(
+		b.historySubject(ch),
+		nats.BindStream(b.streamName(ch)),
+		nats.OrderedConsumer(),
+		nats.StartSequence(first),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	var pubs []*centrifuge.Publication
+	for limit <= 0 || len(pubs) < limit {
+		msg, err := sub.NextMsg(natsHistoryReadTimeout)
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) {
+				// Messages removed from stream while reading.
+				break
+			}
+			return nil, err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		if meta.Sequence.Stream > last {
+			break
+		}
+		pub, err := natsPublicationFromMsg(msg.Header, msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		pub.Offset = meta.Sequence.Stream
+		pubs = append(pubs, pub)
+		if meta.Sequence.Stream == last || meta.NumPending == 0 {
+			break
+		}
+	}
+	return pubs, nil
+}
+
+// RemoveHistory - see centrifuge.Broker interface description. Stream epoch and offset are
+// kept.
+func (b *NatsBroker) RemoveHistory(ch string) error {
+	err := b.js.PurgeStream(b.streamName(ch))
+	if err != nil && !isNatsStreamNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+var _ centrifuge.StreamResetter = (*NatsBroker)(nil)
+
+// ResetStream - see centrifuge.StreamResetter interface description. Returns
+// empty StreamPosition if channel has no stream.
+func (b *NatsBroker) ResetStream(ch string) (centrifuge.StreamPosition, error) {
+	mu := b.pubLock(ch)
+	mu.Lock()
+	defer mu.Unlock()
+	info, err := b.js.StreamInfo(b.streamName(ch))
+	if err != nil {
+		if isNatsStreamNotFound(err) {
+			return centrifuge.StreamPosition{}, nil
+		}
+		return centrifuge.StreamPosition{}, err
+	}
+	err = b.js.DeleteStream(b.streamName(ch))
+	if err != nil && !isNatsStreamNotFound(err) {
+		return centrifuge.StreamPosition{}, err
+	}
+	// Stream re-created with the same limits.
+	s := b.getStream(ch)
+	s.invalidate()
+	s.config = info.Config
+	if err := b.ensureStream(ch, s, nil); err != nil {
+		return centrifuge.StreamPosition{}, err
+	}
+	if err := b.nc.Publish(b.resetSubject(), []byte(ch)); err != nil {
+		return centrifuge.StreamPosition{}, err
+	}
+	return centrifuge.StreamPosition{Offset: s.lastSeq, Epoch: s.epoch}, nil
+}
+
+func isNatsStreamNotFound(err error) bool {
+	return errors.Is(err, nats.ErrStreamNotFound) || strings.Contains(err.Error(), "stream not found")
+}
+
+// natsStream keeps cached state of channel JetStream stream. Fields are
+// protected by channel pubLock.
+type natsStream struct {
+	ready   bool
+	epoch   string
+	lastSeq uint64
+	config  nats.StreamConfig
+	// lastUsed is protected by NatsBroker.streamsMu.
+	lastUsed int64
+}
+
+func (s *natsStream) invalidate() {
+	s.ready = false
+}
+
+func (s *natsStream) load(info *nats.StreamInfo) {
+	s.ready = true
+	s.epoch = info.Config.Description
+	s.lastSeq = info.State.LastSeq
+	s.config = info.Config
+}
+
+func (b *NatsBroker) getStream(ch string) *natsStream {
+	b.streamsMu.Lock()
+	defer b.streamsMu.Unlock()
+	s, ok := b.streams[ch]
+	if !ok {
+		s = &natsStream{}
+		b.streams[ch] = s
+	}
+	s.lastUsed = time.Now().UnixNano()
+	return s
+}
+
+func (b *NatsBroker) removeStream(ch string) {
+	b.streamsMu.Lock()
+	defer b.streamsMu.Unlock()
+	delete(b.streams, ch)
+}
+
+// expireStreams periodically removes cached state of streams not used
+// for natsStreamCacheTTL.
+func (b *NatsBroker) expireStreams() {
+	ticker := time.NewTicker(natsStreamCacheTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closeCh:
+			return
+		case <-ticker.C:
+			b.removeStreamsUsedBefore(time.Now().Add(-natsStreamCacheTTL).UnixNano())
+		}
+	}
+}
+
+func (b *NatsBroker) removeStreamsUsedBefore(t int64) {
+	b.streamsMu.Lock()
+	defer b.streamsMu.Unlock()
+	for ch, s := range b.streams {
+		if s.lastUsed < t {
+			delete(b.streams, ch)
+		}
+	}
+}
+
+// streamConfig builds JetStream stream config. If opts passed then stream limits
+// are set according to history options, otherwise last known limits are kept.
+func (b *NatsBroker) streamConfig(ch string, s *natsStream, opts *centrifuge.PublishOptions, epoch string) nats.StreamConfig {
+	config := nats.StreamConfig{
+		Name:        b.streamName(ch),
+		Description: epoch,
+		Subjects:    []string{b.historySubject(ch)},
+		Storage:     b.config.StreamStorage,
+		Replicas:    b.config.StreamReplicas,
+		Discard:     nats.DiscardOld,
+		MaxMsgs:     -1,
+		MaxBytes:    -1,
+		Duplicates:  defaultNatsDuplicates,
+	}
+	if opts == nil {
+		if s.config.Name != "" {
+			config.MaxMsgs = s.config.MaxMsgs
+			config.MaxBytes = s.config.MaxBytes
+			config.MaxAge = s.config.MaxAge
+			config.Duplicates = s.config.Duplicates
+		}
+		return config
+	}
+	config.MaxMsgs = int64(opts.HistorySize)
+	config.MaxAge = opts.HistoryTTL
+	if opts.HistoryMaxPublicationAge > 0 && opts.HistoryMaxPublicationAge < config.MaxAge {
+		config.MaxAge = opts.HistoryMaxPublicationAge
+	}
+	if opts.HistoryMaxBytes > 0 {
+		config.MaxBytes = int64(opts.HistoryMaxBytes)
+	}
+	if opts.IdempotencyKey != "" && opts.IdempotentResultTTL > 0 {
+		config.Duplicates = opts.IdempotentResultTTL
+	} else if s.config.Name != "" {
+		// Do not change duplicate window when publishing without idempotency key.
+		config.Duplicates = s.config.Duplicates
+	}
+	if config.Duplicates > config.MaxAge {
+		// JetStream requires duplicate window to be not greater than MaxAge.
+		config.Duplicates = config.MaxAge
+	}
+	return config
+}
+
+// ensureStream loads stream state creating stream if needed and updates stream
+// limits if history options changed. Must be called with channel pubLock held.
+func (b *NatsBroker) ensureStream(ch string, s *natsStream, opts *centrifuge.PublishOptions) error {
+	if !s.ready {
+		info, err := b.js.StreamInfo(b.streamName(ch))
+		if err != nil && isNatsStreamNotFound(err) {
+			config := b.streamConfig(ch, s, opts, strconv.FormatInt(time.Now().UnixNano(), 10))
+			info, err = b.js.AddStream(&config)
+			if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+				// Stream was created concurrently.
+				info, err = b.js.StreamInfo(b.streamName(ch))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		s.load(info)
+	}
+	if opts == nil {
+		return nil
+	}
+	config := b.streamConfig(ch, s, opts, s.epoch)
+	if config.MaxMsgs != s.config.MaxMsgs || config.MaxBytes != s.config.MaxBytes ||
+		config.MaxAge != s.config.MaxAge || config.Duplicates != s.config.Duplicates {
+		info, err := b.js.UpdateStream(&config)
+		if err != nil {
+			return err
+		}
+		s.load(info)
+	}
+	return nil
+}
+
+// filterPublications returns publications which match filter. Limit applied
+// to the result if positive.
+func filterPublications(pubs []*centrifuge.Publication, filter centrifuge.HistoryFilter, limit int) []*centrifuge.Publication {
+	if !filter.HasPublicationFilter() {
+		return pubs
+	}
+	result := make([]*centrifuge.Publication, 0, len(pubs))
+	for _, pub := range pubs {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		if filter.Match(pub) {
+			result = append(result, pub)
+		}
+	}
+	return result
+}
+
+func infoFromProto(v *protocol.ClientInfo) *centrifuge.ClientInfo {
+	if v == nil {
+		return nil
+	}
+	info := &centrifuge.ClientInfo{
+		ClientID: v.GetClient(),
+		UserID:   v.GetUser(),
+	}
+	if len(v.ConnInfo) > 0 {
+		info.ConnInfo = v.ConnInfo
+	}
+	if len(v.ChanInfo) > 0 {
+		info.ChanInfo = v.ChanInfo
+	}
+	return info
+}
+
+func infoToProto(v *centrifuge.ClientInfo) *protocol.ClientInfo {
+	if v == nil {
+		return nil
+	}
+	info := &protocol.ClientInfo{
+		Client: v.ClientID,
+		User:   v.UserID,
+	}
+	if len(v.ConnInfo) > 0 {
+		info.ConnInfo = v.ConnInfo
+	}
+	if len(v.ChanInfo) > 0 {
+		info.ChanInfo = v.ChanInfo
+	}
+	return info
+}
+
+func pubFromProto(pub *protocol.Publication) *centrifuge.Publication {
+	return &centrifuge.Publication{
+		Offset: pub.GetOffset(),
+		Data:   pub.Data,
+		Info:   infoFromProto(pub.GetInfo()),
+		Tags:   pub.GetTags(),
+	}
+}
@@ -0,0 +1,201 @@
+package natsbroker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/centrifugal/centrifuge/internal/brokertest"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func runTestNatsServer(tb testing.TB) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  tb.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(tb, err)
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		tb.Fatal("nats server not ready")
+	}
+	tb.Cleanup(s.Shutdown)
+	return s
+}
+
+func testNode(tb testing.TB) *centrifuge.Node {
+	n, err := centrifuge.New(centrifuge.Config{
+		LogLevel:   centrifuge.LogLevelDebug,
+		LogHandler: func(entry centrifuge.LogEntry) {},
+	})
+	require.NoError(tb, err)
+	return n
+}
+
+func newTestNatsBroker(tb testing.TB, s *server.Server) *NatsBroker {
+	n := testNode(tb)
+	b, err := New(n, Config{URL: s.ClientURL()})
+	require.NoError(tb, err)
+	n.SetBroker(b)
+	require.NoError(tb, n.Run())
+	tb.Cleanup(func() { _ = n.Shutdown(context.Background()) })
+	return b
+}
+
+func testNatsBroker(tb testing.TB) *NatsBroker {
+	return newTestNatsBroker(tb, runTestNatsServer(tb))
+}
+
+func testPublicationData() []byte {
+	return []byte("{}")
+}
+
+func TestNatsBrokerSuite(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) centrifuge.Broker {
+		b, err := New(brokertest.NewNode(t, centrifuge.Config{}), Config{URL: runTestNatsServer(t).ClientURL()})
+		require.NoError(t, err)
+		return b
+	})
+}
+
+func TestNatsBrokerMalformedPrefix(t *testing.T) {
+	_, err := New(testNode(t), Config{Prefix: "a.b"})
+	require.Error(t, err)
+}
+
+func TestNatsBrokerHistoryNoStream(t *testing.T) {
+	e := testNatsBroker(t)
+
+	pubs, sp, err := e.History("channel", centrifuge.HistoryFilter{Limit: -1})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+	require.Equal(t, centrifuge.StreamPosition{}, sp)
+	resetSP, err := e.ResetStream("channel")
+	require.NoError(t, err)
+	require.Equal(t, centrifuge.StreamPosition{}, resetSP)
+	require.NoError(t, e.RemoveHistory("channel"))
+
+	// Stream is not created by reading history.
+	_, err = e.js.StreamInfo(e.streamName("channel"))
+	require.ErrorIs(t, err, nats.ErrStreamNotFound)
+	// Neither by publishing without history.
+	_, err = e.Publish("channel", testPublicationData(), centrifuge.PublishOptions{})
+	require.NoError(t, err)
+	_, err = e.js.StreamInfo(e.streamName("channel"))
+	require.ErrorIs(t, err, nats.ErrStreamNotFound)
+
+	pos, err := e.Publish("channel", testPublicationData(), centrifuge.PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), pos.Offset)
+	require.NotEmpty(t, pos.Epoch)
+	info, err := e.js.StreamInfo(e.streamName("channel"))
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, info.Config.MaxAge)
+	require.Equal(t, int64(10), info.Config.MaxMsgs)
+
+	_, sp, err = e.History("channel", centrifuge.HistoryFilter{})
+	require.NoError(t, err)
+	require.Equal(t, pos, sp)
+}
+
+func TestNatsBrokerExpireStreams(t *testing.T) {
+	e := testNatsBroker(t)
+
+	_, err := e.Publish("channel", testPublicationData(), centrifuge.PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	e.removeStreamsUsedBefore(time.Now().Add(-natsStreamCacheTTL).UnixNano())
+	e.streamsMu.Lock()
+	require.Len(t, e.streams, 1)
+	e.streamsMu.Unlock()
+
+	// Cached state is reloaded after removal.
+	e.removeStreamsUsedBefore(time.Now().Add(time.Second).UnixNano())
+	e.streamsMu.Lock()
+	require.Len(t, e.streams, 0)
+	e.streamsMu.Unlock()
+	pos, err := e.Publish("channel", testPublicationData(), centrifuge.PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), pos.Offset)
+}
+
+func TestNatsBrokerHistoryReverseLimit(t *testing.T) {
+	e := testNatsBroker(t)
+
+	for i := 0; i < 10; i++ {
+		_, err := e.Publish("channel", testPublicationData(), centrifuge.PublishOptions{HistorySize: 5, HistoryTTL: time.Minute})
+		require.NoError(t, err)
+	}
+
+	pubs, _, err := e.History("channel", centrifuge.HistoryFilter{Limit: 3, Reverse: true})
+	require.NoError(t, err)
+	require.Len(t, pubs, 3)
+	require.Equal(t, uint64(10), pubs[0].Offset)
+	require.Equal(t, uint64(8), pubs[2].Offset)
+
+	pubs, _, err = e.History("channel", centrifuge.HistoryFilter{Limit: 10, Reverse: true})
+	require.NoError(t, err)
+	require.Len(t, pubs, 5)
+	require.Equal(t, uint64(6), pubs[4].Offset)
+
+	pubs, _, err = e.History("channel", centrifuge.HistoryFilter{Limit: -1, Since: &centrifuge.StreamPosition{Offset: 3}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 5)
+	require.Equal(t, uint64(6), pubs[0].Offset)
+}
+
+func TestNatsBrokerResetStreamOtherNode(t *testing.T) {
+	s := runTestNatsServer(t)
+	e1 := newTestNatsBroker(t, s)
+	e2 := newTestNatsBroker(t, s)
+
+	opts := centrifuge.PublishOptions{HistorySize: 10, HistoryTTL: time.Minute}
+	for i := 0; i < 3; i++ {
+		_, err := e1.Publish("channel", []byte("{}"), opts)
+		require.NoError(t, err)
+	}
+	resetSP, err := e2.ResetStream("channel")
+	require.NoError(t, err)
+
+	pos, err := e1.Publish("channel", []byte("{}"), opts)
+	require.NoError(t, err)
+	require.Equal(t, centrifuge.StreamPosition{Offset: 1, Epoch: resetSP.Epoch}, pos)
+}
+
+func TestNatsBrokerCompactionKeyNotSupported(t *testing.T) {
+	e := testNatsBroker(t)
+	_, err := e.Publish("channel", []byte("{}"), centrifuge.PublishOptions{HistorySize: 10, HistoryTTL: time.Minute, CompactionKey: "k"})
+	require.Error(t, err)
+}
+
+func TestNatsBrokerCloseStopsBackgroundJobs(t *testing.T) {
+	e := testNatsBroker(t)
+	require.NoError(t, e.Close(context.Background()))
+	// Closing again is safe.
+	require.NoError(t, e.Close(context.Background()))
+	select {
+	case <-e.closeCh:
+	default:
+		require.Fail(t, "close channel not closed")
+	}
+
+	c := newResultCache()
+	closeCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.expireResults(closeCh)
+		close(done)
+	}()
+	close(closeCh)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "expireResults not stopped")
+	}
+}
@@ -0,0 +1,92 @@
+package natsbroker
+
+import (
+	"container/heap"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/centrifugal/centrifuge/internal/priority"
+)
+
+// resultCache keeps results of publishing with idempotency key without history.
+type resultCache struct {
+	sync.Mutex
+	results         map[string]resultCacheItem
+	expireQueue     priority.Queue
+	nextExpireCheck int64
+}
+
+type resultCacheItem struct {
+	streamPosition centrifuge.StreamPosition
+	expireAt       int64
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{
+		results: make(map[string]resultCacheItem),
+	}
+}
+
+func resultCacheKey(ch string, key string) string {
+	return strconv.Itoa(len(ch)) + ":" + ch + key
+}
+
+func (c *resultCache) get(ch string, key string) (centrifuge.StreamPosition, bool) {
+	c.Lock()
+	defer c.Unlock()
+	item, ok := c.results[resultCacheKey(ch, key)]
+	if !ok || item.expireAt <= time.Now().UnixNano() {
+		return centrifuge.StreamPosition{}, false
+	}
+	return item.streamPosition, true
+}
+
+func (c *resultCache) set(ch string, key string, sp centrifuge.StreamPosition, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	expireAt := time.Now().Add(ttl).UnixNano()
+	cacheKey := resultCacheKey(ch, key)
+	c.results[cacheKey] = resultCacheItem{streamPosition: sp, expireAt: expireAt}
+	heap.Push(&c.expireQueue, &priority.Item{Value: cacheKey, Priority: expireAt})
+	if c.nextExpireCheck == 0 || c.nextExpireCheck > expireAt {
+		c.nextExpireCheck = expireAt
+	}
+}
+
+// expireResults removes expired results until closeCh is closed.
+func (c *resultCache) expireResults(closeCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var nextExpireCheck int64
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+		}
+		c.Lock()
+		now := time.Now().UnixNano()
+		if c.nextExpireCheck == 0 || c.nextExpireCheck > now {
+			c.Unlock()
+			continue
+		}
+		nextExpireCheck = 0
+		for c.expireQueue.Len() > 0 {
+			item := heap.Pop(&c.expireQueue).(*priority.Item)
+			expireAt := item.Priority
+			if expireAt > now {
+				heap.Push(&c.expireQueue, item)
+				nextExpireCheck = expireAt
+				break
+			}
+			result, ok := c.results[item.Value]
+			if ok && result.expireAt <= expireAt {
+				delete(c.results, item.Value)
+			}
+		}
+		c.nextExpireCheck = nextExpireCheck
+		c.Unlock()
+	}
+}
@@ -61,6 +61,8 @@ type Node struct {
 	controlDecoder controlproto.Decoder
 	// subLocks synchronizes access to adding/removing subscriptions.
 	subLocks map[int]*sync.Mutex
+	// userRateLimiter keeps token buckets of Config.CommandRateLimit.UserLimits.
+	userRateLimiter *rateLimiter
 
 	metricsMu       sync.Mutex
 	metricsExporter *eagle.Eagle
@@ -143,20 +145,21 @@ func New(c Config) (*Node, error) {
 	}
 
 	n := &Node{
-		uid:            uid,
-		nodes:          newNodeRegistry(uid),
-		config:         c,
-		hub:            newHub(lg),
-		startedAt:      time.Now().Unix(),
-		shutdownCh:     make(chan struct{}),
-		logger:         lg,
-		controlEncoder: controlproto.NewProtobufEncoder(),
-		controlDecoder: controlproto.NewProtobufDecoder(),
-		clientEvents:   &eventHub{},
-		subLocks:       subLocks,
-		subDissolver:   dissolve.New(numSubDissolverWorkers),
-		nowTimeGetter:  nowtime.Get,
-		surveyRegistry: make(map[uint64]chan survey),
+		uid:             uid,
+		nodes:           newNodeRegistry(uid),
+		config:          c,
+		hub:             newHub(lg),
+		startedAt:       time.Now().Unix(),
+		shutdownCh:      make(chan struct{}),
+		logger:          lg,
+		controlEncoder:  controlproto.NewProtobufEncoder(),
+		controlDecoder:  controlproto.NewProtobufDecoder(),
+		clientEvents:    &eventHub{},
+		subLocks:        subLocks,
+		userRateLimiter: newRateLimiter(),
+		subDissolver:    dissolve.New(numSubDissolverWorkers),
+		nowTimeGetter:   nowtime.Get,
+		surveyRegistry:  make(map[uint64]chan survey),
 	}
 	n.emulationSurveyHandler = newEmulationSurveyHandler(n)
 
@@ -222,6 +225,11 @@ func (n *Node) Hub() *Hub {
 // Run performs node startup actions. At moment must be called once on start
 // after Broker set to Node.
 func (n *Node) Run() error {
+	if n.config.CommandRateLimit.UserLimitsClusterWide {
+		if _, ok := n.broker.(RateLimiter); !ok {
+			return errors.New("cluster-wide user rate limits require Broker implementing RateLimiter")
+		}
+	}
 	if err := n.broker.Run(&brokerEventHandler{n}); err != nil {
 		return err
 	}
@@ -391,7 +399,7 @@ func (n *Node) handleNotification(fromNodeID string, req *controlpb.Notification
 }
 
 func (n *Node) handleSurveyRequest(fromNodeID string, req *controlpb.SurveyRequest) error {
-	if n.surveyHandler == nil {
+	if n.surveyHandler == nil && req.Op != userStatusOp && req.Op != clientCallOp {
 		return nil
 	}
 	cb := func(reply SurveyReply) {
@@ -409,6 +417,14 @@ func (n *Node) handleSurveyRequest(fromNodeID string, req *controlpb.SurveyReque
 		}
 		_ = n.publishControl(cmd, fromNodeID)
 	}
+	if req.Op == userStatusOp {
+		n.handleUserStatusSurvey(SurveyEvent{Op: req.Op, Data: req.Data}, cb)
+		return nil
+	}
+	if req.Op == clientCallOp {
+		n.handleClientCallSurvey(SurveyEvent{Op: req.Op, Data: req.Data}, cb)
+		return nil
+	}
 	n.surveyHandler(SurveyEvent{Op: req.Op, Data: req.Data}, cb)
 	return nil
 }
@@ -461,7 +477,7 @@ const defaultSurveyTimeout = 10 * time.Second
 // method to handle received surveys.
 // Survey ops starting with `centrifuge_` are reserved by Centrifuge library.
 func (n *Node) Survey(ctx context.Context, op string, data []byte, toNodeID string) (map[string]SurveyResult, error) {
-	if n.surveyHandler == nil && op != emulationOp {
+	if n.surveyHandler == nil && op != emulationOp && op != userStatusOp && op != clientCallOp {
 		return nil, errSurveyHandlerNotRegistered
 	}
 
@@ -524,6 +540,20 @@ func (n *Node) Survey(ctx context.Context, op string, data []byte, toNodeID stri
 					Result: SurveyResult(reply),
 				}
 			})
+		} else if op == userStatusOp {
+			n.handleUserStatusSurvey(SurveyEvent{Op: op, Data: data}, func(reply SurveyReply) {
+				surveyChan <- survey{
+					UID:    n.uid,
+					Result: SurveyResult(reply),
+				}
+			})
+		} else if op == clientCallOp {
+			n.handleClientCallSurvey(SurveyEvent{Op: op, Data: data}, func(reply SurveyReply) {
+				surveyChan <- survey{
+					UID:    n.uid,
+					Result: SurveyResult(reply),
+				}
+			})
 		} else {
 			n.surveyHandler(SurveyEvent{Op: op, Data: data}, func(reply SurveyReply) {
 				surveyChan <- survey{
@@ -670,7 +700,15 @@ func (n *Node) handleControl(data []byte) error {
 		if cmd.RecoverSince != nil {
 			recoverSince = &StreamPosition{Offset: cmd.RecoverSince.Offset, Epoch: cmd.RecoverSince.Epoch}
 		}
-		return n.hub.subscribe(cmd.User, cmd.Channel, cmd.Client, cmd.Session, WithExpireAt(cmd.ExpireAt), WithChannelInfo(cmd.ChannelInfo), WithEmitPresence(cmd.EmitPresence), WithEmitJoinLeave(cmd.EmitJoinLeave), WithPushJoinLeave(cmd.PushJoinLeave), WithPositioning(cmd.Position), WithRecovery(cmd.Recover), WithSubscribeData(cmd.Data), WithRecoverSince(recoverSince), WithSubscribeSource(uint8(cmd.Source)))
+		var tagsFilter *TagsFilter
+		if cmd.TagsFilter != "" {
+			tagsFilter, err = ParseTagsFilter(cmd.TagsFilter)
+			if err != nil {
+				n.logger.log(newLogEntry(LogLevelError, "error parsing subscribe tags filter", map[string]interface{}{"error": err.Error()}))
+				return err
+			}
+		}
+		return n.hub.subscribe(cmd.User, cmd.Channel, cmd.Client, cmd.Session, WithExpireAt(cmd.ExpireAt), WithChannelInfo(cmd.ChannelInfo), WithEmitPresence(cmd.EmitPresence), WithEmitJoinLeave(cmd.EmitJoinLeave), WithPushJoinLeave(cmd.PushJoinLeave), WithPositioning(cmd.Position), WithRecovery(cmd.Recover), WithSubscribeData(cmd.Data), WithRecoverSince(recoverSince), WithSubscribeSource(uint8(cmd.Source)), WithSubscribeFilter(tagsFilter), WithDelta(DeltaType(cmd.DeltaType)), WithLatestPublication(cmd.LatestPublication), WithJoinLeaveUserLevel(cmd.JoinLeaveUserLevel), WithPattern(cmd.Pattern))
 	case controlpb.Command_DISCONNECT:
 		cmd, err := n.controlDecoder.DecodeDisconnect(params)
 		if err != nil {
@@ -706,6 +744,30 @@ func (n *Node) handleControl(data []byte) error {
 			return err
 		}
 		return n.hub.refresh(cmd.User, cmd.Client, cmd.Session, WithRefreshExpired(cmd.Expired), WithRefreshExpireAt(cmd.ExpireAt), WithRefreshInfo(cmd.Info))
+	case controlpb.Command_RESET_STREAM:
+		cmd, err := n.controlDecoder.DecodeResetStream(params)
+		if err != nil {
+			n.logger.log(newLogEntry(LogLevelError, "error decoding reset stream control params", map[string]interface{}{"error": err.Error()}))
+			return err
+		}
+		var sp StreamPosition
+		if cmd.Position != nil {
+			sp = StreamPosition{Offset: cmd.Position.Offset, Epoch: cmd.Position.Epoch}
+		}
+		n.hub.resetStream(cmd.Channel, sp)
+		return nil
+	case controlpb.Command_PRESENCE_INFO:
+		cmd, err := n.controlDecoder.DecodePresenceInfo(params)
+		if err != nil {
+			n.logger.log(newLogEntry(LogLevelError, "error decoding presence info control params", map[string]interface{}{"error": err.Error()}))
+			return err
+		}
+		return n.hub.broadcastPresenceInfo(cmd.Channel, &ClientInfo{
+			UserID:   cmd.User,
+			ClientID: cmd.Client,
+			ConnInfo: cmd.ConnInfo,
+			ChanInfo: cmd.ChanInfo,
+		})
 	default:
 		n.logger.log(newLogEntry(LogLevelError, "unknown control message method", map[string]interface{}{"method": method}))
 		return fmt.Errorf("control method not found: %d", method)
@@ -715,14 +777,39 @@ func (n *Node) handleControl(data []byte) error {
 // handlePublication handles messages published into channel and
 // coming from Broker. The goal of method is to deliver this message
 // to all clients on this node currently subscribed to channel.
-func (n *Node) handlePublication(ch string, pub *Publication, sp StreamPosition) error {
+func (n *Node) handlePublication(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
 	incMessagesReceived("publication")
 	numSubscribers := n.hub.NumSubscribers(ch)
 	hasCurrentSubscribers := numSubscribers > 0
 	if !hasCurrentSubscribers {
 		return nil
 	}
-	return n.hub.BroadcastPublication(ch, pub, sp)
+	return n.hub.broadcastPublication(ch, n.clientPublication(pub), sp, excludeClients)
+}
+
+// handlePatternPublication broadcasts Publication published into channel ch to
+// local clients subscribed on matching pattern.
+func (n *Node) handlePatternPublication(pattern string, ch string, pub *Publication, excludeClients []string) error {
+	if n.hub.numPatternSubscribers(pattern) == 0 {
+		return nil
+	}
+	return n.hub.broadcastPatternPublication(pattern, ch, n.clientPublication(pub), excludeClients)
+}
+
+// clientPublication returns Publication to be sent to clients. It attaches
+// publication time to tags if Config.PublicationTimeTag set.
+func (n *Node) clientPublication(pub *Publication) *Publication {
+	if n.config.PublicationTimeTag == "" || pub.Time == 0 {
+		return pub
+	}
+	tags := make(map[string]string, len(pub.Tags)+1)
+	for k, v := range pub.Tags {
+		tags[k] = v
+	}
+	tags[n.config.PublicationTimeTag] = strconv.FormatInt(pub.Time, 10)
+	pubCopy := *pub
+	pubCopy.Tags = tags
+	return &pubCopy
 }
 
 // handleJoin handles join messages - i.e. broadcasts it to
@@ -788,6 +875,86 @@ func (n *Node) Publish(channel string, data []byte, opts ...PublishOption) (Publ
 	return n.publish(channel, data, opts...)
 }
 
+// PublishRequest describes a single publication in Node.PublishMany.
+type PublishRequest struct {
+	// Channel to publish into.
+	Channel string
+	// Data to publish.
+	Data []byte
+	// Options of publication.
+	Options []PublishOption
+}
+
+// PublishManyResult is a result of a single publication in Node.PublishMany
+// and Node.Broadcast.
+type PublishManyResult struct {
+	PublishResult
+	// Error is set if publication failed.
+	Error error
+}
+
+// PublishMany publishes many publications in one call. If Broker implements
+// BatchPublisher then publications are published in an efficient way (for
+// example, RedisBroker pipelines requests to Redis), otherwise publications
+// are published one by one. See Publish for publication semantics.
+//
+// Returned slice contains a result for each request at the same index.
+func (n *Node) PublishMany(reqs []PublishRequest) []PublishManyResult {
+	brokerReqs := make([]BrokerPublishRequest, 0, len(reqs))
+	for _, req := range reqs {
+		pubOpts := PublishOptions{}
+		for _, opt := range req.Options {
+			opt(&pubOpts)
+		}
+		brokerReqs = append(brokerReqs, BrokerPublishRequest{
+			Channel: req.Channel,
+			Data:    req.Data,
+			Options: pubOpts,
+		})
+	}
+	return n.publishMany(brokerReqs)
+}
+
+// Broadcast publishes the same data with the same options into many channels.
+// This may be useful to send an event to many personal channels of users.
+// See PublishMany for details.
+//
+// Returned slice contains a result for each channel at the same index.
+func (n *Node) Broadcast(channels []string, data []byte, opts ...PublishOption) []PublishManyResult {
+	pubOpts := PublishOptions{}
+	for _, opt := range opts {
+		opt(&pubOpts)
+	}
+	brokerReqs := make([]BrokerPublishRequest, 0, len(channels))
+	for _, ch := range channels {
+		brokerReqs = append(brokerReqs, BrokerPublishRequest{
+			Channel: ch,
+			Data:    data,
+			Options: pubOpts,
+		})
+	}
+	return n.publishMany(brokerReqs)
+}
+
+func (n *Node) publishMany(reqs []BrokerPublishRequest) []PublishManyResult {
+	results := make([]PublishManyResult, len(reqs))
+	for range reqs {
+		incMessagesSent("publication")
+	}
+	if batchPublisher, ok := n.broker.(BatchPublisher); ok {
+		brokerResults := batchPublisher.PublishMany(reqs)
+		for i, res := range brokerResults {
+			results[i] = PublishManyResult{PublishResult: PublishResult{StreamPosition: res.StreamPosition}, Error: res.Error}
+		}
+		return results
+	}
+	for i, req := range reqs {
+		sp, err := n.broker.Publish(req.Channel, req.Data, req.Options)
+		results[i] = PublishManyResult{PublishResult: PublishResult{StreamPosition: sp}, Error: err}
+	}
+	return results
+}
+
 // publishJoin allows publishing join message into channel when someone subscribes on it
 // or leave message when someone unsubscribes from channel.
 func (n *Node) publishJoin(ch string, info *ClientInfo) error {
@@ -927,6 +1094,12 @@ func (n *Node) pubSubscribe(user string, ch string, opts SubscribeOptions) error
 		Session:       opts.sessionID,
 		Data:          opts.Data,
 		Source:        uint32(opts.Source),
+		TagsFilter:    opts.TagsFilter.String(),
+		DeltaType:     string(opts.DeltaType),
+
+		LatestPublication:  opts.EnableLatestPublication,
+		JoinLeaveUserLevel: opts.JoinLeaveUserLevel,
+		Pattern:            opts.Pattern,
 	}
 	if opts.RecoverSince != nil {
 		subscribe.RecoverSince = &controlpb.StreamPosition{
@@ -961,6 +1134,45 @@ func (n *Node) pubRefresh(user string, opts RefreshOptions) error {
 	return n.publishControl(cmd, "")
 }
 
+// pubResetStream publishes reset stream control message to all nodes – so all
+// nodes could let channel subscribers resubscribe.
+func (n *Node) pubResetStream(ch string, sp StreamPosition) error {
+	resetStream := &controlpb.ResetStream{
+		Channel:  ch,
+		Position: &controlpb.StreamPosition{Offset: sp.Offset, Epoch: sp.Epoch},
+	}
+	params, _ := n.controlEncoder.EncodeResetStream(resetStream)
+	cmd := &controlpb.Command{
+		Uid:    n.uid,
+		Method: controlpb.Command_RESET_STREAM,
+		Params: params,
+	}
+	return n.publishControl(cmd, "")
+}
+
+// publishPresenceInfo sends presence info update of client to channel
+// subscribers on the current node and publishes presence info control message
+// to all other nodes.
+func (n *Node) publishPresenceInfo(ch string, info *ClientInfo) error {
+	if err := n.hub.broadcastPresenceInfo(ch, info); err != nil {
+		return err
+	}
+	presenceInfo := &controlpb.PresenceInfo{
+		Channel:  ch,
+		User:     info.UserID,
+		Client:   info.ClientID,
+		ConnInfo: info.ConnInfo,
+		ChanInfo: info.ChanInfo,
+	}
+	params, _ := n.controlEncoder.EncodePresenceInfo(presenceInfo)
+	cmd := &controlpb.Command{
+		Uid:    n.uid,
+		Method: controlpb.Command_PRESENCE_INFO,
+		Params: params,
+	}
+	return n.publishControl(cmd, "")
+}
+
 // pubUnsubscribe publishes unsubscribe control message to all nodes – so all
 // nodes could unsubscribe user from channel.
 func (n *Node) pubUnsubscribe(user string, ch string, unsubscribe Unsubscribe, clientID, sessionID string) error {
@@ -1017,12 +1229,12 @@ func (n *Node) removeClient(c *Client) error {
 
 // addSubscription registers subscription of connection on channel in both
 // Hub and Broker.
-func (n *Node) addSubscription(ch string, c *Client) error {
+func (n *Node) addSubscription(ch string, c *Client, filter *TagsFilter) error {
 	incActionCount("add_subscription")
 	mu := n.subLock(ch)
 	mu.Lock()
 	defer mu.Unlock()
-	first, err := n.hub.addSub(ch, c)
+	first, err := n.hub.addSub(ch, c, filter)
 	if err != nil {
 		return err
 	}
@@ -1067,6 +1279,66 @@ func (n *Node) removeSubscription(ch string, c *Client) error {
 	return nil
 }
 
+// addPatternSubscription registers pattern subscription of connection in Hub
+// and subscribes Node on pattern in Broker if needed.
+func (n *Node) addPatternSubscription(pattern string, c *Client, filter *TagsFilter) error {
+	incActionCount("add_subscription")
+	subscriber, ok := n.broker.(PatternSubscriber)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	mu := n.subLock(pattern)
+	mu.Lock()
+	defer mu.Unlock()
+	first, err := n.hub.addPatternSub(pattern, c, filter)
+	if err != nil {
+		return err
+	}
+	if first {
+		err := subscriber.SubscribePattern(pattern)
+		if err != nil {
+			_, _ = n.hub.removePatternSub(pattern, c)
+			return err
+		}
+	}
+	return nil
+}
+
+// removePatternSubscription removes pattern subscription of connection from
+// Hub and Broker.
+func (n *Node) removePatternSubscription(pattern string, c *Client) error {
+	incActionCount("remove_subscription")
+	subscriber, ok := n.broker.(PatternSubscriber)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	mu := n.subLock(pattern)
+	mu.Lock()
+	defer mu.Unlock()
+	empty, err := n.hub.removePatternSub(pattern, c)
+	if err != nil {
+		return err
+	}
+	if empty {
+		submittedAt := time.Now()
+		_ = n.subDissolver.Submit(func() error {
+			timeSpent := time.Since(submittedAt)
+			if timeSpent < time.Second {
+				time.Sleep(time.Second - timeSpent)
+			}
+			mu := n.subLock(pattern)
+			mu.Lock()
+			defer mu.Unlock()
+			empty := n.hub.numPatternSubscribers(pattern) == 0
+			if empty {
+				return subscriber.UnsubscribePattern(pattern)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
 // nodeCmd handles node control command i.e. updates information about known nodes.
 func (n *Node) nodeCmd(node *controlpb.Node) error {
 	isNewNode := n.nodes.add(node)
@@ -1178,6 +1450,28 @@ func (n *Node) removePresence(ch string, uid string) error {
 	return n.presenceManager.RemovePresence(ch, uid)
 }
 
+// addUserConnection proxies adding user connection to PresenceManager. Returns
+// true if it's the first connection of user in channel.
+func (n *Node) addUserConnection(ch string, userID string, clientID string) (bool, error) {
+	userPresenceManager, ok := n.presenceManager.(UserPresenceManager)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	incActionCount("add_user_connection")
+	return userPresenceManager.AddUserConnection(ch, userID, clientID)
+}
+
+// removeUserConnection proxies removing user connection to PresenceManager.
+// Returns true if it was the last connection of user in channel.
+func (n *Node) removeUserConnection(ch string, userID string, clientID string) (bool, error) {
+	userPresenceManager, ok := n.presenceManager.(UserPresenceManager)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	incActionCount("remove_user_connection")
+	return userPresenceManager.RemoveUserConnection(ch, userID, clientID)
+}
+
 var (
 	presenceGroup      singleflight.Group
 	presenceStatsGroup singleflight.Group
@@ -1212,6 +1506,37 @@ func (n *Node) Presence(ch string) (PresenceResult, error) {
 	return n.presence(ch)
 }
 
+// PresencePageResult wraps a page of presence.
+type PresencePageResult struct {
+	Presence map[string]*ClientInfo
+	// Cursor to pass to Node.PresencePage to get the next page. Empty
+	// Cursor means that there are no more pages.
+	Cursor string
+}
+
+const defaultPresencePageLimit = 100
+
+// PresencePage returns a page of information about active clients in channel
+// starting from cursor. Use empty cursor to get the first page. If limit is not
+// positive then 100 is used. Returns ErrorNotAvailable if PresenceManager does
+// not implement PresencePager. Clients can iterate over presence pages too,
+// see Client.OnPresencePage.
+func (n *Node) PresencePage(ch string, cursor string, limit int) (PresencePageResult, error) {
+	pager, ok := n.presenceManager.(PresencePager)
+	if !ok {
+		return PresencePageResult{}, ErrorNotAvailable
+	}
+	if limit <= 0 {
+		limit = defaultPresencePageLimit
+	}
+	incActionCount("presence_page")
+	presence, nextCursor, err := pager.PresencePage(ch, cursor, limit)
+	if err != nil {
+		return PresencePageResult{}, err
+	}
+	return PresencePageResult{Presence: presence, Cursor: nextCursor}, nil
+}
+
 func infoFromProto(v *protocol.ClientInfo) *ClientInfo {
 	if v == nil {
 		return nil
@@ -1311,9 +1636,12 @@ func (n *Node) history(ch string, opts *HistoryOptions) (HistoryResult, error) {
 		return HistoryResult{}, ErrorBadRequest
 	}
 	pubs, streamTop, err := n.broker.History(ch, HistoryFilter{
-		Limit:   opts.Limit,
-		Since:   opts.Since,
-		Reverse: opts.Reverse,
+		Limit:      opts.Limit,
+		Since:      opts.Since,
+		Reverse:    opts.Reverse,
+		TagsFilter: opts.TagsFilter,
+		SinceTime:  opts.SinceTime,
+		UntilTime:  opts.UntilTime,
 	})
 	if err != nil {
 		return HistoryResult{}, err
@@ -1356,6 +1684,18 @@ func (n *Node) History(ch string, opts ...HistoryOption) (HistoryResult, error)
 		builder.WriteString(strconv.Itoa(historyOpts.Limit))
 		builder.WriteString(",reverse:")
 		builder.WriteString(strconv.FormatBool(historyOpts.Reverse))
+		if historyOpts.TagsFilter != nil {
+			builder.WriteString(",filter:")
+			builder.WriteString(historyOpts.TagsFilter.String())
+		}
+		if !historyOpts.SinceTime.IsZero() {
+			builder.WriteString(",since_time:")
+			builder.WriteString(strconv.FormatInt(historyOpts.SinceTime.UnixMilli(), 10))
+		}
+		if !historyOpts.UntilTime.IsZero() {
+			builder.WriteString(",until_time:")
+			builder.WriteString(strconv.FormatInt(historyOpts.UntilTime.UnixMilli(), 10))
+		}
 		key := builder.String()
 
 		result, err, _ := historyGroup.Do(key, func() (interface{}, error) {
@@ -1377,6 +1717,13 @@ func (n *Node) recoverHistory(ch string, since StreamPosition) (HistoryResult, e
 	return n.History(ch, WithLimit(limit), WithSince(&since))
 }
 
+// latestPublication returns the latest publication in channel history stream
+// together with current stream top StreamPosition.
+func (n *Node) latestPublication(ch string) (HistoryResult, error) {
+	incActionCount("history_latest")
+	return n.History(ch, WithLimit(1), WithReverse(true))
+}
+
 // streamTop returns current stream top StreamPosition for a channel.
 func (n *Node) streamTop(ch string) (StreamPosition, error) {
 	incActionCount("history_stream_top")
@@ -1393,6 +1740,25 @@ func (n *Node) RemoveHistory(ch string) error {
 	return n.broker.RemoveHistory(ch)
 }
 
+// ResetStream removes all publications from channel history and starts a new
+// stream epoch. Subscribers with positioning or recovery enabled on all nodes
+// are then forced to resubscribe (or reconnect for server-side subscriptions)
+// as their state is insufficient. Returns ErrorNotAvailable if Broker does not
+// implement StreamResetter.
+func (n *Node) ResetStream(ch string) (StreamPosition, error) {
+	resetter, ok := n.broker.(StreamResetter)
+	if !ok {
+		return StreamPosition{}, ErrorNotAvailable
+	}
+	incActionCount("reset_stream")
+	sp, err := resetter.ResetStream(ch)
+	if err != nil {
+		return StreamPosition{}, err
+	}
+	n.hub.resetStream(ch, sp)
+	return sp, n.pubResetStream(ch, sp)
+}
+
 type nodeRegistry struct {
 	// mu allows synchronizing access to node registry.
 	mu sync.RWMutex
@@ -1519,6 +1885,8 @@ type eventHub struct {
 	connectHandler        ConnectHandler
 	transportWriteHandler TransportWriteHandler
 	commandReadHandler    CommandReadHandler
+
+	publicationTransformHandler PublicationTransformHandler
 }
 
 // OnConnecting allows setting ConnectingHandler.
@@ -1546,16 +1914,42 @@ func (n *Node) OnCommandRead(handler CommandReadHandler) {
 	n.clientEvents.commandReadHandler = handler
 }
 
+// OnPublicationTransform allows setting PublicationTransformHandler. This should
+// be done before Node.Run called.
+func (n *Node) OnPublicationTransform(handler PublicationTransformHandler) {
+	n.clientEvents.publicationTransformHandler = handler
+}
+
 type brokerEventHandler struct {
 	node *Node
 }
 
+var _ PatternBrokerEventHandler = (*brokerEventHandler)(nil)
+
+var _ ExcludeClientsBrokerEventHandler = (*brokerEventHandler)(nil)
+
 // HandlePublication coming from Broker.
 func (h *brokerEventHandler) HandlePublication(ch string, pub *Publication, sp StreamPosition) error {
 	if pub == nil {
 		panic("nil Publication received, this must never happen")
 	}
-	return h.node.handlePublication(ch, pub, sp)
+	return h.node.handlePublication(ch, pub, sp, nil)
+}
+
+// HandlePublicationExcludeClients coming from Broker.
+func (h *brokerEventHandler) HandlePublicationExcludeClients(ch string, pub *Publication, sp StreamPosition, excludeClients []string) error {
+	if pub == nil {
+		panic("nil Publication received, this must never happen")
+	}
+	return h.node.handlePublication(ch, pub, sp, excludeClients)
+}
+
+// HandlePatternPublication coming from Broker.
+func (h *brokerEventHandler) HandlePatternPublication(pattern string, ch string, pub *Publication, _ StreamPosition, excludeClients []string) error {
+	if pub == nil {
+		panic("nil Publication received, this must never happen")
+	}
+	return h.node.handlePatternPublication(pattern, ch, pub, excludeClients)
 }
 
 // HandleJoin coming from Broker.
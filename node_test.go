@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -144,6 +146,56 @@ func (e *TestPresenceManager) PresenceStats(_ string) (PresenceStats, error) {
 	return PresenceStats{}, nil
 }
 
+// testCluster connects Nodes running in one process, so cluster-wide features
+// can be tested without external server.
+type testCluster struct {
+	mu      sync.RWMutex
+	brokers []*testClusterBroker
+}
+
+// testClusterBroker is a MemoryBroker which delivers control messages to all
+// Nodes of testCluster.
+type testClusterBroker struct {
+	*MemoryBroker
+	cluster *testCluster
+	handler BrokerEventHandler
+}
+
+func (b *testClusterBroker) Run(h BrokerEventHandler) error {
+	b.handler = h
+	b.cluster.mu.Lock()
+	b.cluster.brokers = append(b.cluster.brokers, b)
+	b.cluster.mu.Unlock()
+	return b.MemoryBroker.Run(h)
+}
+
+func (b *testClusterBroker) PublishControl(data []byte, nodeID, _ string) error {
+	b.cluster.mu.RLock()
+	defer b.cluster.mu.RUnlock()
+	for _, broker := range b.cluster.brokers {
+		if nodeID != "" && broker.node.ID() != nodeID {
+			continue
+		}
+		h := broker.handler
+		go func() { _ = h.HandleControl(data) }()
+	}
+	return nil
+}
+
+func newTestClusterNode(tb testing.TB, cluster *testCluster) *Node {
+	n, err := New(Config{
+		LogLevel:   LogLevelDebug,
+		LogHandler: func(entry LogEntry) {},
+	})
+	require.NoError(tb, err)
+	b, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(tb, err)
+	n.SetBroker(&testClusterBroker{MemoryBroker: b, cluster: cluster})
+	require.NoError(tb, n.Run())
+	tb.Cleanup(func() { _ = n.Shutdown(context.Background()) })
+	return n
+}
+
 func nodeWithBroker(broker Broker) *Node {
 	c := Config{}
 	n, err := New(c)
@@ -315,6 +367,8 @@ func TestNode_SetPresenceManager_NilPresenceManager(t *testing.T) {
 	require.Equal(t, ErrorNotAvailable, err)
 	_, err = n.PresenceStats("test")
 	require.Equal(t, ErrorNotAvailable, err)
+	_, err = n.PresencePage("test", "", 10)
+	require.Equal(t, ErrorNotAvailable, err)
 }
 
 func TestNode_LogEnabled(t *testing.T) {
@@ -353,6 +407,37 @@ func TestNode_SetPresenceManager(t *testing.T) {
 	require.Equal(t, n.presenceManager, presenceManager)
 }
 
+func TestNode_PresencePage(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	for i := 0; i < 150; i++ {
+		require.NoError(t, n.addPresence("test", strconv.Itoa(i), &ClientInfo{}))
+	}
+
+	seen := map[string]struct{}{}
+	res, err := n.PresencePage("test", "", 0)
+	require.NoError(t, err)
+	require.Len(t, res.Presence, defaultPresencePageLimit)
+	require.NotEmpty(t, res.Cursor)
+	for k := range res.Presence {
+		seen[k] = struct{}{}
+	}
+	res, err = n.PresencePage("test", res.Cursor, 0)
+	require.NoError(t, err)
+	require.Len(t, res.Presence, 50)
+	require.Empty(t, res.Cursor)
+	for k := range res.Presence {
+		seen[k] = struct{}{}
+	}
+	require.Len(t, seen, 150)
+
+	n2 := nodeWithPresenceManager(NewTestPresenceManager())
+	defer func() { _ = n2.Shutdown(context.Background()) }()
+	_, err = n2.PresencePage("test", "", 10)
+	require.Equal(t, ErrorNotAvailable, err)
+}
+
 func TestNode_Info(t *testing.T) {
 	n := defaultNodeNoHandlers()
 	defer func() { _ = n.Shutdown(context.Background()) }()
@@ -477,6 +562,55 @@ func TestNode_pubUnsubscribe(t *testing.T) {
 	require.EqualValues(t, 2, testBroker.publishControlCount)
 }
 
+func TestNode_ResetStream(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	_, err := n.Publish("test_channel", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	n.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EnableRecovery: true}}, nil)
+		})
+		client.OnUnsubscribe(func(event UnsubscribeEvent) {
+			require.Equal(t, UnsubscribeCodeInsufficient, event.Code)
+			close(done)
+		})
+	})
+
+	client := newTestClientV2(t, n, "42")
+	connectClientV2(t, client)
+	rwWrapper := testReplyWriterWrapper()
+	err = client.handleSubscribe(&protocol.SubscribeRequest{
+		Channel: "test_channel",
+		Recover: true,
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+
+	sp, err := n.ResetStream("test_channel")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), sp.Offset)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout")
+	}
+
+	res, err := n.History("test_channel", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 0)
+	require.Equal(t, sp.Epoch, res.Epoch)
+}
+
+func TestNode_ResetStreamNotAvailable(t *testing.T) {
+	node := nodeWithTestBroker()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	_, err := node.ResetStream("test_channel")
+	require.ErrorIs(t, err, ErrorNotAvailable)
+}
+
 func TestNode_pubDisconnect(t *testing.T) {
 	node := nodeWithTestBroker()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -525,6 +659,61 @@ func TestNode_publishLeave(t *testing.T) {
 	require.EqualValues(t, 2, testBroker.publishLeaveCount)
 }
 
+func TestNode_PublishMany(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	results := n.PublishMany([]PublishRequest{
+		{Channel: "test1", Data: []byte("{}"), Options: []PublishOption{WithHistory(10, time.Minute)}},
+		{Channel: "test2", Data: []byte("{}")},
+		{Channel: "test1", Data: []byte("{}"), Options: []PublishOption{WithHistory(10, time.Minute)}},
+	})
+	require.Len(t, results, 3)
+	for _, res := range results {
+		require.NoError(t, res.Error)
+	}
+	require.EqualValues(t, 1, results[0].Offset)
+	require.EqualValues(t, 0, results[1].Offset)
+	require.EqualValues(t, 2, results[2].Offset)
+
+	historyResult, err := n.History("test1", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Len(t, historyResult.Publications, 2)
+}
+
+func TestNode_Broadcast(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	channels := []string{"test1", "test2", "test3"}
+	results := n.Broadcast(channels, []byte("{}"), WithHistory(10, time.Minute))
+	require.Len(t, results, len(channels))
+	for i, ch := range channels {
+		require.NoError(t, results[i].Error)
+		require.EqualValues(t, 1, results[i].Offset)
+		historyResult, err := n.History(ch, WithLimit(NoLimit))
+		require.NoError(t, err)
+		require.Len(t, historyResult.Publications, 1)
+	}
+}
+
+func TestNode_PublishManyNoBatchPublisher(t *testing.T) {
+	testBroker := NewTestBroker()
+	n := nodeWithBroker(testBroker)
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	results := n.Broadcast([]string{"test1", "test2"}, []byte("{}"))
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Error)
+	require.NoError(t, results[1].Error)
+	require.EqualValues(t, 2, testBroker.publishCount)
+
+	testBroker.errorOnPublish = true
+	results = n.Broadcast([]string{"test1", "test2"}, []byte("{}"))
+	require.Error(t, results[0].Error)
+	require.Error(t, results[1].Error)
+}
+
 func TestNode_RemoveHistory(t *testing.T) {
 	n := defaultNodeNoHandlers()
 	defer func() { _ = n.Shutdown(context.Background()) }()
@@ -737,6 +926,22 @@ func TestNode_handleControl(t *testing.T) {
 		require.NoError(t, err)
 		err = n.handleControl(brokenCmdBytes)
 		require.EqualError(t, err, "unexpected EOF")
+
+		brokenCmdBytes, err = enc.EncodeCommand(&controlpb.Command{
+			Method: controlpb.Command_RESET_STREAM,
+			Params: []byte("random"),
+		})
+		require.NoError(t, err)
+		err = n.handleControl(brokenCmdBytes)
+		require.EqualError(t, err, "unexpected EOF")
+
+		brokenCmdBytes, err = enc.EncodeCommand(&controlpb.Command{
+			Method: controlpb.Command_PRESENCE_INFO,
+			Params: []byte("random"),
+		})
+		require.NoError(t, err)
+		err = n.handleControl(brokenCmdBytes)
+		require.EqualError(t, err, "unexpected EOF")
 	})
 
 	t.Run("Node", func(t *testing.T) {
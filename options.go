@@ -27,6 +27,44 @@ func WithTags(meta map[string]string) PublishOption {
 	}
 }
 
+// WithExcludeClients allows setting PublishOptions.ExcludeClients.
+func WithExcludeClients(clientIDs ...string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.ExcludeClients = clientIDs
+	}
+}
+
+// WithIdempotencyKey allows setting PublishOptions.IdempotencyKey and
+// PublishOptions.IdempotentResultTTL. Publications with the same key published
+// during window are considered duplicates.
+func WithIdempotencyKey(key string, window time.Duration) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.IdempotencyKey = key
+		opts.IdempotentResultTTL = window
+	}
+}
+
+// WithHistoryMaxBytes allows setting PublishOptions.HistoryMaxBytes.
+func WithHistoryMaxBytes(maxBytes int) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.HistoryMaxBytes = maxBytes
+	}
+}
+
+// WithHistoryMaxPublicationAge allows setting PublishOptions.HistoryMaxPublicationAge.
+func WithHistoryMaxPublicationAge(age time.Duration) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.HistoryMaxPublicationAge = age
+	}
+}
+
+// WithCompactionKey allows setting PublishOptions.CompactionKey.
+func WithCompactionKey(key string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.CompactionKey = key
+	}
+}
+
 // SubscribeOptions define per-subscription options.
 type SubscribeOptions struct {
 	// ExpireAt defines time in future when subscription should expire,
@@ -70,6 +108,38 @@ type SubscribeOptions struct {
 	// Source is a way to mark the source of Subscription - i.e. where it comes from. May be useful
 	// for inspection of a connection during its lifetime.
 	Source uint8
+	// TagsFilter if set makes subscriber receive only publications with Tags matching
+	// filter. Applied to publications recovered from history too. Position inside
+	// a stream is still tracked over skipped publications so positioning and recovery
+	// work as usual.
+	TagsFilter *TagsFilter
+	// DeltaType if set turns on delta compression for the subscription. Publications
+	// will be sent to a client as a delta against the previous channel publication
+	// (with delta field of Publication set) when client already received the previous
+	// publication. The first publication after subscribe and recovered publications
+	// are sent with full payload. Only DeltaTypeFossil is supported at the moment.
+	// Delta is not applied when Node has PublicationTransformHandler set.
+	DeltaType DeltaType
+	// EnableLatestPublication makes Centrifuge put the latest publication from channel
+	// history stream into subscribe result, so subscriber gets the current channel
+	// value right away. Publications which came from PUB/SUB while loading the latest
+	// publication are attached to the result too, without gaps and duplicates. Channel
+	// must maintain history stream for this to work. Not applied when client recovers
+	// channel state – recovery rules are used in this case.
+	EnableLatestPublication bool
+	// JoinLeaveUserLevel turns on user-level semantics for EmitJoinLeave: Join message
+	// is only published for the first connection of a user in channel, Leave message
+	// only for the last one. Connections of users are tracked over PresenceManager
+	// which must implement UserPresenceManager.
+	JoinLeaveUserLevel bool
+	// Pattern makes subscription a pattern subscription: channel is treated as
+	// a pattern where * matches any sequence of characters, so client receives
+	// publications from all matching channels (Publication push contains concrete
+	// channel name). Broker must implement PatternSubscriber. History, recovery,
+	// positioning, delta compression, presence and join/leave are not supported
+	// for pattern subscriptions – subscription with such options is rejected
+	// with ErrorNotAvailable.
+	Pattern bool
 }
 
 // SubscribeOption is a type to represent various Subscribe options.
@@ -161,6 +231,55 @@ func WithSubscribeSource(source uint8) SubscribeOption {
 	}
 }
 
+// WithSubscribeFilter allows setting SubscribeOptions.TagsFilter.
+func WithSubscribeFilter(filter *TagsFilter) SubscribeOption {
+	return func(opts *SubscribeOptions) {
+		opts.TagsFilter = filter
+	}
+}
+
+// WithDelta allows setting SubscribeOptions.DeltaType.
+func WithDelta(deltaType DeltaType) SubscribeOption {
+	return func(opts *SubscribeOptions) {
+		opts.DeltaType = deltaType
+	}
+}
+
+// WithLatestPublication allows setting SubscribeOptions.EnableLatestPublication.
+func WithLatestPublication(enabled bool) SubscribeOption {
+	return func(opts *SubscribeOptions) {
+		opts.EnableLatestPublication = enabled
+	}
+}
+
+// WithJoinLeaveUserLevel allows setting SubscribeOptions.JoinLeaveUserLevel.
+func WithJoinLeaveUserLevel(enabled bool) SubscribeOption {
+	return func(opts *SubscribeOptions) {
+		opts.JoinLeaveUserLevel = enabled
+	}
+}
+
+// WithPattern allows setting SubscribeOptions.Pattern.
+func WithPattern(enabled bool) SubscribeOption {
+	return func(opts *SubscribeOptions) {
+		opts.Pattern = enabled
+	}
+}
+
+// WithSinceTime allows setting HistoryOptions.SinceTime option.
+func WithSinceTime(t time.Time) HistoryOption {
+	return func(opts *HistoryOptions) {
+		opts.SinceTime = t
+	}
+}
+
+// WithUntilTime allows setting HistoryOptions.UntilTime option.
+func WithUntilTime(t time.Time) HistoryOption {
+	return func(opts *HistoryOptions) {
+		opts.UntilTime = t
+	}
+}
+
 // RefreshOptions ...
 type RefreshOptions struct {
 	// Expired can close connection with expired reason.
@@ -307,6 +426,12 @@ type HistoryOptions struct {
 	Limit int
 	// Reverse direction
 	Reverse bool
+	// TagsFilter to return only publications with matching tags.
+	TagsFilter *TagsFilter
+	// SinceTime to return only publications published not before this time.
+	SinceTime time.Time
+	// UntilTime to return only publications published before this time.
+	UntilTime time.Time
 }
 
 // HistoryOption is a type to represent various History options.
@@ -335,3 +460,10 @@ func WithReverse(reverse bool) HistoryOption {
 		opts.Reverse = reverse
 	}
 }
+
+// WithFilter allows setting HistoryOptions.TagsFilter option.
+func WithFilter(filter *TagsFilter) HistoryOption {
+	return func(opts *HistoryOptions) {
+		opts.TagsFilter = filter
+	}
+}
@@ -15,6 +15,33 @@ func TestWithHistory(t *testing.T) {
 	require.Equal(t, time.Second, opts.HistoryTTL)
 }
 
+func TestWithCompactionKey(t *testing.T) {
+	opts := &PublishOptions{}
+	WithCompactionKey("order_1")(opts)
+	require.Equal(t, "order_1", opts.CompactionKey)
+}
+
+func TestWithIdempotencyKey(t *testing.T) {
+	opts := &PublishOptions{}
+	WithIdempotencyKey("publish_1", time.Minute)(opts)
+	require.Equal(t, "publish_1", opts.IdempotencyKey)
+	require.Equal(t, time.Minute, opts.IdempotentResultTTL)
+}
+
+func TestWithExcludeClients(t *testing.T) {
+	opts := &PublishOptions{}
+	WithExcludeClients("client1", "client2")(opts)
+	require.Equal(t, []string{"client1", "client2"}, opts.ExcludeClients)
+}
+
+func TestWithHistoryLimits(t *testing.T) {
+	opts := &PublishOptions{}
+	WithHistoryMaxBytes(1024)(opts)
+	WithHistoryMaxPublicationAge(time.Minute)(opts)
+	require.Equal(t, 1024, opts.HistoryMaxBytes)
+	require.Equal(t, time.Minute, opts.HistoryMaxPublicationAge)
+}
+
 func TestWithMeta(t *testing.T) {
 	opt := WithTags(map[string]string{"test": "value"})
 	opts := &PublishOptions{}
@@ -34,6 +61,10 @@ func TestSubscribeOptions(t *testing.T) {
 		WithSubscribeSession("session"),
 		WithSubscribeClient("test"),
 		WithSubscribeSource(4),
+		WithDelta(DeltaTypeFossil),
+		WithLatestPublication(true),
+		WithJoinLeaveUserLevel(true),
+		WithPattern(true),
 	}
 	opts := &SubscribeOptions{}
 	for _, opt := range subscribeOpts {
@@ -49,6 +80,10 @@ func TestSubscribeOptions(t *testing.T) {
 	require.Equal(t, "test", opts.clientID)
 	require.Equal(t, "session", opts.sessionID)
 	require.Equal(t, uint8(4), opts.Source)
+	require.Equal(t, DeltaTypeFossil, opts.DeltaType)
+	require.True(t, opts.EnableLatestPublication)
+	require.True(t, opts.JoinLeaveUserLevel)
+	require.True(t, opts.Pattern)
 }
 
 func TestWithDisconnect(t *testing.T) {
@@ -143,3 +178,24 @@ func TestRefreshOptions(t *testing.T) {
 	require.Equal(t, []byte(`test`), opts.Info)
 	require.Equal(t, "session", opts.sessionID)
 }
+
+func TestWithFilter(t *testing.T) {
+	filter := MustParseTagsFilter(`a = b`)
+	opts := &HistoryOptions{}
+	WithFilter(filter)(opts)
+	require.Equal(t, filter, opts.TagsFilter)
+
+	subscribeOpts := &SubscribeOptions{}
+	WithSubscribeFilter(filter)(subscribeOpts)
+	require.Equal(t, filter, subscribeOpts.TagsFilter)
+}
+
+func TestWithSinceUntilTime(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	until := time.Now()
+	opts := &HistoryOptions{}
+	WithSinceTime(since)(opts)
+	WithUntilTime(until)(opts)
+	require.Equal(t, since, opts.SinceTime)
+	require.Equal(t, until, opts.UntilTime)
+}
@@ -8,6 +8,19 @@ type PresenceStats struct {
 	NumUsers int
 }
 
+// presenceStatsFromInfo counts presence stats of channel presence information.
+// Used by builtin PresenceManager implementations to calculate stats the same way.
+func presenceStatsFromInfo(presence map[string]*ClientInfo) PresenceStats {
+	uniqueUsers := make(map[string]struct{}, len(presence))
+	for _, info := range presence {
+		uniqueUsers[info.UserID] = struct{}{}
+	}
+	return PresenceStats{
+		NumClients: len(presence),
+		NumUsers:   len(uniqueUsers),
+	}
+}
+
 // PresenceManager is responsible for channel presence management.
 type PresenceManager interface {
 	// Presence returns actual presence information for channel.
@@ -25,3 +38,33 @@ type PresenceManager interface {
 	// with specified identifier.
 	RemovePresence(ch string, clientID string) error
 }
+
+// UserPresenceManager is an interface PresenceManager can optionally implement to
+// track connections of users in channels. It's required for user-level join/leave
+// (see SubscribeOptions.JoinLeaveUserLevel). Implementations must update user
+// connections atomically since connections of one user may come to different
+// nodes concurrently.
+type UserPresenceManager interface {
+	// AddUserConnection adds or touches connection of user in channel. Returns true
+	// if connection was added and user has no other connections in channel – i.e.
+	// user joined channel. Similar to presence information connection must expire
+	// if not touched for some time.
+	AddUserConnection(ch string, userID string, clientID string) (bool, error)
+	// RemoveUserConnection removes connection of user in channel. Returns true if
+	// connection was removed and user has no connections in channel left – i.e.
+	// user left channel.
+	RemoveUserConnection(ch string, userID string, clientID string) (bool, error)
+}
+
+// PresencePager is an interface PresenceManager can optionally implement to return
+// presence information of channel page by page. This allows iterating over presence
+// of channels with huge number of connections without loading all of it at once.
+type PresencePager interface {
+	// PresencePage returns a page of presence information for channel starting
+	// from cursor. Empty cursor means start of iteration. Returned cursor must be
+	// passed to get the next page, empty returned cursor means that iteration is
+	// complete. Limit is a desired number of entries in page – implementation may
+	// return slightly more or fewer entries, but iteration must return all
+	// connections which were in channel during the whole iteration.
+	PresencePage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error)
+}
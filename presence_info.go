@@ -0,0 +1,59 @@
+package centrifuge
+
+import (
+	"bytes"
+
+	"github.com/centrifugal/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Presence info updates (see Client.SetChannelPresenceInfo) are sent to channel
+// subscribers with PushJoinLeave as a separate push, so clients can tell them
+// from joins. Push contains Join message with updated ClientInfo.
+//
+// Client protocol used here does not contain presence info push yet, so it's
+// added on encoding: as field 13 of Push message for Protobuf and as
+// "presence_info" key of push object for JSON. Clients which do not know about
+// presence info push just skip it. ProtocolVersion1 clients do not receive
+// presence info updates.
+const pushPresenceInfoFieldNumber protowire.Number = 13
+
+var (
+	jsonJoinKey         = []byte(`"join":`)
+	jsonPresenceInfoKey = []byte(`"presence_info":`)
+)
+
+// encodePresenceInfoPush encodes presence info push for ProtocolVersion2
+// client – as push for unidirectional transports, as reply with push otherwise.
+func encodePresenceInfoPush(protoType protocol.Type, channel string, join *protocol.Join, unidirectional bool) ([]byte, error) {
+	push := &protocol.Push{Channel: channel}
+	if protoType == protocol.TypeJSON {
+		// Encoded as join and renamed below.
+		push.Join = join
+	} else {
+		joinData, err := join.MarshalVT()
+		if err != nil {
+			return nil, err
+		}
+		field := protowire.AppendTag(nil, pushPresenceInfoFieldNumber, protowire.BytesType)
+		push.ProtoReflect().SetUnknown(protowire.AppendBytes(field, joinData))
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if unidirectional {
+		data, err = protocol.GetPushEncoder(protoType).Encode(push)
+	} else {
+		data, err = protocol.GetReplyEncoder(protoType).Encode(&protocol.Reply{Push: push})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if protoType == protocol.TypeJSON {
+		// Channel is encoded before join and can't contain unescaped quotes, so
+		// the first occurrence of key is a join key.
+		data = bytes.Replace(data, jsonJoinKey, jsonPresenceInfoKey, 1)
+	}
+	return data, nil
+}
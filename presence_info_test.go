@@ -0,0 +1,117 @@
+package centrifuge
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge/internal/controlpb"
+	"github.com/centrifugal/centrifuge/internal/controlproto"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestEncodePresenceInfoPushProtobuf(t *testing.T) {
+	join := &protocol.Join{Info: &protocol.ClientInfo{User: "user", Client: "client", ChanInfo: []byte(`{"status":"away"}`)}}
+	for _, unidirectional := range []bool{false, true} {
+		data, err := encodePresenceInfoPush(protocol.TypeProtobuf, "test", join, unidirectional)
+		require.NoError(t, err)
+		push := &protocol.Push{}
+		if unidirectional {
+			require.NoError(t, push.UnmarshalVT(data))
+		} else {
+			reply := &protocol.Reply{}
+			require.NoError(t, reply.UnmarshalVT(data))
+			require.NotNil(t, reply.Push)
+			push = reply.Push
+		}
+		require.Equal(t, "test", push.Channel)
+		require.Nil(t, push.Join)
+
+		unknown := push.ProtoReflect().GetUnknown()
+		num, typ, n := protowire.ConsumeTag(unknown)
+		require.Equal(t, pushPresenceInfoFieldNumber, num)
+		require.Equal(t, protowire.BytesType, typ)
+		joinData, m := protowire.ConsumeBytes(unknown[n:])
+		require.Equal(t, len(unknown), n+m)
+		var decoded protocol.Join
+		require.NoError(t, decoded.UnmarshalVT(joinData))
+		require.Equal(t, "client", decoded.Info.Client)
+		require.Equal(t, []byte(`{"status":"away"}`), []byte(decoded.Info.ChanInfo))
+	}
+}
+
+func TestEncodePresenceInfoPushJSON(t *testing.T) {
+	join := &protocol.Join{Info: &protocol.ClientInfo{User: "user", Client: "client", ChanInfo: []byte(`{"status":"away"}`)}}
+
+	data, err := encodePresenceInfoPush(protocol.TypeJSON, `"join":{`, join, true)
+	require.NoError(t, err)
+	var push map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &push))
+	require.Equal(t, `"\"join\":{"`, string(push["channel"]))
+	require.NotContains(t, push, "join")
+	require.JSONEq(t, `{"info":{"user":"user","client":"client","chan_info":{"status":"away"}}}`, string(push["presence_info"]))
+
+	data, err = encodePresenceInfoPush(protocol.TypeJSON, "test", join, false)
+	require.NoError(t, err)
+	var reply struct {
+		Push map[string]json.RawMessage `json:"push"`
+	}
+	require.NoError(t, json.Unmarshal(data, &reply))
+	require.NotContains(t, reply.Push, "join")
+	require.Contains(t, reply.Push, "presence_info")
+}
+
+func TestNodeHandlePresenceInfoControl(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{PushJoinLeave: true}}, nil)
+		})
+	})
+
+	transport := newTestTransport(func() {})
+	ctx := SetCredentials(context.Background(), &Credentials{UserID: "42"})
+	client, _ := newClient(ctx, node, transport)
+	connectClient(t, client)
+	subscribeClient(t, client, "test")
+	transport.sink = make(chan []byte, 100)
+	transport.setProtocolVersion(ProtocolVersion2)
+
+	enc := controlproto.NewProtobufEncoder()
+	params, err := enc.EncodePresenceInfo(&controlpb.PresenceInfo{
+		Channel:  "test",
+		User:     "43",
+		Client:   "other",
+		ChanInfo: []byte(`{"status":"typing"}`),
+	})
+	require.NoError(t, err)
+	data, err := enc.EncodeCommand(&controlpb.Command{
+		Uid:    "another_node",
+		Method: controlpb.Command_PRESENCE_INFO,
+		Params: params,
+	})
+	require.NoError(t, err)
+	require.NoError(t, node.handleControl(data))
+
+	for {
+		select {
+		case data := <-transport.sink:
+			reply := decodeReply(t, protocol.TypeJSON, data)
+			if reply.Push == nil {
+				// Skip connect and subscribe replies.
+				continue
+			}
+			require.Equal(t, "test", reply.Push.Channel)
+			require.Nil(t, reply.Push.Join)
+			require.Contains(t, string(data), `"presence_info":{"info":{"user":"43","client":"other","chan_info":{"status":"typing"}}}`)
+			return
+		case <-time.After(time.Second):
+			require.Fail(t, "timeout receiving presence info push")
+		}
+	}
+}
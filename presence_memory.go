@@ -3,6 +3,9 @@ package centrifuge
 import (
 	"context"
 	"sync"
+	"time"
+
+	"github.com/centrifugal/centrifuge/internal/skiplist"
 )
 
 // MemoryPresenceManager is builtin default PresenceManager which allows running
@@ -20,24 +23,75 @@ type MemoryPresenceManager struct {
 	node        *Node
 	config      MemoryPresenceManagerConfig
 	presenceHub *presenceHub
+	sweepOnce   sync.Once
+	closeOnce   sync.Once
+	closeCh     chan struct{}
 }
 
 var _ PresenceManager = (*MemoryPresenceManager)(nil)
 
+// DefaultMemoryPresenceTTL is a default value for presence TTL in MemoryPresenceManager.
+const DefaultMemoryPresenceTTL = 60 * time.Second
+
 // MemoryPresenceManagerConfig is a MemoryPresenceManager config.
-type MemoryPresenceManagerConfig struct{}
+type MemoryPresenceManagerConfig struct {
+	// PresenceTTL is an interval how long to consider presence info
+	// valid after receiving presence update. This allows to automatically
+	// clean up presence entries of clients which were not removed properly.
+	// Expired entries are not returned right away and removed from memory
+	// periodically in background. Should be greater than Config.ClientPresenceUpdateInterval
+	// since connected clients refresh their presence with that interval – otherwise
+	// twice the Config.ClientPresenceUpdateInterval is used instead. Zero value
+	// means that DefaultMemoryPresenceTTL will be used.
+	PresenceTTL time.Duration
+}
 
 // NewMemoryPresenceManager initializes MemoryPresenceManager.
 func NewMemoryPresenceManager(n *Node, c MemoryPresenceManagerConfig) (*MemoryPresenceManager, error) {
+	updateInterval := n.config.ClientPresenceUpdateInterval
+	if c.PresenceTTL == 0 {
+		c.PresenceTTL = DefaultMemoryPresenceTTL
+	}
+	if c.PresenceTTL <= updateInterval {
+		n.Log(NewLogEntry(LogLevelWarn, "presence TTL is not greater than client presence update interval, using twice the interval", map[string]interface{}{
+			"presence_ttl":    c.PresenceTTL.String(),
+			"update_interval": updateInterval.String(),
+		}))
+		c.PresenceTTL = 2 * updateInterval
+	}
 	return &MemoryPresenceManager{
 		node:        n,
 		config:      c,
-		presenceHub: newPresenceHub(),
+		presenceHub: newPresenceHub(c.PresenceTTL),
+		closeCh:     make(chan struct{}),
 	}, nil
 }
 
+// runSweeper starts removing expired entries in background. It's started lazily
+// upon first update so MemoryPresenceManager replaced by another PresenceManager
+// does not keep a goroutine.
+func (m *MemoryPresenceManager) runSweeper() {
+	m.sweepOnce.Do(func() {
+		go m.sweep()
+	})
+}
+
+func (m *MemoryPresenceManager) sweep() {
+	ticker := time.NewTicker(m.config.PresenceTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closeCh:
+			return
+		case <-ticker.C:
+			m.presenceHub.removeExpired()
+		}
+	}
+}
+
 // AddPresence - see PresenceManager interface description.
 func (m *MemoryPresenceManager) AddPresence(ch string, uid string, info *ClientInfo) error {
+	m.runSweeper()
 	return m.presenceHub.add(ch, uid, info)
 }
 
@@ -56,31 +110,185 @@ func (m *MemoryPresenceManager) PresenceStats(ch string) (PresenceStats, error)
 	return m.presenceHub.getStats(ch)
 }
 
-// Close is noop for now.
+var _ UserPresenceManager = (*MemoryPresenceManager)(nil)
+
+// AddUserConnection - see UserPresenceManager interface description.
+func (m *MemoryPresenceManager) AddUserConnection(ch string, userID string, clientID string) (bool, error) {
+	m.runSweeper()
+	return m.presenceHub.addUserConnection(ch, userID, clientID), nil
+}
+
+// RemoveUserConnection - see UserPresenceManager interface description.
+func (m *MemoryPresenceManager) RemoveUserConnection(ch string, userID string, clientID string) (bool, error) {
+	return m.presenceHub.removeUserConnection(ch, userID, clientID), nil
+}
+
+var _ PresencePager = (*MemoryPresenceManager)(nil)
+
+// PresencePage - see PresencePager interface description. Connections are
+// iterated in client ID order, cursor is the last client ID of previous page.
+func (m *MemoryPresenceManager) PresencePage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	return m.presenceHub.getPage(ch, cursor, limit)
+}
+
+// Close stops removing expired entries in background.
 func (m *MemoryPresenceManager) Close(_ context.Context) error {
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+	})
 	return nil
 }
 
+type presenceEntry struct {
+	info     *ClientInfo
+	expireAt int64
+}
+
+// channelPresence keeps presence entries of channel together with sorted set
+// of client IDs to seek presence pages by cursor without sorting on every page.
+type channelPresence struct {
+	entries   map[string]presenceEntry
+	clientIDs *skiplist.Set
+}
+
+func newChannelPresence() *channelPresence {
+	return &channelPresence{
+		entries:   make(map[string]presenceEntry),
+		clientIDs: skiplist.New(),
+	}
+}
+
+func (p *channelPresence) set(uid string, entry presenceEntry) {
+	if _, ok := p.entries[uid]; !ok {
+		p.clientIDs.Insert(uid)
+	}
+	p.entries[uid] = entry
+}
+
+func (p *channelPresence) delete(uid string) {
+	if _, ok := p.entries[uid]; !ok {
+		return
+	}
+	delete(p.entries, uid)
+	p.clientIDs.Delete(uid)
+}
+
+func (p *channelPresence) removeExpired(now int64) {
+	for uid, entry := range p.entries {
+		if entry.expireAt <= now {
+			delete(p.entries, uid)
+			p.clientIDs.Delete(uid)
+		}
+	}
+}
+
 type presenceHub struct {
 	sync.RWMutex
-	presence map[string]map[string]*ClientInfo
+	ttl      time.Duration
+	presence map[string]*channelPresence
+	// users keeps connections of users in channels: channel -> user ID ->
+	// client ID -> expire at.
+	users map[string]map[string]map[string]int64
 }
 
-func newPresenceHub() *presenceHub {
+func newPresenceHub(ttl time.Duration) *presenceHub {
 	return &presenceHub{
-		presence: make(map[string]map[string]*ClientInfo),
+		ttl:      ttl,
+		presence: make(map[string]*channelPresence),
+		users:    make(map[string]map[string]map[string]int64),
+	}
+}
+
+func (h *presenceHub) addUserConnection(ch string, userID string, clientID string) bool {
+	now := time.Now().UnixNano()
+
+	h.Lock()
+	defer h.Unlock()
+
+	users, ok := h.users[ch]
+	if !ok {
+		users = make(map[string]map[string]int64)
+		h.users[ch] = users
+	}
+	clients, ok := users[userID]
+	if !ok {
+		clients = make(map[string]int64)
+		users[userID] = clients
+	}
+	removeExpiredUserConnections(clients, now)
+	_, exists := clients[clientID]
+	clients[clientID] = now + int64(h.ttl)
+	return !exists && len(clients) == 1
+}
+
+func (h *presenceHub) removeUserConnection(ch string, userID string, clientID string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	clients, ok := h.users[ch][userID]
+	if !ok {
+		return false
+	}
+	removeExpiredUserConnections(clients, time.Now().UnixNano())
+	_, exists := clients[clientID]
+	delete(clients, clientID)
+	if len(clients) > 0 {
+		return false
+	}
+	// clean up maps if needed
+	delete(h.users[ch], userID)
+	if len(h.users[ch]) == 0 {
+		delete(h.users, ch)
+	}
+	return exists
+}
+
+func removeExpiredUserConnections(clients map[string]int64, now int64) {
+	for clientID, expireAt := range clients {
+		if expireAt <= now {
+			delete(clients, clientID)
+		}
+	}
+}
+
+// removeExpired removes expired presence entries and user connections.
+func (h *presenceHub) removeExpired() {
+	now := time.Now().UnixNano()
+
+	h.Lock()
+	defer h.Unlock()
+
+	for ch, presence := range h.presence {
+		presence.removeExpired(now)
+		if len(presence.entries) == 0 {
+			delete(h.presence, ch)
+		}
+	}
+	for ch, users := range h.users {
+		for userID, clients := range users {
+			removeExpiredUserConnections(clients, now)
+			if len(clients) == 0 {
+				delete(users, userID)
+			}
+		}
+		if len(users) == 0 {
+			delete(h.users, ch)
+		}
 	}
 }
 
 func (h *presenceHub) add(ch string, uid string, info *ClientInfo) error {
+	expireAt := time.Now().Add(h.ttl).UnixNano()
+
 	h.Lock()
 	defer h.Unlock()
 
-	_, ok := h.presence[ch]
+	presence, ok := h.presence[ch]
 	if !ok {
-		h.presence[ch] = make(map[string]*ClientInfo)
+		presence = newChannelPresence()
+		h.presence[ch] = presence
 	}
-	h.presence[ch][uid] = info
+	presence.set(uid, presenceEntry{info: info, expireAt: expireAt})
 	return nil
 }
 
@@ -88,17 +296,15 @@ func (h *presenceHub) remove(ch string, uid string) error {
 	h.Lock()
 	defer h.Unlock()
 
-	if _, ok := h.presence[ch]; !ok {
-		return nil
-	}
-	if _, ok := h.presence[ch][uid]; !ok {
+	presence, ok := h.presence[ch]
+	if !ok {
 		return nil
 	}
 
-	delete(h.presence[ch], uid)
+	presence.delete(uid)
 
 	// clean up map if needed
-	if len(h.presence[ch]) == 0 {
+	if len(presence.entries) == 0 {
 		delete(h.presence, ch)
 	}
 
@@ -106,6 +312,8 @@ func (h *presenceHub) remove(ch string, uid string) error {
 }
 
 func (h *presenceHub) get(ch string) (map[string]*ClientInfo, error) {
+	now := time.Now().UnixNano()
+
 	h.RLock()
 	defer h.RUnlock()
 
@@ -115,37 +323,50 @@ func (h *presenceHub) get(ch string) (map[string]*ClientInfo, error) {
 		return nil, nil
 	}
 
-	data := make(map[string]*ClientInfo, len(presence))
-	for k, v := range presence {
-		data[k] = v
+	data := make(map[string]*ClientInfo, len(presence.entries))
+	for k, v := range presence.entries {
+		if v.expireAt <= now {
+			continue
+		}
+		data[k] = v.info
 	}
 	return data, nil
 }
 
-func (h *presenceHub) getStats(ch string) (PresenceStats, error) {
+func (h *presenceHub) getPage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	now := time.Now().UnixNano()
+
 	h.RLock()
 	defer h.RUnlock()
 
 	presence, ok := h.presence[ch]
 	if !ok {
-		// return empty map
-		return PresenceStats{}, nil
+		return nil, "", nil
 	}
 
-	numClients := len(presence)
-	numUsers := 0
-	uniqueUsers := map[string]struct{}{}
-
-	for _, info := range presence {
-		userID := info.UserID
-		if _, ok := uniqueUsers[userID]; !ok {
-			uniqueUsers[userID] = struct{}{}
-			numUsers++
+	var lastClientID, nextCursor string
+	data := make(map[string]*ClientInfo)
+	presence.clientIDs.AscendAfter(cursor, func(uid string) bool {
+		entry := presence.entries[uid]
+		if entry.expireAt <= now {
+			return true
 		}
-	}
+		if limit > 0 && len(data) == limit {
+			// There is at least one more entry – page is not the last one.
+			nextCursor = lastClientID
+			return false
+		}
+		data[uid] = entry.info
+		lastClientID = uid
+		return true
+	})
+	return data, nextCursor, nil
+}
 
-	return PresenceStats{
-		NumClients: numClients,
-		NumUsers:   numUsers,
-	}, nil
+func (h *presenceHub) getStats(ch string) (PresenceStats, error) {
+	presence, err := h.get(ch)
+	if err != nil {
+		return PresenceStats{}, err
+	}
+	return presenceStatsFromInfo(presence), nil
 }
@@ -2,7 +2,9 @@ package centrifuge
 
 import (
 	"context"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -33,7 +35,7 @@ func TestNewMemoryPresenceManager_RemovePresence(t *testing.T) {
 }
 
 func TestMemoryPresenceHub(t *testing.T) {
-	h := newPresenceHub()
+	h := newPresenceHub(DefaultMemoryPresenceTTL)
 	require.Equal(t, 0, len(h.presence))
 
 	testCh1 := "channel1"
@@ -84,6 +86,76 @@ func TestMemoryPresenceHub(t *testing.T) {
 	require.Equal(t, 1, len(p))
 }
 
+func TestNewMemoryPresenceManagerPresenceTTL(t *testing.T) {
+	var warnings []LogEntry
+	n, _ := New(Config{
+		ClientPresenceUpdateInterval: 10 * time.Second,
+		LogLevel:                     LogLevelWarn,
+		LogHandler: func(entry LogEntry) {
+			warnings = append(warnings, entry)
+		},
+	})
+	m, err := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{PresenceTTL: 10 * time.Second})
+	require.NoError(t, err)
+	require.Equal(t, 20*time.Second, m.config.PresenceTTL)
+	require.Len(t, warnings, 1)
+
+	m, err = NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{})
+	require.NoError(t, err)
+	require.Equal(t, DefaultMemoryPresenceTTL, m.config.PresenceTTL)
+
+	n, _ = New(Config{ClientPresenceUpdateInterval: 2 * time.Minute})
+	m, err = NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{})
+	require.NoError(t, err)
+	require.Equal(t, 4*time.Minute, m.config.PresenceTTL)
+}
+
+func TestMemoryPresenceManagerPresenceTTL(t *testing.T) {
+	n, _ := New(Config{ClientPresenceUpdateInterval: 50 * time.Millisecond})
+	m, err := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{PresenceTTL: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer func() { _ = m.Close(context.Background()) }()
+
+	require.NoError(t, m.AddPresence("channel", "client1", &ClientInfo{ClientID: "client1", UserID: "user1"}))
+	require.NoError(t, m.AddPresence("channel", "client2", &ClientInfo{ClientID: "client2", UserID: "user1"}))
+	require.NoError(t, m.AddPresence("channel", "client3", &ClientInfo{ClientID: "client3", UserID: "user2"}))
+	joined, err := m.AddUserConnection("channel", "user1", "client1")
+	require.NoError(t, err)
+	require.True(t, joined)
+
+	stats, err := m.PresenceStats("channel")
+	require.NoError(t, err)
+	require.Equal(t, PresenceStats{NumClients: 3, NumUsers: 2}, stats)
+
+	// Keep touching client3 presence – other entries must expire.
+	require.Eventually(t, func() bool {
+		require.NoError(t, m.AddPresence("channel", "client3", &ClientInfo{ClientID: "client3", UserID: "user2"}))
+		p, err := m.Presence("channel")
+		require.NoError(t, err)
+		return len(p) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	stats, err = m.PresenceStats("channel")
+	require.NoError(t, err)
+	require.Equal(t, PresenceStats{NumClients: 1, NumUsers: 1}, stats)
+	p, cursor, err := m.PresencePage("channel", "", 10)
+	require.NoError(t, err)
+	require.Len(t, p, 1)
+	require.Empty(t, cursor)
+
+	// Expired user connection does not prevent join.
+	joined, err = m.AddUserConnection("channel", "user1", "client2")
+	require.NoError(t, err)
+	require.True(t, joined)
+
+	// Sweeper removes expired entries from memory.
+	require.Eventually(t, func() bool {
+		m.presenceHub.RLock()
+		defer m.presenceHub.RUnlock()
+		return len(m.presenceHub.presence) == 0 && len(m.presenceHub.users) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
 func BenchmarkMemoryAddPresence_OneChannel(b *testing.B) {
 	e := testMemoryPresenceManager(b)
 	defer func() { _ = e.node.Shutdown(context.Background()) }()
@@ -141,3 +213,175 @@ func BenchmarkMemoryPresence_OneChannel_Parallel(b *testing.B) {
 		}
 	})
 }
+
+func TestMemoryPresenceManagerUserConnections(t *testing.T) {
+	m := testMemoryPresenceManager(t)
+	defer func() { _ = m.node.Shutdown(context.Background()) }()
+
+	joined, err := m.AddUserConnection("channel", "user", "client1")
+	require.NoError(t, err)
+	require.True(t, joined)
+	// Touch is not a join.
+	joined, err = m.AddUserConnection("channel", "user", "client1")
+	require.NoError(t, err)
+	require.False(t, joined)
+	joined, err = m.AddUserConnection("channel", "user", "client2")
+	require.NoError(t, err)
+	require.False(t, joined)
+	joined, err = m.AddUserConnection("channel", "other", "client3")
+	require.NoError(t, err)
+	require.True(t, joined)
+
+	left, err := m.RemoveUserConnection("channel", "user", "client1")
+	require.NoError(t, err)
+	require.False(t, left)
+	left, err = m.RemoveUserConnection("channel", "user", "unknown")
+	require.NoError(t, err)
+	require.False(t, left)
+	left, err = m.RemoveUserConnection("channel", "user", "client2")
+	require.NoError(t, err)
+	require.True(t, left)
+	left, err = m.RemoveUserConnection("channel", "other", "client3")
+	require.NoError(t, err)
+	require.True(t, left)
+	require.Len(t, m.presenceHub.users, 0)
+}
+
+func TestMemoryPresenceManagerPresencePage(t *testing.T) {
+	m := testMemoryPresenceManager(t)
+	defer func() { _ = m.node.Shutdown(context.Background()) }()
+
+	p, cursor, err := m.PresencePage("channel", "", 2)
+	require.NoError(t, err)
+	require.Len(t, p, 0)
+	require.Equal(t, "", cursor)
+
+	for _, uid := range []string{"c", "a", "e", "b", "d"} {
+		require.NoError(t, m.AddPresence("channel", uid, &ClientInfo{ClientID: uid}))
+	}
+
+	var pages [][]string
+	for {
+		p, cursor, err = m.PresencePage("channel", cursor, 2)
+		require.NoError(t, err)
+		var page []string
+		for k := range p {
+			page = append(page, k)
+		}
+		sort.Strings(page)
+		pages = append(pages, page)
+		if cursor == "" {
+			break
+		}
+	}
+	require.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, pages)
+}
+
+func presenceClientIDs(h *presenceHub, ch string) []string {
+	var clientIDs []string
+	h.presence[ch].clientIDs.AscendAfter("", func(clientID string) bool {
+		clientIDs = append(clientIDs, clientID)
+		return true
+	})
+	return clientIDs
+}
+
+func TestPresenceHubPageIndex(t *testing.T) {
+	h := newPresenceHub(time.Minute)
+	for _, uid := range []string{"d", "b", "a", "c", "b"} {
+		require.NoError(t, h.add("channel", uid, &ClientInfo{ClientID: uid}))
+	}
+	require.Equal(t, []string{"a", "b", "c", "d"}, presenceClientIDs(h, "channel"))
+
+	// No next cursor when last page is full.
+	p, cursor, err := h.getPage("channel", "b", 2)
+	require.NoError(t, err)
+	require.Len(t, p, 2)
+	require.Equal(t, "", cursor)
+
+	// Cursor pointing to removed client ID still seeks to the next one.
+	require.NoError(t, h.remove("channel", "b"))
+	require.Equal(t, []string{"a", "c", "d"}, presenceClientIDs(h, "channel"))
+	p, cursor, err = h.getPage("channel", "b", 1)
+	require.NoError(t, err)
+	require.Contains(t, p, "c")
+	require.Equal(t, "c", cursor)
+
+	// Expired entries are skipped in pages and removed from index.
+	h.presence["channel"].entries["c"] = presenceEntry{expireAt: time.Now().UnixNano()}
+	p, cursor, err = h.getPage("channel", "a", 1)
+	require.NoError(t, err)
+	require.Contains(t, p, "d")
+	require.Equal(t, "", cursor)
+	h.removeExpired()
+	require.Equal(t, []string{"a", "d"}, presenceClientIDs(h, "channel"))
+}
+
+type presenceScenarioManager interface {
+	PresenceManager
+	UserPresenceManager
+}
+
+// presenceScenarioResult is a state of presence manager observed after each
+// step of presenceScenario.
+type presenceScenarioResult struct {
+	Stats   PresenceStats
+	Changed bool
+}
+
+// presenceScenario runs the same sequence of presence operations so builtin
+// presence managers can be compared with each other.
+func presenceScenario(t *testing.T, m presenceScenarioManager, ch string) []presenceScenarioResult {
+	var results []presenceScenarioResult
+	step := func(changed bool) {
+		stats, err := m.PresenceStats(ch)
+		require.NoError(t, err)
+		results = append(results, presenceScenarioResult{Stats: stats, Changed: changed})
+	}
+	add := func(userID string, clientID string) {
+		require.NoError(t, m.AddPresence(ch, clientID, &ClientInfo{UserID: userID, ClientID: clientID}))
+		joined, err := m.AddUserConnection(ch, userID, clientID)
+		require.NoError(t, err)
+		step(joined)
+	}
+	remove := func(userID string, clientID string) {
+		require.NoError(t, m.RemovePresence(ch, clientID))
+		left, err := m.RemoveUserConnection(ch, userID, clientID)
+		require.NoError(t, err)
+		step(left)
+	}
+	add("user1", "client1")
+	add("user1", "client1")
+	add("user1", "client2")
+	add("user2", "client3")
+	add("", "client4")
+	add("", "client5")
+	remove("user1", "client1")
+	remove("user1", "client1")
+	remove("user1", "client2")
+	remove("", "client4")
+	remove("user2", "client3")
+	remove("", "client5")
+	return results
+}
+
+var expectedPresenceScenarioResults = []presenceScenarioResult{
+	{Stats: PresenceStats{NumClients: 1, NumUsers: 1}, Changed: true},
+	{Stats: PresenceStats{NumClients: 1, NumUsers: 1}, Changed: false},
+	{Stats: PresenceStats{NumClients: 2, NumUsers: 1}, Changed: false},
+	{Stats: PresenceStats{NumClients: 3, NumUsers: 2}, Changed: true},
+	{Stats: PresenceStats{NumClients: 4, NumUsers: 3}, Changed: true},
+	{Stats: PresenceStats{NumClients: 5, NumUsers: 3}, Changed: false},
+	{Stats: PresenceStats{NumClients: 4, NumUsers: 3}, Changed: false},
+	{Stats: PresenceStats{NumClients: 4, NumUsers: 3}, Changed: false},
+	{Stats: PresenceStats{NumClients: 3, NumUsers: 2}, Changed: true},
+	{Stats: PresenceStats{NumClients: 2, NumUsers: 2}, Changed: false},
+	{Stats: PresenceStats{NumClients: 1, NumUsers: 1}, Changed: true},
+	{Stats: PresenceStats{NumClients: 0, NumUsers: 0}, Changed: true},
+}
+
+func TestMemoryPresenceManagerScenario(t *testing.T) {
+	m := testMemoryPresenceManager(t)
+	defer func() { _ = m.node.Shutdown(context.Background()) }()
+	require.Equal(t, expectedPresenceScenarioResults, presenceScenario(t, m, "channel"))
+}
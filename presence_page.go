@@ -0,0 +1,111 @@
+package centrifuge
+
+import (
+	"encoding/json"
+
+	"github.com/centrifugal/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Clients request presence pages with RPC (see Client.OnPresencePage). Client
+// protocol used here does not contain cursor and limit in presence request and
+// result yet, so RPC data and result are encoded according to client protocol
+// type in a way compatible with presence messages:
+//
+// For JSON request is an object with optional "cursor" and "limit" keys, result
+// is presence result object with "cursor" key added.
+//
+// For Protobuf request is a message with cursor as string field 1 and limit as
+// varint field 2, result is PresenceResult message with cursor as string field 2.
+const (
+	presencePageRequestCursorFieldNumber protowire.Number = 1
+	presencePageRequestLimitFieldNumber  protowire.Number = 2
+	presencePageResultCursorFieldNumber  protowire.Number = 2
+)
+
+// maxPresencePageLimit limits number of entries client may request in one page.
+const maxPresencePageLimit = 1000
+
+type presencePageJSONRequest struct {
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+// decodePresencePageRequest returns cursor and limit from presence page
+// request data. Empty data means the first page with default limit.
+func decodePresencePageRequest(protoType protocol.Type, data []byte) (string, int, error) {
+	if len(data) == 0 {
+		return "", 0, nil
+	}
+	if protoType == protocol.TypeJSON {
+		var req presencePageJSONRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			return "", 0, err
+		}
+		return req.Cursor, req.Limit, nil
+	}
+	var (
+		cursor string
+		limit  int
+	)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", 0, protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch {
+		case num == presencePageRequestCursorFieldNumber && typ == protowire.BytesType:
+			var v string
+			v, n = protowire.ConsumeString(data)
+			cursor = v
+		case num == presencePageRequestLimitFieldNumber && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			limit = int(int32(v))
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return "", 0, protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return cursor, limit, nil
+}
+
+// encodePresencePageResult encodes presence page to be sent to client as RPC
+// result data.
+func encodePresencePageResult(protoType protocol.Type, result PresencePageResult) ([]byte, error) {
+	protoPresence := make(map[string]*protocol.ClientInfo, len(result.Presence))
+	for k, v := range result.Presence {
+		protoPresence[k] = infoToProto(v)
+	}
+	res := &protocol.PresenceResult{Presence: protoPresence}
+	if protoType == protocol.TypeJSON {
+		data, err := protocol.GetResultEncoder(protoType).EncodePresenceResult(res)
+		if err != nil {
+			return nil, err
+		}
+		if result.Cursor == "" {
+			return data, nil
+		}
+		cursor, err := json.Marshal(result.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		// Put cursor at the end of presence result object.
+		data = append(data[:len(data)-1:len(data)-1], `,"cursor":`...)
+		data = append(data, cursor...)
+		return append(data, '}'), nil
+	}
+	data, err := res.MarshalVT()
+	if err != nil {
+		return nil, err
+	}
+	if result.Cursor != "" {
+		data = protowire.AppendTag(data, presencePageResultCursorFieldNumber, protowire.BytesType)
+		data = protowire.AppendString(data, result.Cursor)
+	}
+	return data, nil
+}
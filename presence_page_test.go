@@ -0,0 +1,81 @@
+package centrifuge
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDecodePresencePageRequestJSON(t *testing.T) {
+	cursor, limit, err := decodePresencePageRequest(protocol.TypeJSON, nil)
+	require.NoError(t, err)
+	require.Equal(t, "", cursor)
+	require.Equal(t, 0, limit)
+
+	cursor, limit, err = decodePresencePageRequest(protocol.TypeJSON, []byte(`{"cursor":"abc","limit":10}`))
+	require.NoError(t, err)
+	require.Equal(t, "abc", cursor)
+	require.Equal(t, 10, limit)
+
+	_, _, err = decodePresencePageRequest(protocol.TypeJSON, []byte(`{"limit":"10"}`))
+	require.Error(t, err)
+}
+
+func TestDecodePresencePageRequestProtobuf(t *testing.T) {
+	var data []byte
+	data = protowire.AppendTag(data, presencePageRequestCursorFieldNumber, protowire.BytesType)
+	data = protowire.AppendString(data, "abc")
+	// Unknown fields are skipped.
+	data = protowire.AppendTag(data, 5, protowire.BytesType)
+	data = protowire.AppendString(data, "unknown")
+	data = protowire.AppendTag(data, presencePageRequestLimitFieldNumber, protowire.VarintType)
+	data = protowire.AppendVarint(data, 10)
+
+	cursor, limit, err := decodePresencePageRequest(protocol.TypeProtobuf, data)
+	require.NoError(t, err)
+	require.Equal(t, "abc", cursor)
+	require.Equal(t, 10, limit)
+
+	_, _, err = decodePresencePageRequest(protocol.TypeProtobuf, data[:len(data)-1])
+	require.Error(t, err)
+}
+
+func TestEncodePresencePageResultJSON(t *testing.T) {
+	page := PresencePageResult{
+		Presence: map[string]*ClientInfo{"client": {UserID: "user", ClientID: "client"}},
+		Cursor:   `client"1`,
+	}
+	data, err := encodePresencePageResult(protocol.TypeJSON, page)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"presence":{"client":{"user":"user","client":"client"}},"cursor":"client\"1"}`, string(data))
+
+	page.Cursor = ""
+	data, err = encodePresencePageResult(protocol.TypeJSON, page)
+	require.NoError(t, err)
+	var result map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &result))
+	require.NotContains(t, result, "cursor")
+}
+
+func TestEncodePresencePageResultProtobuf(t *testing.T) {
+	page := PresencePageResult{
+		Presence: map[string]*ClientInfo{"client": {UserID: "user", ClientID: "client"}},
+		Cursor:   "client",
+	}
+	data, err := encodePresencePageResult(protocol.TypeProtobuf, page)
+	require.NoError(t, err)
+	var result protocol.PresenceResult
+	require.NoError(t, result.UnmarshalVT(data))
+	require.Equal(t, "user", result.Presence["client"].User)
+
+	unknown := result.ProtoReflect().GetUnknown()
+	num, typ, n := protowire.ConsumeTag(unknown)
+	require.Equal(t, presencePageResultCursorFieldNumber, num)
+	require.Equal(t, protowire.BytesType, typ)
+	cursor, m := protowire.ConsumeString(unknown[n:])
+	require.Equal(t, len(unknown), n+m)
+	require.Equal(t, "client", cursor)
+}
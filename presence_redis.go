@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,15 +16,18 @@ var _ PresenceManager = (*RedisPresenceManager)(nil)
 
 // RedisPresenceManager keeps presence in Redis thus allows scaling nodes.
 type RedisPresenceManager struct {
-	node              *Node
-	sharding          bool
-	config            RedisPresenceManagerConfig
-	shards            []*RedisShard
-	addPresenceScript *redis.Script
-	remPresenceScript *redis.Script
-	presenceScript    *redis.Script
-	closeOnce         sync.Once
-	closeCh           chan struct{}
+	node               *Node
+	sharding           bool
+	config             RedisPresenceManagerConfig
+	shards             []*RedisShard
+	addPresenceScript  *redis.Script
+	remPresenceScript  *redis.Script
+	presenceScript     *redis.Script
+	presencePageScript *redis.Script
+	addUserScript      *redis.Script
+	remUserScript      *redis.Script
+	closeOnce          sync.Once
+	closeCh            chan struct{}
 }
 
 const (
@@ -87,6 +91,52 @@ if #expired > 0 then
 end
 return redis.call("hgetall", KEYS[2])
 	`
+
+	// Get page of presence information.
+	// KEYS[1] - presence set key
+	// KEYS[2] - presence hash key
+	// ARGV[1] - current timestamp in seconds
+	// ARGV[2] - cursor
+	// ARGV[3] - count
+	presencePageSource = `
+local expired = redis.call("zrangebyscore", KEYS[1], "0", ARGV[1])
+if #expired > 0 then
+  for num = 1, #expired do
+    redis.call("hdel", KEYS[2], expired[num])
+  end
+  redis.call("zremrangebyscore", KEYS[1], "0", ARGV[1])
+end
+return redis.call("hscan", KEYS[2], ARGV[2], "COUNT", ARGV[3])
+	`
+
+	// Add/update user connection.
+	// KEYS[1] - user connections set key
+	// ARGV[1] - key expire seconds
+	// ARGV[2] - expire at for set member
+	// ARGV[3] - client ID
+	// ARGV[4] - current timestamp in seconds
+	addUserSource = `
+redis.call("zremrangebyscore", KEYS[1], "0", ARGV[4])
+local added = redis.call("zadd", KEYS[1], ARGV[2], ARGV[3])
+redis.call("expire", KEYS[1], ARGV[1])
+if added == 1 and redis.call("zcard", KEYS[1]) == 1 then
+  return 1
+end
+return 0
+	`
+
+	// Remove user connection.
+	// KEYS[1] - user connections set key
+	// ARGV[1] - client ID
+	// ARGV[2] - current timestamp in seconds
+	remUserSource = `
+redis.call("zremrangebyscore", KEYS[1], "0", ARGV[2])
+local removed = redis.call("zrem", KEYS[1], ARGV[1])
+if removed == 1 and redis.call("zcard", KEYS[1]) == 0 then
+  return 1
+end
+return 0
+	`
 )
 
 // NewRedisPresenceManager creates new RedisPresenceManager.
@@ -108,14 +158,17 @@ func NewRedisPresenceManager(n *Node, config RedisPresenceManagerConfig) (*Redis
 	}
 
 	m := &RedisPresenceManager{
-		node:              n,
-		shards:            config.Shards,
-		config:            config,
-		sharding:          len(config.Shards) > 1,
-		addPresenceScript: redis.NewScript(2, addPresenceSource),
-		remPresenceScript: redis.NewScript(2, remPresenceSource),
-		presenceScript:    redis.NewScript(2, presenceSource),
-		closeCh:           make(chan struct{}),
+		node:               n,
+		shards:             config.Shards,
+		config:             config,
+		sharding:           len(config.Shards) > 1,
+		addPresenceScript:  redis.NewScript(2, addPresenceSource),
+		remPresenceScript:  redis.NewScript(2, remPresenceSource),
+		presenceScript:     redis.NewScript(2, presenceSource),
+		presencePageScript: redis.NewScript(2, presencePageSource),
+		addUserScript:      redis.NewScript(1, addUserSource),
+		remUserScript:      redis.NewScript(1, remUserSource),
+		closeCh:            make(chan struct{}),
 	}
 
 	for i := range config.Shards {
@@ -123,6 +176,9 @@ func NewRedisPresenceManager(n *Node, config RedisPresenceManagerConfig) (*Redis
 			m.addPresenceScript,
 			m.remPresenceScript,
 			m.presenceScript,
+			m.presencePageScript,
+			m.addUserScript,
+			m.remUserScript,
 		)
 	}
 
@@ -175,6 +231,43 @@ func (m *RedisPresenceManager) removePresence(s *RedisShard, ch string, uid stri
 	return resp.err
 }
 
+var _ UserPresenceManager = (*RedisPresenceManager)(nil)
+
+// AddUserConnection - see UserPresenceManager interface description.
+func (m *RedisPresenceManager) AddUserConnection(ch string, userID string, clientID string) (bool, error) {
+	return m.addUserConnection(m.getShard(ch), ch, userID, clientID)
+}
+
+func (m *RedisPresenceManager) addUserConnection(s *RedisShard, ch string, userID string, clientID string) (bool, error) {
+	expire := int(m.config.PresenceTTL.Seconds())
+	now := time.Now().Unix()
+	expireAt := now + int64(expire)
+	setKey := m.presenceUserKey(s, ch, userID)
+	dr := s.newDataRequest("", m.addUserScript, setKey, []interface{}{setKey, expire, expireAt, clientID, now})
+	resp := s.getDataResponse(dr, m.closeCh)
+	if resp.err != nil {
+		return false, resp.err
+	}
+	added, err := redis.Int(resp.reply, nil)
+	return added == 1, err
+}
+
+// RemoveUserConnection - see UserPresenceManager interface description.
+func (m *RedisPresenceManager) RemoveUserConnection(ch string, userID string, clientID string) (bool, error) {
+	return m.removeUserConnection(m.getShard(ch), ch, userID, clientID)
+}
+
+func (m *RedisPresenceManager) removeUserConnection(s *RedisShard, ch string, userID string, clientID string) (bool, error) {
+	setKey := m.presenceUserKey(s, ch, userID)
+	dr := s.newDataRequest("", m.remUserScript, setKey, []interface{}{setKey, clientID, time.Now().Unix()})
+	resp := s.getDataResponse(dr, m.closeCh)
+	if resp.err != nil {
+		return false, resp.err
+	}
+	removed, err := redis.Int(resp.reply, nil)
+	return removed == 1, err
+}
+
 // Presence - see PresenceManager interface description.
 func (m *RedisPresenceManager) Presence(ch string) (map[string]*ClientInfo, error) {
 	return m.presence(m.getShard(ch), ch)
@@ -193,6 +286,48 @@ func (m *RedisPresenceManager) presence(s *RedisShard, ch string) (map[string]*C
 	return mapStringClientInfo(resp.reply, nil)
 }
 
+var _ PresencePager = (*RedisPresenceManager)(nil)
+
+// PresencePage - see PresencePager interface description. Uses HSCAN under the
+// hood so limit is only a hint for Redis and page may contain a different number
+// of entries. Cursor is an HSCAN cursor.
+func (m *RedisPresenceManager) PresencePage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	return m.presencePage(m.getShard(ch), ch, cursor, limit)
+}
+
+func (m *RedisPresenceManager) presencePage(s *RedisShard, ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	hashKey := m.presenceHashKey(s, ch)
+	setKey := m.presenceSetKey(s, ch)
+	now := int(time.Now().Unix())
+	dr := s.newDataRequest("", m.presencePageScript, setKey, []interface{}{setKey, hashKey, now, cursor, limit})
+	resp := s.getDataResponse(dr, m.closeCh)
+	if resp.err != nil {
+		return nil, "", resp.err
+	}
+	values, err := redis.Values(resp.reply, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(values) != 2 {
+		return nil, "", errors.New("wrong number of values in HSCAN result")
+	}
+	nextCursor, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if nextCursor == "0" {
+		nextCursor = ""
+	}
+	presence, err := mapStringClientInfo(values[1], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return presence, nextCursor, nil
+}
+
 func mapStringClientInfo(result interface{}, err error) (map[string]*ClientInfo, error) {
 	values, err := redis.Values(result, err)
 	if err != nil {
@@ -225,22 +360,7 @@ func (m *RedisPresenceManager) PresenceStats(ch string) (PresenceStats, error) {
 		return PresenceStats{}, err
 	}
 
-	numClients := len(presence)
-	numUsers := 0
-	uniqueUsers := map[string]struct{}{}
-
-	for _, info := range presence {
-		userID := info.UserID
-		if _, ok := uniqueUsers[userID]; !ok {
-			uniqueUsers[userID] = struct{}{}
-			numUsers++
-		}
-	}
-
-	return PresenceStats{
-		NumClients: numClients,
-		NumUsers:   numUsers,
-	}, nil
+	return presenceStatsFromInfo(presence), nil
 }
 
 func (m *RedisPresenceManager) presenceHashKey(s *RedisShard, ch string) channelID {
@@ -256,3 +376,12 @@ func (m *RedisPresenceManager) presenceSetKey(s *RedisShard, ch string) channelI
 	}
 	return channelID(m.config.Prefix + ".presence.expire." + ch)
 }
+
+// presenceUserKey is a key of sorted set with connections of user in channel.
+func (m *RedisPresenceManager) presenceUserKey(s *RedisShard, ch string, userID string) channelID {
+	chLen := strconv.Itoa(len(ch))
+	if s.useCluster {
+		ch = "{" + ch + "}"
+	}
+	return channelID(m.config.Prefix + ".presence.user." + chLen + "." + ch + "." + userID)
+}
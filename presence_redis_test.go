@@ -99,6 +99,104 @@ func TestRedisPresenceManager(t *testing.T) {
 	}
 }
 
+func TestRedisPresenceManagerUpdateInfo(t *testing.T) {
+	for _, tt := range redisPresenceTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisPresenceManager(t, node, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			require.NoError(t, e.AddPresence("channel", "uid", &ClientInfo{ClientID: "uid", ChanInfo: []byte(`{"status":"online"}`)}))
+			require.NoError(t, e.AddPresence("channel", "uid", &ClientInfo{ClientID: "uid", ChanInfo: []byte(`{"status":"away"}`)}))
+
+			p, err := e.Presence("channel")
+			require.NoError(t, err)
+			require.Len(t, p, 1)
+			require.Equal(t, []byte(`{"status":"away"}`), p["uid"].ChanInfo)
+		})
+	}
+}
+
+func TestRedisPresenceManagerUserConnections(t *testing.T) {
+	for _, tt := range redisPresenceTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisPresenceManager(t, node, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			joined, err := e.AddUserConnection("channel", "user", "client1")
+			require.NoError(t, err)
+			require.True(t, joined)
+			joined, err = e.AddUserConnection("channel", "user", "client1")
+			require.NoError(t, err)
+			require.False(t, joined)
+			joined, err = e.AddUserConnection("channel", "user", "client2")
+			require.NoError(t, err)
+			require.False(t, joined)
+
+			left, err := e.RemoveUserConnection("channel", "user", "client1")
+			require.NoError(t, err)
+			require.False(t, left)
+			left, err = e.RemoveUserConnection("channel", "user", "client2")
+			require.NoError(t, err)
+			require.True(t, left)
+			left, err = e.RemoveUserConnection("channel", "user", "client2")
+			require.NoError(t, err)
+			require.False(t, left)
+		})
+	}
+}
+
+func TestRedisPresenceManagerSameAsMemory(t *testing.T) {
+	for _, tt := range redisPresenceTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisPresenceManager(t, node, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			m, err := NewMemoryPresenceManager(node, MemoryPresenceManagerConfig{})
+			require.NoError(t, err)
+			defer func() { _ = m.Close(context.Background()) }()
+
+			redisResults := presenceScenario(t, e, "channel")
+			require.Equal(t, presenceScenario(t, m, "channel"), redisResults)
+			require.Equal(t, expectedPresenceScenarioResults, redisResults)
+		})
+	}
+}
+
+func TestRedisPresenceManagerPresencePage(t *testing.T) {
+	for _, tt := range redisPresenceTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			e := newTestRedisPresenceManager(t, node, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, e.AddPresence("channel", strconv.Itoa(i), &ClientInfo{UserID: "42"}))
+			}
+
+			seen := map[string]struct{}{}
+			var cursor string
+			var numPages int
+			for {
+				p, nextCursor, err := e.PresencePage("channel", cursor, 100)
+				require.NoError(t, err)
+				for k, info := range p {
+					require.Equal(t, "42", info.UserID)
+					seen[k] = struct{}{}
+				}
+				numPages++
+				if nextCursor == "" {
+					break
+				}
+				cursor = nextCursor
+			}
+			require.Len(t, seen, 1000)
+			require.Greater(t, numPages, 1)
+		})
+	}
+}
+
 func BenchmarkRedisAddPresence_1Ch(b *testing.B) {
 	for _, tt := range benchRedisTests {
 		b.Run(tt.Name, func(b *testing.B) {
@@ -0,0 +1,167 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// RoutingPresenceManager is a PresenceManager which dispatches channels to
+// different PresenceManagers. It's a counterpart of RoutingBroker.
+type RoutingPresenceManager struct {
+	node     *Node
+	config   RoutingPresenceManagerConfig
+	managers []PresenceManager
+}
+
+var _ PresenceManager = (*RoutingPresenceManager)(nil)
+
+// RoutingPresenceManagerConfig is a config for RoutingPresenceManager.
+type RoutingPresenceManagerConfig struct {
+	// PresenceManagers is a list of PresenceManagers to route channels to.
+	// At least one PresenceManager must be provided.
+	PresenceManagers []PresenceManager
+	// PresenceManagerResolver returns PresenceManager to use for a channel. It
+	// must be fast and must return one of PresenceManagers – operations with a
+	// channel for which other PresenceManager returned fail with an error. Required.
+	PresenceManagerResolver func(ch string) PresenceManager
+}
+
+// NewRoutingPresenceManager initializes RoutingPresenceManager.
+func NewRoutingPresenceManager(n *Node, config RoutingPresenceManagerConfig) (*RoutingPresenceManager, error) {
+	if len(config.PresenceManagers) == 0 {
+		return nil, errors.New("routing presence manager: no presence managers provided in configuration")
+	}
+	if config.PresenceManagerResolver == nil {
+		return nil, errors.New("routing presence manager: presence manager resolver required")
+	}
+	var managers []PresenceManager
+	for _, m := range config.PresenceManagers {
+		if m == nil {
+			return nil, errors.New("routing presence manager: nil presence manager in configuration")
+		}
+		if !containsPresenceManager(managers, m) {
+			managers = append(managers, m)
+		}
+	}
+	return &RoutingPresenceManager{
+		node:     n,
+		config:   config,
+		managers: managers,
+	}, nil
+}
+
+func containsPresenceManager(managers []PresenceManager, m PresenceManager) bool {
+	for _, manager := range managers {
+		if manager == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *RoutingPresenceManager) getPresenceManager(ch string) (PresenceManager, error) {
+	manager := m.config.PresenceManagerResolver(ch)
+	if manager == nil {
+		return nil, fmt.Errorf("routing presence manager: no presence manager for channel %s", ch)
+	}
+	if !containsPresenceManager(m.managers, manager) {
+		return nil, fmt.Errorf("routing presence manager: unknown presence manager for channel %s", ch)
+	}
+	return manager, nil
+}
+
+// Close closes all PresenceManagers which implement Closer.
+func (m *RoutingPresenceManager) Close(ctx context.Context) error {
+	var firstErr error
+	for _, manager := range m.managers {
+		if closer, ok := manager.(Closer); ok {
+			if err := closer.Close(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Presence - see PresenceManager interface description.
+func (m *RoutingPresenceManager) Presence(ch string) (map[string]*ClientInfo, error) {
+	manager, err := m.getPresenceManager(ch)
+	if err != nil {
+		return nil, err
+	}
+	return manager.Presence(ch)
+}
+
+// PresenceStats - see PresenceManager interface description.
+func (m *RoutingPresenceManager) PresenceStats(ch string) (PresenceStats, error) {
+	manager, err := m.getPresenceManager(ch)
+	if err != nil {
+		return PresenceStats{}, err
+	}
+	return manager.PresenceStats(ch)
+}
+
+// AddPresence - see PresenceManager interface description.
+func (m *RoutingPresenceManager) AddPresence(ch string, clientID string, info *ClientInfo) error {
+	manager, err := m.getPresenceManager(ch)
+	if err != nil {
+		return err
+	}
+	return manager.AddPresence(ch, clientID, info)
+}
+
+// RemovePresence - see PresenceManager interface description.
+func (m *RoutingPresenceManager) RemovePresence(ch string, clientID string) error {
+	manager, err := m.getPresenceManager(ch)
+	if err != nil {
+		return err
+	}
+	return manager.RemovePresence(ch, clientID)
+}
+
+var _ UserPresenceManager = (*RoutingPresenceManager)(nil)
+
+// AddUserConnection - see UserPresenceManager interface description. Returns
+// ErrorNotAvailable if PresenceManager of channel does not implement UserPresenceManager.
+func (m *RoutingPresenceManager) AddUserConnection(ch string, userID string, clientID string) (bool, error) {
+	manager, err := m.getPresenceManager(ch)
+	if err != nil {
+		return false, err
+	}
+	userManager, ok := manager.(UserPresenceManager)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	return userManager.AddUserConnection(ch, userID, clientID)
+}
+
+// RemoveUserConnection - see UserPresenceManager interface description. Returns
+// ErrorNotAvailable if PresenceManager of channel does not implement UserPresenceManager.
+func (m *RoutingPresenceManager) RemoveUserConnection(ch string, userID string, clientID string) (bool, error) {
+	manager, err := m.getPresenceManager(ch)
+	if err != nil {
+		return false, err
+	}
+	userManager, ok := manager.(UserPresenceManager)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	return userManager.RemoveUserConnection(ch, userID, clientID)
+}
+
+var _ PresencePager = (*RoutingPresenceManager)(nil)
+
+// PresencePage - see PresencePager interface description. Returns
+// ErrorNotAvailable if PresenceManager of channel does not implement PresencePager.
+func (m *RoutingPresenceManager) PresencePage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	manager, err := m.getPresenceManager(ch)
+	if err != nil {
+		return nil, "", err
+	}
+	pager, ok := manager.(PresencePager)
+	if !ok {
+		return nil, "", ErrorNotAvailable
+	}
+	return pager.PresencePage(ch, cursor, limit)
+}
@@ -0,0 +1,70 @@
+package centrifuge
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingPresenceManager(t *testing.T) {
+	n, _ := New(Config{})
+	m1, err := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{})
+	require.NoError(t, err)
+	m2, err := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{})
+	require.NoError(t, err)
+
+	_, err = NewRoutingPresenceManager(n, RoutingPresenceManagerConfig{PresenceManagers: []PresenceManager{m1, m2}})
+	require.Error(t, err)
+
+	m, err := NewRoutingPresenceManager(n, RoutingPresenceManagerConfig{
+		PresenceManagers: []PresenceManager{m1, m2},
+		PresenceManagerResolver: func(ch string) PresenceManager {
+			if strings.HasPrefix(ch, "ephemeral:") {
+				return m2
+			}
+			return m1
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, m.AddPresence("ephemeral:test", "uid", &ClientInfo{UserID: "42"}))
+	p, err := m.Presence("ephemeral:test")
+	require.NoError(t, err)
+	require.Len(t, p, 1)
+	p, err = m1.Presence("ephemeral:test")
+	require.NoError(t, err)
+	require.Len(t, p, 0)
+	stats, err := m.PresenceStats("ephemeral:test")
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.NumUsers)
+
+	p, cursor, err := m.PresencePage("ephemeral:test", "", 10)
+	require.NoError(t, err)
+	require.Len(t, p, 1)
+	require.Empty(t, cursor)
+
+	require.NoError(t, m.RemovePresence("ephemeral:test", "uid"))
+	p, err = m2.Presence("ephemeral:test")
+	require.NoError(t, err)
+	require.Len(t, p, 0)
+
+	require.NoError(t, m.Close(context.Background()))
+}
+
+func TestRoutingPresenceManagerUnknownManager(t *testing.T) {
+	n, _ := New(Config{})
+	m1, err := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{})
+	require.NoError(t, err)
+	other, err := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{})
+	require.NoError(t, err)
+	m, err := NewRoutingPresenceManager(n, RoutingPresenceManagerConfig{
+		PresenceManagers:        []PresenceManager{m1},
+		PresenceManagerResolver: func(ch string) PresenceManager { return other },
+	})
+	require.NoError(t, err)
+	require.Error(t, m.AddPresence("test", "uid", &ClientInfo{UserID: "42"}))
+	_, err = m.Presence("test")
+	require.Error(t, err)
+}
@@ -0,0 +1,283 @@
+package centrifuge
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/centrifugal/protocol"
+)
+
+// RateLimit configures a token bucket. Bucket holds up to Burst tokens and is
+// refilled with Rate tokens per second, each command takes one token.
+type RateLimit struct {
+	// Rate is a number of tokens added to a bucket every second. Zero value
+	// means no limit.
+	Rate float64
+	// Burst is a bucket capacity – i.e. maximum number of commands which can
+	// be sent at once. Values less than 1 mean 1.
+	Burst int
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// RateLimitAnyMethod is a key of CommandRateLimitConfig limits which applies to
+// all methods without explicitly configured limit.
+const RateLimitAnyMethod = "*"
+
+// CommandRateLimitConfig configures rate limits of client commands. Limits are
+// set for each command method separately using lowercase method names as keys:
+// "ping", "subscribe", "unsubscribe", "publish", "presence", "presence_stats",
+// "history", "rpc", "send", "refresh", "sub_refresh" (the same names used in
+// metric labels). Limit under RateLimitAnyMethod key applies to methods without
+// explicit limit. Connect command is never rate limited.
+//
+// Throttled commands get ErrorTooManyRequests in reply, throttled asynchronous
+// messages (send) are dropped.
+type CommandRateLimitConfig struct {
+	// ClientLimits are limits applied to each client connection.
+	ClientLimits map[string]RateLimit
+	// UserLimits are limits shared by all connections of a user with the same ID
+	// on a Node. Connections of anonymous users are only limited by ClientLimits.
+	UserLimits map[string]RateLimit
+	// UserLimitsClusterWide makes UserLimits shared by connections on all nodes.
+	// Broker must implement RateLimiter (MemoryBroker and RedisBroker do). Commands
+	// are not throttled by UserLimits if Broker returns an error. Note, this adds
+	// a Broker round trip (to Redis in case of RedisBroker) to processing of every
+	// command limited by UserLimits.
+	UserLimitsClusterWide bool
+	// DisconnectAfter is a number of rate limit violations within DisconnectWindow
+	// after which connection is disconnected with DisconnectTooManyRequests. Zero
+	// value means that connection is never disconnected due to rate limits.
+	DisconnectAfter int
+	// DisconnectWindow is a period during which rate limit violations are counted
+	// for DisconnectAfter. Window starts with a first violation, counter is reset
+	// upon first violation after window end. Zero value means 1 minute.
+	DisconnectWindow time.Duration
+}
+
+const defaultRateLimitDisconnectWindow = time.Minute
+
+func (c CommandRateLimitConfig) disconnectWindow() time.Duration {
+	if c.DisconnectWindow > 0 {
+		return c.DisconnectWindow
+	}
+	return defaultRateLimitDisconnectWindow
+}
+
+func (c CommandRateLimitConfig) enabled() bool {
+	return len(c.ClientLimits) > 0 || len(c.UserLimits) > 0
+}
+
+// getRateLimit returns limit for method, false means that method is not limited.
+func getRateLimit(limits map[string]RateLimit, method string) (RateLimit, bool) {
+	limit, ok := limits[method]
+	if !ok {
+		limit, ok = limits[RateLimitAnyMethod]
+	}
+	if !ok || limit.Rate <= 0 {
+		return RateLimit{}, false
+	}
+	return limit, true
+}
+
+func rateLimitMethodName(method protocol.Command_MethodType) string {
+	return strings.ToLower(protocol.Command_MethodType_name[int32(method)])
+}
+
+// commandMethodV2 returns method of ProtocolVersion2 command in the same way
+// as Client.dispatchCommandV2 does.
+func commandMethodV2(cmd *protocol.Command) protocol.Command_MethodType {
+	switch {
+	case cmd.Connect != nil:
+		return protocol.Command_CONNECT
+	case cmd.Subscribe != nil:
+		return protocol.Command_SUBSCRIBE
+	case cmd.Unsubscribe != nil:
+		return protocol.Command_UNSUBSCRIBE
+	case cmd.Publish != nil:
+		return protocol.Command_PUBLISH
+	case cmd.Presence != nil:
+		return protocol.Command_PRESENCE
+	case cmd.PresenceStats != nil:
+		return protocol.Command_PRESENCE_STATS
+	case cmd.History != nil:
+		return protocol.Command_HISTORY
+	case cmd.Rpc != nil:
+		return protocol.Command_RPC
+	case cmd.Send != nil:
+		return protocol.Command_SEND
+	case cmd.Refresh != nil:
+		return protocol.Command_REFRESH
+	case cmd.SubRefresh != nil:
+		return protocol.Command_SUB_REFRESH
+	default:
+		return protocol.Command_PING
+	}
+}
+
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated int64
+}
+
+// refill adds tokens accumulated since last update.
+func (b *tokenBucket) refill(now int64) {
+	if now > b.updated {
+		b.tokens = math.Min(float64(b.limit.burst()), b.tokens+float64(now-b.updated)/float64(time.Second)*b.limit.Rate)
+		b.updated = now
+	}
+}
+
+// rateLimiter keeps token buckets in process memory.
+type rateLimiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	nextCleanup int64
+}
+
+// rateLimiterCleanupInterval is an interval how often rateLimiter removes full
+// buckets – those are equivalent to not existing buckets.
+const rateLimiterCleanupInterval = time.Minute
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes one token from bucket with the given key, returns false if
+// bucket is empty.
+func (l *rateLimiter) allow(key string, limit RateLimit, now int64) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now >= l.nextCleanup {
+		if l.nextCleanup > 0 {
+			l.removeFull(now)
+		}
+		l.nextCleanup = now + int64(rateLimiterCleanupInterval)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.burst()), updated: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.limit = limit
+		bucket.refill(now)
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *rateLimiter) removeFull(now int64) {
+	for key, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.burst()) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// checkRateLimit takes tokens for command method from configured client and user
+// buckets. Returns ErrorTooManyRequests or DisconnectTooManyRequests if command
+// must be throttled.
+func (c *Client) checkRateLimit(method protocol.Command_MethodType) error {
+	config := c.node.config.CommandRateLimit
+	if !config.enabled() {
+		return nil
+	}
+	methodName := rateLimitMethodName(method)
+	now := time.Now().UnixNano()
+
+	if limit, ok := getRateLimit(config.ClientLimits, methodName); ok {
+		if !c.rateLimiter.allow(methodName, limit, now) {
+			return c.onRateLimited(method, "client", now)
+		}
+	}
+
+	if c.user == "" {
+		return nil
+	}
+	limit, ok := getRateLimit(config.UserLimits, methodName)
+	if !ok {
+		return nil
+	}
+	key := methodName + ":" + c.user
+	if config.UserLimitsClusterWide {
+		allowed, err := c.node.allowRate(key, limit)
+		if err != nil {
+			c.node.logger.log(newLogEntry(LogLevelError, "error checking user rate limit", map[string]interface{}{"client": c.uid, "user": c.user, "method": methodName, "error": err.Error()}))
+			return nil
+		}
+		if !allowed {
+			return c.onRateLimited(method, "user", now)
+		}
+	} else if !c.node.userRateLimiter.allow(key, limit, now) {
+		return c.onRateLimited(method, "user", now)
+	}
+	return nil
+}
+
+func (c *Client) onRateLimited(method protocol.Command_MethodType, scope string, now int64) error {
+	incCommandThrottled(method, scope)
+	numViolations := c.countRateLimitViolation(now)
+	if c.node.LogEnabled(LogLevelDebug) {
+		c.node.logger.log(newLogEntry(LogLevelDebug, "client command throttled", map[string]interface{}{"client": c.uid, "user": c.user, "method": rateLimitMethodName(method), "scope": scope}))
+	}
+	disconnectAfter := c.node.config.CommandRateLimit.DisconnectAfter
+	if disconnectAfter > 0 && numViolations >= disconnectAfter {
+		return DisconnectTooManyRequests
+	}
+	return ErrorTooManyRequests
+}
+
+// countRateLimitViolation returns a number of violations in current window
+// including the one at now.
+func (c *Client) countRateLimitViolation(now int64) int {
+	window := int64(c.node.config.CommandRateLimit.disconnectWindow())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.numRateLimitViolations == 0 || now-c.rateLimitWindowStart >= window {
+		c.numRateLimitViolations = 0
+		c.rateLimitWindowStart = now
+	}
+	c.numRateLimitViolations++
+	return c.numRateLimitViolations
+}
+
+// handleRateLimitError replies to throttled command or returns Disconnect.
+func (c *Client) handleRateLimitError(method protocol.Command_MethodType, cmd *protocol.Command, err error) *Disconnect {
+	if d, ok := err.(Disconnect); ok {
+		return &d
+	}
+	if method == protocol.Command_SEND {
+		// Asynchronous messages have no reply.
+		return nil
+	}
+	c.writeError(method, cmd, toClientErr(err), nil)
+	return nil
+}
+
+// allowRate checks cluster-wide rate limit using Broker.
+func (n *Node) allowRate(key string, limit RateLimit) (bool, error) {
+	limiter, ok := n.broker.(RateLimiter)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	return limiter.AllowRate(key, limit)
+}
@@ -0,0 +1,229 @@
+package centrifuge
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	limit := RateLimit{Rate: 1, Burst: 2}
+	now := time.Now().UnixNano()
+
+	require.True(t, l.allow("test", limit, now))
+	require.True(t, l.allow("test", limit, now))
+	require.False(t, l.allow("test", limit, now))
+	// Buckets are independent.
+	require.True(t, l.allow("other", limit, now))
+
+	// One token refilled after a second.
+	now += int64(time.Second)
+	require.True(t, l.allow("test", limit, now))
+	require.False(t, l.allow("test", limit, now))
+
+	// Bucket never holds more than Burst tokens.
+	now += int64(time.Hour)
+	require.True(t, l.allow("test", limit, now))
+	require.True(t, l.allow("test", limit, now))
+	require.False(t, l.allow("test", limit, now))
+
+	// Zero rate means no limit.
+	for i := 0; i < 10; i++ {
+		require.True(t, l.allow("unlimited", RateLimit{}, now))
+	}
+}
+
+func TestRateLimiterRemoveFull(t *testing.T) {
+	l := newRateLimiter()
+	limit := RateLimit{Rate: 1, Burst: 1}
+	now := time.Now().UnixNano()
+	require.True(t, l.allow("test", limit, now))
+	require.Len(t, l.buckets, 1)
+	now += int64(rateLimiterCleanupInterval)
+	require.True(t, l.allow("other", limit, now))
+	// Bucket of test key refilled and removed.
+	require.Len(t, l.buckets, 1)
+	require.Contains(t, l.buckets, "other")
+}
+
+func TestGetRateLimit(t *testing.T) {
+	limits := map[string]RateLimit{
+		"rpc":              {Rate: 1},
+		"publish":          {Rate: 0},
+		RateLimitAnyMethod: {Rate: 10, Burst: 10},
+	}
+	limit, ok := getRateLimit(limits, "rpc")
+	require.True(t, ok)
+	require.Equal(t, 1, limit.burst())
+	_, ok = getRateLimit(limits, "publish")
+	require.False(t, ok)
+	limit, ok = getRateLimit(limits, "history")
+	require.True(t, ok)
+	require.Equal(t, float64(10), limit.Rate)
+	_, ok = getRateLimit(nil, "history")
+	require.False(t, ok)
+}
+
+func rateLimitTestNode(t *testing.T, config CommandRateLimitConfig, numRPCCalls *int32) *Node {
+	node, err := New(Config{CommandRateLimit: config})
+	require.NoError(t, err)
+	node.OnConnect(func(client *Client) {
+		client.OnRPC(func(e RPCEvent, cb RPCCallback) {
+			atomic.AddInt32(numRPCCalls, 1)
+			cb(RPCReply{}, nil)
+		})
+	})
+	require.NoError(t, node.Run())
+	return node
+}
+
+func rpcCommand(id uint32) *protocol.Command {
+	return &protocol.Command{Id: id, Method: protocol.Command_RPC, Params: []byte(`{"data":{}}`)}
+}
+
+func TestClientCommandRateLimitReply(t *testing.T) {
+	var numRPCCalls int32
+	node := rateLimitTestNode(t, CommandRateLimitConfig{
+		ClientLimits: map[string]RateLimit{
+			"rpc": {Rate: 0.001, Burst: 2},
+		},
+	}, &numRPCCalls)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client, _ := newClient(SetCredentials(context.Background(), &Credentials{UserID: "42"}), node, transport)
+	connectClient(t, client)
+
+	done := make(chan struct{})
+	go func() {
+		for data := range transport.sink {
+			if strings.Contains(string(data), `"id":3,"error":{"code":111`) {
+				close(done)
+			}
+		}
+	}()
+
+	for i := uint32(1); i <= 3; i++ {
+		require.Nil(t, client.dispatchCommand(rpcCommand(i)))
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&numRPCCalls))
+
+	select {
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout receiving too many requests error")
+	case <-done:
+	}
+
+	// Other methods are not limited.
+	require.Nil(t, client.dispatchCommand(&protocol.Command{Id: 4, Method: protocol.Command_PING}))
+}
+
+func TestClientCommandRateLimitDisconnect(t *testing.T) {
+	var numRPCCalls int32
+	node := rateLimitTestNode(t, CommandRateLimitConfig{
+		ClientLimits: map[string]RateLimit{
+			RateLimitAnyMethod: {Rate: 0.001, Burst: 1},
+		},
+		DisconnectAfter: 2,
+	}, &numRPCCalls)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	require.Nil(t, client.dispatchCommand(rpcCommand(1)))
+	require.Nil(t, client.dispatchCommand(rpcCommand(2)))
+	disconnect := client.dispatchCommand(rpcCommand(3))
+	require.NotNil(t, disconnect)
+	require.Equal(t, DisconnectTooManyRequests, *disconnect)
+	require.Equal(t, int32(1), atomic.LoadInt32(&numRPCCalls))
+}
+
+func TestClientRateLimitViolationWindow(t *testing.T) {
+	node := rateLimitTestNode(t, CommandRateLimitConfig{
+		ClientLimits: map[string]RateLimit{
+			RateLimitAnyMethod: {Rate: 0.001, Burst: 1},
+		},
+		DisconnectAfter:  2,
+		DisconnectWindow: time.Second,
+	}, new(int32))
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	now := time.Now().UnixNano()
+	require.Equal(t, ErrorTooManyRequests, client.onRateLimited(protocol.Command_RPC, "client", now))
+	// Violations outside window are not counted.
+	now += int64(time.Second)
+	require.Equal(t, ErrorTooManyRequests, client.onRateLimited(protocol.Command_RPC, "client", now))
+	now += int64(time.Second) - 1
+	require.Equal(t, DisconnectTooManyRequests, client.onRateLimited(protocol.Command_RPC, "client", now))
+}
+
+func TestClientCommandRateLimitUser(t *testing.T) {
+	var numRPCCalls int32
+	node := rateLimitTestNode(t, CommandRateLimitConfig{
+		UserLimits: map[string]RateLimit{
+			"rpc": {Rate: 0.001, Burst: 2},
+		},
+	}, &numRPCCalls)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client1 := newTestClient(t, node, "42")
+	connectClient(t, client1)
+	client2 := newTestClient(t, node, "42")
+	connectClient(t, client2)
+	client3 := newTestClient(t, node, "43")
+	connectClient(t, client3)
+
+	require.Nil(t, client1.dispatchCommand(rpcCommand(1)))
+	require.Nil(t, client2.dispatchCommand(rpcCommand(1)))
+	require.Equal(t, int32(2), atomic.LoadInt32(&numRPCCalls))
+	// Budget shared between connections of user 42.
+	require.Nil(t, client1.dispatchCommand(rpcCommand(2)))
+	require.Nil(t, client2.dispatchCommand(rpcCommand(2)))
+	require.Equal(t, int32(2), atomic.LoadInt32(&numRPCCalls))
+	// Other user has its own budget.
+	require.Nil(t, client3.dispatchCommand(rpcCommand(1)))
+	require.Equal(t, int32(3), atomic.LoadInt32(&numRPCCalls))
+}
+
+func TestClientCommandRateLimitUserClusterWide(t *testing.T) {
+	var numRPCCalls int32
+	node := rateLimitTestNode(t, CommandRateLimitConfig{
+		UserLimits: map[string]RateLimit{
+			"rpc": {Rate: 0.001, Burst: 1},
+		},
+		UserLimitsClusterWide: true,
+	}, &numRPCCalls)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClient(t, client)
+
+	require.Nil(t, client.dispatchCommand(rpcCommand(1)))
+	require.Nil(t, client.dispatchCommand(rpcCommand(2)))
+	require.Equal(t, int32(1), atomic.LoadInt32(&numRPCCalls))
+	// Node keeps no local buckets in cluster-wide mode.
+	require.Len(t, node.userRateLimiter.buckets, 0)
+}
+
+func TestNodeRunRateLimiterNotAvailable(t *testing.T) {
+	node, err := New(Config{
+		CommandRateLimit: CommandRateLimitConfig{
+			UserLimits:            map[string]RateLimit{"rpc": {Rate: 1}},
+			UserLimitsClusterWide: true,
+		},
+	})
+	require.NoError(t, err)
+	node.SetBroker(NewTestBroker())
+	require.Error(t, node.Run())
+}
@@ -297,6 +297,16 @@ func (s *RedisShard) getDataResponse(r *dataRequest, closeCh chan struct{}) *dat
 			err:   err,
 		}
 	}
+	if err := s.sendDataRequest(r, closeCh); err != nil {
+		return &dataResponse{nil, err}
+	}
+	return r.result()
+}
+
+// sendDataRequest puts request into data pipeline without waiting for response.
+// Requests sent one after another are executed by Redis in the same order. Not
+// available in cluster mode.
+func (s *RedisShard) sendDataRequest(r *dataRequest, closeCh chan struct{}) error {
 	select {
 	case s.dataCh <- r:
 	default:
@@ -305,12 +315,12 @@ func (s *RedisShard) getDataResponse(r *dataRequest, closeCh chan struct{}) *dat
 		select {
 		case s.dataCh <- r:
 		case <-closeCh:
-			return &dataResponse{nil, errRedisClosed}
+			return errRedisClosed
 		case <-timer.C:
-			return &dataResponse{nil, errRedisOpTimeout}
+			return errRedisOpTimeout
 		}
 	}
-	return r.result()
+	return nil
 }
 
 func (s *RedisShard) processClusterDataRequest(dr *dataRequest) (interface{}, error) {
@@ -436,7 +446,9 @@ func (s *RedisShard) runDataPipeline() error {
 type subRequest struct {
 	channels  []channelID
 	subscribe bool
-	err       chan error
+	// pattern is true for PSUBSCRIBE and PUNSUBSCRIBE requests.
+	pattern bool
+	err     chan error
 }
 
 // newSubRequest creates a new request to subscribe or unsubscribe form a channel.
@@ -448,6 +460,14 @@ func newSubRequest(chIDs []channelID, subscribe bool) subRequest {
 	}
 }
 
+// newPatternSubRequest creates a new request to subscribe or unsubscribe from
+// one or more patterns.
+func newPatternSubRequest(patternIDs []channelID, subscribe bool) subRequest {
+	r := newSubRequest(patternIDs, subscribe)
+	r.pattern = true
+	return r
+}
+
 // done should only be called once for subRequest.
 func (sr *subRequest) done(err error) {
 	sr.err <- err
@@ -49,3 +49,21 @@ func TestRedisShard_ConfFromAddress(t *testing.T) {
 	require.Equal(t, 0, conf.DB)
 	require.Equal(t, "pass", conf.Password)
 }
+
+func TestParseClusterSlots(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(5460), []interface{}{[]byte("127.0.0.1"), int64(7000), []byte("id1")}, []interface{}{[]byte("127.0.0.1"), int64(7003), []byte("id4")}},
+		[]interface{}{int64(5461), int64(10922), []interface{}{[]byte("127.0.0.1"), int64(7001), []byte("id2")}},
+		[]interface{}{int64(10923), int64(16383), []interface{}{[]byte("127.0.0.1"), int64(7002), []byte("id3")}},
+	}
+	slots, err := parseClusterSlots(reply)
+	require.NoError(t, err)
+	require.Len(t, slots, 3)
+	require.Equal(t, "127.0.0.1:7000", slots.nodeAddr(0))
+	require.Equal(t, "127.0.0.1:7001", slots.nodeAddr(5461))
+	require.Equal(t, "127.0.0.1:7002", slots.nodeAddr(16383))
+	require.Equal(t, "", slots.nodeAddr(16384))
+
+	_, err = parseClusterSlots([]interface{}{[]interface{}{int64(0), int64(5460)}})
+	require.Error(t, err)
+}
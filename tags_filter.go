@@ -0,0 +1,55 @@
+package centrifuge
+
+import (
+	"github.com/centrifugal/centrifuge/internal/tagsfilter"
+)
+
+// TagsFilter is a compiled expression over Publication.Tags. It allows
+// delivering to subscribers and returning from history only publications with
+// matching tags. Expression supports equality (key = value, key != value),
+// set membership (key in (v1, v2)), prefix matching (key prefix value) and
+// combining those with and/or (also && and ||) and parentheses. Values may be
+// double or single quoted. For example:
+//
+//	type = trade and (ticker prefix "BTC" or venue in (binance, kraken))
+//
+// TagsFilter is immutable and safe for concurrent use.
+type TagsFilter struct {
+	expr   string
+	filter *tagsfilter.Filter
+}
+
+// ParseTagsFilter compiles TagsFilter from expression.
+func ParseTagsFilter(expr string) (*TagsFilter, error) {
+	f, err := tagsfilter.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &TagsFilter{expr: expr, filter: f}, nil
+}
+
+// MustParseTagsFilter is like ParseTagsFilter but panics if the expression
+// can not be parsed.
+func MustParseTagsFilter(expr string) *TagsFilter {
+	f, err := ParseTagsFilter(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Match reports whether tags satisfy filter. Nil TagsFilter matches any tags.
+func (f *TagsFilter) Match(tags map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	return f.filter.Match(tags)
+}
+
+// String returns filter source expression.
+func (f *TagsFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
@@ -0,0 +1,99 @@
+package centrifuge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+const userStatusOp = "centrifuge_user_status"
+
+// UserStatusResult describes connections of user in a cluster.
+type UserStatusResult struct {
+	// NumConnections is a number of user connections on all nodes.
+	NumConnections int
+	// Connections of user sorted by node ID and client ID.
+	Connections []UserConnectionStatus
+}
+
+// Online reports whether user has at least one connection in a cluster.
+func (r UserStatusResult) Online() bool {
+	return r.NumConnections > 0
+}
+
+// UserConnectionStatus describes a single user connection.
+type UserConnectionStatus struct {
+	// ClientID is a unique client connection ID.
+	ClientID string
+	// NodeID is an ID of Node connection established with.
+	NodeID string
+	// Channels connection currently subscribed to.
+	Channels []string
+}
+
+type userStatusConnectionJSON struct {
+	Client   string   `json:"client"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+// UserStatus returns information about user connections on all nodes of a cluster:
+// connection count, client IDs, node IDs and subscribed channels. It uses Survey
+// under the hood so all running nodes are asked for user connections – see
+// Node.Survey for details about timeout handling. Nodes reply even if SurveyHandler
+// is not set.
+func (n *Node) UserStatus(ctx context.Context, userID string) (UserStatusResult, error) {
+	incActionCount("user_status")
+	results, err := n.Survey(ctx, userStatusOp, []byte(userID), "")
+	if err != nil {
+		return UserStatusResult{}, err
+	}
+	var connections []UserConnectionStatus
+	for nodeID, result := range results {
+		if result.Code != 0 {
+			return UserStatusResult{}, fmt.Errorf("user status: unexpected reply code %d from node %s", result.Code, nodeID)
+		}
+		var nodeConnections []userStatusConnectionJSON
+		if err := json.Unmarshal(result.Data, &nodeConnections); err != nil {
+			return UserStatusResult{}, fmt.Errorf("user status: error decoding reply from node %s: %w", nodeID, err)
+		}
+		for _, c := range nodeConnections {
+			connections = append(connections, UserConnectionStatus{
+				ClientID: c.Client,
+				NodeID:   nodeID,
+				Channels: c.Channels,
+			})
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		if connections[i].NodeID != connections[j].NodeID {
+			return connections[i].NodeID < connections[j].NodeID
+		}
+		return connections[i].ClientID < connections[j].ClientID
+	})
+	return UserStatusResult{
+		NumConnections: len(connections),
+		Connections:    connections,
+	}, nil
+}
+
+// handleUserStatusSurvey replies with user connections of current Node.
+func (n *Node) handleUserStatusSurvey(e SurveyEvent, cb SurveyCallback) {
+	clients := n.hub.UserConnections(string(e.Data))
+	connections := make([]userStatusConnectionJSON, 0, len(clients))
+	for clientID, c := range clients {
+		channels := c.Channels()
+		sort.Strings(channels)
+		connections = append(connections, userStatusConnectionJSON{
+			Client:   clientID,
+			Channels: channels,
+		})
+	}
+	data, err := json.Marshal(connections)
+	if err != nil {
+		n.logger.log(newLogEntry(LogLevelError, "error encoding user status", map[string]interface{}{"error": err.Error()}))
+		cb(SurveyReply{Code: 1})
+		return
+	}
+	cb(SurveyReply{Data: data})
+}
@@ -0,0 +1,82 @@
+package centrifuge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeUserStatus(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+
+	res, err := node.UserStatus(context.Background(), "42")
+	require.NoError(t, err)
+	require.False(t, res.Online())
+	require.Equal(t, 0, res.NumConnections)
+
+	client1 := newTestClient(t, node, "42")
+	connectClient(t, client1)
+	subscribeClient(t, client1, "test2")
+	subscribeClient(t, client1, "test1")
+	client2 := newTestClient(t, node, "42")
+	connectClient(t, client2)
+	client3 := newTestClient(t, node, "43")
+	connectClient(t, client3)
+
+	res, err = node.UserStatus(context.Background(), "42")
+	require.NoError(t, err)
+	require.True(t, res.Online())
+	require.Equal(t, 2, res.NumConnections)
+	require.Len(t, res.Connections, 2)
+	channels := map[string][]string{}
+	for _, c := range res.Connections {
+		require.Equal(t, node.ID(), c.NodeID)
+		channels[c.ClientID] = c.Channels
+	}
+	require.Equal(t, []string{"test1", "test2"}, channels[client1.ID()])
+	require.Empty(t, channels[client2.ID()])
+}
+
+func TestNodeUserStatusTwoNodes(t *testing.T) {
+	cluster := &testCluster{}
+	node1 := newTestClusterNode(t, cluster)
+	node2 := newTestClusterNode(t, cluster)
+
+	require.Eventually(t, func() bool {
+		return node1.nodes.size() == 2 && node2.nodes.size() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	node2.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+
+	client1 := newTestClient(t, node1, "42")
+	connectClient(t, client1)
+	client2 := newTestClient(t, node2, "42")
+	connectClient(t, client2)
+	subscribeClient(t, client2, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := node1.UserStatus(ctx, "42")
+	require.NoError(t, err)
+	require.Equal(t, 2, res.NumConnections)
+	byNode := map[string]UserConnectionStatus{}
+	for _, c := range res.Connections {
+		byNode[c.NodeID] = c
+	}
+	require.Equal(t, client1.ID(), byNode[node1.ID()].ClientID)
+	require.Equal(t, client2.ID(), byNode[node2.ID()].ClientID)
+	require.Equal(t, []string{"test"}, byNode[node2.ID()].Channels)
+}